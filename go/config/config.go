@@ -25,19 +25,60 @@ import (
 
 // Configuration makes for orchestrator-agent configuration input, which can be provided by user via JSON formatted file.
 type Configuration struct {
-	SnapshotMountPoint                 string            // The single, agreed-upon mountpoint for logical volume snapshots
+	SnapshotMountPoint                 string            // The default, agreed-upon mountpoint for logical volume snapshots
+	SnapshotMountRoot                  string            // Directory under which snapshots may be mounted onto named targets, allowing multiple concurrent mounts
+	LeaseTTLSeconds                    uint              // Time after which a lease on a mount or volume expires unless renewed by its holder
+	StateDirectory                     string            // Directory in which the agent keeps state surviving restarts, e.g. the history of snapshot restores
 	ContinuousPollSeconds              uint              // Poll interval for continuous operation
 	ResubmitAgentIntervalMinutes       uint              // Poll interval for resubmitting this agent on orchestrator agents API
 	CreateSnapshotCommand              string            // Command which creates a snapshot logical volume. It's a "do it yourself" implementation
 	AvailableLocalSnapshotHostsCommand string            // Command which returns list of hosts (one host per line) with available snapshots in local datacenter
 	AvailableSnapshotHostsCommand      string            // Command which returns list of hosts (one host per line) with available snapshots in any datacenter
 	SnapshotVolumesFilter              string            // text pattern filtering agent logical volumes that are valid snapshots
+	StorageBackend                     string            // Storage backend managing snapshots: "lvm" (default), "zfs" or "btrfs"
+	ZFSDataset                         string            // With zfs StorageBackend: the dataset (e.g. tank/mysql) whose snapshots are managed
+	ZFSMountByClone                    bool              // With zfs StorageBackend: mount a writable clone of the snapshot rather than the read-only snapshot itself
+	BtrfsSubvolume                     string            // With btrfs StorageBackend: the subvolume (e.g. /data/mysql) which is snapshotted
+	BtrfsSnapshotsDirectory            string            // With btrfs StorageBackend: directory in which subvolume snapshots are kept (e.g. /data/.snapshots)
 	MySQLDatadirCommand                string            // command expected to present with @@datadir
 	MySQLPortCommand                   string            // command expected to present with @@port
+	MySQLDSN                           string            // DSN (go-sql-driver/mysql format) of a connection to the local MySQL server. Overrides the below connection settings
+	MySQLSocket                        string            // Socket of the local MySQL server; takes precedence over MySQLHost
+	MySQLHost                          string            // Host of the local MySQL server, connected to via TCP
+	MySQLConnectPort                   uint              // Port the local MySQL server is connected to on MySQLHost
+	MySQLUser                          string            // User connecting to the local MySQL server
+	MySQLPassword                      string            // Password of MySQLUser
+	MySQLCredentialsConfigFile         string            // my.cnf style file with [client] user & password; overrides MySQLUser and MySQLPassword
+	MySQLConnectTimeoutSeconds         uint              // Timeout connecting to the local MySQL server
 	MySQLDeleteDatadirContentCommand   string            // command which deletes all content from MySQL datadir (does not remvoe directory itself)
 	MySQLServiceStopCommand            string            // Command to stop mysql, e.g. /etc/init.d/mysql stop
 	MySQLServiceStartCommand           string            // Command to start mysql, e.g. /etc/init.d/mysql start
 	MySQLServiceStatusCommand          string            // Command to check mysql status. Expects 0 return value when running, non-zero when not running, e.g. /etc/init.d/mysql status
+	SandboxMySQLDCommand               string            // mysqld binary used to start snapshot sandboxes
+	SandboxMySQLDOptions               []string          // Extra mysqld options for sandboxes, e.g. innodb_buffer_pool_size=1G. Sandboxes do not read the server's defaults file
+	SandboxMySQLUser                   string            // OS user sandbox mysqld runs as
+	SandboxPort                        uint              // First port for sandboxes; concurrent sandboxes use subsequent ports
+	SandboxStartupTimeoutSeconds       uint              // Time to wait for a sandbox to complete crash recovery and accept connections
+	SandboxSanityQueries               []string          // Queries run on a sandbox to verify the snapshot is usable
+	MySQLStartupTimeoutSeconds         uint              // Time to wait for MySQL to accept connections, once started by a point-in-time recovery
+	PITRDirectory                      string            // Directory in which point-in-time recoveries keep binary logs copied or fetched for replay
+	BackupDirectory                    string            // Directory into which snapshots are exported as archives, and from which archives are imported
+	BackupStore                        string            // Object store backups are pushed to and pulled from: "s3" or "directory". Empty to disable
+	BackupStoreDirectory               string            // Local or NFS mounted directory, for "directory" BackupStore
+	BackupStorePrefix                  string            // Key prefix under which backups are stored
+	BackupRetentionCount               uint              // Number of most recent backups kept in the store; 0 for unlimited
+	BackupRetentionDays                uint              // Backups older than this are removed from the store, unless among the BackupRetentionCount most recent; 0 for unlimited
+	S3Endpoint                         string            // URL of S3 compatible API, for "s3" BackupStore
+	S3Region                           string            // S3 region
+	S3Bucket                           string            // S3 bucket
+	S3AccessKeyId                      string            // S3 credentials
+	S3SecretAccessKey                  string            // S3 credentials
+	S3PartSizeMB                       uint              // Part size of S3 multipart uploads; each upload buffers one part in memory, and is limited to 10,000 parts
+	S3TimeoutSeconds                   uint              // Timeout connecting to S3, and waiting for a response to a request
+	XtrabackupCommand                  string            // xtrabackup binary, used for full and incremental physical backups
+	XtrabackupOptions                  string            // Additional xtrabackup options, e.g. --defaults-file or credentials
+	XtrabackupDirectory                string            // Directory holding physical backup chains, one directory per chain
+	XtrabackupRestoreOwner             string            // Owner (user:group) given to data directory files restored from a chain; empty to leave as is
 	ReceiveSeedDataCommand             string            // Accepts incoming data (e.g. tarball over netcat)
 	SendSeedDataCommand                string            // Sends date to remote host (e.g. tarball via netcat)
 	PostCopyCommand                    string            // command that is executed after seed is done and before MySQL starts
@@ -69,18 +110,59 @@ var Config = NewConfiguration()
 func NewConfiguration() *Configuration {
 	return &Configuration{
 		SnapshotMountPoint:                 "",
+		SnapshotMountRoot:                  "",
+		LeaseTTLSeconds:                    60,
+		StateDirectory:                     "/var/lib/orchestrator-agent",
 		ContinuousPollSeconds:              60,
 		ResubmitAgentIntervalMinutes:       60,
 		CreateSnapshotCommand:              "",
 		AvailableLocalSnapshotHostsCommand: "",
 		AvailableSnapshotHostsCommand:      "",
 		SnapshotVolumesFilter:              "",
+		StorageBackend:                     "lvm",
+		ZFSDataset:                         "",
+		ZFSMountByClone:                    false,
+		BtrfsSubvolume:                     "",
+		BtrfsSnapshotsDirectory:            "",
 		MySQLDatadirCommand:                "",
 		MySQLPortCommand:                   "",
+		MySQLDSN:                           "",
+		MySQLSocket:                        "",
+		MySQLHost:                          "",
+		MySQLConnectPort:                   3306,
+		MySQLUser:                          "",
+		MySQLPassword:                      "",
+		MySQLCredentialsConfigFile:         "",
+		MySQLConnectTimeoutSeconds:         2,
 		MySQLDeleteDatadirContentCommand:   "",
 		MySQLServiceStopCommand:            "",
 		MySQLServiceStartCommand:           "",
 		MySQLServiceStatusCommand:          "",
+		SandboxMySQLDCommand:               "mysqld",
+		SandboxMySQLDOptions:               []string{},
+		SandboxMySQLUser:                   "mysql",
+		SandboxPort:                        3307,
+		SandboxStartupTimeoutSeconds:       900,
+		SandboxSanityQueries:               []string{"SELECT @@version", "SHOW DATABASES", "SELECT COUNT(*) FROM mysql.user", "SELECT COUNT(*) FROM information_schema.tables"},
+		MySQLStartupTimeoutSeconds:         900,
+		PITRDirectory:                      "/var/lib/orchestrator-agent/pitr",
+		BackupDirectory:                    "",
+		BackupStore:                        "",
+		BackupStoreDirectory:               "",
+		BackupStorePrefix:                  "orchestrator-agent/",
+		BackupRetentionCount:               0,
+		BackupRetentionDays:                0,
+		S3Endpoint:                         "",
+		S3Region:                           "us-east-1",
+		S3Bucket:                           "",
+		S3AccessKeyId:                      "",
+		S3SecretAccessKey:                  "",
+		S3PartSizeMB:                       64,
+		S3TimeoutSeconds:                   60,
+		XtrabackupCommand:                  "xtrabackup",
+		XtrabackupOptions:                  "",
+		XtrabackupDirectory:                "",
+		XtrabackupRestoreOwner:             "mysql:mysql",
 		ReceiveSeedDataCommand:             "",
 		SendSeedDataCommand:                "",
 		PostCopyCommand:                    "",
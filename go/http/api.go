@@ -20,16 +20,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/github/orchestrator-agent/go/agent"
 	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
 	"github.com/github/orchestrator-agent/go/osagent"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
@@ -85,6 +88,21 @@ func (this *HttpAPI) validateToken(r render.Render, req *http.Request) error {
 	return err
 }
 
+// storageBackend returns the configured snapshot storage backend, rendering an error if there is none
+func (this *HttpAPI) storageBackend(r render.Render) (osagent.StorageBackend, error) {
+	backend, err := osagent.GetStorageBackend()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+	}
+	return backend, err
+}
+
+// isForced returns true when the request asks to override safety checks (e.g. leases)
+func (this *HttpAPI) isForced(req *http.Request) bool {
+	force, _ := strconv.ParseBool(req.URL.Query().Get("force"))
+	return force
+}
+
 // Hostname provides information on this process
 func (this *HttpAPI) Hostname(params martini.Params, r render.Render) {
 	hostname, err := os.Hostname()
@@ -100,7 +118,11 @@ func (this *HttpAPI) ListLogicalVolumes(params martini.Params, r render.Render,
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	output, err := osagent.LogicalVolumes("", params["pattern"])
+	backend, err := this.storageBackend(r)
+	if err != nil {
+		return
+	}
+	output, err := backend.Volumes("", params["pattern"])
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -113,7 +135,24 @@ func (this *HttpAPI) ListSnapshotsLogicalVolumes(params martini.Params, r render
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	output, err := osagent.LogicalVolumes("", config.Config.SnapshotVolumesFilter)
+	backend, err := this.storageBackend(r)
+	if err != nil {
+		return
+	}
+	output, err := backend.Volumes("", config.Config.SnapshotVolumesFilter)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// ListVolumeGroups lists LVM volume groups
+func (this *HttpAPI) ListVolumeGroups(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.VolumeGroups()
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -130,7 +169,11 @@ func (this *HttpAPI) LogicalVolume(params martini.Params, r render.Render, req *
 	if lv == "" {
 		lv = req.URL.Query().Get("lv")
 	}
-	output, err := osagent.LogicalVolumes(lv, "")
+	backend, err := this.storageBackend(r)
+	if err != nil {
+		return
+	}
+	output, err := backend.Volumes(lv, "")
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -138,12 +181,61 @@ func (this *HttpAPI) LogicalVolume(params martini.Params, r render.Render, req *
 	r.JSON(200, output)
 }
 
-// GetMount shows the configured mount point's status
+// GetMount shows the status of all agent managed mount points
 func (this *HttpAPI) GetMount(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	output, err := osagent.GetMount(config.Config.SnapshotMountPoint)
+	output, err := osagent.ManagedMounts()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// MySQLInstance returns the local MySQL server's settings, as read over the MySQL connection
+func (this *HttpAPI) MySQLInstance(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.GetMySQLInstance()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// ReplicationStatus returns the status of the local MySQL server's replication channels, optionally
+// filtered by the `channel` param
+func (this *HttpAPI) ReplicationStatus(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	statuses, err := osagent.ReplicationStatus()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	if channel, ok := req.URL.Query()["channel"]; ok {
+		output := []inst.ReplicationStatus{}
+		for _, status := range statuses {
+			if status.ChannelName == channel[0] {
+				output = append(output, status)
+			}
+		}
+		statuses = output
+	}
+	r.JSON(200, statuses)
+}
+
+// MySQLMounts lists mounts relevant to MySQL: datadir's mount, and snapshot mounts
+func (this *HttpAPI) MySQLMounts(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.MySQLMounts()
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -151,7 +243,7 @@ func (this *HttpAPI) GetMount(params martini.Params, r render.Render, req *http.
 	r.JSON(200, output)
 }
 
-// MountLV mounts a logical volume on config mount point
+// MountLV mounts a logical volume on config mount point, or on a named target under the mount root
 func (this *HttpAPI) MountLV(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
@@ -160,7 +252,7 @@ func (this *HttpAPI) MountLV(params martini.Params, r render.Render, req *http.R
 	if lv == "" {
 		lv = req.URL.Query().Get("lv")
 	}
-	output, err := osagent.MountLV(config.Config.SnapshotMountPoint, lv)
+	output, err := osagent.MountSnapshot(req.URL.Query().Get("target"), lv)
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -177,7 +269,7 @@ func (this *HttpAPI) RemoveLV(params martini.Params, r render.Render, req *http.
 	if lv == "" {
 		lv = req.URL.Query().Get("lv")
 	}
-	err := osagent.RemoveLV(lv)
+	err := osagent.RemoveSnapshot(lv, this.isForced(req))
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -185,12 +277,37 @@ func (this *HttpAPI) RemoveLV(params martini.Params, r render.Render, req *http.
 	r.JSON(200, err == nil)
 }
 
-// Unmount umounts the config mount point
+// RestoreLV rolls back a logical volume's origin to the snapshot, merging the snapshot into it. MySQL must be stopped.
+func (this *HttpAPI) RestoreLV(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	lv := params["lv"]
+	if lv == "" {
+		lv = req.URL.Query().Get("lv")
+	}
+	output, err := osagent.RestoreSnapshot(lv, this.isForced(req))
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// RestoreHistory lists snapshot restores made by this agent
+func (this *HttpAPI) RestoreHistory(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	r.JSON(200, osagent.SnapshotRestores())
+}
+
+// Unmount umounts the config mount point, or a named target under the mount root
 func (this *HttpAPI) Unmount(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	output, err := osagent.Unmount(config.Config.SnapshotMountPoint)
+	output, err := osagent.UnmountSnapshot(req.URL.Query().Get("target"), this.isForced(req))
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -233,7 +350,11 @@ func (this *HttpAPI) CreateSnapshot(params martini.Params, r render.Render, req
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	err := osagent.CreateSnapshot()
+	backend, err := this.storageBackend(r)
+	if err != nil {
+		return
+	}
+	err = backend.CreateSnapshot()
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -386,74 +507,124 @@ func (this *HttpAPI) SendMySQLSeedData(params martini.Params, r render.Render, r
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	mount, err := osagent.GetMount(config.Config.SnapshotMountPoint)
+	mount, err := osagent.GetSnapshotMount(req.URL.Query().Get("target"))
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
 	}
-	go osagent.SendMySQLSeedData(params["targetHost"], mount.MySQLDataPath, params["seedId"])
+	// The lease is taken before responding, such that the mount cannot be removed before the seed starts
+	lease, err := osagent.AcquireLease(mount.Path, fmt.Sprintf("seed:%s", params["seedId"]), 0)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	go osagent.HoldLease(lease, func() error {
+		return osagent.SendMySQLSeedData(params["targetHost"], mount.MySQLDataPath, params["seedId"])
+	})
 	r.JSON(200, err == nil)
 }
 
-// AbortSeed
-func (this *HttpAPI) AbortSeed(params martini.Params, r render.Render, req *http.Request) {
+// ExportSnapshot archives a mounted snapshot's MySQL data into the backup directory. It runs as a job
+// whose status is checked via the seed-command-completed/seed-command-succeeded API, by job id.
+func (this *HttpAPI) ExportSnapshot(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	osagent.AbortSeed(params["seedId"])
-	r.JSON(200, true)
+	err := osagent.ExportSnapshot(req.URL.Query().Get("target"), params["archive"], params["jobId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, err == nil)
 }
 
-// SeedCommandCompleted
-func (this *HttpAPI) SeedCommandCompleted(params martini.Params, r render.Render, req *http.Request) {
+// ImportArchive extracts an archive into the MySQL data directory. It runs as a job whose status
+// is checked via the seed-command-completed/seed-command-succeeded API, by job id.
+func (this *HttpAPI) ImportArchive(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	output := osagent.SeedCommandCompleted(params["seedId"])
-	r.JSON(200, output)
+	err := osagent.ImportArchive(params["archive"], params["jobId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, err == nil)
 }
 
-// SeedCommandCompleted
-func (this *HttpAPI) SeedCommandSucceeded(params martini.Params, r render.Render, req *http.Request) {
+// Archives lists archives in the backup directory
+func (this *HttpAPI) Archives(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	output := osagent.SeedCommandSucceeded(params["seedId"])
+	output, err := osagent.Archives()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
 	r.JSON(200, output)
 }
 
-// A simple status endpoint to ping to see if the agent is up and responding.  There's not much
-// to do here except respond with 200 and OK
-// This is pointed to by a configurable endpoint and has a configurable status message
-func (this *HttpAPI) Status(params martini.Params, r render.Render, req *http.Request) {
-	if uint(time.Since(agent.LastTalkback).Seconds()) > config.Config.StatusBadSeconds {
-		r.JSON(500, "BAD")
-	} else {
-		r.JSON(200, "OK")
+// VerifyArchive validates an archive's checksum
+func (this *HttpAPI) VerifyArchive(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	err := osagent.VerifyArchive(params["archive"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
 	}
+	r.JSON(200, err == nil)
 }
 
-// RelayLogIndexFile returns mysql relay log index file, full path
-func (this *HttpAPI) RelayLogIndexFile(params martini.Params, r render.Render, req *http.Request) {
+// BackupSnapshot streams a mounted snapshot's MySQL data into the backup store. It runs as a job
+// whose status is checked via the seed-command-completed/seed-command-succeeded API, by job id.
+func (this *HttpAPI) BackupSnapshot(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
+	err := osagent.BackupSnapshot(req.URL.Query().Get("target"), params["backup"], params["jobId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, err == nil)
+}
 
-	output, err := osagent.GetRelayLogIndexFileName()
+// PushArchive uploads an archive from the backup directory into the backup store, as a job
+func (this *HttpAPI) PushArchive(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	err := osagent.PushArchive(params["archive"], params["jobId"])
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
 	}
-	r.JSON(200, output)
+	r.JSON(200, err == nil)
 }
 
-// RelayLogFiles returns the list of active relay logs
-func (this *HttpAPI) RelayLogFiles(params martini.Params, r render.Render, req *http.Request) {
+// RestoreBackup seeds the MySQL data directory from a backup in the backup store. It is the
+// receiving end of a seed, in place of ReceiveMySQLSeedData/SendMySQLSeedData, and is tracked by seed id.
+func (this *HttpAPI) RestoreBackup(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
+	err := osagent.RestoreBackup(params["backup"], params["seedId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, err == nil)
+}
 
-	output, err := osagent.GetRelayLogFileNames()
+// Backups lists backups in the backup store
+func (this *HttpAPI) Backups(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.Backups()
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -461,48 +632,52 @@ func (this *HttpAPI) RelayLogFiles(params martini.Params, r render.Render, req *
 	r.JSON(200, output)
 }
 
-// RelayLogFiles returns the list of active relay logs
-func (this *HttpAPI) RelayLogEndCoordinates(params martini.Params, r render.Render, req *http.Request) {
+// VerifyBackup downloads a backup and validates its size and checksum
+func (this *HttpAPI) VerifyBackup(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-
-	coordinates, err := osagent.GetRelayLogEndCoordinates()
+	err := osagent.VerifyBackup(params["backup"])
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
 	}
-	r.JSON(200, coordinates)
+	r.JSON(200, err == nil)
 }
 
-// RelaylogContentsTail returns contents of relay logs, from given position to the very last entry
-func (this *HttpAPI) RelaylogContentsTail(params martini.Params, r render.Render, req *http.Request) {
+// DeleteBackup removes a backup from the backup store
+func (this *HttpAPI) DeleteBackup(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-
-	var err error
-	var startPosition int64
-	if startPosition, err = strconv.ParseInt(params["start"], 10, 0); err != nil {
-		err = fmt.Errorf("Cannot parse startPosition: %s", err.Error())
+	err := osagent.DeleteBackup(params["backup"])
+	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
 	}
-	firstRelaylog := params["relaylog"]
-	var parseRelaylogs []string
-	if existingRelaylogs, err := osagent.GetRelayLogFileNames(); err != nil {
+	r.JSON(200, err == nil)
+}
+
+// ApplyBackupRetention removes backups per the configured retention, returning the removed backups' names
+func (this *HttpAPI) ApplyBackupRetention(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.ApplyBackupRetention()
+	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
-	} else {
-		for i, relaylog := range existingRelaylogs {
-			if (firstRelaylog == relaylog) || (firstRelaylog == path.Base(relaylog)) {
-				// found the relay log we want to start with
-				parseRelaylogs = existingRelaylogs[i:]
-			}
-		}
 	}
+	r.JSON(200, output)
+}
 
-	output, err := osagent.MySQLBinlogBinaryContents(parseRelaylogs, startPosition, 0)
+// CreatePhysicalBackup takes a full (starting a new chain) or incremental xtrabackup backup. It runs as a job
+// whose status is checked via the seed-command-completed/seed-command-succeeded API, by job id.
+func (this *HttpAPI) CreatePhysicalBackup(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.CreatePhysicalBackup(params["chain"], params["type"], params["jobId"])
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -510,30 +685,25 @@ func (this *HttpAPI) RelaylogContentsTail(params martini.Params, r render.Render
 	r.JSON(200, output)
 }
 
-// binlogContents returns contents of binary log entries
-func (this *HttpAPI) binlogContents(params martini.Params, r render.Render, req *http.Request,
-	contentsFunc func(binlogFiles []string, startPosition int64, stopPosition int64) (string, error),
-) {
+// BackupChains lists the catalog of physical backup chains
+func (this *HttpAPI) BackupChains(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-
-	var err error
-	var startPosition, stopPosition int64
-	if start := req.URL.Query().Get("start"); start != "" {
-		if startPosition, err = strconv.ParseInt(start, 10, 0); err != nil {
-			r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
-			return
-		}
+	output, err := osagent.BackupChains()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
 	}
-	if stop := req.URL.Query().Get("stop"); stop != "" {
-		if stopPosition, err = strconv.ParseInt(stop, 10, 0); err != nil {
-			r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
-			return
-		}
+	r.JSON(200, output)
+}
+
+// BackupChain returns a single physical backup chain
+func (this *HttpAPI) BackupChain(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
 	}
-	binlogFileNames := req.URL.Query()["binlog"]
-	output, err := osagent.MySQLBinlogContents(binlogFileNames, startPosition, stopPosition)
+	output, err := osagent.GetBackupChain(params["chain"])
 	if err != nil {
 		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -541,34 +711,653 @@ func (this *HttpAPI) binlogContents(params martini.Params, r render.Render, req
 	r.JSON(200, output)
 }
 
-// BinlogContents returns contents of binary log entries
-func (this *HttpAPI) BinlogContents(params martini.Params, r render.Render, req *http.Request) {
-	this.binlogContents(params, r, req, osagent.MySQLBinlogContents)
+// RestoreBackupChain restores the MySQL data directory from a backup chain, up to the backup given
+// by the `upto` param (or the entire chain). It is a seed source, tracked by seed id.
+func (this *HttpAPI) RestoreBackupChain(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	err := osagent.RestoreBackupChain(params["chain"], req.URL.Query().Get("upto"), params["seedId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, err == nil)
 }
 
-// BinlogBinaryContents returns contents of binary log entries
-func (this *HttpAPI) BinlogBinaryContents(params martini.Params, r render.Render, req *http.Request) {
-	this.binlogContents(params, r, req, osagent.MySQLBinlogBinaryContents)
+// AbortSeed
+func (this *HttpAPI) AbortSeed(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	osagent.AbortSeed(params["seedId"])
+	r.JSON(200, true)
 }
 
-// ApplyRelaylogContents reads binlog contents from request's body and applies them locally
-func (this *HttpAPI) ApplyRelaylogContents(params martini.Params, r render.Render, req *http.Request) {
+// SeedCommandCompleted
+func (this *HttpAPI) SeedCommandCompleted(params martini.Params, r render.Render, req *http.Request) {
 	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	defer req.Body.Close()
+	output := osagent.SeedCommandCompleted(params["seedId"])
+	r.JSON(200, output)
+}
 
-	body, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+// SeedCommandCompleted
+func (this *HttpAPI) SeedCommandSucceeded(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	err = osagent.ApplyRelaylogContents(body)
-	if err != nil {
-		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+	output := osagent.SeedCommandSucceeded(params["seedId"])
+	r.JSON(200, output)
+}
+
+// Leases lists active leases on mount points and volumes
+func (this *HttpAPI) Leases(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
 		return
 	}
-	r.JSON(200, "OK")
+	r.JSON(200, osagent.ActiveLeases(req.URL.Query().Get("resource")))
+}
+
+// leaseTTL parses the optional ttl (seconds) request parameter
+func (this *HttpAPI) leaseTTL(req *http.Request) (time.Duration, error) {
+	ttl := req.URL.Query().Get("ttl")
+	if ttl == "" {
+		return 0, nil
+	}
+	ttlSeconds, err := strconv.ParseUint(ttl, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot parse ttl: %s", err.Error())
+	}
+	return time.Duration(ttlSeconds) * time.Second, nil
+}
+
+// AcquireLease places a lease on a resource (mount point or volume), preventing its unmount/removal
+func (this *HttpAPI) AcquireLease(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	ttl, err := this.leaseTTL(req)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	output, err := osagent.AcquireLease(req.URL.Query().Get("resource"), req.URL.Query().Get("holder"), ttl)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// RenewLease extends a lease
+func (this *HttpAPI) RenewLease(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	ttl, err := this.leaseTTL(req)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	output, err := osagent.RenewLease(params["leaseId"], ttl)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// ReleaseLease removes a lease
+func (this *HttpAPI) ReleaseLease(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	osagent.ReleaseLease(params["leaseId"])
+	r.JSON(200, true)
+}
+
+// StartSandbox starts a temporary mysqld on a mounted snapshot, verifying it is recoverable.
+// With ttl (seconds), the sandbox stays up for ad-hoc read-only queries until it expires.
+func (this *HttpAPI) StartSandbox(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	ttl, err := this.leaseTTL(req)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	output, err := osagent.StartSandbox(req.URL.Query().Get("target"), ttl)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// Sandboxes lists snapshot sandboxes
+func (this *HttpAPI) Sandboxes(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	r.JSON(200, osagent.Sandboxes())
+}
+
+// Sandbox shows the status of a snapshot sandbox
+func (this *HttpAPI) Sandbox(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.GetSandbox(params["sandboxId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// SandboxQuery runs a read-only query on a running sandbox
+func (this *HttpAPI) SandboxQuery(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.SandboxQuery(params["sandboxId"], req.URL.Query().Get("query"))
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, &APIResponse{Code: OK, Message: output})
+}
+
+// StopSandbox tears down a sandbox
+func (this *HttpAPI) StopSandbox(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	err := osagent.StopSandbox(params["sandboxId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, err == nil)
+}
+
+// StartPITR starts a point-in-time recovery: a snapshot (in a sandbox) or a backup (onto the live data directory),
+// or else the live server as is, rolled forward by local binary logs or those of a source agent, up to a stop point
+func (this *HttpAPI) StartPITR(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	query := req.URL.Query()
+	request := osagent.PITRRequest{
+		Snapshot:    query.Get("snapshot"),
+		Backup:      query.Get("backup"),
+		SourceAgent: query.Get("source"),
+		SourceToken: query.Get("source-token"),
+	}
+	err := func() (err error) {
+		if request.SandboxTTL, err = this.leaseTTL(req); err != nil {
+			return err
+		}
+		if start := query.Get("start"); start != "" {
+			if request.StartCoordinates, err = inst.ParseBinlogCoordinates(start); err != nil {
+				return err
+			}
+		}
+		if stopTime := query.Get("stop-time"); stopTime != "" {
+			if request.Stop.Time, err = parseTime(stopTime); err != nil {
+				return err
+			}
+		}
+		if stop := query.Get("stop"); stop != "" {
+			if request.Stop.Coordinates, err = inst.ParseBinlogCoordinates(stop); err != nil {
+				return err
+			}
+		}
+		request.Stop.Gtid = query.Get("stop-gtid")
+		return nil
+	}()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	output, err := osagent.StartPITR(request)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// PITRJobs lists point-in-time recoveries
+func (this *HttpAPI) PITRJobs(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	r.JSON(200, osagent.PITRJobs())
+}
+
+// PITRJob shows the progress of a point-in-time recovery, and where it stopped
+func (this *HttpAPI) PITRJob(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	output, err := osagent.GetPITRJob(params["jobId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// AbortPITR aborts a running point-in-time recovery
+func (this *HttpAPI) AbortPITR(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	err := osagent.AbortPITR(params["jobId"])
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, err == nil)
+}
+
+// A simple status endpoint to ping to see if the agent is up and responding.  There's not much
+// to do here except respond with 200 and OK
+// This is pointed to by a configurable endpoint and has a configurable status message
+func (this *HttpAPI) Status(params martini.Params, r render.Render, req *http.Request) {
+	if uint(time.Since(agent.LastTalkback).Seconds()) > config.Config.StatusBadSeconds {
+		r.JSON(500, "BAD")
+	} else {
+		r.JSON(200, "OK")
+	}
+}
+
+// RelayLogIndexFile returns mysql relay log index file, full path
+func (this *HttpAPI) RelayLogIndexFile(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	output, err := osagent.GetRelayLogIndexFileName()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// RelayLogFiles returns the list of active relay logs
+func (this *HttpAPI) RelayLogFiles(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	output, err := osagent.GetRelayLogFileNames()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// RelayLogEndCoordinates returns the coordinates at the end of the last complete event of the relay logs, with
+// the GTID of the last transaction begun, and whether a partially written event follows
+func (this *HttpAPI) RelayLogEndCoordinates(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	coordinates, err := osagent.GetRelayLogEndCoordinates()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, coordinates)
+}
+
+// BinaryLogIndexFile returns mysql binary log index file, full path
+func (this *HttpAPI) BinaryLogIndexFile(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	output, err := osagent.GetBinaryLogIndexFileName()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// BinaryLogFiles returns the list of binary logs, with sizes and first/last event times
+func (this *HttpAPI) BinaryLogFiles(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	output, err := osagent.GetBinaryLogFiles()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// BinaryLogEndCoordinates returns the coordinates at the end of the binary logs
+func (this *HttpAPI) BinaryLogEndCoordinates(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	coordinates, err := osagent.GetBinaryLogEndCoordinates()
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, coordinates)
+}
+
+// FindBinlogCoordinates returns the binary (or, given type=relay, relay) log coordinates of the first transaction
+// at or after given time, or of given GTID
+func (this *HttpAPI) FindBinlogCoordinates(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	logType := inst.BinaryLog
+	if req.URL.Query().Get("type") == "relay" {
+		logType = inst.RelayLog
+	}
+	var coordinates *inst.BinlogCoordinates
+	var err error
+	if gtid := req.URL.Query().Get("gtid"); gtid != "" {
+		coordinates, err = osagent.FindBinlogCoordinatesByGtid(logType, gtid)
+	} else if timeParam := req.URL.Query().Get("time"); timeParam != "" {
+		var atOrAfter time.Time
+		if atOrAfter, err = parseTime(timeParam); err == nil {
+			coordinates, err = osagent.FindBinlogCoordinatesByTime(logType, atOrAfter)
+		}
+	} else {
+		err = fmt.Errorf("Expected either time or gtid")
+	}
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, coordinates)
+}
+
+// parseTime parses a time given as RFC3339, or as local time in "2006-01-02 15:04:05" format
+func parseTime(value string) (time.Time, error) {
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		result, err = time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	}
+	return result, err
+}
+
+// BinlogFlashback returns the statements undoing the row changes logged from one set of coordinates (from=file:pos)
+// up to another (to=file:pos, exclusive), optionally of given tables only (table=schema.table, repeatable, with
+// wildcards). Given apply=true, the statements are applied; on failure, the transactions undone so far are flagged
+// in the response's details.
+func (this *HttpAPI) BinlogFlashback(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	query := req.URL.Query()
+	from, err := inst.ParseBinlogCoordinates(query.Get("from"))
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	to, err := inst.ParseBinlogCoordinates(query.Get("to"))
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	output, err := osagent.FlashbackBinlogs(osagent.BinlogFlashbackRequest{
+		From:   *from,
+		To:     *to,
+		Filter: osagent.BinlogFilter{Tables: query["table"]},
+		Apply:  query.Get("apply") == "true",
+	})
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error(), Details: output})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// RelaylogContentsTail returns contents of relay logs, from given position to the very last entry
+func (this *HttpAPI) RelaylogContentsTail(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	var err error
+	var startPosition int64
+	if startPosition, err = strconv.ParseInt(params["start"], 10, 0); err != nil {
+		err = fmt.Errorf("Cannot parse startPosition: %s", err.Error())
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	firstRelaylog := params["relaylog"]
+	var parseRelaylogs []string
+	if existingRelaylogs, err := osagent.GetRelayLogFileNames(); err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	} else {
+		for i, relaylog := range existingRelaylogs {
+			if (firstRelaylog == relaylog) || (firstRelaylog == path.Base(relaylog)) {
+				// found the relay log we want to start with
+				parseRelaylogs = existingRelaylogs[i:]
+			}
+		}
+	}
+
+	output, err := osagent.MySQLBinlogBinaryContents(parseRelaylogs, startPosition, 0)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// binlogContents returns contents of binary log entries
+func (this *HttpAPI) binlogContents(params martini.Params, r render.Render, req *http.Request,
+	contentsFunc func(binlogFiles []string, startPosition int64, stopPosition int64) (string, error),
+) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	binlogFileNames, startPosition, stopPosition, err := this.binlogRangeParams(req)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	output, err := contentsFunc(binlogFileNames, startPosition, stopPosition)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// binlogRangeParams reads binlog file names and start/stop positions off a request
+func (this *HttpAPI) binlogRangeParams(req *http.Request) (binlogFileNames []string, startPosition int64, stopPosition int64, err error) {
+	if start := req.URL.Query().Get("start"); start != "" {
+		if startPosition, err = strconv.ParseInt(start, 10, 0); err != nil {
+			return binlogFileNames, startPosition, stopPosition, err
+		}
+	}
+	if stop := req.URL.Query().Get("stop"); stop != "" {
+		if stopPosition, err = strconv.ParseInt(stop, 10, 0); err != nil {
+			return binlogFileNames, startPosition, stopPosition, err
+		}
+	}
+	return req.URL.Query()["binlog"], startPosition, stopPosition, nil
+}
+
+// startedWriter tells whether anything was written to the response
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (this *startedWriter) Write(p []byte) (int, error) {
+	this.started = true
+	return this.ResponseWriter.Write(p)
+}
+
+// binlogContentsStream streams contents of binary logs over chunked HTTP, rather than as a JSON string. Contents
+// are gzipped where the client accepts gzip encoding. Their length and SHA256 checksum (before compression)
+// follow as trailers, as does an error, should one occur once streaming has begun.
+func (this *HttpAPI) binlogContentsStream(params martini.Params, r render.Render, req *http.Request, w http.ResponseWriter, contentType string,
+	streamFunc func(writer io.Writer, compress bool, binlogFiles []string, startPosition int64, stopPosition int64) (osagent.ContentDigest, error),
+) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	binlogFileNames, startPosition, stopPosition, err := this.binlogRangeParams(req)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	compress := strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
+	w.Header().Set("Content-Type", contentType)
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Set("Trailer", strings.Join([]string{osagent.BinlogContentLengthHeader, osagent.BinlogContentChecksumHeader, osagent.BinlogContentErrorHeader}, ", "))
+
+	writer := &startedWriter{ResponseWriter: w}
+	digest, err := streamFunc(writer, compress, binlogFileNames, startPosition, stopPosition)
+	if err != nil && !writer.started {
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Trailer")
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	if err != nil {
+		w.Header().Set(osagent.BinlogContentErrorHeader, err.Error())
+		return
+	}
+	w.Header().Set(osagent.BinlogContentLengthHeader, strconv.FormatInt(digest.Length, 10))
+	w.Header().Set(osagent.BinlogContentChecksumHeader, digest.Checksum)
+}
+
+// BinlogContents returns contents of binary log entries
+func (this *HttpAPI) BinlogContents(params martini.Params, r render.Render, req *http.Request) {
+	this.binlogContents(params, r, req, osagent.MySQLBinlogContents)
+}
+
+// BinlogBinaryContents returns contents of binary log entries
+func (this *HttpAPI) BinlogBinaryContents(params martini.Params, r render.Render, req *http.Request) {
+	this.binlogContents(params, r, req, osagent.MySQLBinlogBinaryContents)
+}
+
+// BinlogContentsStream streams contents of binary log entries, as SQL
+func (this *HttpAPI) BinlogContentsStream(params martini.Params, r render.Render, req *http.Request, w http.ResponseWriter) {
+	this.binlogContentsStream(params, r, req, w, "text/plain; charset=utf-8", osagent.StreamMySQLBinlogContents)
+}
+
+// BinlogBinaryContentsStream streams binary contents of binary log entries
+func (this *HttpAPI) BinlogBinaryContentsStream(params martini.Params, r render.Render, req *http.Request, w http.ResponseWriter) {
+	this.binlogContentsStream(params, r, req, w, "application/octet-stream", osagent.StreamMySQLBinlogBinaryContents)
+}
+
+// BinlogEvents lists events of a relay or binary log, a page at a time
+func (this *HttpAPI) BinlogEvents(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+
+	var err error
+	var startPosition, stopPosition int64
+	var limit int
+	if start := req.URL.Query().Get("start"); start != "" {
+		if startPosition, err = strconv.ParseInt(start, 10, 0); err != nil {
+			r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+			return
+		}
+	}
+	if stop := req.URL.Query().Get("stop"); stop != "" {
+		if stopPosition, err = strconv.ParseInt(stop, 10, 0); err != nil {
+			r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+			return
+		}
+	}
+	if limitParam := req.URL.Query().Get("limit"); limitParam != "" {
+		if limit, err = strconv.Atoi(limitParam); err != nil {
+			r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+			return
+		}
+	}
+	output, err := osagent.ListBinlogEvents(params["log"], startPosition, stopPosition, limit)
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, output)
+}
+
+// ApplyRelaylogContents reads binlog contents from request's body and applies them locally, or on dry run,
+// returns the SQL which would be applied. Events may be filtered by table (skip-table=schema.table, with
+// wildcards), and applying stopped before a position within the contents (stop). Transactions already executed
+// are skipped with skip-executed-gtids=true, which is the default where a MySQL connection is configured, as
+// executed GTIDs are read off it. A request-id identifies the request, such that a retry is not applied again.
+// On failure, the report of transactions applied so far is given in the response's details.
+func (this *HttpAPI) ApplyRelaylogContents(params martini.Params, r render.Render, req *http.Request) {
+	if err := this.validateToken(r, req); err != nil {
+		return
+	}
+	defer req.Body.Close()
+
+	query := req.URL.Query()
+	options := osagent.RelaylogApplyOptions{
+		RequestId:         query.Get("request-id"),
+		DryRun:            query.Get("dry-run") == "true",
+		Filter:            osagent.BinlogFilter{SkipTables: query["skip-table"]},
+		SkipExecutedGtids: query.Get("skip-executed-gtids") == "true",
+	}
+	if query.Get("skip-executed-gtids") == "" {
+		options.SkipExecutedGtids = osagent.MySQLConnectionConfigured()
+	}
+	var err error
+	if stop := query.Get("stop"); stop != "" {
+		if options.StopPosition, err = strconv.ParseInt(stop, 10, 0); err != nil {
+			r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error()})
+			return
+		}
+	}
+	var output *osagent.RelaylogApplyReport
+	if req.Header.Get("Content-Type") == "application/octet-stream" {
+		// Streamed binary contents, as served by BinlogBinaryContentsStream; the digest may be given in headers or trailers
+		output, err = osagent.ApplyRelaylogContentsStream(req.Body, req.Header.Get("Content-Encoding") == "gzip", func() (*osagent.ContentDigest, error) {
+			header := req.Header
+			if header.Get(osagent.BinlogContentLengthHeader) == "" && header.Get(osagent.BinlogContentChecksumHeader) == "" {
+				header = req.Trailer
+			}
+			return osagent.ParseContentDigest(header.Get(osagent.BinlogContentLengthHeader), header.Get(osagent.BinlogContentChecksumHeader))
+		}, options)
+	} else {
+		var body []byte
+		if body, err = ioutil.ReadAll(req.Body); err == nil {
+			output, err = osagent.ApplyRelaylogContents(body, options)
+		}
+	}
+	if err != nil {
+		r.JSON(500, &APIResponse{Code: ERROR, Message: err.Error(), Details: output})
+		return
+	}
+	r.JSON(200, output)
 }
 
 func (this *HttpAPI) RunCommand(params martini.Params, r render.Render, req *http.Request) {
@@ -598,11 +1387,17 @@ func (this *HttpAPI) RegisterRequests(m *martini.ClassicMartini) {
 	m.Get("/api/lvs", this.ListLogicalVolumes)
 	m.Get("/api/lvs/:pattern", this.ListLogicalVolumes)
 	m.Get("/api/lvs-snapshots", this.ListSnapshotsLogicalVolumes)
+	m.Get("/api/vgs", this.ListVolumeGroups)
 	m.Get("/api/lv", this.LogicalVolume)
 	m.Get("/api/lv/:lv", this.LogicalVolume)
 	m.Get("/api/mount", this.GetMount)
+	m.Get("/api/mysql-mounts", this.MySQLMounts)
+	m.Get("/api/mysql-instance", this.MySQLInstance)
+	m.Get("/api/replication-status", this.ReplicationStatus)
 	m.Get("/api/mountlv", this.MountLV)
 	m.Get("/api/removelv", this.RemoveLV)
+	m.Get("/api/restorelv", this.RestoreLV)
+	m.Get("/api/restore-history", this.RestoreHistory)
 	m.Get("/api/umount", this.Unmount)
 	m.Get("/api/du", this.DiskUsage)
 	m.Get("/api/mysql-du", this.MySQLDiskUsage)
@@ -620,15 +1415,51 @@ func (this *HttpAPI) RegisterRequests(m *martini.ClassicMartini) {
 	m.Get("/api/receive-mysql-seed-data/:seedId", this.ReceiveMySQLSeedData)
 	m.Get("/api/send-mysql-seed-data/:targetHost/:seedId", this.SendMySQLSeedData)
 	m.Get("/api/abort-seed/:seedId", this.AbortSeed)
+	m.Get("/api/export-snapshot/:archive/:jobId", this.ExportSnapshot)
+	m.Get("/api/import-archive/:archive/:jobId", this.ImportArchive)
+	m.Get("/api/archives", this.Archives)
+	m.Get("/api/verify-archive/:archive", this.VerifyArchive)
+	m.Get("/api/backup-snapshot/:backup/:jobId", this.BackupSnapshot)
+	m.Get("/api/push-archive/:archive/:jobId", this.PushArchive)
+	m.Get("/api/restore-backup/:backup/:seedId", this.RestoreBackup)
+	m.Get("/api/backups", this.Backups)
+	m.Get("/api/verify-backup/:backup", this.VerifyBackup)
+	m.Get("/api/delete-backup/:backup", this.DeleteBackup)
+	m.Get("/api/backup-retention", this.ApplyBackupRetention)
+	m.Get("/api/physical-backup/:chain/:type/:jobId", this.CreatePhysicalBackup)
+	m.Get("/api/backup-chains", this.BackupChains)
+	m.Get("/api/backup-chain/:chain", this.BackupChain)
+	m.Get("/api/restore-backup-chain/:chain/:seedId", this.RestoreBackupChain)
 	m.Get("/api/seed-command-completed/:seedId", this.SeedCommandCompleted)
 	m.Get("/api/seed-command-succeeded/:seedId", this.SeedCommandSucceeded)
+	m.Get("/api/leases", this.Leases)
+	m.Get("/api/lease/acquire", this.AcquireLease)
+	m.Get("/api/lease/renew/:leaseId", this.RenewLease)
+	m.Get("/api/lease/release/:leaseId", this.ReleaseLease)
+	m.Get("/api/sandbox/start", this.StartSandbox)
+	m.Get("/api/sandboxes", this.Sandboxes)
+	m.Get("/api/sandbox/:sandboxId", this.Sandbox)
+	m.Get("/api/sandbox/:sandboxId/query", this.SandboxQuery)
+	m.Get("/api/sandbox/:sandboxId/stop", this.StopSandbox)
+	m.Get("/api/pitr/start", this.StartPITR)
+	m.Get("/api/pitr-jobs", this.PITRJobs)
+	m.Get("/api/pitr/:jobId", this.PITRJob)
+	m.Get("/api/pitr/:jobId/abort", this.AbortPITR)
 	m.Get("/api/mysql-relay-log-index-file", this.RelayLogIndexFile)
 	m.Get("/api/mysql-relay-log-files", this.RelayLogFiles)
 	m.Get("/api/mysql-relay-log-end-coordinates", this.RelayLogEndCoordinates)
+	m.Get("/api/mysql-binlog-index-file", this.BinaryLogIndexFile)
+	m.Get("/api/mysql-binlog-files", this.BinaryLogFiles)
+	m.Get("/api/mysql-binlog-end-coordinates", this.BinaryLogEndCoordinates)
+	m.Get("/api/mysql-binlog-coordinates", this.FindBinlogCoordinates)
 	m.Get("/api/mysql-binlog-contents", this.BinlogContents)
 	m.Get("/api/mysql-binlog-binary-contents", this.BinlogBinaryContents)
+	m.Get("/api/mysql-binlog-contents-stream", this.BinlogContentsStream)
+	m.Get("/api/mysql-binlog-binary-contents-stream", this.BinlogBinaryContentsStream)
 	m.Get("/api/mysql-relaylog-contents-tail/:relaylog/:start", this.RelaylogContentsTail)
 	m.Post("/api/apply-relaylog-contents", this.ApplyRelaylogContents)
+	m.Get("/api/mysql-binlog-events/:log", this.BinlogEvents)
+	m.Get("/api/mysql-binlog-flashback", this.BinlogFlashback)
 	m.Get("/api/custom-commands/:cmd", this.RunCommand)
 	m.Get(config.Config.StatusEndpoint, this.Status)
 
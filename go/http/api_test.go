@@ -0,0 +1,189 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/agent"
+	agenthttp "github.com/github/orchestrator-agent/go/http"
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/github/orchestrator-agent/go/osagent"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// testRender renders JSON responses onto a plain http.ResponseWriter, standing in for martini's renderer
+type testRender struct {
+	render.Render
+	writer http.ResponseWriter
+}
+
+func (this *testRender) JSON(status int, v interface{}) {
+	this.writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	this.writer.WriteHeader(status)
+	json.NewEncoder(this.writer).Encode(v)
+}
+
+// newTestServer serves the binlog streaming and relay log applying APIs
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/mysql-binlog-binary-contents-stream", func(w http.ResponseWriter, req *http.Request) {
+		agenthttp.API.BinlogBinaryContentsStream(martini.Params{}, &testRender{writer: w}, req, w)
+	})
+	mux.HandleFunc("/api/apply-relaylog-contents", func(w http.ResponseWriter, req *http.Request) {
+		agenthttp.API.ApplyRelaylogContents(martini.Params{}, &testRender{writer: w}, req)
+	})
+	return httptest.NewServer(mux)
+}
+
+// writeTestBinlog writes a binary log of given query events, followed by trailing bytes
+func writeTestBinlog(t *testing.T, fileName string, queries []string, trailing []byte) {
+	binlog, _ := inst.EncodeQueryBinlog("8.0.20", 1600000000, 1, queries)
+	if err := ioutil.WriteFile(fileName, append(binlog, trailing...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// streamBinlog requests the gzipped binary contents of given logs, returning the response along with its
+// uncompressed body, read in full such that trailers are available
+func streamBinlog(t *testing.T, server *httptest.Server, binlogFiles []string, start int64) (*http.Response, []byte) {
+	query := url.Values{"token": {agent.ProcessToken.Hash}, "binlog": binlogFiles, "start": {strconv.FormatInt(start, 10)}}
+	req, _ := http.NewRequest("GET", server.URL+"/api/mysql-binlog-binary-contents-stream?"+query.Encode(), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Contents cut short by an error leave the gzip stream unterminated
+		body, _ = ioutil.ReadAll(gzipReader)
+	}
+	return response, body
+}
+
+func TestBinlogBinaryContentsStream(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	binlog, corrupt := path.Join(directory, "relay-bin.000001"), path.Join(directory, "relay-bin.000002")
+	writeTestBinlog(t, binlog, []string{"create table a (id int)", "create table b (id int)"}, nil)
+	writeTestBinlog(t, corrupt, []string{"create table c (id int)"}, []byte{1, 2, 3})
+	expected, _ := ioutil.ReadFile(binlog)
+	server := newTestServer()
+	defer server.Close()
+
+	response, body := streamBinlog(t, server, []string{binlog}, 0)
+	checksum := sha256.Sum256(expected)
+	if response.StatusCode != 200 || !bytes.Equal(body, expected) {
+		t.Errorf("Unexpected response: %d, %d bytes", response.StatusCode, len(body))
+	}
+	if response.Trailer.Get(osagent.BinlogContentLengthHeader) != strconv.Itoa(len(expected)) ||
+		response.Trailer.Get(osagent.BinlogContentChecksumHeader) != hex.EncodeToString(checksum[:]) ||
+		response.Trailer.Get(osagent.BinlogContentErrorHeader) != "" {
+		t.Errorf("Unexpected trailers: %+v", response.Trailer)
+	}
+
+	// Errors found before streaming begins make for an error response, rather than for an error trailer
+	for _, binlogFiles := range [][]string{{binlog, path.Join(directory, "relay-bin.000009")}, {path.Join(directory, "relay-bin.000009"), binlog}} {
+		response, body := streamBinlog(t, server, binlogFiles, 0)
+		apiResponse := struct{ Message string }{}
+		if err := json.Unmarshal(body, &apiResponse); err != nil || response.StatusCode != 500 || !strings.Contains(apiResponse.Message, "relay-bin.000009") {
+			t.Errorf("Expected error response on missing log, got %d: %s", response.StatusCode, body)
+		}
+	}
+	response, body = streamBinlog(t, server, []string{binlog}, 5)
+	if response.StatusCode != 500 || !strings.Contains(string(body), "not at an event boundary") {
+		t.Errorf("Expected error response on bad start position, got %d: %s", response.StatusCode, body)
+	}
+
+	// Errors found once streaming has begun are reported in a trailer
+	response, _ = streamBinlog(t, server, []string{corrupt, binlog}, 0)
+	if response.StatusCode != 200 || response.Trailer.Get(osagent.BinlogContentErrorHeader) == "" || response.Trailer.Get(osagent.BinlogContentChecksumHeader) != "" {
+		t.Errorf("Expected error trailer on corrupt log, got %d: %+v", response.StatusCode, response.Trailer)
+	}
+}
+
+func TestApplyRelaylogContentsStream(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	binlog := path.Join(directory, "relay-bin.000001")
+	writeTestBinlog(t, binlog, []string{"create table a (id int)", "create table b (id int)"}, nil)
+	contents, _ := ioutil.ReadFile(binlog)
+	checksum := sha256.Sum256(contents)
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(contents)
+	gzipWriter.Close()
+	server := newTestServer()
+	defer server.Close()
+
+	// Contents are applied as streamed by BinlogBinaryContentsStream: gzipped, with their digest in trailers
+	apply := func(checksum string) (*http.Response, []byte) {
+		// With no MySQL connection configured, executed GTIDs are not looked up by default
+		query := url.Values{"token": {agent.ProcessToken.Hash}, "dry-run": {"true"}}
+		req, _ := http.NewRequest("POST", server.URL+"/api/apply-relaylog-contents?"+query.Encode(), bytes.NewReader(compressed.Bytes()))
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Trailer = http.Header{}
+		req.Trailer.Set(osagent.BinlogContentLengthHeader, strconv.Itoa(len(contents)))
+		req.Trailer.Set(osagent.BinlogContentChecksumHeader, checksum)
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return response, body
+	}
+
+	response, body := apply(hex.EncodeToString(checksum[:]))
+	report := osagent.RelaylogApplyReport{}
+	if err := json.Unmarshal(body, &report); err != nil || response.StatusCode != 200 {
+		t.Fatalf("Unexpected response: %d: %s", response.StatusCode, body)
+	}
+	if !report.DryRun || !strings.Contains(report.SQL, "create table a") || !strings.Contains(report.SQL, "create table b") {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	response, body = apply(strings.Repeat("0", 64))
+	if response.StatusCode != 500 || !strings.Contains(string(body), "checksum mismatch") {
+		t.Errorf("Expected error on checksum mismatch, got %d: %s", response.StatusCode, body)
+	}
+}
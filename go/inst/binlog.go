@@ -17,7 +17,6 @@
 package inst
 
 import (
-	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -81,13 +80,54 @@ func (this *BinlogCoordinates) IsEmpty() bool {
 	return this.LogFile == ""
 }
 
+// maxLogFileNumber is the largest number MySQL gives a binary or relay log file
+const maxLogFileNumber = 0x7FFFFFFF
+
+// fileBaseAndNumber splits the file name into its base and numeric extension, e.g. mysql-bin.000123 into
+// (mysql-bin, 123). ok is false where the extension is not numeric.
+func (this *BinlogCoordinates) fileBaseAndNumber() (base string, number int64, ok bool) {
+	dot := strings.LastIndex(this.LogFile, ".")
+	if dot < 0 {
+		return this.LogFile, 0, false
+	}
+	extension := this.LogFile[dot+1:]
+	if extension == "" || strings.TrimLeft(extension, "0123456789") != "" {
+		return this.LogFile, 0, false
+	}
+	number, err := strconv.ParseInt(extension, 10, 64)
+	if err != nil {
+		return this.LogFile, 0, false
+	}
+	return this.LogFile[:dot], number, true
+}
+
+// compareFiles compares this coordinate's file with the other's: by base name, then by number, such that
+// mysql-bin.999999 precedes mysql-bin.1000000. Files without numeric extensions compare by name.
+func (this *BinlogCoordinates) compareFiles(other *BinlogCoordinates) int {
+	thisBase, thisNumber, thisOk := this.fileBaseAndNumber()
+	otherBase, otherNumber, otherOk := other.fileBaseAndNumber()
+	if !thisOk || !otherOk {
+		return strings.Compare(this.LogFile, other.LogFile)
+	}
+	if thisBase != otherBase {
+		return strings.Compare(thisBase, otherBase)
+	}
+	switch {
+	case thisNumber < otherNumber:
+		return -1
+	case thisNumber > otherNumber:
+		return 1
+	}
+	return 0
+}
+
 // SmallerThan returns true if this coordinate is strictly smaller than the other.
 func (this *BinlogCoordinates) SmallerThan(other *BinlogCoordinates) bool {
-	if this.LogFile < other.LogFile {
-		return true
-	}
-	if this.LogFile == other.LogFile && this.LogPos < other.LogPos {
+	switch this.compareFiles(other) {
+	case -1:
 		return true
+	case 0:
+		return this.LogPos < other.LogPos
 	}
 	return false
 }
@@ -98,12 +138,12 @@ func (this *BinlogCoordinates) SmallerThanOrEquals(other *BinlogCoordinates) boo
 	if this.SmallerThan(other) {
 		return true
 	}
-	return this.LogFile == other.LogFile && this.LogPos == other.LogPos // No Type comparison
+	return this.compareFiles(other) == 0 && this.LogPos == other.LogPos // No Type comparison
 }
 
 // FileSmallerThan returns true if this coordinate's file is strictly smaller than the other's.
 func (this *BinlogCoordinates) FileSmallerThan(other *BinlogCoordinates) bool {
-	return this.LogFile < other.LogFile
+	return this.compareFiles(other) < 0
 }
 
 // FileNumberDistance returns the numeric distance between this corrdinate's file number and the other's.
@@ -117,50 +157,120 @@ func (this *BinlogCoordinates) FileNumberDistance(other *BinlogCoordinates) int
 // FileNumber returns the numeric value of the file, and the length in characters representing the number in the filename.
 // Example: FileNumber() of mysqld.log.000789 is (789, 6)
 func (this *BinlogCoordinates) FileNumber() (int, int) {
-	tokens := strings.Split(this.LogFile, ".")
-	numPart := tokens[len(tokens)-1]
-	numLen := len(numPart)
-	fileNum, err := strconv.Atoi(numPart)
-	if err != nil {
+	_, fileNum, ok := this.fileBaseAndNumber()
+	if !ok {
 		return 0, 0
 	}
-	return fileNum, numLen
+	return int(fileNum), len(this.LogFile) - strings.LastIndex(this.LogFile, ".") - 1
 }
 
-// PreviousFileCoordinatesBy guesses the filename of the previous binlog/relaylog, by given offset (number of files back)
-func (this *BinlogCoordinates) PreviousFileCoordinatesBy(offset int) (BinlogCoordinates, error) {
+// fileCoordinatesBy returns the coordinates at the beginning of the file offset files away from this one,
+// keeping the number's zero padding
+func (this *BinlogCoordinates) fileCoordinatesBy(offset int) (BinlogCoordinates, error) {
 	result := BinlogCoordinates{LogPos: 0, Type: this.Type}
 
 	fileNum, numLen := this.FileNumber()
 	if fileNum == 0 {
-		return result, errors.New("Log file number is zero, cannot detect previous file")
+		return result, fmt.Errorf("Log file number of %s is zero or missing, cannot detect file by offset", this.LogFile)
+	}
+	newNum := int64(fileNum) + int64(offset)
+	if newNum < 1 || newNum > maxLogFileNumber {
+		return result, fmt.Errorf("Log file %s offset by %d is out of range: %d", this.LogFile, offset, newNum)
 	}
-	newNumStr := fmt.Sprintf("%d", fileNum-offset)
-	newNumStr = strings.Repeat("0", numLen-len(newNumStr)) + newNumStr
-
 	tokens := strings.Split(this.LogFile, ".")
-	tokens[len(tokens)-1] = newNumStr
+	tokens[len(tokens)-1] = fmt.Sprintf("%0*d", numLen, newNum)
 	result.LogFile = strings.Join(tokens, ".")
 	return result, nil
 }
 
+// PreviousFileCoordinatesBy guesses the filename of the previous binlog/relaylog, by given offset (number of files back)
+func (this *BinlogCoordinates) PreviousFileCoordinatesBy(offset int) (BinlogCoordinates, error) {
+	if offset < 0 {
+		return BinlogCoordinates{Type: this.Type}, fmt.Errorf("Negative offset: %d", offset)
+	}
+	return this.fileCoordinatesBy(-offset)
+}
+
 // PreviousFileCoordinates guesses the filename of the previous binlog/relaylog
 func (this *BinlogCoordinates) PreviousFileCoordinates() (BinlogCoordinates, error) {
 	return this.PreviousFileCoordinatesBy(1)
 }
 
-// PreviousFileCoordinates guesses the filename of the previous binlog/relaylog
+// NextFileCoordinates guesses the filename of the next binlog/relaylog
 func (this *BinlogCoordinates) NextFileCoordinates() (BinlogCoordinates, error) {
-	result := BinlogCoordinates{LogPos: 0, Type: this.Type}
+	return this.fileCoordinatesBy(1)
+}
 
-	fileNum, numLen := this.FileNumber()
-	newNumStr := fmt.Sprintf("%d", fileNum+1)
-	newNumStr = strings.Repeat("0", numLen-len(newNumStr)) + newNumStr
+// BinlogCoordinatesRange spans logs from (inclusive) one set of coordinates to (exclusive) another, possibly
+// across files
+type BinlogCoordinatesRange struct {
+	From BinlogCoordinates
+	To   BinlogCoordinates
+}
 
-	tokens := strings.Split(this.LogFile, ".")
-	tokens[len(tokens)-1] = newNumStr
-	result.LogFile = strings.Join(tokens, ".")
-	return result, nil
+// NewBinlogCoordinatesRange validates and returns a range. Both ends must be of the same sequence of logs, and
+// From may not follow To.
+func NewBinlogCoordinatesRange(from BinlogCoordinates, to BinlogCoordinates) (*BinlogCoordinatesRange, error) {
+	if from.LogPos < 0 || to.LogPos < 0 {
+		return nil, fmt.Errorf("Negative position in range %s to %s", from.DisplayString(), to.DisplayString())
+	}
+	if from.Type != to.Type {
+		return nil, fmt.Errorf("Range %s to %s spans different log types", from.DisplayString(), to.DisplayString())
+	}
+	fromBase, _, fromOk := from.fileBaseAndNumber()
+	toBase, _, toOk := to.fileBaseAndNumber()
+	if from.LogFile != to.LogFile && (!fromOk || !toOk || fromBase != toBase) {
+		return nil, fmt.Errorf("Range %s to %s spans unrelated log files", from.DisplayString(), to.DisplayString())
+	}
+	if to.SmallerThan(&from) {
+		return nil, fmt.Errorf("Range %s to %s ends before it begins", from.DisplayString(), to.DisplayString())
+	}
+	return &BinlogCoordinatesRange{From: from, To: to}, nil
+}
+
+// Contains tells whether given coordinates fall within this range
+func (this *BinlogCoordinatesRange) Contains(coordinates *BinlogCoordinates) bool {
+	return this.From.SmallerThanOrEquals(coordinates) && coordinates.SmallerThan(&this.To)
+}
+
+// LogFiles lists the files this range spans, in order
+func (this *BinlogCoordinatesRange) LogFiles() ([]string, error) {
+	logFiles := []string{this.From.LogFile}
+	for coordinates := this.From; coordinates.FileSmallerThan(&this.To); {
+		var err error
+		if coordinates, err = coordinates.NextFileCoordinates(); err != nil {
+			return logFiles, err
+		}
+		logFiles = append(logFiles, coordinates.LogFile)
+	}
+	return logFiles, nil
+}
+
+// Size returns the number of bytes this range spans, by the sizes of the actual files as given by fileSize,
+// e.g. by stat-ing them. Positions beyond the ends of their files are an error.
+func (this *BinlogCoordinatesRange) Size(fileSize func(logFile string) (int64, error)) (size int64, err error) {
+	logFiles, err := this.LogFiles()
+	if err != nil {
+		return 0, err
+	}
+	for i, logFile := range logFiles {
+		fileEnd, err := fileSize(logFile)
+		if err != nil {
+			return 0, err
+		}
+		start, end := int64(0), fileEnd
+		if i == 0 {
+			start = this.From.LogPos
+		}
+		if i == len(logFiles)-1 {
+			end = this.To.LogPos
+		}
+		if start > fileEnd || end > fileEnd {
+			return 0, fmt.Errorf("Range %s to %s exceeds %s, of %d bytes", this.From.DisplayString(), this.To.DisplayString(), logFile, fileEnd)
+		}
+		size += end - start
+	}
+	return size, nil
 }
 
 // FileSmallerThan returns true if this coordinate's file is strictly smaller than the other's.
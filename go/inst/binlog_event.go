@@ -0,0 +1,356 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+)
+
+type BinlogEventType byte
+
+const (
+	UnknownEventType           BinlogEventType = 0
+	StartEventV3               BinlogEventType = 1
+	QueryEventType             BinlogEventType = 2
+	StopEventType              BinlogEventType = 3
+	RotateEventType            BinlogEventType = 4
+	IntvarEventType            BinlogEventType = 5
+	RandEventType              BinlogEventType = 13
+	UserVarEventType           BinlogEventType = 14
+	FormatDescriptionEventType BinlogEventType = 15
+	XidEventType               BinlogEventType = 16
+	TableMapEventType          BinlogEventType = 19
+	WriteRowsEventV0           BinlogEventType = 20
+	UpdateRowsEventV0          BinlogEventType = 21
+	DeleteRowsEventV0          BinlogEventType = 22
+	WriteRowsEventV1           BinlogEventType = 23
+	UpdateRowsEventV1          BinlogEventType = 24
+	DeleteRowsEventV1          BinlogEventType = 25
+	IncidentEventType          BinlogEventType = 26
+	HeartbeatEventType         BinlogEventType = 27
+	IgnorableEventType         BinlogEventType = 28
+	RowsQueryEventType         BinlogEventType = 29
+	WriteRowsEventV2           BinlogEventType = 30
+	UpdateRowsEventV2          BinlogEventType = 31
+	DeleteRowsEventV2          BinlogEventType = 32
+	GtidEventType              BinlogEventType = 33
+	AnonymousGtidEventType     BinlogEventType = 34
+	PreviousGtidsEventType     BinlogEventType = 35
+	TransactionContextEvent    BinlogEventType = 36
+	ViewChangeEventType        BinlogEventType = 37
+	XAPrepareEventType         BinlogEventType = 38
+	PartialUpdateRowsEvent     BinlogEventType = 39
+	TransactionPayloadEvent    BinlogEventType = 40
+	HeartbeatEventV2           BinlogEventType = 41
+	MariaDBAnnotateRowsEvent   BinlogEventType = 160
+	MariaDBBinlogCheckpoint    BinlogEventType = 161
+	MariaDBGtidEventType       BinlogEventType = 162
+	MariaDBGtidListEventType   BinlogEventType = 163
+	MariaDBStartEncryption     BinlogEventType = 164
+)
+
+var binlogEventTypeNames = map[BinlogEventType]string{
+	UnknownEventType:           "Unknown",
+	StartEventV3:               "Start_v3",
+	QueryEventType:             "Query",
+	StopEventType:              "Stop",
+	RotateEventType:            "Rotate",
+	IntvarEventType:            "Intvar",
+	RandEventType:              "RAND",
+	UserVarEventType:           "User var",
+	FormatDescriptionEventType: "Format_desc",
+	XidEventType:               "Xid",
+	TableMapEventType:          "Table_map",
+	WriteRowsEventV0:           "Write_rows_v0",
+	UpdateRowsEventV0:          "Update_rows_v0",
+	DeleteRowsEventV0:          "Delete_rows_v0",
+	WriteRowsEventV1:           "Write_rows_v1",
+	UpdateRowsEventV1:          "Update_rows_v1",
+	DeleteRowsEventV1:          "Delete_rows_v1",
+	IncidentEventType:          "Incident",
+	HeartbeatEventType:         "Heartbeat",
+	IgnorableEventType:         "Ignorable",
+	RowsQueryEventType:         "Rows_query",
+	WriteRowsEventV2:           "Write_rows",
+	UpdateRowsEventV2:          "Update_rows",
+	DeleteRowsEventV2:          "Delete_rows",
+	GtidEventType:              "Gtid",
+	AnonymousGtidEventType:     "Anonymous_Gtid",
+	PreviousGtidsEventType:     "Previous_gtids",
+	TransactionContextEvent:    "Transaction_context",
+	ViewChangeEventType:        "View_change",
+	XAPrepareEventType:         "XA_prepare",
+	PartialUpdateRowsEvent:     "Update_rows_partial",
+	TransactionPayloadEvent:    "Transaction_payload",
+	HeartbeatEventV2:           "Heartbeat_v2",
+	MariaDBAnnotateRowsEvent:   "Annotate_rows",
+	MariaDBBinlogCheckpoint:    "Binlog_checkpoint",
+	MariaDBGtidEventType:       "Gtid",
+	MariaDBGtidListEventType:   "Gtid_list",
+	MariaDBStartEncryption:     "Start_encryption",
+}
+
+// String returns the event type's name, as in SHOW BINLOG EVENTS
+func (this BinlogEventType) String() string {
+	if name, ok := binlogEventTypeNames[this]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", byte(this))
+}
+
+// IsRowsEvent returns true for write/update/delete rows events of any version
+func (this BinlogEventType) IsRowsEvent() bool {
+	return (this >= WriteRowsEventV0 && this <= DeleteRowsEventV1) || (this >= WriteRowsEventV2 && this <= DeleteRowsEventV2)
+}
+
+const (
+	BinlogChecksumAlgOff   byte = 0
+	BinlogChecksumAlgCRC32 byte = 1
+	BinlogChecksumAlgUndef byte = 255
+)
+
+// BinlogEventHeader is the common (v4) header of all events
+type BinlogEventHeader struct {
+	Timestamp    uint32
+	EventType    BinlogEventType
+	ServerId     uint32
+	EventSize    uint32
+	NextPosition uint32 // as written by the originating server; in relay logs, a position in the master's binary log
+	Flags        uint16
+}
+
+// BinlogEvent is an event read from a binary or relay log
+type BinlogEvent struct {
+	BinlogEventHeader
+	Position    int64 // where the event begins in the log file
+	EndPosition int64 // where the event ends (and the next begins) in the log file
+	Payload     interface{}
+	Raw         []byte `json:"-"` // the event as found in the log, including header and checksum
+}
+
+// Time returns the event's timestamp
+func (this *BinlogEvent) Time() time.Time {
+	return time.Unix(int64(this.Timestamp), 0)
+}
+
+// FormatDescriptionEvent describes the format of the events that follow it
+type FormatDescriptionEvent struct {
+	BinlogVersion     uint16
+	ServerVersion     string
+	CreateTimestamp   uint32
+	HeaderLength      uint8
+	PostHeaderLengths []byte `json:"-"`
+	ChecksumAlgorithm byte
+}
+
+// postHeaderLength returns the post header length of given event type, or the fallback where undescribed
+func (this *FormatDescriptionEvent) postHeaderLength(eventType BinlogEventType, fallback int) int {
+	if this != nil && int(eventType) >= 1 && int(eventType) <= len(this.PostHeaderLengths) {
+		return int(this.PostHeaderLengths[eventType-1])
+	}
+	return fallback
+}
+
+// IsMariaDB tells whether the log was written by MariaDB
+func (this *FormatDescriptionEvent) IsMariaDB() bool {
+	return strings.Contains(this.ServerVersion, "MariaDB")
+}
+
+// RotateEvent points to the next log file
+type RotateEvent struct {
+	Position    uint64
+	NextLogFile string
+}
+
+// QueryEvent is a statement, including BEGIN of transactions
+type QueryEvent struct {
+	ThreadId      uint32
+	ExecutionTime uint32
+	ErrorCode     uint16
+	Database      string
+	Query         string
+	StatusVars    []byte `json:"-"`
+}
+
+// IntvarEvent sets the LAST_INSERT_ID() or the auto increment value used by the statement following it
+type IntvarEvent struct {
+	Type  byte
+	Value uint64
+}
+
+const (
+	IntvarLastInsertId byte = 1
+	IntvarInsertId     byte = 2
+)
+
+// RandEvent seeds RAND() for the statement following it
+type RandEvent struct {
+	Seed1 uint64
+	Seed2 uint64
+}
+
+// UserVarEvent sets a user variable referenced by the statement following it
+type UserVarEvent struct {
+	Name      string
+	IsNull    bool
+	Type      byte // item result type: string, real, int or decimal
+	Collation uint32
+	Value     []byte `json:"-"`
+	Flags     byte
+}
+
+const (
+	UserVarStringResult  byte = 0
+	UserVarRealResult    byte = 1
+	UserVarIntResult     byte = 2
+	UserVarDecimalResult byte = 4
+)
+
+const userVarUnsignedFlag = 0x01
+
+// XidEvent commits a transaction
+type XidEvent struct {
+	Xid uint64
+}
+
+// GtidEvent begins a MySQL transaction, (when not anonymous) identified by uuid:gno
+type GtidEvent struct {
+	Anonymous      bool
+	Flags          byte
+	UUID           string
+	GNO            int64
+	LastCommitted  int64 // logical clock, as of 5.7
+	SequenceNumber int64
+}
+
+// Gtid returns the transaction's GTID in uuid:gno form, or empty for anonymous transactions
+func (this *GtidEvent) Gtid() string {
+	if this.Anonymous {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", this.UUID, this.GNO)
+}
+
+// MariaDBGtidEvent begins a MariaDB transaction (or standalone statement)
+type MariaDBGtidEvent struct {
+	MariaDBGtid
+	Flags byte
+}
+
+// PreviousGtidsEvent holds the GTIDs executed before the log file, MySQL's Previous_gtids or MariaDB's Gtid_list
+type PreviousGtidsEvent struct {
+	GtidSet *GtidSet
+}
+
+// TableMapEvent maps a table id, used by following rows events, onto a table and its column types
+type TableMapEvent struct {
+	TableId        uint64
+	Flags          uint16
+	Database       string
+	Table          string
+	ColumnCount    uint64
+	ColumnTypes    []byte
+	ColumnMetadata []byte `json:"-"`
+	NullBitmap     []byte `json:"-"`
+}
+
+// RowsEvent holds row images of a write, update or delete on a single table
+type RowsEvent struct {
+	TableId             uint64
+	Flags               uint16
+	Version             int
+	Database            string // as resolved by the preceding table map event
+	Table               string
+	ColumnCount         uint64
+	ColumnsPresent      []byte         `json:"-"`
+	ColumnsPresentAfter []byte         `json:"-"` // update events: columns present in after image
+	TableMap            *TableMapEvent `json:"-"`
+	RowsData            []byte         `json:"-"`
+	flagsOffset         int            // where flags are found in the raw event
+	withChecksum        bool           // whether the raw event ends with a CRC32 checksum
+}
+
+const rowsEventStmtEndFlag = 0x0001
+
+// IsStatementEnd tells whether this is the last rows event of its statement
+func (this *RowsEvent) IsStatementEnd() bool {
+	return this.Flags&rowsEventStmtEndFlag != 0
+}
+
+// rawWithStatementEnd returns the raw event of a rows event, flagged as ending its statement, for where the rows
+// event which did end the statement is left out. The checksum is computed anew.
+func (this *BinlogEvent) rawWithStatementEnd() []byte {
+	payload, ok := this.Payload.(*RowsEvent)
+	if !ok || payload.IsStatementEnd() || payload.flagsOffset <= 0 || payload.flagsOffset+2 > len(this.Raw) {
+		return this.Raw
+	}
+	raw := append([]byte{}, this.Raw...)
+	binary.LittleEndian.PutUint16(raw[payload.flagsOffset:], payload.Flags|rowsEventStmtEndFlag)
+	if payload.withChecksum {
+		checksumOffset := len(raw) - 4
+		binary.LittleEndian.PutUint32(raw[checksumOffset:], crc32.ChecksumIEEE(raw[:checksumOffset]))
+	}
+	return raw
+}
+
+// Info returns a description of the event, akin to the Info column of SHOW BINLOG EVENTS
+func (this *BinlogEvent) Info() string {
+	switch payload := this.Payload.(type) {
+	case *FormatDescriptionEvent:
+		return fmt.Sprintf("Server ver: %s, Binlog ver: %d", payload.ServerVersion, payload.BinlogVersion)
+	case *RotateEvent:
+		return fmt.Sprintf("%s;pos=%d", payload.NextLogFile, payload.Position)
+	case *QueryEvent:
+		if payload.Database != "" {
+			return fmt.Sprintf("use `%s`; %s", payload.Database, payload.Query)
+		}
+		return payload.Query
+	case *XidEvent:
+		return fmt.Sprintf("COMMIT /* xid=%d */", payload.Xid)
+	case *IntvarEvent:
+		if payload.Type == IntvarLastInsertId {
+			return fmt.Sprintf("LAST_INSERT_ID=%d", payload.Value)
+		}
+		return fmt.Sprintf("INSERT_ID=%d", payload.Value)
+	case *RandEvent:
+		return fmt.Sprintf("rand_seed1=%d,rand_seed2=%d", payload.Seed1, payload.Seed2)
+	case *UserVarEvent:
+		return fmt.Sprintf("@`%s`", payload.Name)
+	case *GtidEvent:
+		if payload.Anonymous {
+			return "SET @@SESSION.GTID_NEXT= 'ANONYMOUS'"
+		}
+		return fmt.Sprintf("SET @@SESSION.GTID_NEXT= '%s'", payload.Gtid())
+	case *MariaDBGtidEvent:
+		return fmt.Sprintf("BEGIN GTID %s", payload.MariaDBGtid.String())
+	case *PreviousGtidsEvent:
+		return payload.GtidSet.String()
+	case *TableMapEvent:
+		return fmt.Sprintf("table_id: %d (%s.%s)", payload.TableId, payload.Database, payload.Table)
+	case *RowsEvent:
+		info := fmt.Sprintf("table_id: %d", payload.TableId)
+		if payload.IsStatementEnd() {
+			info += " flags: STMT_END_F"
+		}
+		return info
+	}
+	return ""
+}
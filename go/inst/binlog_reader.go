@@ -0,0 +1,553 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BinlogMagic opens every binary and relay log
+var BinlogMagic = []byte{0xfe, 'b', 'i', 'n'}
+
+const BinlogMagicSize = 4
+const BinlogEventHeaderSize = 19
+
+// maxBinlogEventSize bounds event size (as max_allowed_packet does), so that garbage is not mistaken for a huge event
+const maxBinlogEventSize = 1024 * 1024 * 1024
+
+var ErrBinlogChecksumMismatch = errors.New("Binlog event checksum mismatch")
+
+var serverVersionPattern = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)`)
+
+// BinlogReader reads events off a binary or relay log, tracking the format description and table maps
+// needed to interpret them
+type BinlogReader struct {
+	reader            *bufio.Reader
+	seeker            io.ReadSeeker // underlying the buffered reader, where the log may be seeked through
+	position          int64
+	FormatDescription *FormatDescriptionEvent
+	tableMaps         map[uint64]*TableMapEvent
+}
+
+// NewBinlogReader validates the magic header and returns a reader positioned at the first event. The reader
+// is buffered; a reader which is also an io.Seeker, such as a file, is seeked through when skipping events.
+func NewBinlogReader(reader io.Reader) (*BinlogReader, error) {
+	this := &BinlogReader{reader: bufio.NewReader(reader), position: BinlogMagicSize, tableMaps: map[uint64]*TableMapEvent{}}
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		this.seeker = seeker
+	}
+	magic := make([]byte, BinlogMagicSize)
+	if _, err := io.ReadFull(this.reader, magic); err != nil {
+		return nil, fmt.Errorf("Cannot read binlog magic header: %+v", err)
+	}
+	if !bytes.Equal(magic, BinlogMagic) {
+		return nil, fmt.Errorf("Not a binary log: bad magic header %x", magic)
+	}
+	return this, nil
+}
+
+// skip advances the underlying reader from one position in the log to another. Positions beyond what is
+// buffered are seeked to, where the reader allows, rather than read through.
+func (this *BinlogReader) skip(from int64, to int64) error {
+	if this.seeker != nil && to-from > int64(this.reader.Buffered()) {
+		if _, err := this.seeker.Seek(to, io.SeekStart); err != nil {
+			return err
+		}
+		this.reader.Reset(this.seeker)
+		return nil
+	}
+	_, err := io.CopyN(ioutil.Discard, this.reader, to-from)
+	return err
+}
+
+// Position returns the position of the next event to be read
+func (this *BinlogReader) Position() int64 {
+	return this.position
+}
+
+// SkipTo advances the reader to given position, which is expected to be that of an event. Events up to
+// that position are not interpreted, hence the format description should be read beforehand.
+func (this *BinlogReader) SkipTo(position int64) error {
+	if position < this.position {
+		return fmt.Errorf("Cannot skip back from position %d to %d", this.position, position)
+	}
+	if err := this.skip(this.position, position); err != nil {
+		return err
+	}
+	this.position = position
+	return nil
+}
+
+// ReadEvent reads the next event. It returns io.EOF at the clean end of the log, and io.ErrUnexpectedEOF
+// on a partially written (or truncated) last event, in which case Position() remains at the event's start.
+func (this *BinlogReader) ReadEvent() (*BinlogEvent, error) {
+	event, headerBytes, err := this.readEventHeader()
+	if err != nil {
+		return nil, err
+	}
+	return this.readEventBody(event, headerBytes)
+}
+
+// ReadEventHeader reads the next event's header, skipping over its body without verifying or interpreting it,
+// which makes for a fast scan of a log: on a file, bodies are seeked past rather than read. Format description,
+// previous GTIDs and GTID events are read in full nonetheless.
+func (this *BinlogReader) ReadEventHeader() (*BinlogEvent, error) {
+	event, headerBytes, err := this.readEventHeader()
+	if err != nil {
+		return nil, err
+	}
+	switch event.EventType {
+	case FormatDescriptionEventType, PreviousGtidsEventType, MariaDBGtidListEventType,
+		GtidEventType, AnonymousGtidEventType, MariaDBGtidEventType:
+		return this.readEventBody(event, headerBytes)
+	}
+	event.EndPosition = event.Position + int64(event.EventSize)
+	if event.EventSize > BinlogEventHeaderSize {
+		// Seeking past the end of a file succeeds; the event's last byte is read to tell it is all written
+		if err := this.skip(event.Position+BinlogEventHeaderSize, event.EndPosition-1); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if _, err := this.reader.ReadByte(); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	this.position = event.EndPosition
+	return event, nil
+}
+
+func (this *BinlogReader) readEventHeader() (*BinlogEvent, []byte, error) {
+	headerBytes := make([]byte, BinlogEventHeaderSize)
+	if n, err := io.ReadFull(this.reader, headerBytes); err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, nil, io.EOF
+		}
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	event := &BinlogEvent{Position: this.position}
+	event.BinlogEventHeader = BinlogEventHeader{
+		Timestamp:    binary.LittleEndian.Uint32(headerBytes[0:]),
+		EventType:    BinlogEventType(headerBytes[4]),
+		ServerId:     binary.LittleEndian.Uint32(headerBytes[5:]),
+		EventSize:    binary.LittleEndian.Uint32(headerBytes[9:]),
+		NextPosition: binary.LittleEndian.Uint32(headerBytes[13:]),
+		Flags:        binary.LittleEndian.Uint16(headerBytes[17:]),
+	}
+	if event.EventSize < BinlogEventHeaderSize || event.EventSize > maxBinlogEventSize {
+		return nil, nil, fmt.Errorf("Corrupt binlog event at position %d: size %d", event.Position, event.EventSize)
+	}
+	return event, headerBytes, nil
+}
+
+func (this *BinlogReader) readEventBody(event *BinlogEvent, headerBytes []byte) (*BinlogEvent, error) {
+	event.Raw = make([]byte, event.EventSize)
+	copy(event.Raw, headerBytes)
+	if _, err := io.ReadFull(this.reader, event.Raw[BinlogEventHeaderSize:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	event.EndPosition = event.Position + int64(event.EventSize)
+	this.position = event.EndPosition
+
+	body := event.Raw[BinlogEventHeaderSize:]
+	if event.EventType == FormatDescriptionEventType {
+		formatDescription, err := parseFormatDescriptionEvent(body)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid format description event at position %d: %+v", event.Position, err)
+		}
+		this.FormatDescription = formatDescription
+		event.Payload = formatDescription
+	}
+	if this.FormatDescription != nil && this.FormatDescription.ChecksumAlgorithm == BinlogChecksumAlgCRC32 {
+		if len(body) < 4 {
+			return nil, fmt.Errorf("Binlog event at position %d too short for checksum", event.Position)
+		}
+		checksumOffset := len(event.Raw) - 4
+		if crc32.ChecksumIEEE(event.Raw[:checksumOffset]) != binary.LittleEndian.Uint32(event.Raw[checksumOffset:]) {
+			return event, fmt.Errorf("%s at position %d", ErrBinlogChecksumMismatch.Error(), event.Position)
+		}
+		body = body[:len(body)-4]
+	}
+	if event.EventType == FormatDescriptionEventType {
+		return event, nil
+	}
+	if this.FormatDescription != nil && this.FormatDescription.HeaderLength > BinlogEventHeaderSize {
+		extraHeaderLength := int(this.FormatDescription.HeaderLength) - BinlogEventHeaderSize
+		if len(body) < extraHeaderLength {
+			return nil, fmt.Errorf("Binlog event at position %d too short", event.Position)
+		}
+		body = body[extraHeaderLength:]
+	}
+	if err := this.parsePayload(event, body); err != nil {
+		return event, fmt.Errorf("Cannot parse %s event at position %d: %+v", event.EventType, event.Position, err)
+	}
+	return event, nil
+}
+
+// serverVersionProduct converts a version such as 5.6.1 into 50601, for comparison
+func serverVersionProduct(serverVersion string) int {
+	submatch := serverVersionPattern.FindStringSubmatch(serverVersion)
+	if submatch == nil {
+		return 0
+	}
+	major, _ := strconv.Atoi(submatch[1])
+	minor, _ := strconv.Atoi(submatch[2])
+	patch, _ := strconv.Atoi(submatch[3])
+	return major*10000 + minor*100 + patch
+}
+
+func parseFormatDescriptionEvent(body []byte) (*FormatDescriptionEvent, error) {
+	// binlog version (2), server version (50), create timestamp (4), header length (1), post header lengths
+	if len(body) < 57 {
+		return nil, errors.New("too short")
+	}
+	event := &FormatDescriptionEvent{
+		BinlogVersion:     binary.LittleEndian.Uint16(body[0:]),
+		ServerVersion:     strings.TrimRight(string(body[2:52]), "\x00"),
+		CreateTimestamp:   binary.LittleEndian.Uint32(body[52:]),
+		HeaderLength:      body[56],
+		ChecksumAlgorithm: BinlogChecksumAlgUndef,
+	}
+	if event.BinlogVersion != 4 {
+		return nil, fmt.Errorf("unsupported binlog version %d", event.BinlogVersion)
+	}
+	postHeaderLengths := body[57:]
+	// Servers aware of checksums (MySQL 5.6.1, MariaDB 5.3) end the event with the algorithm (1) and a checksum (4)
+	minimumChecksumVersion := 50601
+	if event.IsMariaDB() {
+		minimumChecksumVersion = 50300
+	}
+	if serverVersionProduct(event.ServerVersion) >= minimumChecksumVersion {
+		if len(postHeaderLengths) < 5 {
+			return nil, errors.New("too short for checksum algorithm")
+		}
+		event.ChecksumAlgorithm = postHeaderLengths[len(postHeaderLengths)-5]
+		postHeaderLengths = postHeaderLengths[:len(postHeaderLengths)-5]
+	}
+	event.PostHeaderLengths = append([]byte{}, postHeaderLengths...)
+	return event, nil
+}
+
+// binlogBuffer decodes little endian fields off an event body, recording the first error
+type binlogBuffer struct {
+	data []byte
+	err  error
+}
+
+func (this *binlogBuffer) next(n int) []byte {
+	if this.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || n > len(this.data) {
+		this.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	result := this.data[:n]
+	this.data = this.data[n:]
+	return result
+}
+
+func (this *binlogBuffer) uint8() uint8 {
+	return this.next(1)[0]
+}
+
+func (this *binlogBuffer) uint16() uint16 {
+	return binary.LittleEndian.Uint16(this.next(2))
+}
+
+func (this *binlogBuffer) uint32() uint32 {
+	return binary.LittleEndian.Uint32(this.next(4))
+}
+
+func (this *binlogBuffer) uint64() uint64 {
+	return binary.LittleEndian.Uint64(this.next(8))
+}
+
+// uintN reads an n byte little endian unsigned integer
+func (this *binlogBuffer) uintN(n int) uint64 {
+	var result uint64
+	for i, b := range this.next(n) {
+		result |= uint64(b) << (8 * uint(i))
+	}
+	return result
+}
+
+// lengthEncodedInt reads a MySQL length encoded integer
+func (this *binlogBuffer) lengthEncodedInt() uint64 {
+	first := this.uint8()
+	switch {
+	case first < 0xfb:
+		return uint64(first)
+	case first == 0xfc:
+		return this.uintN(2)
+	case first == 0xfd:
+		return this.uintN(3)
+	case first == 0xfe:
+		return this.uintN(8)
+	}
+	this.err = fmt.Errorf("invalid length encoded integer prefix %x", first)
+	return 0
+}
+
+func (this *binlogBuffer) rest() []byte {
+	result := this.data
+	this.data = nil
+	return result
+}
+
+func (this *BinlogReader) parsePayload(event *BinlogEvent, body []byte) error {
+	buffer := &binlogBuffer{data: body}
+	switch event.EventType {
+	case RotateEventType:
+		payload := &RotateEvent{Position: buffer.uint64()}
+		payload.NextLogFile = string(buffer.rest())
+		event.Payload = payload
+	case QueryEventType:
+		payload := &QueryEvent{
+			ThreadId:      buffer.uint32(),
+			ExecutionTime: buffer.uint32(),
+		}
+		databaseLength := int(buffer.uint8())
+		payload.ErrorCode = buffer.uint16()
+		postHeaderLength := this.FormatDescription.postHeaderLength(QueryEventType, 13)
+		statusVarsLength := 0
+		if postHeaderLength >= 13 {
+			statusVarsLength = int(buffer.uint16())
+			buffer.next(postHeaderLength - 13)
+		}
+		payload.StatusVars = buffer.next(statusVarsLength)
+		payload.Database = string(buffer.next(databaseLength))
+		buffer.next(1)
+		payload.Query = string(buffer.rest())
+		event.Payload = payload
+	case XidEventType:
+		event.Payload = &XidEvent{Xid: buffer.uint64()}
+	case IntvarEventType:
+		event.Payload = &IntvarEvent{Type: buffer.uint8(), Value: buffer.uint64()}
+	case RandEventType:
+		event.Payload = &RandEvent{Seed1: buffer.uint64(), Seed2: buffer.uint64()}
+	case UserVarEventType:
+		payload := &UserVarEvent{Name: string(buffer.next(int(buffer.uint32())))}
+		payload.IsNull = buffer.uint8() != 0
+		if !payload.IsNull {
+			payload.Type = buffer.uint8()
+			payload.Collation = buffer.uint32()
+			payload.Value = buffer.next(int(buffer.uint32()))
+			// flags are as of 5.6
+			if buffer.err == nil && len(buffer.data) > 0 {
+				payload.Flags = buffer.uint8()
+			}
+		}
+		event.Payload = payload
+	case GtidEventType, AnonymousGtidEventType:
+		payload := &GtidEvent{Anonymous: event.EventType == AnonymousGtidEventType, Flags: buffer.uint8()}
+		sid := buffer.next(16)
+		payload.UUID = fmt.Sprintf("%s-%s-%s-%s-%s", hex.EncodeToString(sid[0:4]), hex.EncodeToString(sid[4:6]), hex.EncodeToString(sid[6:8]), hex.EncodeToString(sid[8:10]), hex.EncodeToString(sid[10:16]))
+		payload.GNO = int64(buffer.uint64())
+		// 5.7 logical clock
+		if len(buffer.data) >= 17 && buffer.uint8() == 2 {
+			payload.LastCommitted = int64(buffer.uint64())
+			payload.SequenceNumber = int64(buffer.uint64())
+		}
+		event.Payload = payload
+	case MariaDBGtidEventType:
+		payload := &MariaDBGtidEvent{}
+		payload.SequenceNumber = buffer.uint64()
+		payload.DomainId = buffer.uint32()
+		payload.ServerId = event.ServerId
+		payload.Flags = buffer.uint8()
+		event.Payload = payload
+	case PreviousGtidsEventType:
+		tokens := []string{}
+		sidCount := buffer.uint64()
+		for i := uint64(0); i < sidCount && buffer.err == nil; i++ {
+			sid := hex.EncodeToString(buffer.next(16))
+			token := fmt.Sprintf("%s-%s-%s-%s-%s", sid[0:8], sid[8:12], sid[12:16], sid[16:20], sid[20:32])
+			intervalCount := buffer.uint64()
+			for j := uint64(0); j < intervalCount && buffer.err == nil; j++ {
+				// intervals are [start, end)
+				start, end := int64(buffer.uint64()), int64(buffer.uint64())
+				token = fmt.Sprintf("%s:%d-%d", token, start, end-1)
+			}
+			tokens = append(tokens, token)
+		}
+		if buffer.err != nil {
+			return buffer.err
+		}
+		gtidSet, err := ParseGtidSet(strings.Join(tokens, ","))
+		if err != nil {
+			return err
+		}
+		event.Payload = &PreviousGtidsEvent{GtidSet: gtidSet}
+	case MariaDBGtidListEventType:
+		tokens := []string{}
+		count := buffer.uint32() & 0x0fffffff
+		for i := uint32(0); i < count && buffer.err == nil; i++ {
+			gtid := MariaDBGtid{DomainId: buffer.uint32(), ServerId: buffer.uint32(), SequenceNumber: buffer.uint64()}
+			tokens = append(tokens, gtid.String())
+		}
+		if buffer.err != nil {
+			return buffer.err
+		}
+		gtidSet, err := ParseGtidSet(strings.Join(tokens, ","))
+		if err != nil {
+			return err
+		}
+		event.Payload = &PreviousGtidsEvent{GtidSet: gtidSet}
+	case TableMapEventType:
+		payload := &TableMapEvent{}
+		postHeaderLength := this.FormatDescription.postHeaderLength(TableMapEventType, 8)
+		if postHeaderLength == 6 {
+			payload.TableId = buffer.uintN(4)
+		} else {
+			payload.TableId = buffer.uintN(6)
+		}
+		payload.Flags = buffer.uint16()
+		payload.Database = string(buffer.next(int(buffer.uint8())))
+		buffer.next(1)
+		payload.Table = string(buffer.next(int(buffer.uint8())))
+		buffer.next(1)
+		payload.ColumnCount = buffer.lengthEncodedInt()
+		payload.ColumnTypes = buffer.next(int(payload.ColumnCount))
+		payload.ColumnMetadata = buffer.next(int(buffer.lengthEncodedInt()))
+		payload.NullBitmap = buffer.next(int(payload.ColumnCount+7) / 8)
+		if buffer.err == nil {
+			this.tableMaps[payload.TableId] = payload
+		}
+		event.Payload = payload
+	default:
+		if !event.EventType.IsRowsEvent() {
+			return nil
+		}
+		payload := &RowsEvent{Version: 1}
+		postHeaderLength := this.FormatDescription.postHeaderLength(event.EventType, 8)
+		if event.EventType >= WriteRowsEventV2 {
+			payload.Version = 2
+			postHeaderLength = this.FormatDescription.postHeaderLength(event.EventType, 10)
+		} else if event.EventType <= DeleteRowsEventV0 {
+			payload.Version = 0
+		}
+		headerLength := BinlogEventHeaderSize
+		if this.FormatDescription != nil && int(this.FormatDescription.HeaderLength) > headerLength {
+			headerLength = int(this.FormatDescription.HeaderLength)
+		}
+		if postHeaderLength == 6 {
+			payload.TableId = buffer.uintN(4)
+			payload.flagsOffset = headerLength + 4
+		} else {
+			payload.TableId = buffer.uintN(6)
+			payload.flagsOffset = headerLength + 6
+		}
+		payload.withChecksum = this.FormatDescription != nil && this.FormatDescription.ChecksumAlgorithm == BinlogChecksumAlgCRC32
+		payload.Flags = buffer.uint16()
+		if payload.Version == 2 {
+			// extra data length includes its own two bytes
+			buffer.next(int(buffer.uint16()) - 2)
+		}
+		payload.ColumnCount = buffer.lengthEncodedInt()
+		payload.ColumnsPresent = buffer.next(int(payload.ColumnCount+7) / 8)
+		if event.EventType == UpdateRowsEventV1 || event.EventType == UpdateRowsEventV2 || event.EventType == UpdateRowsEventV0 {
+			payload.ColumnsPresentAfter = buffer.next(int(payload.ColumnCount+7) / 8)
+		}
+		payload.RowsData = buffer.rest()
+		if tableMap, ok := this.tableMaps[payload.TableId]; ok {
+			payload.TableMap = tableMap
+			payload.Database = tableMap.Database
+			payload.Table = tableMap.Table
+		}
+		if payload.IsStatementEnd() {
+			// table ids may be reused by following statements
+			defer func() { this.tableMaps = map[uint64]*TableMapEvent{} }()
+		}
+		event.Payload = payload
+	}
+	return buffer.err
+}
+
+// defaultPostHeaderLengths are MySQL 5.7's, for event types 1 and onwards
+var defaultPostHeaderLengths = []byte{
+	56, 13, 0, 8, 0, 18, 0, 4, 4, 4, 4, 18, 0, 0, 95, 0, 4, 26, 8, 0, 0, 0, 8, 8, 8, 2, 0, 0, 0, 10, 10, 10, 42, 42, 0, 18, 52, 0,
+}
+
+// EncodeBinlogEvent serializes an event placed at given position in a log, setting its size and next position,
+// and appending a CRC32 checksum if so requested
+func EncodeBinlogEvent(header BinlogEventHeader, position int64, body []byte, withChecksum bool) []byte {
+	size := BinlogEventHeaderSize + len(body)
+	if withChecksum {
+		size += 4
+	}
+	header.EventSize = uint32(size)
+	header.NextPosition = uint32(position + int64(size))
+
+	event := make([]byte, BinlogEventHeaderSize, size)
+	binary.LittleEndian.PutUint32(event[0:], header.Timestamp)
+	event[4] = byte(header.EventType)
+	binary.LittleEndian.PutUint32(event[5:], header.ServerId)
+	binary.LittleEndian.PutUint32(event[9:], header.EventSize)
+	binary.LittleEndian.PutUint32(event[13:], header.NextPosition)
+	binary.LittleEndian.PutUint16(event[17:], header.Flags)
+	event = append(event, body...)
+	if withChecksum {
+		checksum := make([]byte, 4)
+		binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(event))
+		event = append(event, checksum...)
+	}
+	return event
+}
+
+// EncodeFormatDescriptionEvent serializes a format description event, placed right after the magic header
+func EncodeFormatDescriptionEvent(serverVersion string, timestamp uint32, serverId uint32, checksumAlgorithm byte) []byte {
+	body := make([]byte, 57)
+	binary.LittleEndian.PutUint16(body[0:], 4)
+	copy(body[2:52], serverVersion)
+	binary.LittleEndian.PutUint32(body[52:], timestamp)
+	body[56] = BinlogEventHeaderSize
+	body = append(body, defaultPostHeaderLengths...)
+	body = append(body, checksumAlgorithm)
+	header := BinlogEventHeader{Timestamp: timestamp, EventType: FormatDescriptionEventType, ServerId: serverId}
+	if checksumAlgorithm == BinlogChecksumAlgCRC32 {
+		return EncodeBinlogEvent(header, BinlogMagicSize, body, true)
+	}
+	// With checksums off, the checksum field is still present, zeroed
+	return EncodeBinlogEvent(header, BinlogMagicSize, append(body, 0, 0, 0, 0), false)
+}
+
+// EncodeQueryBinlog serializes a binary log of given statements, as query events with CRC32 checksums following the
+// magic header and format description. It returns the log along with the position of each query event.
+func EncodeQueryBinlog(serverVersion string, timestamp uint32, serverId uint32, queries []string) ([]byte, []int64) {
+	binlog := append(append([]byte{}, BinlogMagic...), EncodeFormatDescriptionEvent(serverVersion, timestamp, serverId, BinlogChecksumAlgCRC32)...)
+	positions := []int64{}
+	for _, query := range queries {
+		// Thread id, execution time, database length, error code and status vars length; no database nor status vars
+		body := make([]byte, 13)
+		binary.LittleEndian.PutUint32(body, 7)
+		body = append(append(body, 0), query...)
+		header := BinlogEventHeader{Timestamp: timestamp, EventType: QueryEventType, ServerId: serverId}
+		positions = append(positions, int64(len(binlog)))
+		binlog = append(binlog, EncodeBinlogEvent(header, int64(len(binlog)), body, true)...)
+	}
+	return binlog, positions
+}
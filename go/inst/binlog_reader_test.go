@@ -0,0 +1,421 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+const testBinlogTimestamp = 1600000000
+
+func le(size int, value uint64) []byte {
+	result := make([]byte, 8)
+	binary.LittleEndian.PutUint64(result, value)
+	return result[:size]
+}
+
+func mustDecodeBase64(t *testing.T, s string) []byte {
+	result, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// testBinlog builds a binary log with a single row based transaction, followed by a rotate event
+func testBinlog(withChecksum bool) []byte {
+	sid, _ := hex.DecodeString(strings.Replace(uuid1, "-", "", -1))
+	checksumAlgorithm := inst.BinlogChecksumAlgOff
+	if withChecksum {
+		checksumAlgorithm = inst.BinlogChecksumAlgCRC32
+	}
+	binlog := concat(inst.BinlogMagic, inst.EncodeFormatDescriptionEvent("5.7.30-log", testBinlogTimestamp, 1, checksumAlgorithm))
+	addEvent := func(eventType inst.BinlogEventType, body []byte) {
+		header := inst.BinlogEventHeader{Timestamp: testBinlogTimestamp, EventType: eventType, ServerId: 1}
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), body, withChecksum)...)
+	}
+	addEvent(inst.PreviousGtidsEventType, concat(le(8, 1), sid, le(8, 1), le(8, 1), le(8, 6)))
+	addEvent(inst.GtidEventType, concat([]byte{1}, sid, le(8, 6), []byte{2}, le(8, 0), le(8, 1)))
+	statusVars := concat([]byte{0}, le(4, 0), []byte{1}, le(8, 1436549152))
+	addEvent(inst.QueryEventType, concat(le(4, 7), le(4, 0), []byte{4}, le(2, 0), le(2, uint64(len(statusVars))), statusVars, []byte("test\x00BEGIN")))
+	addEvent(inst.TableMapEventType, concat(le(6, 70), le(2, 1), []byte("\x04test\x00\x02t1\x00"), []byte{1, 3, 0, 0}))
+	addEvent(inst.WriteRowsEventV2, concat(le(6, 70), le(2, 1), le(2, 2), []byte{1, 0xff, 0}, le(4, 42)))
+	addEvent(inst.XidEventType, le(8, 99))
+	addEvent(inst.RotateEventType, concat(le(8, 4), []byte("mysql-bin.000002")))
+	return binlog
+}
+
+func readAllBinlogEvents(t *testing.T, binlog []byte) []*inst.BinlogEvent {
+	reader, err := inst.NewBinlogReader(bytes.NewReader(binlog))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	events := []*inst.BinlogEvent{}
+	for {
+		event, err := reader.ReadEvent()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestBinlogReaderEvents(t *testing.T) {
+	for _, withChecksum := range []bool{false, true} {
+		binlog := testBinlog(withChecksum)
+		events := readAllBinlogEvents(t, binlog)
+		expectedTypes := []inst.BinlogEventType{
+			inst.FormatDescriptionEventType, inst.PreviousGtidsEventType, inst.GtidEventType, inst.QueryEventType,
+			inst.TableMapEventType, inst.WriteRowsEventV2, inst.XidEventType, inst.RotateEventType,
+		}
+		if len(events) != len(expectedTypes) {
+			t.Fatalf("Expected %d events, got %d", len(expectedTypes), len(events))
+		}
+		position := int64(inst.BinlogMagicSize)
+		for i, event := range events {
+			if event.EventType != expectedTypes[i] {
+				t.Errorf("Event %d: expected %s, got %s", i, expectedTypes[i], event.EventType)
+			}
+			if event.Position != position || event.EndPosition != int64(event.NextPosition) {
+				t.Errorf("Event %d: unexpected positions %d-%d", i, event.Position, event.EndPosition)
+			}
+			if event.Time().Unix() != testBinlogTimestamp {
+				t.Errorf("Event %d: unexpected time %s", i, event.Time())
+			}
+			position = event.EndPosition
+		}
+		if position != int64(len(binlog)) {
+			t.Errorf("Expected to end at %d, ended at %d", len(binlog), position)
+		}
+
+		formatDescription := events[0].Payload.(*inst.FormatDescriptionEvent)
+		if formatDescription.ServerVersion != "5.7.30-log" || formatDescription.ChecksumAlgorithm != map[bool]byte{false: 0, true: 1}[withChecksum] {
+			t.Errorf("Unexpected format description: %+v", formatDescription)
+		}
+		if gtidSet := events[1].Payload.(*inst.PreviousGtidsEvent).GtidSet.String(); gtidSet != uuid1+":1-5" {
+			t.Errorf("Unexpected previous GTIDs: %s", gtidSet)
+		}
+		if gtid := events[2].Payload.(*inst.GtidEvent); gtid.Gtid() != uuid1+":6" || gtid.SequenceNumber != 1 {
+			t.Errorf("Unexpected GTID: %+v", gtid)
+		}
+		if query := events[3].Payload.(*inst.QueryEvent); query.Database != "test" || query.Query != "BEGIN" || query.ThreadId != 7 {
+			t.Errorf("Unexpected query: %+v", query)
+		}
+		rows := events[5].Payload.(*inst.RowsEvent)
+		if rows.TableId != 70 || rows.Database != "test" || rows.Table != "t1" || !rows.IsStatementEnd() || rows.Version != 2 {
+			t.Errorf("Unexpected rows: %+v", rows)
+		}
+		if !bytes.Equal(rows.RowsData, concat([]byte{0}, le(4, 42))) {
+			t.Errorf("Unexpected rows data: %x", rows.RowsData)
+		}
+		if xid := events[6].Payload.(*inst.XidEvent); xid.Xid != 99 {
+			t.Errorf("Unexpected xid: %+v", xid)
+		}
+		if info := events[7].Info(); info != "mysql-bin.000002;pos=4" {
+			t.Errorf("Unexpected rotate info: %s", info)
+		}
+	}
+}
+
+func TestBinlogReaderChecksumMismatch(t *testing.T) {
+	binlog := testBinlog(true)
+	events := readAllBinlogEvents(t, binlog)
+	// Corrupt the query
+	binlog[events[3].EndPosition-6] ^= 0xff
+
+	reader, _ := inst.NewBinlogReader(bytes.NewReader(binlog))
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ReadEvent(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if _, err := reader.ReadEvent(); err == nil || !strings.Contains(err.Error(), inst.ErrBinlogChecksumMismatch.Error()) {
+		t.Errorf("Expected checksum mismatch, got %+v", err)
+	}
+}
+
+func TestBinlogReaderTruncated(t *testing.T) {
+	binlog := testBinlog(true)
+	events := readAllBinlogEvents(t, binlog)
+	reader, _ := inst.NewBinlogReader(bytes.NewReader(binlog[:events[6].Position+10]))
+	for i := 0; i < 6; i++ {
+		if _, err := reader.ReadEvent(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if _, err := reader.ReadEvent(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF, got %+v", err)
+	}
+	if reader.Position() != events[6].Position {
+		t.Errorf("Expected position to remain at %d, got %d", events[6].Position, reader.Position())
+	}
+}
+
+func TestBinlogReaderSkipTo(t *testing.T) {
+	binlog := testBinlog(false)
+	events := readAllBinlogEvents(t, binlog)
+	reader, _ := inst.NewBinlogReader(bytes.NewReader(binlog))
+	if _, err := reader.ReadEvent(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := reader.SkipTo(events[6].Position); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if event, err := reader.ReadEvent(); err != nil || event.EventType != inst.XidEventType {
+		t.Errorf("Expected Xid event, got %+v, %+v", event, err)
+	}
+}
+
+func TestBinlogReaderBadMagic(t *testing.T) {
+	if _, err := inst.NewBinlogReader(bytes.NewReader([]byte("not a binlog"))); err == nil {
+		t.Errorf("Expected error on bad magic header")
+	}
+}
+
+func TestBinlogSQLWriter(t *testing.T) {
+	var output bytes.Buffer
+	writer := inst.NewBinlogSQLWriter(&output)
+	for _, event := range readAllBinlogEvents(t, testBinlog(true)) {
+		if err := writer.WriteEvent(event); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sql := output.String()
+	expected := []string{
+		"DELIMITER /*!*/;\n",
+		"SET @@SESSION.GTID_NEXT= '" + uuid1 + ":6'/*!*/;\n",
+		"use `test`/*!*/;\n",
+		"SET TIMESTAMP=1600000000/*!*/;\n",
+		"SET @@session.foreign_key_checks=1, @@session.sql_auto_is_null=0, @@session.unique_checks=1, @@session.autocommit=1/*!*/;\n",
+		"SET @@session.sql_mode=1436549152/*!*/;\n",
+		"BEGIN\n/*!*/;\n",
+		"COMMIT/*!*/;\n",
+		"SET @@SESSION.GTID_NEXT= 'AUTOMATIC' /*!*/;\n",
+		"DELIMITER ;\n",
+	}
+	position := 0
+	for _, statement := range expected {
+		index := strings.Index(sql[position:], statement)
+		if index < 0 {
+			t.Fatalf("Expected %q in order in:\n%s", statement, sql)
+		}
+		position += index
+	}
+	// Format description, and then table map with rows in a single statement
+	if count := strings.Count(sql, "BINLOG '\n"); count != 2 {
+		t.Errorf("Expected 2 BINLOG statements, got %d", count)
+	}
+}
+
+func TestBinlogSQLWriterStatementContext(t *testing.T) {
+	binlog := concat(inst.BinlogMagic, inst.EncodeFormatDescriptionEvent("5.7.30-log", testBinlogTimestamp, 1, inst.BinlogChecksumAlgCRC32))
+	addEvent := func(eventType inst.BinlogEventType, body []byte) {
+		header := inst.BinlogEventHeader{Timestamp: testBinlogTimestamp, EventType: eventType, ServerId: 1}
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), body, true)...)
+	}
+	userVar := func(name string, valueType byte, collation uint64, value []byte, flags byte) []byte {
+		return concat(le(4, uint64(len(name))), []byte(name), []byte{0, valueType}, le(4, collation), le(4, uint64(len(value))), value, []byte{flags})
+	}
+	addEvent(inst.IntvarEventType, concat([]byte{2}, le(8, 17)))
+	addEvent(inst.IntvarEventType, concat([]byte{1}, le(8, 16)))
+	addEvent(inst.RandEventType, concat(le(8, 123), le(8, 456)))
+	addEvent(inst.UserVarEventType, userVar("s", 0, 45, []byte("it's"), 0))
+	addEvent(inst.UserVarEventType, userVar("i", 2, 63, le(8, 0xffffffffffffffff), 0))
+	addEvent(inst.UserVarEventType, userVar("u", 2, 63, le(8, 0xffffffffffffffff), 1))
+	addEvent(inst.UserVarEventType, userVar("r", 1, 63, le(8, 0x3ff8000000000000), 0))
+	addEvent(inst.UserVarEventType, userVar("d", 4, 63, []byte{4, 2, 0x8c, 0x22}, 0))
+	addEvent(inst.UserVarEventType, concat(le(4, 1), []byte("n"), []byte{1}))
+
+	var output bytes.Buffer
+	writer := inst.NewBinlogSQLWriter(&output)
+	for _, event := range readAllBinlogEvents(t, binlog) {
+		if err := writer.WriteEvent(event); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	sql := output.String()
+	for _, statement := range []string{
+		"SET INSERT_ID=17/*!*/;\n",
+		"SET LAST_INSERT_ID=16/*!*/;\n",
+		"SET @@RAND_SEED1=123, @@RAND_SEED2=456/*!*/;\n",
+		"SET @`s`:=_utf8mb4 X'69742773' COLLATE `utf8mb4_general_ci`/*!*/;\n",
+		"SET @`i`:=-1/*!*/;\n",
+		"SET @`u`:=18446744073709551615/*!*/;\n",
+		"SET @`r`:=1.5/*!*/;\n",
+		"SET @`d`:=12.34/*!*/;\n",
+		"SET @`n`:=NULL/*!*/;\n",
+	} {
+		if !strings.Contains(sql, statement) {
+			t.Errorf("Expected %q in:\n%s", statement, sql)
+		}
+	}
+}
+
+func TestBinlogSQLWriterUnsupportedEvents(t *testing.T) {
+	for _, eventType := range []inst.BinlogEventType{inst.TransactionPayloadEvent, inst.XAPrepareEventType, inst.PartialUpdateRowsEvent} {
+		binlog := concat(inst.BinlogMagic, inst.EncodeFormatDescriptionEvent("8.0.20", testBinlogTimestamp, 1, inst.BinlogChecksumAlgOff))
+		header := inst.BinlogEventHeader{Timestamp: testBinlogTimestamp, EventType: eventType, ServerId: 1}
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), []byte{1, 2, 3}, false)...)
+
+		writer := inst.NewBinlogSQLWriter(ioutil.Discard)
+		events := readAllBinlogEvents(t, binlog)
+		if err := writer.WriteEvent(events[0]); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if err := writer.WriteEvent(events[1]); err == nil || !strings.Contains(err.Error(), eventType.String()) {
+			t.Errorf("Expected error writing %s event, got %+v", eventType, err)
+		}
+		if err := writer.Close(); err == nil {
+			t.Errorf("Expected error closing writer having failed on %s event", eventType)
+		}
+	}
+}
+
+func TestBinlogSQLWriterFilteredStatementEnd(t *testing.T) {
+	binlog := concat(inst.BinlogMagic, inst.EncodeFormatDescriptionEvent("8.0.20", testBinlogTimestamp, 1, inst.BinlogChecksumAlgCRC32))
+	addEvent := func(eventType inst.BinlogEventType, body []byte) {
+		header := inst.BinlogEventHeader{Timestamp: testBinlogTimestamp, EventType: eventType, ServerId: 1}
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), body, true)...)
+	}
+	// A single statement on test.t1 and test.t2: the rows event on t2 ends it
+	for i, table := range []string{"\x04test\x00\x02t1\x00", "\x04test\x00\x02t2\x00"} {
+		addEvent(inst.TableMapEventType, concat(le(6, uint64(70+i)), le(2, 1), []byte(table), []byte{1, 3, 0, 0}))
+	}
+	for i := 0; i < 2; i++ {
+		addEvent(inst.WriteRowsEventV2, concat(le(6, uint64(70+i)), le(2, uint64(i)), le(2, 2), []byte{1, 0xff, 0}, le(4, 42)))
+	}
+	addEvent(inst.XidEventType, le(8, 1))
+	events := readAllBinlogEvents(t, binlog)
+	formatDescription, tableMap1, tableMap2, rows1, xid := events[0], events[1], events[2], events[3], events[5]
+
+	// Events of t2 are left out, as by a table filter: either both, or the rows event alone
+	for _, written := range [][]*inst.BinlogEvent{{formatDescription, tableMap1, rows1, xid}, {formatDescription, tableMap1, rows1, tableMap2, xid}} {
+		var output bytes.Buffer
+		writer := inst.NewBinlogSQLWriter(&output)
+		for _, event := range written {
+			if err := writer.WriteEvent(event); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+		}
+		writer.Close()
+		statements := strings.Split(output.String(), "BINLOG '\n")
+		if len(statements) != 3 {
+			t.Fatalf("Expected 2 BINLOG statements in:\n%s", output.String())
+		}
+		// Each of the statement's events is short enough for a single line of base64
+		statement := concat(inst.BinlogMagic, formatDescription.Raw)
+		for _, line := range strings.Split(strings.Split(statements[2], "'")[0], "\n") {
+			if line != "" {
+				statement = append(statement, mustDecodeBase64(t, line)...)
+			}
+		}
+		statementEvents := readAllBinlogEvents(t, statement)
+		if len(statementEvents) != 3 || statementEvents[1].EventType != inst.TableMapEventType {
+			t.Fatalf("Expected table map and rows event of t1, got %d events", len(statementEvents)-1)
+		}
+		if rows := statementEvents[2].Payload.(*inst.RowsEvent); rows.Table != "t1" || !rows.IsStatementEnd() {
+			t.Errorf("Expected rows event of t1 to end the statement, got %+v", rows)
+		}
+	}
+}
+
+func TestBinlogReaderEventHeaders(t *testing.T) {
+	binlog := testBinlog(true)
+	events := readAllBinlogEvents(t, binlog)
+	reader, _ := inst.NewBinlogReader(bytes.NewReader(binlog[:len(binlog)-3]))
+	for i, expected := range events[:len(events)-1] {
+		event, err := reader.ReadEventHeader()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if event.EventType != expected.EventType || event.Position != expected.Position || event.EndPosition != expected.EndPosition {
+			t.Errorf("Event %d: expected %+v, got %+v", i, expected.BinlogEventHeader, event.BinlogEventHeader)
+		}
+	}
+	if reader.FormatDescription == nil || reader.FormatDescription.ChecksumAlgorithm != inst.BinlogChecksumAlgCRC32 {
+		t.Errorf("Expected format description to be read")
+	}
+	if _, err := reader.ReadEventHeader(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF on truncated event, got %+v", err)
+	}
+}
+
+// countingReader counts the bytes read off a log, which may be seeked through
+type countingReader struct {
+	*bytes.Reader
+	count int
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.Reader.Read(p)
+	this.count += n
+	return n, err
+}
+
+func TestEncodeQueryBinlog(t *testing.T) {
+	binlog, positions := inst.EncodeQueryBinlog("8.0.20", testBinlogTimestamp, 1, []string{"create table a (id int)", "create table b (id int)"})
+	events := readAllBinlogEvents(t, binlog)
+	if len(events) != 3 || len(positions) != 2 {
+		t.Fatalf("Expected a format description and 2 query events, got %d events, positions %+v", len(events), positions)
+	}
+	for i, query := range []string{"create table a (id int)", "create table b (id int)"} {
+		event := events[i+1]
+		if event.EventType != inst.QueryEventType || event.Info() != query || int64(event.NextPosition-event.EventSize) != positions[i] {
+			t.Errorf("Unexpected event at %d: %+v", positions[i], event)
+		}
+	}
+}
+
+func TestBinlogReaderEventHeadersSeek(t *testing.T) {
+	binlog := concat(inst.BinlogMagic, inst.EncodeFormatDescriptionEvent("5.7.30-log", testBinlogTimestamp, 1, inst.BinlogChecksumAlgCRC32))
+	header := inst.BinlogEventHeader{Timestamp: testBinlogTimestamp, EventType: inst.QueryEventType, ServerId: 1}
+	for i := 0; i < 4; i++ {
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), make([]byte, 1024*1024), true)...)
+	}
+	reader := &countingReader{Reader: bytes.NewReader(binlog[:len(binlog)-1])}
+	binlogReader, _ := inst.NewBinlogReader(reader)
+	for i := 0; i < 4; i++ {
+		if _, err := binlogReader.ReadEventHeader(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if _, err := binlogReader.ReadEventHeader(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF on truncated event, got %+v", err)
+	}
+	if reader.count > len(binlog)/2 {
+		t.Errorf("Expected event bodies to be seeked past, read %d bytes of %d", reader.count, len(binlog))
+	}
+}
@@ -0,0 +1,890 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Column types, as logged in table map events
+const (
+	mysqlTypeTiny       byte = 1
+	mysqlTypeShort      byte = 2
+	mysqlTypeLong       byte = 3
+	mysqlTypeFloat      byte = 4
+	mysqlTypeDouble     byte = 5
+	mysqlTypeNull       byte = 6
+	mysqlTypeTimestamp  byte = 7
+	mysqlTypeLongLong   byte = 8
+	mysqlTypeInt24      byte = 9
+	mysqlTypeDate       byte = 10
+	mysqlTypeTime       byte = 11
+	mysqlTypeDatetime   byte = 12
+	mysqlTypeYear       byte = 13
+	mysqlTypeNewDate    byte = 14
+	mysqlTypeVarchar    byte = 15
+	mysqlTypeBit        byte = 16
+	mysqlTypeTimestamp2 byte = 17
+	mysqlTypeDatetime2  byte = 18
+	mysqlTypeTime2      byte = 19
+	mysqlTypeJSON       byte = 245
+	mysqlTypeNewDecimal byte = 246
+	mysqlTypeEnum       byte = 247
+	mysqlTypeSet        byte = 248
+	mysqlTypeTinyBlob   byte = 249
+	mysqlTypeMediumBlob byte = 250
+	mysqlTypeLongBlob   byte = 251
+	mysqlTypeBlob       byte = 252
+	mysqlTypeVarString  byte = 253
+	mysqlTypeString     byte = 254
+	mysqlTypeGeometry   byte = 255
+)
+
+// sqlLiteral is a value already rendered as SQL, e.g. a quoted date or a function call
+type sqlLiteral string
+
+// RowValue is a column value decoded off a row image. Value is nil for NULL; integers are held as int64, sign
+// extended, as table maps do not tell signedness.
+type RowValue struct {
+	Type  byte // column type, as in the table map
+	Value interface{}
+}
+
+// RowImage holds a row's values by column. Columns absent from the image (as with binlog_row_image=MINIMAL)
+// are nil.
+type RowImage []*RowValue
+
+// IsFull tells whether the image holds all columns
+func (this RowImage) IsFull() bool {
+	for _, value := range this {
+		if value == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// RowChange is a row changed by a rows event: a write has an after image, a delete a before image, and an update
+// both
+type RowChange struct {
+	Before RowImage
+	After  RowImage
+}
+
+// TableColumn describes a table's column, as needed to render its values as SQL
+type TableColumn struct {
+	Name      string
+	DataType  string // as in information_schema.columns, e.g. "varchar"; where empty, the type is not verified
+	Unsigned  bool
+	Generated bool // values of generated columns are not written
+}
+
+// loggedDataTypes lists the data types, as in information_schema.columns, by which columns of a type are logged in
+// table maps. The string type covers char and binary columns; enum and set columns are told apart by metadata.
+var loggedDataTypes = map[byte][]string{
+	mysqlTypeTiny:       {"tinyint"},
+	mysqlTypeShort:      {"smallint"},
+	mysqlTypeInt24:      {"mediumint"},
+	mysqlTypeLong:       {"int"},
+	mysqlTypeLongLong:   {"bigint"},
+	mysqlTypeFloat:      {"float"},
+	mysqlTypeDouble:     {"double"},
+	mysqlTypeNewDecimal: {"decimal"},
+	mysqlTypeTimestamp:  {"timestamp"},
+	mysqlTypeTimestamp2: {"timestamp"},
+	mysqlTypeDatetime:   {"datetime"},
+	mysqlTypeDatetime2:  {"datetime"},
+	mysqlTypeDate:       {"date"},
+	mysqlTypeNewDate:    {"date"},
+	mysqlTypeTime:       {"time"},
+	mysqlTypeTime2:      {"time"},
+	mysqlTypeYear:       {"year"},
+	mysqlTypeBit:        {"bit"},
+	mysqlTypeVarchar:    {"varchar", "varbinary"},
+	mysqlTypeVarString:  {"varchar", "varbinary"},
+	mysqlTypeString:     {"char", "binary"},
+	mysqlTypeEnum:       {"enum"},
+	mysqlTypeSet:        {"set"},
+	mysqlTypeTinyBlob:   {"tinyblob", "tinytext"},
+	mysqlTypeMediumBlob: {"mediumblob", "mediumtext"},
+	mysqlTypeLongBlob:   {"longblob", "longtext"},
+	mysqlTypeJSON:       {"json"},
+	mysqlTypeGeometry:   {"geometry", "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection", "geomcollection"},
+}
+
+// loggedBlobDataTypes lists the data types of blob and text columns, by the length size found in their metadata
+var loggedBlobDataTypes = map[uint16][]string{
+	1: {"tinyblob", "tinytext"},
+	2: {"blob", "text"},
+	3: {"mediumblob", "mediumtext"},
+	4: {"longblob", "longtext"},
+}
+
+// matchesColumnDataType tells whether a column logged with given type and metadata may be of given data type
+func matchesColumnDataType(columnType byte, metadata uint16, dataType string) bool {
+	dataTypes := loggedDataTypes[columnType]
+	switch columnType {
+	case mysqlTypeBlob:
+		dataTypes = loggedBlobDataTypes[metadata]
+	case mysqlTypeString:
+		if realType := byte(metadata>>8) | 0x30; realType == mysqlTypeEnum || realType == mysqlTypeSet {
+			dataTypes = loggedDataTypes[realType]
+		}
+	}
+	for _, loggedDataType := range dataTypes {
+		if loggedDataType == dataType {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyColumns compares the columns of a table with those logged in its table map
+func (this *TableMapEvent) verifyColumns(columns []TableColumn) error {
+	if len(columns) != len(this.ColumnTypes) {
+		return fmt.Errorf("%s.%s has %d columns, whereas the table map has %d", this.Database, this.Table, len(columns), len(this.ColumnTypes))
+	}
+	metadata, err := this.columnMetadata()
+	if err != nil {
+		return err
+	}
+	for i, column := range columns {
+		if column.DataType != "" && !matchesColumnDataType(this.ColumnTypes[i], metadata[i], column.DataType) {
+			return fmt.Errorf("Column %s of %s.%s is %s, whereas the table map logs type %d", column.Name, this.Database, this.Table, column.DataType, this.ColumnTypes[i])
+		}
+	}
+	return nil
+}
+
+// columnMetadata splits the table map's metadata by column. Types not listed carry no metadata.
+func (this *TableMapEvent) columnMetadata() ([]uint16, error) {
+	buffer := &binlogBuffer{data: this.ColumnMetadata}
+	metadata := make([]uint16, len(this.ColumnTypes))
+	for i, columnType := range this.ColumnTypes {
+		switch columnType {
+		case mysqlTypeFloat, mysqlTypeDouble, mysqlTypeTimestamp2, mysqlTypeDatetime2, mysqlTypeTime2,
+			mysqlTypeJSON, mysqlTypeTinyBlob, mysqlTypeMediumBlob, mysqlTypeLongBlob, mysqlTypeBlob, mysqlTypeGeometry:
+			metadata[i] = uint16(buffer.uint8())
+		case mysqlTypeVarchar, mysqlTypeVarString, mysqlTypeBit:
+			metadata[i] = buffer.uint16()
+		case mysqlTypeNewDecimal, mysqlTypeString, mysqlTypeEnum, mysqlTypeSet:
+			// precision and scale, or real type and length
+			metadata[i] = uint16(buffer.uint8())<<8 | uint16(buffer.uint8())
+		}
+	}
+	return metadata, buffer.err
+}
+
+// bitSet tells whether the i-th bit of a bitmap is set
+func bitSet(bitmap []byte, i int) bool {
+	return i/8 < len(bitmap) && bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+// bigEndian reads an n byte big endian unsigned integer
+func (this *binlogBuffer) bigEndian(n int) uint64 {
+	var result uint64
+	for _, b := range this.next(n) {
+		result = result<<8 | uint64(b)
+	}
+	return result
+}
+
+// fraction reads the fractional seconds of a temporal value of given precision, as microseconds
+func (this *binlogBuffer) fraction(fsp uint16) int64 {
+	switch fsp {
+	case 1, 2:
+		return int64(this.bigEndian(1)) * 10000
+	case 3, 4:
+		return int64(this.bigEndian(2)) * 100
+	case 5, 6:
+		return int64(this.bigEndian(3))
+	}
+	return 0
+}
+
+// formatFraction formats microseconds to given precision, e.g. ".123" for precision 3
+func formatFraction(microseconds int64, fsp int) string {
+	if fsp <= 0 {
+		return ""
+	}
+	if fsp > 6 {
+		fsp = 6
+	}
+	return fmt.Sprintf(".%06d", microseconds)[:fsp+1]
+}
+
+// formatPackedDatetime formats the integral part of a DATETIME2 value, or of a packed datetime
+func formatPackedDatetime(packed int64) string {
+	ymd, hms := packed>>17, packed%(1<<17)
+	ym := ymd >> 5
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", ym/13, ym%13, ymd%(1<<5), hms>>12, (hms>>6)%(1<<6), hms%(1<<6))
+}
+
+// formatPackedTime formats a time held as hours, minutes and seconds bit fields
+func formatPackedTime(negative bool, hms int64, microseconds int64, fsp int) string {
+	sign := ""
+	if negative {
+		sign = "-"
+	}
+	return fmt.Sprintf("%s%02d:%02d:%02d%s", sign, (hms>>12)%(1<<10), (hms>>6)%(1<<6), hms%(1<<6), formatFraction(microseconds, fsp))
+}
+
+var decimalDigitBytes = []int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+// decimalSize is the size of a binary DECIMAL of given precision and scale
+func decimalSize(precision int, scale int) int {
+	integral := precision - scale
+	return integral/9*4 + decimalDigitBytes[integral%9] + scale/9*4 + decimalDigitBytes[scale%9]
+}
+
+// decodeDecimal decodes a binary DECIMAL of given precision and scale. Digits are stored in groups of nine per
+// four bytes, big endian, with the sign in the first bit, and negative values inverted.
+func decodeDecimal(data []byte, precision int, scale int) (string, error) {
+	if precision < scale || precision > 65 {
+		return "", fmt.Errorf("Invalid decimal precision %d and scale %d", precision, scale)
+	}
+	size := decimalSize(precision, scale)
+	if len(data) < size || size == 0 {
+		return "", fmt.Errorf("Decimal of %d bytes too short, expected %d", len(data), size)
+	}
+	raw := append([]byte{}, data[:size]...)
+	negative := raw[0]&0x80 == 0
+	raw[0] ^= 0x80
+	if negative {
+		for i := range raw {
+			raw[i] ^= 0xff
+		}
+	}
+	buffer := &binlogBuffer{data: raw}
+	integral := precision - scale
+	integralDigits := ""
+	if leading := integral % 9; leading > 0 {
+		integralDigits = strconv.FormatUint(buffer.bigEndian(decimalDigitBytes[leading]), 10)
+	}
+	for i := 0; i < integral/9; i++ {
+		integralDigits += fmt.Sprintf("%09d", buffer.bigEndian(4))
+	}
+	result := strings.TrimLeft(integralDigits, "0")
+	if result == "" {
+		result = "0"
+	}
+	if scale > 0 {
+		fractionDigits := ""
+		for i := 0; i < scale/9; i++ {
+			fractionDigits += fmt.Sprintf("%09d", buffer.bigEndian(4))
+		}
+		if trailing := scale % 9; trailing > 0 {
+			fractionDigits += fmt.Sprintf("%0*d", trailing, buffer.bigEndian(decimalDigitBytes[trailing]))
+		}
+		result += "." + fractionDigits
+	}
+	if negative {
+		result = "-" + result
+	}
+	return result, buffer.err
+}
+
+// decodeRowValue decodes a column value of given type and metadata off a row image
+func decodeRowValue(buffer *binlogBuffer, columnType byte, metadata uint16) (interface{}, error) {
+	switch columnType {
+	case mysqlTypeTiny:
+		return int64(int8(buffer.uint8())), nil
+	case mysqlTypeShort:
+		return int64(int16(buffer.uint16())), nil
+	case mysqlTypeInt24:
+		value := buffer.uintN(3)
+		if value&0x800000 != 0 {
+			value |= 0xffffffffff000000
+		}
+		return int64(value), nil
+	case mysqlTypeLong:
+		return int64(int32(buffer.uint32())), nil
+	case mysqlTypeLongLong:
+		return int64(buffer.uint64()), nil
+	case mysqlTypeYear:
+		if year := buffer.uint8(); year != 0 {
+			return int64(year) + 1900, nil
+		}
+		return int64(0), nil
+	case mysqlTypeFloat:
+		return math.Float32frombits(buffer.uint32()), nil
+	case mysqlTypeDouble:
+		return math.Float64frombits(buffer.uint64()), nil
+	case mysqlTypeNull:
+		return nil, nil
+	case mysqlTypeNewDecimal:
+		precision, scale := int(metadata>>8), int(metadata&0xff)
+		if precision < scale || precision > 65 {
+			return nil, fmt.Errorf("Invalid decimal precision %d and scale %d", precision, scale)
+		}
+		value, err := decodeDecimal(buffer.next(decimalSize(precision, scale)), precision, scale)
+		return sqlLiteral(value), err
+	case mysqlTypeTimestamp:
+		if seconds := buffer.uint32(); seconds != 0 {
+			return sqlLiteral(fmt.Sprintf("FROM_UNIXTIME(%d)", seconds)), nil
+		}
+		return sqlLiteral("'0000-00-00 00:00:00'"), nil
+	case mysqlTypeTimestamp2:
+		seconds := buffer.bigEndian(4)
+		microseconds := buffer.fraction(metadata)
+		if seconds == 0 && microseconds == 0 {
+			return sqlLiteral(fmt.Sprintf("'0000-00-00 00:00:00%s'", formatFraction(0, int(metadata)))), nil
+		}
+		return sqlLiteral(fmt.Sprintf("FROM_UNIXTIME(%d%s)", seconds, formatFraction(microseconds, int(metadata)))), nil
+	case mysqlTypeDate, mysqlTypeNewDate:
+		value := buffer.uintN(3)
+		return sqlLiteral(fmt.Sprintf("'%04d-%02d-%02d'", value>>9, (value>>5)&15, value&31)), nil
+	case mysqlTypeTime:
+		value := int64(buffer.uintN(3))
+		if value&0x800000 != 0 {
+			value -= 0x1000000
+		}
+		sign := ""
+		if value < 0 {
+			sign, value = "-", -value
+		}
+		return sqlLiteral(fmt.Sprintf("'%s%02d:%02d:%02d'", sign, value/10000, (value/100)%100, value%100)), nil
+	case mysqlTypeTime2:
+		var packed int64
+		switch metadata {
+		case 1, 2, 3, 4:
+			integral := int64(buffer.bigEndian(3)) - 0x800000
+			fractionBytes := int(metadata+1) / 2
+			fraction := int64(buffer.bigEndian(fractionBytes))
+			if integral < 0 && fraction > 0 {
+				integral++
+				fraction -= 1 << uint(8*fractionBytes)
+			}
+			if fractionBytes == 1 {
+				fraction *= 10000
+			} else {
+				fraction *= 100
+			}
+			packed = integral<<24 + fraction
+		case 5, 6:
+			packed = int64(buffer.bigEndian(6)) - 0x800000000000
+		default:
+			packed = (int64(buffer.bigEndian(3)) - 0x800000) << 24
+		}
+		negative := packed < 0
+		if negative {
+			packed = -packed
+		}
+		return sqlLiteral("'" + formatPackedTime(negative, packed>>24, packed%(1<<24), int(metadata)) + "'"), nil
+	case mysqlTypeDatetime:
+		value := buffer.uint64()
+		date, clock := value/1000000, value%1000000
+		return sqlLiteral(fmt.Sprintf("'%04d-%02d-%02d %02d:%02d:%02d'", date/10000, (date/100)%100, date%100, clock/10000, (clock/100)%100, clock%100)), nil
+	case mysqlTypeDatetime2:
+		packed := int64(buffer.bigEndian(5)) - 0x8000000000
+		microseconds := buffer.fraction(metadata)
+		return sqlLiteral("'" + formatPackedDatetime(packed) + formatFraction(microseconds, int(metadata)) + "'"), nil
+	case mysqlTypeVarchar, mysqlTypeVarString:
+		if metadata < 256 {
+			return buffer.next(int(buffer.uint8())), nil
+		}
+		return buffer.next(int(buffer.uint16())), nil
+	case mysqlTypeString, mysqlTypeEnum, mysqlTypeSet:
+		realType, length := byte(metadata>>8), int(metadata&0xff)
+		if realType&0x30 != 0x30 {
+			// lengths beyond 255 borrow bits of the real type
+			length |= int((realType&0x30)^0x30) << 4
+			realType |= 0x30
+		}
+		switch realType {
+		case mysqlTypeEnum:
+			return int64(buffer.uintN(length)), nil
+		case mysqlTypeSet:
+			return buffer.uintN(length), nil
+		}
+		if length < 256 {
+			return buffer.next(int(buffer.uint8())), nil
+		}
+		return buffer.next(int(buffer.uint16())), nil
+	case mysqlTypeBit:
+		bits := int(metadata>>8)*8 + int(metadata&0xff)
+		return buffer.bigEndian((bits + 7) / 8), nil
+	case mysqlTypeTinyBlob, mysqlTypeMediumBlob, mysqlTypeLongBlob, mysqlTypeBlob:
+		return buffer.next(int(buffer.uintN(int(metadata)))), nil
+	case mysqlTypeJSON:
+		value, err := decodeBinaryJSON(buffer.next(int(buffer.uintN(int(metadata)))))
+		if err != nil {
+			return nil, err
+		}
+		return sqlLiteral(fmt.Sprintf("CAST(%s AS JSON)", sqlStringLiteral([]byte(value), true))), nil
+	case mysqlTypeGeometry:
+		value := buffer.next(int(buffer.uintN(int(metadata))))
+		if len(value) < 4 {
+			return nil, fmt.Errorf("Geometry value of %d bytes too short", len(value))
+		}
+		// SRID followed by WKB
+		return sqlLiteral(fmt.Sprintf("ST_GeomFromWKB(X'%s', %d)", hex.EncodeToString(value[4:]), binary.LittleEndian.Uint32(value))), nil
+	}
+	return nil, fmt.Errorf("Unsupported column type %d", columnType)
+}
+
+// sqlStringLiteral renders bytes as a quoted string where printable ASCII, hence read alike in any character set,
+// or otherwise as a hex literal, optionally converted to utf8mb4
+func sqlStringLiteral(value []byte, utf8 bool) string {
+	for _, b := range value {
+		if (b < 0x20 || b > 0x7e) && b != '\t' && b != '\n' && b != '\r' {
+			if utf8 {
+				return fmt.Sprintf("CONVERT(X'%s' USING utf8mb4)", hex.EncodeToString(value))
+			}
+			return fmt.Sprintf("X'%s'", hex.EncodeToString(value))
+		}
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(string(value))
+	return "'" + escaped + "'"
+}
+
+// SQL renders the value as an SQL literal, given the signedness of its column
+func (this *RowValue) SQL(unsigned bool) string {
+	switch value := this.Value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		if unsigned && value < 0 {
+			bits := map[byte]uint{mysqlTypeTiny: 8, mysqlTypeShort: 16, mysqlTypeInt24: 24, mysqlTypeLong: 32}[this.Type]
+			if bits == 0 {
+				return strconv.FormatUint(uint64(value), 10)
+			}
+			return strconv.FormatUint(uint64(value)&(1<<bits-1), 10)
+		}
+		return strconv.FormatInt(value, 10)
+	case uint64:
+		return strconv.FormatUint(value, 10)
+	case float32:
+		return strconv.FormatFloat(float64(value), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case []byte:
+		return sqlStringLiteral(value, false)
+	case sqlLiteral:
+		return string(value)
+	}
+	return fmt.Sprintf("%v", this.Value)
+}
+
+// decodeRowImage decodes a row image off rows event data: a bitmap of NULLs among present columns, followed by
+// the values of present columns which are not NULL
+func decodeRowImage(buffer *binlogBuffer, tableMap *TableMapEvent, metadata []uint16, columnsPresent []byte) (RowImage, error) {
+	presentCount := 0
+	for i := range tableMap.ColumnTypes {
+		if bitSet(columnsPresent, i) {
+			presentCount++
+		}
+	}
+	nullBitmap := buffer.next((presentCount + 7) / 8)
+	image := make(RowImage, len(tableMap.ColumnTypes))
+	presentIndex := 0
+	for i, columnType := range tableMap.ColumnTypes {
+		if !bitSet(columnsPresent, i) {
+			continue
+		}
+		value := &RowValue{Type: columnType}
+		if !bitSet(nullBitmap, presentIndex) {
+			var err error
+			if value.Value, err = decodeRowValue(buffer, columnType, metadata[i]); err != nil {
+				return nil, fmt.Errorf("column %d: %+v", i+1, err)
+			}
+		}
+		presentIndex++
+		image[i] = value
+		if buffer.err != nil {
+			return nil, fmt.Errorf("column %d: %+v", i+1, buffer.err)
+		}
+	}
+	return image, nil
+}
+
+// RowChanges decodes the rows of a rows event, by the column types and metadata of its table map
+func (this *BinlogEvent) RowChanges() ([]RowChange, error) {
+	payload, ok := this.Payload.(*RowsEvent)
+	if !ok {
+		return nil, fmt.Errorf("Not a rows event at position %d: %s", this.Position, this.EventType)
+	}
+	if payload.TableMap == nil {
+		return nil, fmt.Errorf("No table map for rows event at position %d", this.Position)
+	}
+	if payload.ColumnCount != uint64(len(payload.TableMap.ColumnTypes)) {
+		return nil, fmt.Errorf("Rows event at position %d has %d columns, whereas its table map has %d", this.Position, payload.ColumnCount, len(payload.TableMap.ColumnTypes))
+	}
+	metadata, err := payload.TableMap.columnMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse column metadata of %s.%s: %+v", payload.Database, payload.Table, err)
+	}
+	buffer := &binlogBuffer{data: payload.RowsData}
+	changes := []RowChange{}
+	for len(buffer.data) > 0 {
+		var change RowChange
+		switch this.EventType {
+		case WriteRowsEventV0, WriteRowsEventV1, WriteRowsEventV2:
+			change.After, err = decodeRowImage(buffer, payload.TableMap, metadata, payload.ColumnsPresent)
+		case DeleteRowsEventV0, DeleteRowsEventV1, DeleteRowsEventV2:
+			change.Before, err = decodeRowImage(buffer, payload.TableMap, metadata, payload.ColumnsPresent)
+		default:
+			if change.Before, err = decodeRowImage(buffer, payload.TableMap, metadata, payload.ColumnsPresent); err == nil {
+				change.After, err = decodeRowImage(buffer, payload.TableMap, metadata, payload.ColumnsPresentAfter)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode row %d of %s.%s at position %d: %+v", len(changes)+1, payload.Database, payload.Table, this.Position, err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// FlashbackStatements returns the statements undoing the row changes of a rows event, in reverse order: a write
+// is undone by a delete, a delete by an insert, and an update by an update restoring the before image. Rows are
+// identified by all their columns, bar FLOATs which do not compare exactly, hence full row images are required
+// (binlog_row_image=FULL).
+func (this *BinlogEvent) FlashbackStatements(columns []TableColumn) ([]string, error) {
+	changes, err := this.RowChanges()
+	if err != nil {
+		return nil, err
+	}
+	payload := this.Payload.(*RowsEvent)
+	if err := payload.TableMap.verifyColumns(columns); err != nil {
+		return nil, fmt.Errorf("Rows event at position %d: %+v", this.Position, err)
+	}
+	table := fmt.Sprintf("%s.%s", quoteIdentifier(payload.Database), quoteIdentifier(payload.Table))
+	assignments := func(image RowImage) string {
+		tokens := []string{}
+		for i, value := range image {
+			if !columns[i].Generated {
+				tokens = append(tokens, fmt.Sprintf("%s=%s", quoteIdentifier(columns[i].Name), value.SQL(columns[i].Unsigned)))
+			}
+		}
+		return strings.Join(tokens, ", ")
+	}
+	condition := func(image RowImage) (string, error) {
+		tokens := []string{}
+		for i, value := range image {
+			switch {
+			case value.Type == mysqlTypeFloat:
+				continue
+			case value.Value == nil:
+				tokens = append(tokens, fmt.Sprintf("%s IS NULL", quoteIdentifier(columns[i].Name)))
+			default:
+				tokens = append(tokens, fmt.Sprintf("%s=%s", quoteIdentifier(columns[i].Name), value.SQL(columns[i].Unsigned)))
+			}
+		}
+		if len(tokens) == 0 {
+			return "", fmt.Errorf("Cannot identify rows of %s by their columns", table)
+		}
+		return strings.Join(tokens, " AND "), nil
+	}
+
+	statements := []string{}
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if (change.Before != nil && !change.Before.IsFull()) || (change.After != nil && !change.After.IsFull()) {
+			return nil, fmt.Errorf("Partial row image of %s at position %d: flashback requires binlog_row_image=FULL", table, this.Position)
+		}
+		var statement string
+		switch {
+		case change.Before == nil:
+			where, err := condition(change.After)
+			if err != nil {
+				return nil, err
+			}
+			statement = fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT 1", table, where)
+		case change.After == nil:
+			names, values := []string{}, []string{}
+			for i, value := range change.Before {
+				if !columns[i].Generated {
+					names = append(names, quoteIdentifier(columns[i].Name))
+					values = append(values, value.SQL(columns[i].Unsigned))
+				}
+			}
+			statement = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(names, ", "), strings.Join(values, ", "))
+		default:
+			where, err := condition(change.After)
+			if err != nil {
+				return nil, err
+			}
+			statement = fmt.Sprintf("UPDATE %s SET %s WHERE %s LIMIT 1", table, assignments(change.Before), where)
+		}
+		statements = append(statements, statement)
+	}
+	return statements, nil
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Binary JSON value types
+const (
+	jsonbSmallObject byte = 0x00
+	jsonbLargeObject byte = 0x01
+	jsonbSmallArray  byte = 0x02
+	jsonbLargeArray  byte = 0x03
+	jsonbLiteral     byte = 0x04
+	jsonbInt16       byte = 0x05
+	jsonbUint16      byte = 0x06
+	jsonbInt32       byte = 0x07
+	jsonbUint32      byte = 0x08
+	jsonbInt64       byte = 0x09
+	jsonbUint64      byte = 0x0a
+	jsonbDouble      byte = 0x0b
+	jsonbString      byte = 0x0c
+	jsonbOpaque      byte = 0x0f
+)
+
+// decodeBinaryJSON renders a JSON column value, as stored in row images, as JSON text
+func decodeBinaryJSON(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "null", nil
+	}
+	var output bytes.Buffer
+	if err := writeJSONValue(&output, data[0], data[1:]); err != nil {
+		return "", fmt.Errorf("Cannot decode JSON: %+v", err)
+	}
+	return output.String(), nil
+}
+
+// jsonVariableLength reads a length stored in 7 bit groups, least significant first, returning the length and
+// the number of bytes read
+func jsonVariableLength(data []byte) (int, int, error) {
+	length := 0
+	for i := 0; i < 5 && i < len(data); i++ {
+		length |= int(data[i]&0x7f) << uint(7*i)
+		if data[i]&0x80 == 0 {
+			return length, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid variable length")
+}
+
+func writeJSONString(output *bytes.Buffer, value string) {
+	encoded, _ := json.Marshal(value)
+	output.Write(encoded)
+}
+
+func writeJSONValue(output *bytes.Buffer, valueType byte, data []byte) error {
+	need := func(n int) error {
+		if len(data) < n {
+			return fmt.Errorf("value of type %d truncated", valueType)
+		}
+		return nil
+	}
+	switch valueType {
+	case jsonbSmallObject, jsonbLargeObject, jsonbSmallArray, jsonbLargeArray:
+		return writeJSONContainer(output, valueType, data)
+	case jsonbLiteral:
+		if err := need(1); err != nil {
+			return err
+		}
+		switch data[0] {
+		case 0x00:
+			output.WriteString("null")
+		case 0x01:
+			output.WriteString("true")
+		case 0x02:
+			output.WriteString("false")
+		default:
+			return fmt.Errorf("invalid literal %d", data[0])
+		}
+	case jsonbInt16, jsonbUint16:
+		if err := need(2); err != nil {
+			return err
+		}
+		value := binary.LittleEndian.Uint16(data)
+		if valueType == jsonbInt16 {
+			output.WriteString(strconv.FormatInt(int64(int16(value)), 10))
+		} else {
+			output.WriteString(strconv.FormatUint(uint64(value), 10))
+		}
+	case jsonbInt32, jsonbUint32:
+		if err := need(4); err != nil {
+			return err
+		}
+		value := binary.LittleEndian.Uint32(data)
+		if valueType == jsonbInt32 {
+			output.WriteString(strconv.FormatInt(int64(int32(value)), 10))
+		} else {
+			output.WriteString(strconv.FormatUint(uint64(value), 10))
+		}
+	case jsonbInt64, jsonbUint64, jsonbDouble:
+		if err := need(8); err != nil {
+			return err
+		}
+		value := binary.LittleEndian.Uint64(data)
+		switch valueType {
+		case jsonbInt64:
+			output.WriteString(strconv.FormatInt(int64(value), 10))
+		case jsonbUint64:
+			output.WriteString(strconv.FormatUint(value, 10))
+		default:
+			output.WriteString(strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64))
+		}
+	case jsonbString:
+		length, n, err := jsonVariableLength(data)
+		if err != nil {
+			return err
+		}
+		if err := need(n + length); err != nil {
+			return err
+		}
+		writeJSONString(output, string(data[n:n+length]))
+	case jsonbOpaque:
+		if err := need(1); err != nil {
+			return err
+		}
+		length, n, err := jsonVariableLength(data[1:])
+		if err != nil {
+			return err
+		}
+		if err := need(1 + n + length); err != nil {
+			return err
+		}
+		return writeJSONOpaque(output, data[0], data[1+n:1+n+length])
+	default:
+		return fmt.Errorf("unknown value type %d", valueType)
+	}
+	return nil
+}
+
+// writeJSONContainer writes an object or array: element count and size, followed by key entries (objects),
+// value entries, keys and values. Small values are inlined in their entries; others are at offsets relative
+// to the container.
+func writeJSONContainer(output *bytes.Buffer, valueType byte, data []byte) error {
+	large := (valueType == jsonbLargeObject || valueType == jsonbLargeArray)
+	isObject := (valueType == jsonbSmallObject || valueType == jsonbLargeObject)
+	offsetSize := 2
+	if large {
+		offsetSize = 4
+	}
+	readOffset := func(at int) (int, error) {
+		if at+offsetSize > len(data) {
+			return 0, fmt.Errorf("container truncated")
+		}
+		if large {
+			return int(binary.LittleEndian.Uint32(data[at:])), nil
+		}
+		return int(binary.LittleEndian.Uint16(data[at:])), nil
+	}
+	count, err := readOffset(0)
+	if err != nil {
+		return err
+	}
+	keyEntrySize, valueEntrySize := offsetSize+2, 1+offsetSize
+	keyEntries := 2 * offsetSize
+	valueEntries := keyEntries
+	if isObject {
+		valueEntries += count * keyEntrySize
+	}
+	if valueEntries+count*valueEntrySize > len(data) {
+		return fmt.Errorf("container of %d elements truncated", count)
+	}
+
+	if isObject {
+		output.WriteString("{")
+	} else {
+		output.WriteString("[")
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			output.WriteString(", ")
+		}
+		if isObject {
+			keyEntry := keyEntries + i*keyEntrySize
+			keyOffset, _ := readOffset(keyEntry)
+			keyLength := int(binary.LittleEndian.Uint16(data[keyEntry+offsetSize:]))
+			if keyOffset+keyLength > len(data) {
+				return fmt.Errorf("key %d truncated", i)
+			}
+			writeJSONString(output, string(data[keyOffset:keyOffset+keyLength]))
+			output.WriteString(": ")
+		}
+		valueEntry := valueEntries + i*valueEntrySize
+		elementType := data[valueEntry]
+		inlined := false
+		switch elementType {
+		case jsonbLiteral, jsonbInt16, jsonbUint16:
+			inlined = true
+		case jsonbInt32, jsonbUint32:
+			inlined = large
+		}
+		if inlined {
+			err = writeJSONValue(output, elementType, data[valueEntry+1:valueEntry+1+offsetSize])
+		} else {
+			valueOffset, _ := readOffset(valueEntry + 1)
+			if valueOffset >= len(data) {
+				return fmt.Errorf("value %d truncated", i)
+			}
+			err = writeJSONValue(output, elementType, data[valueOffset:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if isObject {
+		output.WriteString("}")
+	} else {
+		output.WriteString("]")
+	}
+	return nil
+}
+
+// writeJSONOpaque writes a value of a MySQL type with no JSON equivalent: decimals and temporal values are
+// written as numbers and strings respectively, others as base64 strings, alike MySQL
+func writeJSONOpaque(output *bytes.Buffer, fieldType byte, data []byte) error {
+	switch fieldType {
+	case mysqlTypeNewDecimal:
+		if len(data) < 2 {
+			return fmt.Errorf("decimal truncated")
+		}
+		value, err := decodeDecimal(data[2:], int(data[0]), int(data[1]))
+		if err != nil {
+			return err
+		}
+		output.WriteString(value)
+		return nil
+	case mysqlTypeDate, mysqlTypeDatetime, mysqlTypeTimestamp, mysqlTypeTime:
+		if len(data) < 8 {
+			return fmt.Errorf("temporal value truncated")
+		}
+		packed := int64(binary.LittleEndian.Uint64(data))
+		negative := packed < 0
+		if negative {
+			packed = -packed
+		}
+		switch fieldType {
+		case mysqlTypeDate:
+			writeJSONString(output, formatPackedDatetime(packed >> 24)[:10])
+		case mysqlTypeTime:
+			writeJSONString(output, formatPackedTime(negative, packed>>24, packed%(1<<24), 6))
+		default:
+			writeJSONString(output, formatPackedDatetime(packed>>24)+formatFraction(packed%(1<<24), 6))
+		}
+		return nil
+	}
+	writeJSONString(output, fmt.Sprintf("base64:type%d:%s", fieldType, base64.StdEncoding.EncodeToString(data)))
+	return nil
+}
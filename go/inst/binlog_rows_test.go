@@ -0,0 +1,162 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst_test
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+func mustDecodeHex(s string) []byte {
+	result, _ := hex.DecodeString(s)
+	return result
+}
+
+// testRowsBinlog builds a binary log of a table map followed by given rows events, of a table of given column
+// types and metadata
+func testRowsBinlog(columnTypes []byte, metadata []byte, rowsEvents []inst.BinlogEventType, rows [][]byte, columnsPresent byte) []byte {
+	binlog := concat(inst.BinlogMagic, inst.EncodeFormatDescriptionEvent("8.0.20", testBinlogTimestamp, 1, inst.BinlogChecksumAlgCRC32))
+	addEvent := func(eventType inst.BinlogEventType, body []byte) {
+		header := inst.BinlogEventHeader{Timestamp: testBinlogTimestamp, EventType: eventType, ServerId: 1}
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), body, true)...)
+	}
+	for i, eventType := range rowsEvents {
+		addEvent(inst.TableMapEventType, concat(le(6, 70), le(2, 1), []byte("\x04test\x00\x02t1\x00"), []byte{byte(len(columnTypes))}, columnTypes,
+			[]byte{byte(len(metadata))}, metadata, make([]byte, (len(columnTypes)+7)/8)))
+		bitmaps := []byte{columnsPresent}
+		if eventType == inst.UpdateRowsEventV2 {
+			bitmaps = append(bitmaps, columnsPresent)
+		}
+		addEvent(eventType, concat(le(6, 70), le(2, 1), le(2, 2), []byte{byte(len(columnTypes))}, bitmaps, rows[i]))
+	}
+	return binlog
+}
+
+// Columns: INT UNSIGNED, VARCHAR(20), DECIMAL(10,2), DATETIME(3), TEXT, FLOAT, TINYINT, JSON
+var testColumnTypes = []byte{3, 15, 246, 18, 252, 4, 1, 245}
+var testColumnMetadata = concat(le(2, 80), []byte{10, 2}, []byte{3}, []byte{2}, []byte{4}, []byte{4})
+var testColumns = []inst.TableColumn{
+	{Name: "id", Unsigned: true}, {Name: "name"}, {Name: "price"}, {Name: "created"}, {Name: "note"}, {Name: "ratio"}, {Name: "tiny"}, {Name: "doc"},
+}
+
+// testRowImage encodes a row of the test columns, with a NULL note
+func testRowImage(name string, price []byte) []byte {
+	json := concat([]byte{0x00}, le(2, 2), le(2, 22), le(2, 18), le(2, 1), le(2, 19), le(2, 1), []byte{0x05}, le(2, 1), []byte{0x0c}, le(2, 20), []byte("ab"), []byte{1, 'x'})
+	return concat([]byte{0x10}, le(4, 0xffffffff), []byte{byte(len(name))}, []byte(name), price, mustDecodeHex("99a5443105"), mustDecodeHex("1a7c"),
+		le(4, 0x3fc00000), []byte{0xfb}, le(4, uint64(len(json))), json)
+}
+
+const testRowCondition = "`id`=4294967295 AND `name`='it\\'s' AND `price`=1234.56 AND `created`='2020-01-02 03:04:05.678' AND `note` IS NULL AND `tiny`=-5 AND `doc`=CAST('{\"a\": 1, \"b\": \"x\"}' AS JSON)"
+
+func flashbackStatements(t *testing.T, binlog []byte, columns []inst.TableColumn) [][]string {
+	result := [][]string{}
+	for _, event := range readAllBinlogEvents(t, binlog) {
+		if event.EventType.IsRowsEvent() {
+			statements, err := event.FlashbackStatements(columns)
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			result = append(result, statements)
+		}
+	}
+	return result
+}
+
+func TestFlashbackStatements(t *testing.T) {
+	rowA := testRowImage("it's", mustDecodeHex("800004d238"))
+	rowB := testRowImage("b", mustDecodeHex("7ffffb2dc7"))
+	binlog := testRowsBinlog(testColumnTypes, testColumnMetadata,
+		[]inst.BinlogEventType{inst.WriteRowsEventV2, inst.UpdateRowsEventV2, inst.DeleteRowsEventV2},
+		[][]byte{rowA, concat(rowA, rowB), concat(rowA, rowB)}, 0xff)
+
+	statements := flashbackStatements(t, binlog, testColumns)
+	values := "4294967295, 'it\\'s', 1234.56, '2020-01-02 03:04:05.678', NULL, 1.5, -5, CAST('{\"a\": 1, \"b\": \"x\"}' AS JSON)"
+	expected := [][]string{
+		{"DELETE FROM `test`.`t1` WHERE " + testRowCondition + " LIMIT 1"},
+		{"UPDATE `test`.`t1` SET `id`=4294967295, `name`='it\\'s', `price`=1234.56, `created`='2020-01-02 03:04:05.678', `note`=NULL, `ratio`=1.5, `tiny`=-5, `doc`=CAST('{\"a\": 1, \"b\": \"x\"}' AS JSON)" +
+			" WHERE " + strings.Replace(strings.Replace(testRowCondition, "'it\\'s'", "'b'", 1), "1234.56", "-1234.56", 1) + " LIMIT 1"},
+		{
+			"INSERT INTO `test`.`t1` (`id`, `name`, `price`, `created`, `note`, `ratio`, `tiny`, `doc`) VALUES (" + strings.Replace(strings.Replace(values, "'it\\'s'", "'b'", 1), "1234.56", "-1234.56", 1) + ")",
+			"INSERT INTO `test`.`t1` (`id`, `name`, `price`, `created`, `note`, `ratio`, `tiny`, `doc`) VALUES (" + values + ")",
+		},
+	}
+	if !reflect.DeepEqual(statements, expected) {
+		t.Errorf("Unexpected statements:\n%q\nexpected:\n%q", statements, expected)
+	}
+
+	// Generated columns are not written
+	generated := append([]inst.TableColumn{}, testColumns...)
+	generated[6].Generated = true
+	statements = flashbackStatements(t, binlog, generated)
+	if strings.Contains(statements[2][0], "`tiny`") || !strings.Contains(statements[1][0], "WHERE `id`") || strings.Contains(statements[1][0], "`tiny`=-5,") {
+		t.Errorf("Unexpected statements with generated column: %q", statements)
+	}
+
+	for _, event := range readAllBinlogEvents(t, binlog) {
+		if event.EventType.IsRowsEvent() {
+			if _, err := event.FlashbackStatements(testColumns[:7]); err == nil {
+				t.Errorf("Expected error on column count mismatch")
+			}
+		}
+	}
+	// Columns are verified by type, where their types are given
+	typed := append([]inst.TableColumn{}, testColumns...)
+	for i, dataType := range []string{"int", "varchar", "decimal", "datetime", "text", "float", "tinyint", "json"} {
+		typed[i].DataType = dataType
+	}
+	if statements := flashbackStatements(t, binlog, typed); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("Unexpected statements with typed columns:\n%q", statements)
+	}
+	for i, dataType := range map[int]string{1: "int", 4: "mediumtext", 6: "smallint"} {
+		mismatched := append([]inst.TableColumn{}, typed...)
+		mismatched[i].DataType = dataType
+		for _, event := range readAllBinlogEvents(t, binlog) {
+			if event.EventType.IsRowsEvent() {
+				if _, err := event.FlashbackStatements(mismatched); err == nil || !strings.Contains(err.Error(), "Column "+mismatched[i].Name+" ") {
+					t.Errorf("Expected error on %s column of type %s, got %+v", mismatched[i].Name, dataType, err)
+				}
+			}
+		}
+	}
+	// A minimal row image, lacking the note, cannot be undone
+	partial := testRowsBinlog(testColumnTypes, testColumnMetadata, []inst.BinlogEventType{inst.DeleteRowsEventV2}, [][]byte{concat([]byte{0}, le(4, 7))}, 0x01)
+	for _, event := range readAllBinlogEvents(t, partial) {
+		if event.EventType.IsRowsEvent() {
+			if _, err := event.FlashbackStatements(testColumns); err == nil || !strings.Contains(err.Error(), "binlog_row_image=FULL") {
+				t.Errorf("Expected error on partial row image, got %+v", err)
+			}
+		}
+	}
+}
+
+func TestRowChangesTemporalTypes(t *testing.T) {
+	// Columns: TIME, TIMESTAMP, DATE, YEAR, ENUM, BIT(10)
+	columnTypes := []byte{19, 17, 10, 13, 254, 16}
+	metadata := []byte{0, 0, 0xf7, 1, 2, 1}
+	row := concat([]byte{0}, mustDecodeHex("7fef7d"), mustDecodeHex("5f5e1000"), mustDecodeHex("22c80f"), []byte{121}, []byte{2}, mustDecodeHex("0203"))
+	binlog := testRowsBinlog(columnTypes, metadata, []inst.BinlogEventType{inst.WriteRowsEventV2}, [][]byte{row}, 0x3f)
+	columns := []inst.TableColumn{{Name: "t"}, {Name: "ts"}, {Name: "d"}, {Name: "y"}, {Name: "e"}, {Name: "b"}}
+
+	expected := "DELETE FROM `test`.`t1` WHERE `t`='-01:02:03' AND `ts`=FROM_UNIXTIME(1600000000) AND `d`='2020-01-02' AND `y`=2021 AND `e`=2 AND `b`=515 LIMIT 1"
+	if statements := flashbackStatements(t, binlog, columns); len(statements) != 1 || !reflect.DeepEqual(statements[0], []string{expected}) {
+		t.Errorf("Unexpected statements: %q", statements)
+	}
+}
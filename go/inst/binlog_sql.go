@@ -0,0 +1,378 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// flags2 options, as logged in query events
+const (
+	optionAutoIsNull          = 1 << 14
+	optionNotAutocommit       = 1 << 19
+	optionNoForeignKeyChecks  = 1 << 26
+	optionRelaxedUniqueChecks = 1 << 27
+)
+
+const mariadbGtidStandaloneFlag = 0x01
+const binlogBase64LineLength = 76
+const binlogSQLStatementDelimiter = "/*!*/;"
+
+// querySessionStatements decodes the status variables of a query event into the statements setting the
+// session up for the query, keyed by what they set. Decoding stops at an unknown status variable, since
+// its length cannot be told.
+func querySessionStatements(statusVars []byte) map[string]string {
+	statements := map[string]string{}
+	buffer := &binlogBuffer{data: statusVars}
+	for len(buffer.data) > 0 && buffer.err == nil {
+		switch code := buffer.uint8(); code {
+		case 0:
+			flags2 := buffer.uint32()
+			boolean := func(option uint32, negate bool) int {
+				if (flags2&option != 0) != negate {
+					return 1
+				}
+				return 0
+			}
+			statements["flags2"] = fmt.Sprintf("SET @@session.foreign_key_checks=%d, @@session.sql_auto_is_null=%d, @@session.unique_checks=%d, @@session.autocommit=%d",
+				boolean(optionNoForeignKeyChecks, true), boolean(optionAutoIsNull, false), boolean(optionRelaxedUniqueChecks, true), boolean(optionNotAutocommit, true))
+		case 1:
+			statements["sql_mode"] = fmt.Sprintf("SET @@session.sql_mode=%d", buffer.uint64())
+		case 2:
+			buffer.next(int(buffer.uint8()) + 1)
+		case 3:
+			increment, offset := buffer.uint16(), buffer.uint16()
+			statements["auto_increment"] = fmt.Sprintf("SET @@session.auto_increment_increment=%d, @@session.auto_increment_offset=%d", increment, offset)
+		case 4:
+			client, connection, server := buffer.uint16(), buffer.uint16(), buffer.uint16()
+			statements["charset"] = fmt.Sprintf("SET @@session.character_set_client=%d,@@session.collation_connection=%d,@@session.collation_server=%d", client, connection, server)
+		case 5:
+			timeZone := string(buffer.next(int(buffer.uint8())))
+			statements["time_zone"] = fmt.Sprintf("SET @@session.time_zone='%s'", strings.Replace(timeZone, "'", "''", -1))
+		case 6:
+			buffer.next(int(buffer.uint8()))
+		case 7:
+			statements["lc_time_names"] = fmt.Sprintf("SET @@session.lc_time_names=%d", buffer.uint16())
+		case 8:
+			if collation := buffer.uint16(); collation == 0 {
+				statements["collation_database"] = "SET @@session.collation_database=DEFAULT"
+			} else {
+				statements["collation_database"] = fmt.Sprintf("SET @@session.collation_database=%d", collation)
+			}
+		case 9, 17, 129:
+			buffer.next(8)
+		case 10:
+			buffer.next(4)
+		case 11:
+			buffer.next(int(buffer.uint8()))
+			buffer.next(int(buffer.uint8()))
+		case 12:
+			if count := buffer.uint8(); count != 254 {
+				for i := 0; i < int(count) && buffer.err == nil; i++ {
+					if end := strings.IndexByte(string(buffer.data), 0); end >= 0 {
+						buffer.next(end + 1)
+					} else {
+						buffer.rest()
+					}
+				}
+			}
+		case 13, 128:
+			buffer.next(3)
+		case 16, 19, 20:
+			buffer.next(1)
+		case 18:
+			buffer.next(2)
+		default:
+			return statements
+		}
+	}
+	return statements
+}
+
+// userVarCollations maps collation ids of string user variables onto their character set and collation names.
+// Listed are the defaults of common character sets, and their binary collations.
+var userVarCollations = map[uint32][2]string{
+	1:   {"big5", "big5_chinese_ci"},
+	8:   {"latin1", "latin1_swedish_ci"},
+	11:  {"ascii", "ascii_general_ci"},
+	12:  {"ujis", "ujis_japanese_ci"},
+	13:  {"sjis", "sjis_japanese_ci"},
+	24:  {"gb2312", "gb2312_chinese_ci"},
+	28:  {"gbk", "gbk_chinese_ci"},
+	33:  {"utf8", "utf8_general_ci"},
+	35:  {"ucs2", "ucs2_general_ci"},
+	45:  {"utf8mb4", "utf8mb4_general_ci"},
+	46:  {"utf8mb4", "utf8mb4_bin"},
+	47:  {"latin1", "latin1_bin"},
+	48:  {"latin1", "latin1_general_ci"},
+	54:  {"utf16", "utf16_general_ci"},
+	60:  {"utf32", "utf32_general_ci"},
+	63:  {"binary", "binary"},
+	65:  {"ascii", "ascii_bin"},
+	83:  {"utf8", "utf8_bin"},
+	95:  {"cp932", "cp932_japanese_ci"},
+	192: {"utf8", "utf8_unicode_ci"},
+	224: {"utf8mb4", "utf8mb4_unicode_ci"},
+	246: {"utf8mb4", "utf8mb4_unicode_520_ci"},
+	248: {"gb18030", "gb18030_chinese_ci"},
+	255: {"utf8mb4", "utf8mb4_0900_ai_ci"},
+	309: {"utf8mb4", "utf8mb4_0900_bin"},
+}
+
+// userVarValueSQL renders the value of a user variable as an SQL literal of its type and collation
+func userVarValueSQL(userVar *UserVarEvent) (string, error) {
+	if userVar.IsNull {
+		return "NULL", nil
+	}
+	switch userVar.Type {
+	case UserVarStringResult:
+		collation, ok := userVarCollations[userVar.Collation]
+		if !ok {
+			return "", fmt.Errorf("Unsupported collation %d of user variable %s", userVar.Collation, userVar.Name)
+		}
+		return fmt.Sprintf("_%s X'%s' COLLATE `%s`", collation[0], hex.EncodeToString(userVar.Value), collation[1]), nil
+	case UserVarRealResult:
+		if len(userVar.Value) < 8 {
+			return "", fmt.Errorf("Invalid real value of user variable %s", userVar.Name)
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(userVar.Value)), 'g', -1, 64), nil
+	case UserVarIntResult:
+		if len(userVar.Value) < 8 {
+			return "", fmt.Errorf("Invalid int value of user variable %s", userVar.Name)
+		}
+		value := binary.LittleEndian.Uint64(userVar.Value)
+		if userVar.Flags&userVarUnsignedFlag != 0 {
+			return strconv.FormatUint(value, 10), nil
+		}
+		return strconv.FormatInt(int64(value), 10), nil
+	case UserVarDecimalResult:
+		if len(userVar.Value) < 2 {
+			return "", fmt.Errorf("Invalid decimal value of user variable %s", userVar.Name)
+		}
+		return decodeDecimal(userVar.Value[2:], int(userVar.Value[0]), int(userVar.Value[1]))
+	}
+	return "", fmt.Errorf("Unsupported type %d of user variable %s", userVar.Type, userVar.Name)
+}
+
+// isSQLNeutral tells whether events of this type have no effect when applied, such that they are
+// written as comments alone
+func (this BinlogEventType) isSQLNeutral() bool {
+	switch this {
+	case IgnorableEventType, RowsQueryEventType, TransactionContextEvent, ViewChangeEventType, MariaDBAnnotateRowsEvent:
+		return true
+	}
+	return this.IsGroupless()
+}
+
+// BinlogSQLWriter renders binlog events as SQL, in the manner of mysqlbinlog, such that the output may be
+// applied with the mysql command line client. Row events are passed on as BINLOG statements, hence row images
+// need not be decoded.
+type BinlogSQLWriter struct {
+	writer            io.Writer
+	err               error
+	database          string
+	sessionStatements map[string]string
+	gtidNextSet       bool
+	pendingRowEvents  []*BinlogEvent
+}
+
+// NewBinlogSQLWriter writes the preamble of the SQL output and returns a writer for events
+func NewBinlogSQLWriter(writer io.Writer) *BinlogSQLWriter {
+	this := &BinlogSQLWriter{writer: writer, sessionStatements: map[string]string{}}
+	this.printf("/*!50530 SET @@SESSION.PSEUDO_SLAVE_MODE=1*/;\n")
+	this.printf("/*!50003 SET @OLD_COMPLETION_TYPE=@@COMPLETION_TYPE,COMPLETION_TYPE=0*/;\n")
+	this.printf("DELIMITER %s\n", binlogSQLStatementDelimiter)
+	return this
+}
+
+func (this *BinlogSQLWriter) printf(format string, args ...interface{}) {
+	if this.err != nil {
+		return
+	}
+	_, this.err = fmt.Fprintf(this.writer, format, args...)
+}
+
+// statement writes a statement terminated by the delimiter
+func (this *BinlogSQLWriter) statement(format string, args ...interface{}) {
+	this.printf(format, args...)
+	this.printf("%s\n", binlogSQLStatementDelimiter)
+}
+
+// binlogStatement writes a BINLOG statement of given raw events
+func (this *BinlogSQLWriter) binlogStatement(rawEvents ...[]byte) {
+	this.printf("BINLOG '\n")
+	for _, raw := range rawEvents {
+		encoded := base64.StdEncoding.EncodeToString(raw)
+		for len(encoded) > binlogBase64LineLength {
+			this.printf("%s\n", encoded[:binlogBase64LineLength])
+			encoded = encoded[binlogBase64LineLength:]
+		}
+		this.printf("%s\n", encoded)
+	}
+	this.statement("'")
+}
+
+// WriteEvent writes the SQL of an event, preceded by a comment describing it
+func (this *BinlogSQLWriter) WriteEvent(event *BinlogEvent) error {
+	if event.EventType != TableMapEventType && !event.EventType.IsRowsEvent() {
+		// Row events left pending, e.g. where those ending their statement were filtered out
+		this.flushRowEvents()
+	}
+	this.printf("# at %d\n", event.Position)
+	this.printf("#%s server id %d  end_log_pos %d \t%s\t%s\n", event.Time().Format("060102 15:04:05"), event.ServerId, event.NextPosition, event.EventType, strings.Replace(event.Info(), "\n", " ", -1))
+
+	switch payload := event.Payload.(type) {
+	case *FormatDescriptionEvent:
+		this.binlogStatement(event.Raw)
+	case *QueryEvent:
+		if payload.Database != "" && payload.Database != this.database {
+			this.statement("use `%s`", strings.Replace(payload.Database, "`", "``", -1))
+			this.database = payload.Database
+		}
+		this.statement("SET TIMESTAMP=%d", event.Timestamp)
+		sessionStatements := querySessionStatements(payload.StatusVars)
+		keys := []string{}
+		for key := range sessionStatements {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if this.sessionStatements[key] != sessionStatements[key] {
+				this.statement("%s", sessionStatements[key])
+				this.sessionStatements[key] = sessionStatements[key]
+			}
+		}
+		this.statement("%s\n", payload.Query)
+	case *XidEvent:
+		this.statement("COMMIT")
+	case *IntvarEvent:
+		switch payload.Type {
+		case IntvarLastInsertId:
+			this.statement("SET LAST_INSERT_ID=%d", payload.Value)
+		case IntvarInsertId:
+			this.statement("SET INSERT_ID=%d", payload.Value)
+		default:
+			return this.fail(event, fmt.Errorf("unknown type %d", payload.Type))
+		}
+	case *RandEvent:
+		this.statement("SET @@RAND_SEED1=%d, @@RAND_SEED2=%d", payload.Seed1, payload.Seed2)
+	case *UserVarEvent:
+		value, err := userVarValueSQL(payload)
+		if err != nil {
+			return this.fail(event, err)
+		}
+		this.statement("SET @%s:=%s", quoteIdentifier(payload.Name), value)
+	case *GtidEvent:
+		if payload.Anonymous {
+			this.statement("SET @@SESSION.GTID_NEXT= 'ANONYMOUS'")
+		} else {
+			this.statement("SET @@SESSION.GTID_NEXT= '%s'", payload.Gtid())
+		}
+		this.gtidNextSet = true
+	case *MariaDBGtidEvent:
+		this.statement("/*!100001 SET @@session.gtid_domain_id=%d*/", payload.DomainId)
+		this.statement("/*!100001 SET @@session.server_id=%d*/", payload.ServerId)
+		this.statement("/*!100001 SET @@session.gtid_seq_no=%d*/", payload.SequenceNumber)
+		if payload.Flags&mariadbGtidStandaloneFlag == 0 {
+			this.statement("START TRANSACTION\n")
+		}
+	case *TableMapEvent:
+		this.pendingRowEvents = append(this.pendingRowEvents, event)
+	case *RowsEvent:
+		this.pendingRowEvents = append(this.pendingRowEvents, event)
+		if payload.IsStatementEnd() {
+			this.flushRowEvents()
+		}
+	default:
+		if !event.EventType.isSQLNeutral() {
+			// Applying the rest while leaving out the changes of this event would silently diverge
+			return this.fail(event, fmt.Errorf("unsupported event type"))
+		}
+	}
+	return this.err
+}
+
+// fail stops the writer on an event it cannot render
+func (this *BinlogSQLWriter) fail(event *BinlogEvent, err error) error {
+	if this.err == nil {
+		this.err = fmt.Errorf("Cannot write %s event at position %d as SQL: %+v", event.EventType, event.Position, err)
+	}
+	return this.err
+}
+
+// flushRowEvents writes pending table map and row events. Where the rows event ending the statement was left out,
+// the last rows event written is flagged as ending it instead, and table maps following it are dropped, such that
+// the server does not hold on to the statement's table maps and locks.
+func (this *BinlogSQLWriter) flushRowEvents() {
+	pendingRowEvents := this.pendingRowEvents
+	this.pendingRowEvents = nil
+	for len(pendingRowEvents) > 0 && !pendingRowEvents[len(pendingRowEvents)-1].EventType.IsRowsEvent() {
+		pendingRowEvents = pendingRowEvents[:len(pendingRowEvents)-1]
+	}
+	if len(pendingRowEvents) == 0 {
+		return
+	}
+	rawEvents := [][]byte{}
+	for _, event := range pendingRowEvents[:len(pendingRowEvents)-1] {
+		rawEvents = append(rawEvents, event.Raw)
+	}
+	rawEvents = append(rawEvents, pendingRowEvents[len(pendingRowEvents)-1].rawWithStatementEnd())
+	this.binlogStatement(rawEvents...)
+}
+
+// WriteEmptyTransaction writes an empty transaction, consuming the GTID of a transaction whose events are
+// all left out
+func (this *BinlogSQLWriter) WriteEmptyTransaction() error {
+	this.flushRowEvents()
+	this.statement("BEGIN")
+	this.statement("COMMIT")
+	return this.err
+}
+
+// WriteProgressMarker writes a statement selecting given value, such that the client's output tells how far
+// applying the SQL got. Expected between transactions. GTID_NEXT is reset beforehand, as MySQL accepts no
+// statement between a transaction and the next GTID assignment.
+func (this *BinlogSQLWriter) WriteProgressMarker(value int) error {
+	this.flushRowEvents()
+	if this.gtidNextSet {
+		this.statement("SET @@SESSION.GTID_NEXT= 'AUTOMATIC' ")
+		this.gtidNextSet = false
+	}
+	this.statement("SELECT %d AS progress_marker", value)
+	return this.err
+}
+
+// Close flushes pending events and writes the epilogue of the SQL output. It does not close the underlying writer.
+func (this *BinlogSQLWriter) Close() error {
+	this.flushRowEvents()
+	if this.gtidNextSet {
+		this.statement("SET @@SESSION.GTID_NEXT= 'AUTOMATIC' ")
+	}
+	this.printf("DELIMITER ;\n")
+	this.printf("# End of log file\n")
+	this.printf("/*!50003 SET COMPLETION_TYPE=@OLD_COMPLETION_TYPE*/;\n")
+	this.printf("/*!50530 SET @@SESSION.PSEUDO_SLAVE_MODE=0*/;\n")
+	return this.err
+}
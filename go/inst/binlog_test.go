@@ -0,0 +1,135 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+func TestBinlogCoordinatesOrdering(t *testing.T) {
+	tests := []struct {
+		smaller inst.BinlogCoordinates
+		larger  inst.BinlogCoordinates
+	}{
+		{inst.BinlogCoordinates{LogFile: "mysql-bin.000017", LogPos: 120}, inst.BinlogCoordinates{LogFile: "mysql-bin.000017", LogPos: 4000}},
+		{inst.BinlogCoordinates{LogFile: "mysql-bin.000017", LogPos: 4000}, inst.BinlogCoordinates{LogFile: "mysql-bin.000018", LogPos: 4}},
+		{inst.BinlogCoordinates{LogFile: "mysql-bin.999999", LogPos: 4000}, inst.BinlogCoordinates{LogFile: "mysql-bin.1000000", LogPos: 4}},
+		{inst.BinlogCoordinates{LogFile: "/var/lib/mysql/relay-bin.99", LogPos: 4}, inst.BinlogCoordinates{LogFile: "/var/lib/mysql/relay-bin.100", LogPos: 4}},
+		{inst.BinlogCoordinates{LogFile: "binlog", LogPos: 4}, inst.BinlogCoordinates{LogFile: "binlog2", LogPos: 4}},
+	}
+	for _, test := range tests {
+		if !test.smaller.SmallerThan(&test.larger) || test.larger.SmallerThan(&test.smaller) {
+			t.Errorf("Expected %s < %s", test.smaller, test.larger)
+		}
+		if !test.smaller.SmallerThanOrEquals(&test.larger) || test.larger.SmallerThanOrEquals(&test.smaller) {
+			t.Errorf("Expected %s <= %s", test.smaller, test.larger)
+		}
+		if !test.smaller.SmallerThanOrEquals(&test.smaller) || test.smaller.SmallerThan(&test.smaller) {
+			t.Errorf("Expected %s to equal itself", test.smaller)
+		}
+	}
+	a := inst.BinlogCoordinates{LogFile: "mysql-bin.999999"}
+	b := inst.BinlogCoordinates{LogFile: "mysql-bin.1000000"}
+	if !a.FileSmallerThan(&b) || b.FileSmallerThan(&a) || a.FileNumberDistance(&b) != 1 {
+		t.Errorf("Unexpected file comparison of %s and %s", a, b)
+	}
+}
+
+func TestBinlogCoordinatesFileOffsets(t *testing.T) {
+	coordinates := inst.BinlogCoordinates{LogFile: "mysql-bin.000010", LogPos: 1234, Type: inst.RelayLog}
+	previous, err := coordinates.PreviousFileCoordinatesBy(9)
+	if err != nil || previous.LogFile != "mysql-bin.000001" || previous.LogPos != 0 || previous.Type != inst.RelayLog {
+		t.Errorf("Unexpected previous coordinates: %+v, %+v", previous, err)
+	}
+	next, err := coordinates.NextFileCoordinates()
+	if err != nil || next.LogFile != "mysql-bin.000011" {
+		t.Errorf("Unexpected next coordinates: %+v, %+v", next, err)
+	}
+	wide := inst.BinlogCoordinates{LogFile: "mysql-bin.999999"}
+	if next, err := wide.NextFileCoordinates(); err != nil || next.LogFile != "mysql-bin.1000000" {
+		t.Errorf("Unexpected next coordinates: %+v, %+v", next, err)
+	}
+
+	invalid := []func() (inst.BinlogCoordinates, error){
+		func() (inst.BinlogCoordinates, error) { return coordinates.PreviousFileCoordinatesBy(10) },
+		func() (inst.BinlogCoordinates, error) { return coordinates.PreviousFileCoordinatesBy(-1) },
+		(&inst.BinlogCoordinates{LogFile: "mysql-bin.000001"}).PreviousFileCoordinates,
+		(&inst.BinlogCoordinates{LogFile: "mysql-bin.2147483647"}).NextFileCoordinates,
+		(&inst.BinlogCoordinates{LogFile: "mysql-bin.index"}).NextFileCoordinates,
+		(&inst.BinlogCoordinates{LogFile: "mysql-bin.-5"}).NextFileCoordinates,
+	}
+	for i, compute := range invalid {
+		if result, err := compute(); err == nil {
+			t.Errorf("Case %d: expected error, got %+v", i, result)
+		}
+	}
+}
+
+func TestBinlogCoordinatesRange(t *testing.T) {
+	fileSizes := map[string]int64{"mysql-bin.999998": 1000, "mysql-bin.999999": 2000, "mysql-bin.1000000": 500}
+	fileSize := func(logFile string) (int64, error) {
+		if size, ok := fileSizes[logFile]; ok {
+			return size, nil
+		}
+		return 0, fmt.Errorf("No such file: %s", logFile)
+	}
+
+	coordinatesRange, err := inst.NewBinlogCoordinatesRange(inst.BinlogCoordinates{LogFile: "mysql-bin.999998", LogPos: 400}, inst.BinlogCoordinates{LogFile: "mysql-bin.1000000", LogPos: 120})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	logFiles, err := coordinatesRange.LogFiles()
+	if err != nil || !reflect.DeepEqual(logFiles, []string{"mysql-bin.999998", "mysql-bin.999999", "mysql-bin.1000000"}) {
+		t.Errorf("Unexpected log files: %+v, %+v", logFiles, err)
+	}
+	if size, err := coordinatesRange.Size(fileSize); err != nil || size != 600+2000+120 {
+		t.Errorf("Unexpected size: %d, %+v", size, err)
+	}
+	if !coordinatesRange.Contains(&inst.BinlogCoordinates{LogFile: "mysql-bin.999999", LogPos: 4}) || coordinatesRange.Contains(&inst.BinlogCoordinates{LogFile: "mysql-bin.1000000", LogPos: 120}) {
+		t.Errorf("Unexpected containment in %+v", coordinatesRange)
+	}
+
+	coordinatesRange, _ = inst.NewBinlogCoordinatesRange(inst.BinlogCoordinates{LogFile: "mysql-bin.999999", LogPos: 4}, inst.BinlogCoordinates{LogFile: "mysql-bin.999999", LogPos: 1004})
+	if size, err := coordinatesRange.Size(fileSize); err != nil || size != 1000 {
+		t.Errorf("Unexpected size within a file: %d, %+v", size, err)
+	}
+	coordinatesRange, _ = inst.NewBinlogCoordinatesRange(inst.BinlogCoordinates{LogFile: "mysql-bin.999999", LogPos: 4}, inst.BinlogCoordinates{LogFile: "mysql-bin.1000000", LogPos: 600})
+	if _, err := coordinatesRange.Size(fileSize); err == nil {
+		t.Errorf("Expected error on position beyond end of file")
+	}
+	coordinatesRange, _ = inst.NewBinlogCoordinatesRange(inst.BinlogCoordinates{LogFile: "mysql-bin.999997", LogPos: 4}, inst.BinlogCoordinates{LogFile: "mysql-bin.999998", LogPos: 4})
+	if _, err := coordinatesRange.Size(fileSize); err == nil {
+		t.Errorf("Expected error on missing file")
+	}
+
+	invalid := [][2]inst.BinlogCoordinates{
+		{{LogFile: "mysql-bin.1000000", LogPos: 4}, {LogFile: "mysql-bin.999999", LogPos: 4}},
+		{{LogFile: "mysql-bin.000001", LogPos: 400}, {LogFile: "mysql-bin.000001", LogPos: 4}},
+		{{LogFile: "mysql-bin.000001", LogPos: 4}, {LogFile: "relay-bin.000002", LogPos: 4}},
+		{{LogFile: "mysql-bin.000001", LogPos: 4}, {LogFile: "mysql-bin.000002", LogPos: 4, Type: inst.RelayLog}},
+		{{LogFile: "mysql-bin.000001", LogPos: -4}, {LogFile: "mysql-bin.000002", LogPos: 4}},
+	}
+	for _, ends := range invalid {
+		if _, err := inst.NewBinlogCoordinatesRange(ends[0], ends[1]); err == nil {
+			t.Errorf("Expected error on range %s to %s", ends[0], ends[1])
+		}
+	}
+}
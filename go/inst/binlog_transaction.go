@@ -0,0 +1,92 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"strings"
+)
+
+// IsGroupless tells whether events of this type stand outside of transactions: they describe the log
+// rather than changes to data
+func (this BinlogEventType) IsGroupless() bool {
+	switch this {
+	case FormatDescriptionEventType, RotateEventType, StopEventType, PreviousGtidsEventType, HeartbeatEventType,
+		HeartbeatEventV2, MariaDBBinlogCheckpoint, MariaDBGtidListEventType, MariaDBStartEncryption:
+		return true
+	}
+	return false
+}
+
+// BinlogTransactionTracker follows event groups through a log: transactions, or statements standing
+// on their own (such as DDL), along with the GTID where there is one. Events must be read in full.
+type BinlogTransactionTracker struct {
+	GroupStart int64  // position of the first event of the current group
+	Gtid       string // GTID of the current group, if any
+	inGroup    bool
+	hasBegin   bool
+}
+
+// InGroup tells whether the last tracked event left a group open
+func (this *BinlogTransactionTracker) InGroup() bool {
+	return this.inGroup
+}
+
+// Track accounts for the next event of a log, and returns true when that event ends its group, i.e. when the
+// position following it is a transaction boundary
+func (this *BinlogTransactionTracker) Track(event *BinlogEvent) (groupEnd bool) {
+	if !this.inGroup {
+		this.GroupStart = event.Position
+		this.Gtid = ""
+		this.hasBegin = false
+	}
+	if event.EventType.IsGroupless() && !this.inGroup {
+		return false
+	}
+	this.inGroup = true
+	switch payload := event.Payload.(type) {
+	case *GtidEvent:
+		this.GroupStart = event.Position
+		this.Gtid = payload.Gtid()
+		this.hasBegin = false
+	case *MariaDBGtidEvent:
+		this.GroupStart = event.Position
+		this.Gtid = payload.MariaDBGtid.String()
+		// MariaDB's GTID event implies BEGIN, unless for a standalone statement
+		this.hasBegin = (payload.Flags&mariadbGtidStandaloneFlag == 0)
+	case *QueryEvent:
+		switch strings.ToUpper(strings.TrimSpace(payload.Query)) {
+		case "BEGIN":
+			this.hasBegin = true
+			return false
+		case "COMMIT", "ROLLBACK":
+			this.inGroup = false
+			return true
+		}
+		if !this.hasBegin {
+			this.inGroup = false
+			return true
+		}
+	case *XidEvent:
+		this.inGroup = false
+		return true
+	}
+	if event.EventType == XAPrepareEventType {
+		this.inGroup = false
+		return true
+	}
+	return false
+}
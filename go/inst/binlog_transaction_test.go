@@ -0,0 +1,71 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst_test
+
+import (
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+func TestBinlogTransactionTracker(t *testing.T) {
+	events := readAllBinlogEvents(t, testBinlog(false))
+	tracker := &inst.BinlogTransactionTracker{}
+	for i, event := range events {
+		groupEnd := tracker.Track(event)
+		if groupEnd != (event.EventType == inst.XidEventType) {
+			t.Errorf("Event %d (%s): unexpected group end %t", i, event.EventType, groupEnd)
+		}
+		if event.EventType == inst.XidEventType && (tracker.GroupStart != events[2].Position || tracker.Gtid != uuid1+":6") {
+			t.Errorf("Unexpected group: %+v", tracker)
+		}
+	}
+	if tracker.InGroup() {
+		t.Errorf("Expected no open group after rotate")
+	}
+}
+
+func TestBinlogTransactionTrackerStatements(t *testing.T) {
+	query := func(position int64, query string) *inst.BinlogEvent {
+		return &inst.BinlogEvent{
+			BinlogEventHeader: inst.BinlogEventHeader{EventType: inst.QueryEventType},
+			Position:          position,
+			Payload:           &inst.QueryEvent{Query: query},
+		}
+	}
+	intvar := &inst.BinlogEvent{BinlogEventHeader: inst.BinlogEventHeader{EventType: inst.IntvarEventType}, Position: 100}
+	mariadbGtid := &inst.BinlogEvent{
+		BinlogEventHeader: inst.BinlogEventHeader{EventType: inst.MariaDBGtidEventType},
+		Position:          300,
+		Payload:           &inst.MariaDBGtidEvent{MariaDBGtid: inst.MariaDBGtid{DomainId: 0, ServerId: 1, SequenceNumber: 7}},
+	}
+
+	tracker := &inst.BinlogTransactionTracker{}
+	if tracker.Track(intvar) || !tracker.Track(query(150, "insert into t values (null)")) || tracker.GroupStart != 100 {
+		t.Errorf("Expected statement group starting at intvar: %+v", tracker)
+	}
+	if !tracker.Track(query(200, "create table t2 (id int)")) || tracker.GroupStart != 200 {
+		t.Errorf("Expected standalone DDL group: %+v", tracker)
+	}
+	// MariaDB GTID implies BEGIN
+	if tracker.Track(mariadbGtid) || tracker.Track(query(350, "insert into t values (1)")) || !tracker.Track(query(400, "COMMIT")) {
+		t.Errorf("Expected MariaDB transaction to end at COMMIT: %+v", tracker)
+	}
+	if tracker.GroupStart != 300 || tracker.Gtid != "0-1-7" {
+		t.Errorf("Unexpected MariaDB group: %+v", tracker)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+var mariadbGtidPattern = regexp.MustCompile(`^(\d+)-(\d+)-(\d+)$`)
+
+type GtidFlavor int
+
+const (
+	UnknownGtidFlavor GtidFlavor = iota // an empty set, compatible with either flavor
+	MySQLGtidFlavor
+	MariaDBGtidFlavor
+)
+
+// GtidInterval is an inclusive range of transaction numbers of a single source UUID
+type GtidInterval struct {
+	Start int64
+	End   int64
+}
+
+// MariaDBGtid is a MariaDB GTID, in the form domain-server-sequence
+type MariaDBGtid struct {
+	DomainId       uint32
+	ServerId       uint32
+	SequenceNumber uint64
+}
+
+func (this MariaDBGtid) String() string {
+	return fmt.Sprintf("%d-%d-%d", this.DomainId, this.ServerId, this.SequenceNumber)
+}
+
+// GtidSet is either a MySQL GTID set (e.g. 3e11fa47-71ca-11e1-9e33-c80aa9429562:1-100:200) or a MariaDB
+// GTID position (e.g. 0-1-100,1-2-50), the latter being the last GTID per replication domain, implying
+// all preceding GTIDs of that domain. Sets are immutable; operations return new sets.
+type GtidSet struct {
+	Flavor    GtidFlavor
+	intervals map[string][]GtidInterval // MySQL: lowercase UUID -> sorted, non adjacent intervals
+	positions map[uint32]MariaDBGtid    // MariaDB: domain -> last GTID
+}
+
+// NewGtidSet returns an empty set
+func NewGtidSet() *GtidSet {
+	return &GtidSet{intervals: map[string][]GtidInterval{}, positions: map[uint32]MariaDBGtid{}}
+}
+
+// ParseGtidSet parses a MySQL GTID set or MariaDB GTID position, telling the two apart by format.
+// Whitespace, including the line breaks MySQL places between UUIDs, is ignored.
+func ParseGtidSet(gtidSet string) (*GtidSet, error) {
+	gtidSet = strings.Join(strings.Fields(gtidSet), "")
+	set := NewGtidSet()
+	if gtidSet == "" {
+		return set, nil
+	}
+	for _, token := range strings.Split(gtidSet, ",") {
+		if token == "" {
+			continue
+		}
+		if submatch := mariadbGtidPattern.FindStringSubmatch(token); submatch != nil {
+			if err := set.addMariaDBGtid(submatch); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := set.addMySQLGtids(token); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// setFlavor sets the flavor of a set being parsed, refusing mixed flavors
+func (this *GtidSet) setFlavor(flavor GtidFlavor) error {
+	if this.Flavor != UnknownGtidFlavor && this.Flavor != flavor {
+		return fmt.Errorf("Mixed MySQL and MariaDB GTIDs")
+	}
+	this.Flavor = flavor
+	return nil
+}
+
+func (this *GtidSet) addMariaDBGtid(submatch []string) error {
+	if err := this.setFlavor(MariaDBGtidFlavor); err != nil {
+		return err
+	}
+	domainId, err := strconv.ParseUint(submatch[1], 10, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid GTID domain: %s", submatch[0])
+	}
+	serverId, err := strconv.ParseUint(submatch[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid GTID server id: %s", submatch[0])
+	}
+	sequenceNumber, err := strconv.ParseUint(submatch[3], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid GTID sequence number: %s", submatch[0])
+	}
+	if _, exists := this.positions[uint32(domainId)]; exists {
+		return fmt.Errorf("Duplicate GTID domain %d", domainId)
+	}
+	this.positions[uint32(domainId)] = MariaDBGtid{DomainId: uint32(domainId), ServerId: uint32(serverId), SequenceNumber: sequenceNumber}
+	return nil
+}
+
+// addMySQLGtids adds a uuid:interval[:interval...] token
+func (this *GtidSet) addMySQLGtids(token string) error {
+	if err := this.setFlavor(MySQLGtidFlavor); err != nil {
+		return err
+	}
+	tokens := strings.Split(token, ":")
+	if len(tokens) < 2 || !uuidPattern.MatchString(tokens[0]) {
+		return fmt.Errorf("Invalid GTID set element: %s", token)
+	}
+	uuid := strings.ToLower(tokens[0])
+	intervals := this.intervals[uuid]
+	for _, intervalToken := range tokens[1:] {
+		interval, err := parseGtidInterval(intervalToken)
+		if err != nil {
+			return fmt.Errorf("Invalid GTID interval in %s: %s", token, intervalToken)
+		}
+		intervals = append(intervals, interval)
+	}
+	this.intervals[uuid] = normalizeGtidIntervals(intervals)
+	return nil
+}
+
+func parseGtidInterval(token string) (interval GtidInterval, err error) {
+	bounds := strings.SplitN(token, "-", 2)
+	if interval.Start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+		return interval, err
+	}
+	interval.End = interval.Start
+	if len(bounds) == 2 {
+		if interval.End, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+			return interval, err
+		}
+	}
+	if interval.Start < 1 || interval.End < interval.Start {
+		return interval, fmt.Errorf("Invalid interval %d-%d", interval.Start, interval.End)
+	}
+	return interval, nil
+}
+
+// normalizeGtidIntervals sorts intervals and merges overlapping or adjacent ones
+func normalizeGtidIntervals(intervals []GtidInterval) []GtidInterval {
+	sorted := append([]GtidInterval{}, intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	normalized := []GtidInterval{}
+	for _, interval := range sorted {
+		last := len(normalized) - 1
+		if last >= 0 && interval.Start <= normalized[last].End+1 {
+			if interval.End > normalized[last].End {
+				normalized[last].End = interval.End
+			}
+			continue
+		}
+		normalized = append(normalized, interval)
+	}
+	return normalized
+}
+
+// subtractGtidIntervals returns the parts of intervals not covered by others. Both are normalized.
+func subtractGtidIntervals(intervals []GtidInterval, others []GtidInterval) []GtidInterval {
+	result := []GtidInterval{}
+	for _, interval := range intervals {
+		remaining := []GtidInterval{interval}
+		for _, other := range others {
+			next := []GtidInterval{}
+			for _, r := range remaining {
+				if other.End < r.Start || other.Start > r.End {
+					next = append(next, r)
+					continue
+				}
+				if other.Start > r.Start {
+					next = append(next, GtidInterval{Start: r.Start, End: other.Start - 1})
+				}
+				if other.End < r.End {
+					next = append(next, GtidInterval{Start: other.End + 1, End: r.End})
+				}
+			}
+			remaining = next
+		}
+		result = append(result, remaining...)
+	}
+	return result
+}
+
+// compatibleFlavor returns the flavor of the result of an operation on both sets
+func (this *GtidSet) compatibleFlavor(other *GtidSet) (GtidFlavor, error) {
+	switch {
+	case this.Flavor == UnknownGtidFlavor:
+		return other.Flavor, nil
+	case other.Flavor == UnknownGtidFlavor || other.Flavor == this.Flavor:
+		return this.Flavor, nil
+	}
+	return UnknownGtidFlavor, fmt.Errorf("Cannot operate on MySQL and MariaDB GTID sets together")
+}
+
+// IsEmpty returns true when the set holds no GTIDs
+func (this *GtidSet) IsEmpty() bool {
+	return len(this.intervals) == 0 && len(this.positions) == 0
+}
+
+// Union returns the GTIDs in either set. For MariaDB, this is the most advanced position per domain.
+func (this *GtidSet) Union(other *GtidSet) (*GtidSet, error) {
+	flavor, err := this.compatibleFlavor(other)
+	if err != nil {
+		return nil, err
+	}
+	result := NewGtidSet()
+	result.Flavor = flavor
+	for _, set := range []*GtidSet{this, other} {
+		for uuid, intervals := range set.intervals {
+			result.intervals[uuid] = normalizeGtidIntervals(append(append([]GtidInterval{}, result.intervals[uuid]...), intervals...))
+		}
+		for domainId, gtid := range set.positions {
+			if existing, ok := result.positions[domainId]; !ok || gtid.SequenceNumber > existing.SequenceNumber {
+				result.positions[domainId] = gtid
+			}
+		}
+	}
+	return result, nil
+}
+
+// Subtract returns the GTIDs in this set which are not in the other. For MariaDB, these are the positions
+// of domains in which this set is ahead of the other.
+func (this *GtidSet) Subtract(other *GtidSet) (*GtidSet, error) {
+	flavor, err := this.compatibleFlavor(other)
+	if err != nil {
+		return nil, err
+	}
+	result := NewGtidSet()
+	result.Flavor = flavor
+	for uuid, intervals := range this.intervals {
+		if remaining := subtractGtidIntervals(intervals, other.intervals[uuid]); len(remaining) > 0 {
+			result.intervals[uuid] = remaining
+		}
+	}
+	for domainId, gtid := range this.positions {
+		if otherGtid, ok := other.positions[domainId]; !ok || gtid.SequenceNumber > otherGtid.SequenceNumber {
+			result.positions[domainId] = gtid
+		}
+	}
+	if result.IsEmpty() {
+		result.Flavor = UnknownGtidFlavor
+	}
+	return result, nil
+}
+
+// Contains returns true when all GTIDs in the other set are in this set
+func (this *GtidSet) Contains(other *GtidSet) bool {
+	difference, err := other.Subtract(this)
+	if err != nil {
+		return false
+	}
+	return difference.IsEmpty()
+}
+
+// Equals returns true when both sets hold the same GTIDs. MariaDB positions must also agree on server ids.
+func (this *GtidSet) Equals(other *GtidSet) bool {
+	if other == nil {
+		return false
+	}
+	return this.String() == other.String()
+}
+
+// String returns the canonical representation of the set: UUIDs (lowercase) or domains sorted, intervals
+// merged and sorted
+func (this *GtidSet) String() string {
+	tokens := []string{}
+	uuids := []string{}
+	for uuid := range this.intervals {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		token := uuid
+		for _, interval := range this.intervals[uuid] {
+			if interval.Start == interval.End {
+				token = fmt.Sprintf("%s:%d", token, interval.Start)
+			} else {
+				token = fmt.Sprintf("%s:%d-%d", token, interval.Start, interval.End)
+			}
+		}
+		tokens = append(tokens, token)
+	}
+
+	domainIds := []int{}
+	for domainId := range this.positions {
+		domainIds = append(domainIds, int(domainId))
+	}
+	sort.Ints(domainIds)
+	for _, domainId := range domainIds {
+		tokens = append(tokens, this.positions[uint32(domainId)].String())
+	}
+	return strings.Join(tokens, ",")
+}
+
+// MarshalJSON marshals the set in its canonical representation
+func (this *GtidSet) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(this.String())), nil
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+const uuid1 = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+const uuid2 = "4e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+func mustParseGtidSet(t *testing.T, gtidSet string) *inst.GtidSet {
+	set, err := inst.ParseGtidSet(gtidSet)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing %s: %s", gtidSet, err)
+	}
+	return set
+}
+
+func TestParseGtidSetCanonical(t *testing.T) {
+	tests := []struct {
+		gtidSet   string
+		canonical string
+		flavor    inst.GtidFlavor
+	}{
+		{"", "", inst.UnknownGtidFlavor},
+		{"  \n", "", inst.UnknownGtidFlavor},
+		{uuid1 + ":1-100", uuid1 + ":1-100", inst.MySQLGtidFlavor},
+		{uuid1 + ":5", uuid1 + ":5", inst.MySQLGtidFlavor},
+		{uuid1 + ":1-100:200", uuid1 + ":1-100:200", inst.MySQLGtidFlavor},
+		{uuid1 + ":200:1-100", uuid1 + ":1-100:200", inst.MySQLGtidFlavor},
+		{uuid1 + ":1-5:6-10", uuid1 + ":1-10", inst.MySQLGtidFlavor},
+		{uuid1 + ":1-5:3-8:20-30:25", uuid1 + ":1-8:20-30", inst.MySQLGtidFlavor},
+		{uuid1 + ":1-5:7", uuid1 + ":1-5:7", inst.MySQLGtidFlavor},
+		{"3E11FA47-71CA-11E1-9E33-C80AA9429562:1-3", uuid1 + ":1-3", inst.MySQLGtidFlavor},
+		{uuid2 + ":1-9,\n" + uuid1 + ":1-4", uuid1 + ":1-4," + uuid2 + ":1-9", inst.MySQLGtidFlavor},
+		{uuid1 + ":1-4," + uuid1 + ":5-9", uuid1 + ":1-9", inst.MySQLGtidFlavor},
+		{"0-1-100", "0-1-100", inst.MariaDBGtidFlavor},
+		{"1-2-50,0-1-100", "0-1-100,1-2-50", inst.MariaDBGtidFlavor},
+		{"0-1-100, 10-3-7", "0-1-100,10-3-7", inst.MariaDBGtidFlavor},
+	}
+	for _, test := range tests {
+		set := mustParseGtidSet(t, test.gtidSet)
+		if set.String() != test.canonical {
+			t.Errorf("Parsing %q: expected %q, got %q", test.gtidSet, test.canonical, set.String())
+		}
+		if set.Flavor != test.flavor {
+			t.Errorf("Parsing %q: expected flavor %d, got %d", test.gtidSet, test.flavor, set.Flavor)
+		}
+		if reparsed := mustParseGtidSet(t, set.String()); !reparsed.Equals(set) {
+			t.Errorf("Canonical form of %q does not round trip", test.gtidSet)
+		}
+	}
+}
+
+func TestParseGtidSetErrors(t *testing.T) {
+	invalid := []string{
+		"not-a-gtid",
+		uuid1,
+		uuid1 + ":",
+		uuid1 + ":0",
+		uuid1 + ":0-5",
+		uuid1 + ":10-5",
+		uuid1 + ":a-b",
+		uuid1 + ":1--5",
+		"3e11fa47-71ca-11e1-9e33:1-5",
+		"zzzzzzzz-71ca-11e1-9e33-c80aa9429562:1-5",
+		"0-1",
+		"0-1-100,0-2-200",
+		"0-1-100," + uuid1 + ":1-5",
+		"4294967296-1-100",
+	}
+	for _, gtidSet := range invalid {
+		if _, err := inst.ParseGtidSet(gtidSet); err == nil {
+			t.Errorf("Expected error parsing %q", gtidSet)
+		}
+	}
+}
+
+func TestGtidSetUnion(t *testing.T) {
+	tests := []struct {
+		a, b, union string
+	}{
+		{uuid1 + ":1-5", uuid1 + ":6-10", uuid1 + ":1-10"},
+		{uuid1 + ":1-5", uuid1 + ":3-8:20", uuid1 + ":1-8:20"},
+		{uuid1 + ":1-5", uuid2 + ":1-3", uuid1 + ":1-5," + uuid2 + ":1-3"},
+		{uuid1 + ":1-5", "", uuid1 + ":1-5"},
+		{"", uuid1 + ":1-5", uuid1 + ":1-5"},
+		{"", "", ""},
+		{"0-1-100,1-2-50", "0-3-120", "0-3-120,1-2-50"},
+		{"0-1-100", "0-3-90,2-1-5", "0-1-100,2-1-5"},
+	}
+	for _, test := range tests {
+		union, err := mustParseGtidSet(t, test.a).Union(mustParseGtidSet(t, test.b))
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+			continue
+		}
+		if union.String() != test.union {
+			t.Errorf("%q union %q: expected %q, got %q", test.a, test.b, test.union, union.String())
+		}
+	}
+	if _, err := mustParseGtidSet(t, uuid1+":1").Union(mustParseGtidSet(t, "0-1-1")); err == nil {
+		t.Errorf("Expected error on union of mixed flavors")
+	}
+}
+
+func TestGtidSetSubtract(t *testing.T) {
+	tests := []struct {
+		a, b, difference string
+	}{
+		{uuid1 + ":1-10", uuid1 + ":1-10", ""},
+		{uuid1 + ":1-10", uuid1 + ":1-5", uuid1 + ":6-10"},
+		{uuid1 + ":1-10", uuid1 + ":3-4:7", uuid1 + ":1-2:5-6:8-10"},
+		{uuid1 + ":1-10", uuid1 + ":5-20", uuid1 + ":1-4"},
+		{uuid1 + ":5-10", uuid1 + ":1-20", ""},
+		{uuid1 + ":1-10:20-30", uuid1 + ":8-25", uuid1 + ":1-7:26-30"},
+		{uuid1 + ":1-10," + uuid2 + ":1-3", uuid2 + ":1-3", uuid1 + ":1-10"},
+		{uuid1 + ":1-10", uuid2 + ":1-10", uuid1 + ":1-10"},
+		{uuid1 + ":1-10", "", uuid1 + ":1-10"},
+		{"", uuid1 + ":1-10", ""},
+		{"0-1-100,1-2-50", "0-1-100", "1-2-50"},
+		{"0-1-100,1-2-50", "0-1-90,1-2-60", "0-1-100"},
+		{"0-1-100", "0-1-100", ""},
+	}
+	for _, test := range tests {
+		difference, err := mustParseGtidSet(t, test.a).Subtract(mustParseGtidSet(t, test.b))
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+			continue
+		}
+		if difference.String() != test.difference {
+			t.Errorf("%q minus %q: expected %q, got %q", test.a, test.b, test.difference, difference.String())
+		}
+		if difference.IsEmpty() != (test.difference == "") {
+			t.Errorf("%q minus %q: unexpected IsEmpty() %t", test.a, test.b, difference.IsEmpty())
+		}
+	}
+	if _, err := mustParseGtidSet(t, "0-1-1").Subtract(mustParseGtidSet(t, uuid1+":1")); err == nil {
+		t.Errorf("Expected error on subtraction of mixed flavors")
+	}
+}
+
+func TestGtidSetContains(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		contains bool
+	}{
+		{uuid1 + ":1-10", uuid1 + ":1-10", true},
+		{uuid1 + ":1-10", uuid1 + ":3-5:7", true},
+		{uuid1 + ":1-10", uuid1 + ":3-11", false},
+		{uuid1 + ":1-10", uuid2 + ":1", false},
+		{uuid1 + ":1-10," + uuid2 + ":1-5", uuid2 + ":2", true},
+		{uuid1 + ":1-10", "", true},
+		{"", uuid1 + ":1", false},
+		{"", "", true},
+		{"0-1-100,1-2-50", "0-7-80", true},
+		{"0-1-100,1-2-50", "0-1-101", false},
+		{"0-1-100", "1-2-1", false},
+		{uuid1 + ":1-10", "0-1-1", false},
+	}
+	for _, test := range tests {
+		if contains := mustParseGtidSet(t, test.a).Contains(mustParseGtidSet(t, test.b)); contains != test.contains {
+			t.Errorf("%q contains %q: expected %t", test.a, test.b, test.contains)
+		}
+	}
+}
+
+func TestGtidSetEquals(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		equals bool
+	}{
+		{uuid1 + ":1-10", uuid1 + ":1-5:6-10", true},
+		{uuid1 + ":1-10," + uuid2 + ":1", uuid2 + ":1,\n" + uuid1 + ":1-10", true},
+		{uuid1 + ":1-10", uuid1 + ":1-9", false},
+		{uuid1 + ":1-10", uuid2 + ":1-10", false},
+		{"", "", true},
+		{"0-1-100,1-2-50", "1-2-50,0-1-100", true},
+		{"0-1-100", "0-2-100", false},
+	}
+	for _, test := range tests {
+		if equals := mustParseGtidSet(t, test.a).Equals(mustParseGtidSet(t, test.b)); equals != test.equals {
+			t.Errorf("%q equals %q: expected %t", test.a, test.b, test.equals)
+		}
+	}
+	if mustParseGtidSet(t, "").Equals(nil) {
+		t.Errorf("Expected set not to equal nil")
+	}
+}
+
+func TestGtidSetImmutable(t *testing.T) {
+	a := mustParseGtidSet(t, uuid1+":1-5")
+	b := mustParseGtidSet(t, uuid1+":3-10")
+	a.Union(b)
+	a.Subtract(b)
+	if a.String() != uuid1+":1-5" || b.String() != uuid1+":3-10" {
+		t.Errorf("Operands modified by operations: %s, %s", a, b)
+	}
+}
+
+func TestGtidSetMarshalJSON(t *testing.T) {
+	content, err := json.Marshal(mustParseGtidSet(t, uuid1+":1-5:3-8"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(content) != `"`+uuid1+`:1-8"` {
+		t.Errorf("Unexpected JSON: %s", content)
+	}
+}
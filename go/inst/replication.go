@@ -0,0 +1,130 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// ReplicationStatus is a parsed row of SHOW SLAVE STATUS/SHOW REPLICA STATUS, i.e. the status of a single
+// replication channel. MariaDB's SHOW ALL SLAVES STATUS names channels "connections".
+type ReplicationStatus struct {
+	ChannelName           string
+	MasterHost            string
+	MasterPort            int
+	MasterServerId        uint
+	MasterUUID            string
+	IOThreadState         string // Yes, No or Connecting
+	SQLThreadState        string
+	IOThreadRunning       bool
+	SQLThreadRunning      bool
+	IOState               string
+	SQLRunningState       string
+	LastIOErrno           int
+	LastIOError           string
+	LastSQLErrno          int
+	LastSQLError          string
+	ReadBinlogCoordinates BinlogCoordinates // master's binlog coordinates, up to which events were retrieved
+	ExecBinlogCoordinates BinlogCoordinates // master's binlog coordinates, up to which events were executed
+	RelayLogCoordinates   BinlogCoordinates // relay log coordinates, up to which events were executed
+	RetrievedGtidSet      string
+	ExecutedGtidSet       string
+	UsingGtid             bool
+	SecondsBehindMaster   sql.NullInt64
+	SQLDelay              int64
+}
+
+// IsRunning returns true when both IO and SQL threads are running
+func (this *ReplicationStatus) IsRunning() bool {
+	return this.IOThreadRunning && this.SQLThreadRunning
+}
+
+// replicationStatusRow looks up values by any of the given column names, as these were renamed
+// (e.g. Master_Host to Source_Host) in SHOW REPLICA STATUS
+type replicationStatusRow map[string]string
+
+func (this replicationStatusRow) get(names ...string) string {
+	for _, name := range names {
+		if value, ok := this[name]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func (this replicationStatusRow) getInt64(names ...string) int64 {
+	value, _ := strconv.ParseInt(this.get(names...), 10, 64)
+	return value
+}
+
+// normalizeGtidSet removes the line breaks MySQL places between a set's UUIDs
+func normalizeGtidSet(gtidSet string) string {
+	return strings.Replace(strings.Replace(gtidSet, "\n", "", -1), "\r", "", -1)
+}
+
+// NewReplicationStatus parses a SHOW SLAVE STATUS, SHOW REPLICA STATUS or SHOW ALL SLAVES STATUS row,
+// given as column name to value. NULL values are expected to be absent from the row.
+func NewReplicationStatus(row map[string]string) *ReplicationStatus {
+	r := replicationStatusRow(row)
+	status := &ReplicationStatus{
+		ChannelName:     r.get("Channel_Name", "Connection_name"),
+		MasterHost:      r.get("Source_Host", "Master_Host"),
+		MasterPort:      int(r.getInt64("Source_Port", "Master_Port")),
+		MasterServerId:  uint(r.getInt64("Source_Server_Id", "Master_Server_Id")),
+		MasterUUID:      r.get("Source_UUID", "Master_UUID"),
+		IOThreadState:   r.get("Replica_IO_Running", "Slave_IO_Running"),
+		SQLThreadState:  r.get("Replica_SQL_Running", "Slave_SQL_Running"),
+		IOState:         r.get("Replica_IO_State", "Slave_IO_State"),
+		SQLRunningState: r.get("Replica_SQL_Running_State", "Slave_SQL_Running_State"),
+		LastIOErrno:     int(r.getInt64("Last_IO_Errno")),
+		LastIOError:     r.get("Last_IO_Error"),
+		LastSQLErrno:    int(r.getInt64("Last_SQL_Errno")),
+		LastSQLError:    r.get("Last_SQL_Error"),
+		ReadBinlogCoordinates: BinlogCoordinates{
+			LogFile: r.get("Source_Log_File", "Master_Log_File"),
+			LogPos:  r.getInt64("Read_Source_Log_Pos", "Read_Master_Log_Pos"),
+			Type:    BinaryLog,
+		},
+		ExecBinlogCoordinates: BinlogCoordinates{
+			LogFile: r.get("Relay_Source_Log_File", "Relay_Master_Log_File"),
+			LogPos:  r.getInt64("Exec_Source_Log_Pos", "Exec_Master_Log_Pos"),
+			Type:    BinaryLog,
+		},
+		RelayLogCoordinates: BinlogCoordinates{
+			LogFile: r.get("Relay_Log_File"),
+			LogPos:  r.getInt64("Relay_Log_Pos"),
+			Type:    RelayLog,
+		},
+		RetrievedGtidSet: normalizeGtidSet(r.get("Retrieved_Gtid_Set", "Gtid_IO_Pos")),
+		ExecutedGtidSet:  normalizeGtidSet(r.get("Executed_Gtid_Set")),
+		SQLDelay:         r.getInt64("SQL_Delay"),
+	}
+	status.IOThreadRunning = (status.IOThreadState == "Yes")
+	status.SQLThreadRunning = (status.SQLThreadState == "Yes")
+
+	// MySQL: Auto_Position is 1 or 0; MariaDB: Using_Gtid is Slave_Pos, Current_Pos or No
+	usingGtid := r.get("Auto_Position", "Using_Gtid")
+	status.UsingGtid = (usingGtid != "" && usingGtid != "0" && usingGtid != "No")
+
+	// NULL (i.e. absent) when the SQL thread is not running, or the IO thread is not connected
+	if secondsBehindMaster, err := strconv.ParseInt(r.get("Seconds_Behind_Source", "Seconds_Behind_Master"), 10, 64); err == nil {
+		status.SecondsBehindMaster = sql.NullInt64{Int64: secondsBehindMaster, Valid: true}
+	}
+	return status
+}
@@ -0,0 +1,121 @@
+/*
+   Copyright 2015 Shlomi Noach, courtesy Booking.com
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst_test
+
+import (
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+func TestReplicationStatusSlaveStatus(t *testing.T) {
+	status := inst.NewReplicationStatus(map[string]string{
+		"Slave_IO_State":          "Waiting for master to send event",
+		"Master_Host":             "db-master",
+		"Master_Port":             "3306",
+		"Master_Log_File":         "mysql-bin.000123",
+		"Read_Master_Log_Pos":     "4567",
+		"Relay_Log_File":          "relay-bin.000045",
+		"Relay_Log_Pos":           "890",
+		"Relay_Master_Log_File":   "mysql-bin.000122",
+		"Slave_IO_Running":        "Yes",
+		"Slave_SQL_Running":       "No",
+		"Exec_Master_Log_Pos":     "1234",
+		"Last_SQL_Errno":          "1062",
+		"Last_SQL_Error":          "Duplicate entry",
+		"Master_Server_Id":        "101",
+		"Master_UUID":             "3e11fa47-71ca-11e1-9e33-c80aa9429562",
+		"Retrieved_Gtid_Set":      "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5",
+		"Executed_Gtid_Set":       "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-4,\n4e11fa47-71ca-11e1-9e33-c80aa9429562:1-9",
+		"Auto_Position":           "1",
+		"Channel_Name":            "east",
+		"Slave_SQL_Running_State": "",
+	})
+	if status.ChannelName != "east" || status.MasterHost != "db-master" || status.MasterPort != 3306 || status.MasterServerId != 101 {
+		t.Errorf("Unexpected master: %+v", status)
+	}
+	if !status.IOThreadRunning || status.SQLThreadRunning || status.IsRunning() {
+		t.Errorf("Unexpected thread states: %+v", status)
+	}
+	if status.LastSQLErrno != 1062 || status.LastSQLError != "Duplicate entry" {
+		t.Errorf("Unexpected SQL error: %+v", status)
+	}
+	if status.ReadBinlogCoordinates.DisplayString() != "mysql-bin.000123:4567" || status.ReadBinlogCoordinates.Type != inst.BinaryLog {
+		t.Errorf("Unexpected read coordinates: %+v", status.ReadBinlogCoordinates)
+	}
+	if status.ExecBinlogCoordinates.DisplayString() != "mysql-bin.000122:1234" {
+		t.Errorf("Unexpected exec coordinates: %+v", status.ExecBinlogCoordinates)
+	}
+	if status.RelayLogCoordinates.DisplayString() != "relay-bin.000045:890" || status.RelayLogCoordinates.Type != inst.RelayLog {
+		t.Errorf("Unexpected relay log coordinates: %+v", status.RelayLogCoordinates)
+	}
+	if status.ExecutedGtidSet != "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-4,4e11fa47-71ca-11e1-9e33-c80aa9429562:1-9" || !status.UsingGtid {
+		t.Errorf("Unexpected GTID status: %+v", status)
+	}
+	if status.SecondsBehindMaster.Valid {
+		t.Errorf("Expected NULL seconds behind master, got %+v", status.SecondsBehindMaster)
+	}
+}
+
+func TestReplicationStatusReplicaStatus(t *testing.T) {
+	status := inst.NewReplicationStatus(map[string]string{
+		"Source_Host":           "db-source",
+		"Source_Port":           "3307",
+		"Source_Log_File":       "binlog.000010",
+		"Read_Source_Log_Pos":   "200",
+		"Relay_Source_Log_File": "binlog.000010",
+		"Exec_Source_Log_Pos":   "150",
+		"Replica_IO_Running":    "Connecting",
+		"Replica_SQL_Running":   "Yes",
+		"Seconds_Behind_Source": "0",
+		"Auto_Position":         "0",
+		"SQL_Delay":             "3600",
+	})
+	if status.MasterHost != "db-source" || status.MasterPort != 3307 {
+		t.Errorf("Unexpected source: %+v", status)
+	}
+	if status.IOThreadRunning || status.IOThreadState != "Connecting" || !status.SQLThreadRunning {
+		t.Errorf("Unexpected thread states: %+v", status)
+	}
+	if status.ExecBinlogCoordinates.DisplayString() != "binlog.000010:150" {
+		t.Errorf("Unexpected exec coordinates: %+v", status.ExecBinlogCoordinates)
+	}
+	if !status.SecondsBehindMaster.Valid || status.SecondsBehindMaster.Int64 != 0 || status.SQLDelay != 3600 {
+		t.Errorf("Unexpected lag: %+v", status)
+	}
+	if status.UsingGtid {
+		t.Errorf("Expected no GTID auto positioning")
+	}
+}
+
+func TestReplicationStatusMariaDB(t *testing.T) {
+	status := inst.NewReplicationStatus(map[string]string{
+		"Connection_name":       "west",
+		"Master_Host":           "db-west",
+		"Slave_IO_Running":      "Yes",
+		"Slave_SQL_Running":     "Yes",
+		"Seconds_Behind_Master": "12",
+		"Using_Gtid":            "Slave_Pos",
+		"Gtid_IO_Pos":           "0-1-100,1-2-50",
+	})
+	if status.ChannelName != "west" || !status.IsRunning() || status.SecondsBehindMaster.Int64 != 12 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if !status.UsingGtid || status.RetrievedGtidSet != "0-1-100,1-2-50" {
+		t.Errorf("Unexpected GTID status: %+v", status)
+	}
+}
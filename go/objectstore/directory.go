@@ -0,0 +1,136 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package objectstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirectoryStore is an ObjectStore on a plain (local or NFS mounted) directory. Keys map onto file paths.
+type DirectoryStore struct {
+	Directory string
+}
+
+// NewDirectoryStore creates a store on given directory
+func NewDirectoryStore(directory string) (*DirectoryStore, error) {
+	if directory == "" {
+		return nil, errors.New("BackupStoreDirectory is unconfigured")
+	}
+	return &DirectoryStore{Directory: directory}, nil
+}
+
+func (this *DirectoryStore) Name() string {
+	return DirectoryObjectStore
+}
+
+// keyPath maps a key onto a file path, refusing keys which escape the directory
+func (this *DirectoryStore) keyPath(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("Empty object key")
+	}
+	keyPath := filepath.Join(this.Directory, filepath.FromSlash(key))
+	if !strings.HasPrefix(keyPath, filepath.Clean(this.Directory)+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid object key: %s", key)
+	}
+	return keyPath, nil
+}
+
+// Upload writes into a temporary file which is renamed upon success, such that partial uploads are never listed
+func (this *DirectoryStore) Upload(key string, reader io.Reader) (info ObjectInfo, err error) {
+	keyPath, err := this.keyPath(key)
+	if err != nil {
+		return info, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0755); err != nil {
+		return info, err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(keyPath), ".upload-")
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	size, err := io.Copy(tmpFile, reader)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return info, err
+	}
+	if err := os.Rename(tmpFile.Name(), keyPath); err != nil {
+		return info, err
+	}
+	fileInfo, err := os.Stat(keyPath)
+	if err != nil {
+		return info, err
+	}
+	return ObjectInfo{Key: key, Size: size, LastModified: fileInfo.ModTime()}, nil
+}
+
+func (this *DirectoryStore) Download(key string, writer io.Writer) error {
+	keyPath, err := this.keyPath(key)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(keyPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func (this *DirectoryStore) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.Walk(this.Directory, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".upload-") {
+			return nil
+		}
+		relativePath, err := filepath.Rel(this.Directory, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relativePath)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: fileInfo.Size(), LastModified: fileInfo.ModTime()})
+		}
+		return nil
+	})
+	sortObjects(objects)
+	return objects, err
+}
+
+func (this *DirectoryStore) Delete(key string) error {
+	keyPath, err := this.keyPath(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(keyPath)
+}
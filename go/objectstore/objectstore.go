@@ -0,0 +1,79 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package objectstore
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+)
+
+const (
+	S3ObjectStore        = "s3"
+	DirectoryObjectStore = "directory"
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ObjectStore is a backup target to which backups are streamed and from which they are pulled
+type ObjectStore interface {
+	// Name is the store's identifier, as used in the BackupStore config
+	Name() string
+	// Upload streams reader's content into given key, without knowing the size in advance
+	Upload(key string, reader io.Reader) (ObjectInfo, error)
+	// Download streams given key's content into writer
+	Download(key string, writer io.Writer) error
+	// List lists objects whose keys begin with prefix, sorted by key
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes an object
+	Delete(key string) error
+}
+
+// NewObjectStore returns the object store as configured by BackupStore
+func NewObjectStore() (ObjectStore, error) {
+	switch strings.ToLower(config.Config.BackupStore) {
+	case S3ObjectStore:
+		return NewS3Store(S3Config{
+			Endpoint:        config.Config.S3Endpoint,
+			Region:          config.Config.S3Region,
+			Bucket:          config.Config.S3Bucket,
+			AccessKeyId:     config.Config.S3AccessKeyId,
+			SecretAccessKey: config.Config.S3SecretAccessKey,
+			PartSize:        int64(config.Config.S3PartSizeMB) * 1024 * 1024,
+			Timeout:         time.Duration(config.Config.S3TimeoutSeconds) * time.Second,
+		})
+	case DirectoryObjectStore:
+		return NewDirectoryStore(config.Config.BackupStoreDirectory)
+	case "":
+		return nil, fmt.Errorf("BackupStore is unconfigured")
+	}
+	return nil, fmt.Errorf("Unknown BackupStore: %s", config.Config.BackupStore)
+}
+
+// sortObjects sorts objects by key
+func sortObjects(objects []ObjectInfo) {
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+}
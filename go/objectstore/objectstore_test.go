@@ -0,0 +1,263 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package objectstore_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/objectstore"
+)
+
+// s3StandIn is a minimal in-memory server for the subset of the S3 API used by S3Store
+type s3StandIn struct {
+	sync.Mutex
+	bucket    string
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	partSizes []int
+	// completeError, when set, fails multipart upload completion with an error despite a 200 OK status
+	completeError string
+}
+
+func newS3StandIn(bucket string) *s3StandIn {
+	return &s3StandIn{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (this *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.Lock()
+	defer this.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+this.bucket) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+this.bucket), "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case r.Method == "GET" && key == "":
+		fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+		for objectKey, content := range this.objects {
+			if strings.HasPrefix(objectKey, query.Get("prefix")) {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>", objectKey, len(content), time.Now().UTC().Format(time.RFC3339))
+			}
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == "POST" && query.Get("uploads") == "" && len(query["uploads"]) > 0:
+		uploadId := fmt.Sprintf("upload-%d", len(this.uploads)+1)
+		this.uploads[uploadId] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadId)
+	case r.Method == "PUT" && query.Get("uploadId") != "":
+		var partNumber int
+		fmt.Sscanf(query.Get("partNumber"), "%d", &partNumber)
+		this.uploads[query.Get("uploadId")][partNumber] = body
+		this.partSizes = append(this.partSizes, len(body))
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, partNumber))
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		completion := struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}{}
+		xml.Unmarshal(body, &completion)
+		if this.completeError != "" {
+			fmt.Fprintf(w, "<Error><Code>%s</Code><Message>completion failed</Message></Error>", this.completeError)
+			return
+		}
+		var content []byte
+		for _, part := range completion.Parts {
+			content = append(content, this.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		this.objects[key] = content
+		delete(this.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+	case r.Method == "DELETE" && query.Get("uploadId") != "":
+		delete(this.uploads, query.Get("uploadId"))
+	case r.Method == "PUT":
+		this.objects[key] = body
+	case r.Method == "GET":
+		content, ok := this.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	case r.Method == "DELETE":
+		delete(this.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testObjectStore(t *testing.T, store objectstore.ObjectStore, content []byte) {
+	info, err := store.Upload("backups/db1.tar.gz", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("expected size %d, got %d", len(content), info.Size)
+	}
+	if _, err := store.Upload("backups/db1.manifest.json", strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Upload("other/db2.tar.gz", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := store.List("backups/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if strings.Join(keys, ",") != "backups/db1.manifest.json,backups/db1.tar.gz" {
+		t.Errorf("unexpected listing: %+v", keys)
+	}
+
+	var downloaded bytes.Buffer
+	if err := store.Download("backups/db1.tar.gz", &downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Errorf("downloaded content differs from uploaded content")
+	}
+
+	if err := store.Delete("backups/db1.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Download("backups/db1.tar.gz", ioutil.Discard); err == nil {
+		t.Errorf("expected error downloading deleted object")
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	standIn := newS3StandIn("bucket")
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	store, err := objectstore.NewS3Store(objectstore.S3Config{Endpoint: server.URL, Bucket: "bucket", AccessKeyId: "key", SecretAccessKey: "secret", PartSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Just over two minimal parts, so as to go through a multipart upload
+	content := bytes.Repeat([]byte("0123456789abcdef"), 5*1024*1024*2/16+1)
+	testObjectStore(t, store, content)
+
+	sort.Ints(standIn.partSizes)
+	if len(standIn.partSizes) != 3 || standIn.partSizes[0] != 16 || standIn.partSizes[2] != 5*1024*1024 {
+		t.Errorf("unexpected multipart upload part sizes: %+v", standIn.partSizes)
+	}
+	if len(standIn.uploads) != 0 {
+		t.Errorf("expected no pending multipart uploads, found %d", len(standIn.uploads))
+	}
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	server := httptest.NewServer(newS3StandIn("bucket"))
+	defer server.Close()
+
+	store, err := objectstore.NewS3Store(objectstore.S3Config{Endpoint: server.URL, Bucket: "nosuchbucket", AccessKeyId: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Upload("key", strings.NewReader("content")); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected 404 error, got %+v", err)
+	}
+	if _, err := objectstore.NewS3Store(objectstore.S3Config{Endpoint: server.URL}); err == nil {
+		t.Errorf("expected error on missing bucket")
+	}
+}
+
+func TestS3StoreMultipartErrors(t *testing.T) {
+	standIn := newS3StandIn("bucket")
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	store, err := objectstore.NewS3Store(objectstore.S3Config{Endpoint: server.URL, Bucket: "bucket", AccessKeyId: "key", SecretAccessKey: "secret", PartSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 5*1024*1024*2/16+1)
+
+	standIn.completeError = "InternalError"
+	if _, err := store.Upload("backups/db1.tar.gz", bytes.NewReader(content)); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Errorf("expected completion error, got %+v", err)
+	}
+	standIn.completeError = ""
+
+	defer objectstore.SetMaxS3Parts(2)()
+	if _, err := store.Upload("backups/db1.tar.gz", bytes.NewReader(content)); err == nil || !strings.Contains(err.Error(), "exceeds 2 parts") {
+		t.Errorf("expected error exceeding the parts limit, got %+v", err)
+	}
+	if len(standIn.uploads) != 0 || len(standIn.objects) != 0 {
+		t.Errorf("expected failed uploads to be aborted, found %d pending uploads and %d objects", len(standIn.uploads), len(standIn.objects))
+	}
+}
+
+func TestS3StoreTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	store, err := objectstore.NewS3Store(objectstore.S3Config{Endpoint: server.URL, Bucket: "bucket", AccessKeyId: "key", Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := store.Delete("key"); err == nil {
+		t.Errorf("expected error on stalled endpoint")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected request on stalled endpoint to time out, took %s", elapsed)
+	}
+}
+
+func TestDirectoryStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "objectstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := objectstore.NewDirectoryStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testObjectStore(t, store, []byte("archive content"))
+
+	if _, err := store.Upload("../escape", strings.NewReader("")); err == nil {
+		t.Errorf("expected error on key escaping the directory")
+	}
+}
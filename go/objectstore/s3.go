@@ -0,0 +1,354 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package objectstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const minS3PartSize = 5 * 1024 * 1024
+const defaultS3Timeout = time.Minute
+
+// maxS3Parts is the S3 limit on parts in a multipart upload, making for an upload size ceiling of
+// 10,000 times the part size
+var maxS3Parts = 10000
+
+// S3Config is the connection configuration of an S3 compatible store
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com, or a compatible server's URL
+	Region          string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	PartSize        int64         // multipart upload part size; also the memory buffered per upload
+	Timeout         time.Duration // connect, TLS handshake and response header timeout; a stalled endpoint fails requests rather than hang them
+}
+
+// S3Store is an ObjectStore on an S3 compatible API. Requests are path-style and signed with AWS signature version 4.
+type S3Store struct {
+	S3Config
+	client *http.Client
+}
+
+// NewS3Store creates a store on given bucket
+func NewS3Store(s3Config S3Config) (*S3Store, error) {
+	if s3Config.Endpoint == "" || s3Config.Bucket == "" {
+		return nil, errors.New("S3Endpoint and S3Bucket must be configured")
+	}
+	if _, err := url.Parse(s3Config.Endpoint); err != nil {
+		return nil, err
+	}
+	if s3Config.Region == "" {
+		s3Config.Region = "us-east-1"
+	}
+	if s3Config.PartSize < minS3PartSize {
+		s3Config.PartSize = minS3PartSize
+	}
+	if s3Config.Timeout <= 0 {
+		s3Config.Timeout = defaultS3Timeout
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: s3Config.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   s3Config.Timeout,
+		ResponseHeaderTimeout: s3Config.Timeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &S3Store{S3Config: s3Config, client: &http.Client{Transport: transport}}, nil
+}
+
+func (this *S3Store) Name() string {
+	return S3ObjectStore
+}
+
+// objectURL returns the path-style URL of given key (or of the bucket, for an empty key)
+func (this *S3Store) objectURL(key string, query url.Values) string {
+	objectPath := "/" + this.Bucket
+	if key != "" {
+		objectPath += "/" + key
+	}
+	u := strings.TrimSuffix(this.Endpoint, "/") + uriEncode(objectPath, false)
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	return u
+}
+
+// do signs and sends a request, returning the response on 2xx statuses and an error otherwise
+func (this *S3Store) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, this.objectURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256.Sum256(body)
+	this.sign(request, hex.EncodeToString(payloadHash[:]), time.Now().UTC())
+
+	response, err := this.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, request.URL.Path, response.Status, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// sign adds AWS signature version 4 headers onto a request
+func (this *S3Store) sign(request *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", request.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, this.Region)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+this.SecretAccessKey), date)
+	for _, part := range []string{this.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", this.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode encodes per the AWS rules: everything but unreserved characters (and, in paths, slashes)
+func uriEncode(s string, encodeSlash bool) string {
+	var buffer bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~':
+			buffer.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buffer.WriteByte(b)
+		default:
+			fmt.Fprintf(&buffer, "%%%02X", b)
+		}
+	}
+	return buffer.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tokens := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			tokens = append(tokens, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(tokens, "&")
+}
+
+type initiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// completeMultipartUploadResult is either a CompleteMultipartUploadResult or, as the request may still fail after
+// a 200 OK status, an Error
+type completeMultipartUploadResult struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// Upload streams the reader in parts of PartSize. Content fitting in a single part is sent by a plain PUT;
+// anything larger goes through a multipart upload, which is aborted on failure. Uploads are limited to maxS3Parts parts.
+func (this *S3Store) Upload(key string, reader io.Reader) (info ObjectInfo, err error) {
+	info.Key = key
+	part := make([]byte, this.PartSize)
+	n, err := io.ReadFull(reader, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		response, err := this.do("PUT", key, nil, part[:n])
+		if err != nil {
+			return info, err
+		}
+		response.Body.Close()
+		info.Size = int64(n)
+		info.LastModified = time.Now()
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+
+	response, err := this.do("POST", key, url.Values{"uploads": {""}}, []byte{})
+	if err != nil {
+		return info, err
+	}
+	initiateResult := initiateMultipartUploadResult{}
+	err = xml.NewDecoder(response.Body).Decode(&initiateResult)
+	response.Body.Close()
+	if err != nil {
+		return info, err
+	}
+	uploadId := initiateResult.UploadId
+	abort := func(err error) (ObjectInfo, error) {
+		if response, abortErr := this.do("DELETE", key, url.Values{"uploadId": {uploadId}}, nil); abortErr == nil {
+			response.Body.Close()
+		}
+		return info, err
+	}
+
+	completion := completeMultipartUpload{}
+	for partNumber := 1; n > 0; partNumber++ {
+		if partNumber > maxS3Parts {
+			return abort(fmt.Errorf("S3 upload of %s exceeds %d parts of %d bytes; increase S3PartSizeMB", key, maxS3Parts, this.PartSize))
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadId}}
+		response, err := this.do("PUT", key, query, part[:n])
+		if err != nil {
+			return abort(err)
+		}
+		response.Body.Close()
+		completion.Parts = append(completion.Parts, completedPart{PartNumber: partNumber, ETag: response.Header.Get("ETag")})
+		info.Size += int64(n)
+
+		n, err = io.ReadFull(reader, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+	}
+
+	body, err := xml.Marshal(completion)
+	if err != nil {
+		return abort(err)
+	}
+	response, err = this.do("POST", key, url.Values{"uploadId": {uploadId}}, body)
+	if err != nil {
+		return abort(err)
+	}
+	completeResult := completeMultipartUploadResult{}
+	err = xml.NewDecoder(response.Body).Decode(&completeResult)
+	response.Body.Close()
+	if err != nil {
+		return abort(err)
+	}
+	if completeResult.XMLName.Local == "Error" {
+		return abort(fmt.Errorf("S3 upload of %s: %s: %s", key, completeResult.Code, completeResult.Message))
+	}
+	info.LastModified = time.Now()
+	return info, nil
+}
+
+func (this *S3Store) Download(key string, writer io.Writer) error {
+	response, err := this.do("GET", key, nil, []byte{})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(writer, response.Body)
+	return err
+}
+
+func (this *S3Store) List(prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		response, err := this.do("GET", "", query, []byte{})
+		if err != nil {
+			return objects, err
+		}
+		result := listBucketResult{}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return objects, err
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, ObjectInfo{Key: content.Key, Size: content.Size, LastModified: content.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+	sortObjects(objects)
+	return objects, nil
+}
+
+func (this *S3Store) Delete(key string) error {
+	response, err := this.do("DELETE", key, nil, []byte{})
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
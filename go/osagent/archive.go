@@ -0,0 +1,244 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/outbrain/golib/log"
+)
+
+const archiveFileSuffix = ".tar.gz"
+const archiveManifestSuffix = ".manifest.json"
+
+// ArchiveManifest describes an archive of a snapshot's MySQL data, and is stored alongside the archive
+type ArchiveManifest struct {
+	Name       string
+	FileName   string
+	Hostname   string
+	SourcePath string
+	Volume     string
+	Created    time.Time
+	Size       int64
+	SHA256     string
+}
+
+// archivePaths returns the archive file and manifest file for given archive name
+func archivePaths(archiveName string) (archiveFile string, manifestFile string, err error) {
+	if config.Config.BackupDirectory == "" {
+		return "", "", errors.New("BackupDirectory is unconfigured")
+	}
+	if archiveName == "" || strings.Contains(archiveName, "/") || strings.HasPrefix(archiveName, ".") {
+		return "", "", fmt.Errorf("Invalid archive name: %s", archiveName)
+	}
+	archiveFile = path.Join(config.Config.BackupDirectory, archiveName+archiveFileSuffix)
+	manifestFile = path.Join(config.Config.BackupDirectory, archiveName+archiveManifestSuffix)
+	return archiveFile, manifestFile, nil
+}
+
+// ReadArchiveManifest reads the manifest of given archive
+func ReadArchiveManifest(archiveName string) (manifest ArchiveManifest, err error) {
+	_, manifestFile, err := archivePaths(archiveName)
+	if err != nil {
+		return manifest, err
+	}
+	content, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return manifest, log.Errore(err)
+	}
+	err = json.Unmarshal(content, &manifest)
+	return manifest, err
+}
+
+// Archives lists the archives found in the backup directory
+func Archives() ([]ArchiveManifest, error) {
+	manifests := []ArchiveManifest{}
+	if config.Config.BackupDirectory == "" {
+		return manifests, errors.New("BackupDirectory is unconfigured")
+	}
+	fileInfos, err := ioutil.ReadDir(config.Config.BackupDirectory)
+	if err != nil {
+		return manifests, log.Errore(err)
+	}
+	for _, fileInfo := range fileInfos {
+		if !strings.HasSuffix(fileInfo.Name(), archiveManifestSuffix) {
+			continue
+		}
+		manifest, err := ReadArchiveManifest(strings.TrimSuffix(fileInfo.Name(), archiveManifestSuffix))
+		if err != nil {
+			log.Errore(err)
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Created.Before(manifests[j].Created) })
+	return manifests, nil
+}
+
+// ExportSnapshot archives the MySQL data path of the snapshot mounted on given target into the backup
+// directory, along with a manifest holding its checksum. Having validated the request, it runs in the
+// background as a job identified by jobId, the status of which is tracked the same as seeds'. The job
+// completes once the manifest is written; an archive lacking its manifest is removed. The mount is leased
+// while exporting.
+func ExportSnapshot(target string, archiveName string, jobId string) error {
+	archiveFile, manifestFile, err := archivePaths(archiveName)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if _, err := os.Stat(archiveFile); err == nil {
+		return log.Errorf("Archive already exists: %s", archiveFile)
+	}
+	mount, err := GetSnapshotMount(target)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if !mount.IsMounted || mount.MySQLDataPath == "" {
+		return log.Errorf("No MySQL data found on %s", mount.Path)
+	}
+
+	beginJobPhase(jobId)
+	go func() {
+		err := WithLease(mount.Path, fmt.Sprintf("export:%s", jobId), func() error {
+			return exportSnapshot(mount, archiveName, archiveFile, manifestFile, jobId)
+		})
+		if err != nil {
+			os.Remove(archiveFile)
+			os.Remove(manifestFile)
+		}
+		endJobPhase(jobId, err)
+	}()
+	return nil
+}
+
+// exportSnapshot archives a mount's MySQL data path and writes the archive's manifest
+func exportSnapshot(mount Mount, archiveName string, archiveFile string, manifestFile string, jobId string) error {
+	checksumFile := archiveFile + ".sha256"
+	defer os.Remove(checksumFile)
+	cmd := fmt.Sprintf("set -o pipefail; %s | gzip > %s.tmp && mv %s.tmp %s && sha256sum %s | cut -d ' ' -f 1 > %s",
+		sudoCmd(fmt.Sprintf("tar -C %s -cf - .", mount.MySQLDataPath)), archiveFile, archiveFile, archiveFile, archiveFile, checksumFile,
+	)
+	err := commandRun(cmd, func(cmd *exec.Cmd) {
+		setActiveCommand(jobId, cmd)
+	})
+	if err != nil {
+		os.Remove(archiveFile + ".tmp")
+		return log.Errore(err)
+	}
+
+	checksum, err := ioutil.ReadFile(checksumFile)
+	if err != nil {
+		return log.Errore(err)
+	}
+	fileInfo, err := os.Stat(archiveFile)
+	if err != nil {
+		return log.Errore(err)
+	}
+	hostname, _ := os.Hostname()
+	manifest := ArchiveManifest{
+		Name:       archiveName,
+		FileName:   path.Base(archiveFile),
+		Hostname:   hostname,
+		SourcePath: mount.MySQLDataPath,
+		Volume:     mount.LVPath,
+		Created:    time.Now(),
+		Size:       fileInfo.Size(),
+		SHA256:     strings.TrimSpace(string(checksum)),
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return log.Errore(err)
+	}
+	if err := ioutil.WriteFile(manifestFile, content, 0644); err != nil {
+		return log.Errore(err)
+	}
+	log.Infof("Exported %s into %s", mount.MySQLDataPath, archiveFile)
+	return nil
+}
+
+// VerifyArchive validates an archive's checksum against its manifest
+func VerifyArchive(archiveName string) error {
+	archiveFile, _, err := archivePaths(archiveName)
+	if err != nil {
+		return err
+	}
+	manifest, err := ReadArchiveManifest(archiveName)
+	if err != nil {
+		return err
+	}
+	output, err := commandOutput(fmt.Sprintf("sha256sum %s | cut -d ' ' -f 1", archiveFile))
+	if err != nil {
+		return err
+	}
+	if checksum := strings.TrimSpace(string(output)); checksum != manifest.SHA256 {
+		return fmt.Errorf("Checksum mismatch on %s: expected %s, found %s", archiveFile, manifest.SHA256, checksum)
+	}
+	return nil
+}
+
+// ImportArchive verifies an archive and extracts it into the MySQL data directory. MySQL must be stopped;
+// clearing the data directory beforehand is up to the caller, as with seeds. Having validated the request,
+// extraction runs in the background as a job identified by jobId.
+func ImportArchive(archiveName string, jobId string) error {
+	archiveFile, _, err := archivePaths(archiveName)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if running, err := MySQLRunning(); err != nil {
+		return log.Errore(err)
+	} else if running {
+		return log.Errorf("MySQL is running; refusing to import archive %s", archiveName)
+	}
+	directory, err := GetMySQLDataDir()
+	if err != nil {
+		return log.Errore(err)
+	}
+	if directory == "" {
+		return log.Errorf("Empty MySQL data directory")
+	}
+	manifest, err := ReadArchiveManifest(archiveName)
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	beginJobPhase(jobId)
+	go func() {
+		// The checksum is verified as part of the job, as it takes a while on large archives
+		cmd := fmt.Sprintf("set -o pipefail; echo '%s  %s' | sha256sum -c - && gzip -dc %s | %s",
+			manifest.SHA256, archiveFile, archiveFile, sudoCmd(fmt.Sprintf("tar -C %s -xf -", directory)),
+		)
+		err := commandRun(cmd, func(cmd *exec.Cmd) {
+			setActiveCommand(jobId, cmd)
+		})
+		endJobPhase(jobId, err)
+		if err != nil {
+			log.Errore(err)
+			return
+		}
+		log.Infof("Imported %s into %s", archiveFile, directory)
+	}()
+	return nil
+}
@@ -0,0 +1,87 @@
+package osagent_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+func waitForJob(t *testing.T, jobId string) bool {
+	for i := 0; i < 100; i++ {
+		if osagent.SeedCommandCompleted(jobId) {
+			return osagent.SeedCommandSucceeded(jobId)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for job %s", jobId)
+	return false
+}
+
+func TestExportAndImportArchive(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	// The snapshot holds the datadir at the same path as the live server
+	datadir := path.Join(directory, "datadir")
+	mountPoint := path.Join(directory, "snapshot")
+	os.MkdirAll(path.Join(mountPoint, datadir), 0755)
+	ioutil.WriteFile(path.Join(mountPoint, datadir, "ibdata1"), []byte("ibdata"), 0644)
+	os.MkdirAll(datadir, 0755)
+	backupDirectory := path.Join(directory, "backups")
+	os.MkdirAll(backupDirectory, 0755)
+
+	defer useMountInfo(t, fmt.Sprintf("22 1 253:0 / / rw - xfs /dev/mapper/vg0-root rw\n65 22 253:8 / %s rw - xfs /dev/vg0/snap rw\n", mountPoint))()
+	config.Config.SnapshotMountPoint = mountPoint
+	config.Config.BackupDirectory = backupDirectory
+	config.Config.MySQLDatadirCommand = "echo " + datadir
+	config.Config.MySQLServiceStatusCommand = "false"
+	defer func() {
+		config.Config.BackupDirectory = ""
+		config.Config.MySQLServiceStatusCommand = ""
+	}()
+
+	if err := osagent.ExportSnapshot("", "a", "export-a"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !waitForJob(t, "export-a") {
+		t.Fatalf("Expected export to succeed")
+	}
+	// The manifest is written by the time the job completes
+	manifest, err := osagent.ReadArchiveManifest("a")
+	if err != nil || manifest.SHA256 == "" || manifest.SourcePath != path.Join(mountPoint, datadir) {
+		t.Errorf("Unexpected manifest: %+v, %+v", manifest, err)
+	}
+	if err := osagent.VerifyArchive("a"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := osagent.ExportSnapshot("", "a", "export-a-again"); err == nil {
+		t.Errorf("Expected error exporting an existing archive")
+	}
+
+	if err := osagent.ImportArchive("a", "import-a"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !waitForJob(t, "import-a") {
+		t.Fatalf("Expected import to succeed")
+	}
+	if contents, err := ioutil.ReadFile(path.Join(datadir, "ibdata1")); err != nil || string(contents) != "ibdata" {
+		t.Errorf("Unexpected imported contents: %s, %+v", contents, err)
+	}
+
+	// A manifest which cannot be written fails the job, leaving no archive behind
+	os.Mkdir(path.Join(backupDirectory, "b.manifest.json"), 0755)
+	if err := osagent.ExportSnapshot("", "b", "export-b"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if waitForJob(t, "export-b") {
+		t.Errorf("Expected export to fail")
+	}
+	if _, err := os.Stat(path.Join(backupDirectory, "b.tar.gz")); !os.IsNotExist(err) {
+		t.Errorf("Expected archive to be removed, got %+v", err)
+	}
+}
@@ -0,0 +1,389 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/objectstore"
+	"github.com/outbrain/golib/log"
+)
+
+// Backups in the backup store take the same form as archives in the backup directory: a compressed
+// tarball plus a manifest, the presence of which marks the backup as complete.
+
+// backupKeys returns the data and manifest keys of given backup
+func backupKeys(backupName string) (dataKey string, manifestKey string, err error) {
+	if backupName == "" || strings.Contains(backupName, "/") || strings.HasPrefix(backupName, ".") {
+		return "", "", fmt.Errorf("Invalid backup name: %s", backupName)
+	}
+	dataKey = config.Config.BackupStorePrefix + backupName + archiveFileSuffix
+	manifestKey = config.Config.BackupStorePrefix + backupName + archiveManifestSuffix
+	return dataKey, manifestKey, nil
+}
+
+// readBackupManifest reads a manifest from the backup store
+func readBackupManifest(store objectstore.ObjectStore, manifestKey string) (manifest ArchiveManifest, err error) {
+	var content bytes.Buffer
+	if err := store.Download(manifestKey, &content); err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(content.Bytes(), &manifest)
+	return manifest, err
+}
+
+// ReadBackupManifest reads the manifest of given backup
+func ReadBackupManifest(backupName string) (manifest ArchiveManifest, err error) {
+	_, manifestKey, err := backupKeys(backupName)
+	if err != nil {
+		return manifest, err
+	}
+	store, err := objectstore.NewObjectStore()
+	if err != nil {
+		return manifest, err
+	}
+	return readBackupManifest(store, manifestKey)
+}
+
+// Backups lists the complete backups in the backup store, oldest first
+func Backups() ([]ArchiveManifest, error) {
+	manifests := []ArchiveManifest{}
+	store, err := objectstore.NewObjectStore()
+	if err != nil {
+		return manifests, err
+	}
+	objects, err := store.List(config.Config.BackupStorePrefix)
+	if err != nil {
+		return manifests, log.Errore(err)
+	}
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, archiveManifestSuffix) {
+			continue
+		}
+		manifest, err := readBackupManifest(store, object.Key)
+		if err != nil {
+			log.Errore(err)
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].Created.Before(manifests[j].Created) })
+	return manifests, nil
+}
+
+// newBackupUpload validates a new backup's name and returns the store to which it is to be uploaded
+func newBackupUpload(backupName string) (store objectstore.ObjectStore, dataKey string, manifestKey string, err error) {
+	if dataKey, manifestKey, err = backupKeys(backupName); err != nil {
+		return nil, "", "", err
+	}
+	if store, err = objectstore.NewObjectStore(); err != nil {
+		return nil, "", "", err
+	}
+	existing, err := store.List(manifestKey)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(existing) > 0 {
+		return nil, "", "", fmt.Errorf("Backup already exists: %s", backupName)
+	}
+	return store, dataKey, manifestKey, nil
+}
+
+// completeBackupUpload writes a backup's manifest, which marks it as complete, then applies retention
+func completeBackupUpload(store objectstore.ObjectStore, manifestKey string, manifest ArchiveManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := store.Upload(manifestKey, bytes.NewReader(content)); err != nil {
+		return err
+	}
+	log.Infof("Backup %s pushed to %s store", manifest.Name, store.Name())
+	if _, err := ApplyBackupRetention(); err != nil {
+		log.Errore(err)
+	}
+	return nil
+}
+
+// BackupSnapshot streams the MySQL data path of the snapshot mounted on given target into the backup store,
+// without staging it locally. Having validated the request, it runs in the background as a job identified by
+// jobId, the status of which is tracked the same as seeds'. The mount is leased while backing up.
+func BackupSnapshot(target string, backupName string, jobId string) error {
+	store, dataKey, manifestKey, err := newBackupUpload(backupName)
+	if err != nil {
+		return log.Errore(err)
+	}
+	mount, err := GetSnapshotMount(target)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if !mount.IsMounted || mount.MySQLDataPath == "" {
+		return log.Errorf("No MySQL data found on %s", mount.Path)
+	}
+
+	beginJobPhase(jobId)
+	go func() {
+		err := WithLease(mount.Path, fmt.Sprintf("backup:%s", jobId), func() error {
+			cmd, tmpFileName, err := execCmd(fmt.Sprintf("set -o pipefail; %s | gzip", sudoCmd(fmt.Sprintf("tar -C %s -cf - .", mount.MySQLDataPath))))
+			if err != nil {
+				return err
+			}
+			defer os.Remove(tmpFileName)
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				return err
+			}
+			setActiveCommand(jobId, cmd)
+			if err := cmd.Start(); err != nil {
+				return err
+			}
+
+			hash := sha256.New()
+			info, uploadErr := store.Upload(dataKey, io.TeeReader(stdout, hash))
+			if uploadErr != nil {
+				cmd.Process.Kill()
+			}
+			if err := cmd.Wait(); err != nil || uploadErr != nil {
+				// A killed (e.g. aborted) command makes for a truncated, yet successful, upload
+				store.Delete(dataKey)
+				if uploadErr != nil {
+					return uploadErr
+				}
+				return err
+			}
+
+			hostname, _ := os.Hostname()
+			return completeBackupUpload(store, manifestKey, ArchiveManifest{
+				Name:       backupName,
+				FileName:   path.Base(dataKey),
+				Hostname:   hostname,
+				SourcePath: mount.MySQLDataPath,
+				Volume:     mount.LVPath,
+				Created:    time.Now(),
+				Size:       info.Size,
+				SHA256:     hex.EncodeToString(hash.Sum(nil)),
+			})
+		})
+		endJobPhase(jobId, log.Errore(err))
+	}()
+	return nil
+}
+
+// PushArchive uploads an archive from the backup directory into the backup store, verifying its checksum on
+// the way. It runs in the background as a job identified by jobId.
+func PushArchive(archiveName string, jobId string) error {
+	archiveFile, _, err := archivePaths(archiveName)
+	if err != nil {
+		return log.Errore(err)
+	}
+	manifest, err := ReadArchiveManifest(archiveName)
+	if err != nil {
+		return log.Errore(err)
+	}
+	store, dataKey, manifestKey, err := newBackupUpload(archiveName)
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	beginJobPhase(jobId)
+	go func() {
+		err := func() error {
+			file, err := os.Open(archiveFile)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			hash := sha256.New()
+			if _, err := store.Upload(dataKey, io.TeeReader(file, hash)); err != nil {
+				return err
+			}
+			if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != manifest.SHA256 {
+				store.Delete(dataKey)
+				return fmt.Errorf("Checksum mismatch on %s: expected %s, found %s", archiveFile, manifest.SHA256, checksum)
+			}
+			return completeBackupUpload(store, manifestKey, manifest)
+		}()
+		endJobPhase(jobId, log.Errore(err))
+	}()
+	return nil
+}
+
+// verifyBackupContent streams a backup's data through writer, and validates it against the manifest
+func verifyBackupContent(store objectstore.ObjectStore, dataKey string, manifest ArchiveManifest, writer io.Writer) error {
+	hash := sha256.New()
+	counter := &countingWriter{}
+	err := store.Download(dataKey, io.MultiWriter(writer, hash, counter))
+	if err != nil {
+		return err
+	}
+	if counter.count != manifest.Size {
+		return fmt.Errorf("Size mismatch on backup %s: expected %d, found %d", manifest.Name, manifest.Size, counter.count)
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != manifest.SHA256 {
+		return fmt.Errorf("Checksum mismatch on backup %s: expected %s, found %s", manifest.Name, manifest.SHA256, checksum)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	count int64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	this.count += int64(len(p))
+	return len(p), nil
+}
+
+// VerifyBackup downloads a backup and validates its size and checksum against its manifest
+func VerifyBackup(backupName string) error {
+	dataKey, manifestKey, err := backupKeys(backupName)
+	if err != nil {
+		return err
+	}
+	store, err := objectstore.NewObjectStore()
+	if err != nil {
+		return err
+	}
+	manifest, err := readBackupManifest(store, manifestKey)
+	if err != nil {
+		return err
+	}
+	return verifyBackupContent(store, dataKey, manifest, ioutil.Discard)
+}
+
+// RestoreBackup is a seed source alternative to SendMySQLSeedData: it streams a backup from the backup store
+// into the MySQL data directory. MySQL must be stopped; clearing the data directory beforehand is up to the
+// caller, as with seeds. Having validated the request, it runs in the background as a job identified by seedId.
+// The checksum is validated as data streams in; a mismatch fails the job, and the data directory must then
+// be discarded.
+func RestoreBackup(backupName string, seedId string) error {
+	dataKey, manifestKey, err := backupKeys(backupName)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if running, err := MySQLRunning(); err != nil {
+		return log.Errore(err)
+	} else if running {
+		return log.Errorf("MySQL is running; refusing to restore backup %s", backupName)
+	}
+	directory, err := GetMySQLDataDir()
+	if err != nil {
+		return log.Errore(err)
+	}
+	if directory == "" {
+		return log.Errorf("Empty MySQL data directory")
+	}
+	store, err := objectstore.NewObjectStore()
+	if err != nil {
+		return log.Errore(err)
+	}
+	manifest, err := readBackupManifest(store, manifestKey)
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	beginJobPhase(seedId)
+	go func() {
+		err := func() error {
+			cmd, tmpFileName, err := execCmd(fmt.Sprintf("set -o pipefail; gzip -dc | %s", sudoCmd(fmt.Sprintf("tar -C %s -xf -", directory))))
+			if err != nil {
+				return err
+			}
+			defer os.Remove(tmpFileName)
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				return err
+			}
+			setActiveCommand(seedId, cmd)
+			if err := cmd.Start(); err != nil {
+				return err
+			}
+
+			verifyErr := verifyBackupContent(store, dataKey, manifest, stdin)
+			stdin.Close()
+			if err := cmd.Wait(); err != nil {
+				return err
+			}
+			return verifyErr
+		}()
+		if err == nil {
+			log.Infof("Restored backup %s into %s", backupName, directory)
+		}
+		endJobPhase(seedId, log.Errore(err))
+	}()
+	return nil
+}
+
+// DeleteBackup removes a backup from the backup store. The manifest goes first, so that a partially
+// deleted backup is never listed.
+func DeleteBackup(backupName string) error {
+	dataKey, manifestKey, err := backupKeys(backupName)
+	if err != nil {
+		return err
+	}
+	store, err := objectstore.NewObjectStore()
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(manifestKey); err != nil {
+		return err
+	}
+	return store.Delete(dataKey)
+}
+
+// ApplyBackupRetention removes backups beyond BackupRetentionCount most recent ones, which are also older than
+// BackupRetentionDays, where configured. It returns the names of removed backups.
+func ApplyBackupRetention() (removed []string, err error) {
+	removed = []string{}
+	if config.Config.BackupRetentionCount == 0 && config.Config.BackupRetentionDays == 0 {
+		return removed, nil
+	}
+	manifests, err := Backups()
+	if err != nil {
+		return removed, err
+	}
+	cutoff := time.Now().Add(-time.Duration(config.Config.BackupRetentionDays) * 24 * time.Hour)
+	for i := range manifests {
+		// newest first
+		manifest := manifests[len(manifests)-1-i]
+		if config.Config.BackupRetentionCount > 0 && uint(i) < config.Config.BackupRetentionCount {
+			continue
+		}
+		if config.Config.BackupRetentionDays > 0 && manifest.Created.After(cutoff) {
+			continue
+		}
+		if err := DeleteBackup(manifest.Name); err != nil {
+			return removed, log.Errore(err)
+		}
+		log.Infof("Removed backup %s per retention", manifest.Name)
+		removed = append(removed, manifest.Name)
+	}
+	return removed, nil
+}
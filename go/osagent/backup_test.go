@@ -0,0 +1,104 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+// writeArchive places an archive and its manifest in the backup directory
+func writeArchive(t *testing.T, name string, content string, created time.Time) {
+	checksum := sha256.Sum256([]byte(content))
+	manifest, _ := json.Marshal(osagent.ArchiveManifest{Name: name, Created: created, Size: int64(len(content)), SHA256: hex.EncodeToString(checksum[:])})
+	if err := ioutil.WriteFile(path.Join(config.Config.BackupDirectory, name+".tar.gz"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(config.Config.BackupDirectory, name+".manifest.json"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pushArchive(t *testing.T, name string, jobId string) bool {
+	if err := osagent.PushArchive(name, jobId); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for !osagent.SeedCommandCompleted(jobId) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return osagent.SeedCommandSucceeded(jobId)
+}
+
+func TestPushArchive(t *testing.T) {
+	backupDirectory, _ := ioutil.TempDir("", "archives")
+	defer os.RemoveAll(backupDirectory)
+	storeDirectory, _ := ioutil.TempDir("", "store")
+	defer os.RemoveAll(storeDirectory)
+	config.Config.BackupDirectory = backupDirectory
+	config.Config.BackupStore = "directory"
+	config.Config.BackupStoreDirectory = storeDirectory
+	config.Config.BackupRetentionCount = 2
+	config.Config.BackupRetentionDays = 0
+
+	writeArchive(t, "db-1", "first", time.Now().Add(-3*time.Hour))
+	writeArchive(t, "db-2", "second", time.Now().Add(-2*time.Hour))
+	writeArchive(t, "db-3", "third", time.Now().Add(-1*time.Hour))
+	for i, name := range []string{"db-1", "db-2", "db-3"} {
+		if !pushArchive(t, name, "push-"+name) {
+			t.Errorf("Expected push %d to succeed", i)
+		}
+	}
+	if err := osagent.PushArchive("db-3", "push-again"); err == nil {
+		t.Errorf("Expected error pushing existing backup")
+	}
+
+	backups, err := osagent.Backups()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(backups) != 2 || backups[0].Name != "db-2" || backups[1].Name != "db-3" {
+		t.Errorf("Expected retention to keep two most recent backups, got %+v", backups)
+	}
+	if err := osagent.VerifyBackup("db-3"); err != nil {
+		t.Errorf("Unexpected verification error: %s", err)
+	}
+
+	// Corrupt the stored data
+	ioutil.WriteFile(path.Join(storeDirectory, config.Config.BackupStorePrefix, "db-2.tar.gz"), []byte("sec0nd"), 0644)
+	if err := osagent.VerifyBackup("db-2"); err == nil {
+		t.Errorf("Expected verification error on corrupt backup")
+	}
+
+	// Archive content not matching its manifest is not pushed
+	writeArchive(t, "db-4", "fourth", time.Now())
+	ioutil.WriteFile(path.Join(backupDirectory, "db-4.tar.gz"), []byte("f0urth"), 0644)
+	if pushArchive(t, "db-4", "push-db-4") {
+		t.Errorf("Expected push of corrupt archive to fail")
+	}
+	if _, err := osagent.ReadBackupManifest("db-4"); err == nil {
+		t.Errorf("Expected no manifest for failed push")
+	}
+}
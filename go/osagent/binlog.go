@@ -0,0 +1,346 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+// base64LineLength is where `base64` wraps its output
+const base64LineLength = 76
+
+const defaultBinlogEventsLimit = 100
+const maxBinlogEventsLimit = 1000
+
+// BinlogEventEntry describes an event listed off a binary or relay log
+type BinlogEventEntry struct {
+	EventType   string
+	Position    int64
+	EndPosition int64
+	Timestamp   time.Time
+	ServerId    uint32
+	Gtid        string // of the transaction the event belongs to, where known
+	Database    string
+	Table       string
+	Info        string
+}
+
+// BinlogEventsPage is a page of events listed off a binary or relay log
+type BinlogEventsPage struct {
+	LogFile      string
+	Events       []BinlogEventEntry
+	NextPosition int64 // where the next page starts; zero when there are no more events
+}
+
+// ResolveLogFile maps a log name, either a full path or a base name, onto one of the server's relay or binary logs,
+// such that only these may be read
+func ResolveLogFile(logFile string) (string, error) {
+	for _, getFileNames := range []func() ([]string, error){GetRelayLogFileNames, GetBinaryLogFileNames} {
+		fileNames, _ := getFileNames()
+		for _, fileName := range fileNames {
+			if logFile == fileName || logFile == path.Base(fileName) {
+				return fileName, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Unknown relay or binary log: %s", logFile)
+}
+
+// sudoFileReader reads a file via `sudo cat`, for files the agent may not read by itself
+type sudoFileReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+// Close stops reading. cat, which may be owned by root, exits on a write to the closed pipe.
+func (this *sudoFileReader) Close() error {
+	this.ReadCloser.Close()
+	if err := this.cmd.Wait(); err != nil && this.stderr.Len() > 0 {
+		return fmt.Errorf("%s: %s", strings.Join(this.cmd.Args, " "), strings.TrimSpace(this.stderr.String()))
+	}
+	return nil
+}
+
+// openLogFile opens a binary or relay log for reading. Logs are typically owned by the mysql user: where the
+// agent may not read them, and is configured to run privileged commands with sudo, they are read via sudo.
+func openLogFile(fileName string) (io.ReadCloser, error) {
+	file, err := os.Open(fileName)
+	if err == nil {
+		return file, nil
+	}
+	if !os.IsPermission(err) || !config.Config.ExecWithSudo {
+		return nil, err
+	}
+	reader := &sudoFileReader{cmd: exec.Command("sudo", "cat", "--", fileName)}
+	reader.cmd.Stderr = &reader.stderr
+	if reader.ReadCloser, err = reader.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := reader.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// openBinlog opens a binary or relay log, validating its magic header
+func openBinlog(binlogFile string) (io.ReadCloser, *inst.BinlogReader, error) {
+	file, err := openLogFile(binlogFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := inst.NewBinlogReader(file)
+	if err != nil {
+		if closeErr := file.Close(); closeErr != nil {
+			err = closeErr
+		}
+		return nil, nil, fmt.Errorf("%s: %+v", binlogFile, err)
+	}
+	return file, reader, nil
+}
+
+// readBinlogEvents reads events off given binary or relay logs, from startPosition of the first log up to (and
+// excluding events at or beyond) stopPosition of the last, in the manner of mysqlbinlog's --start-position and
+// --stop-position. Zero positions stand for the beginning and end of logs. The format description event opening
+// each log is handed over even where preceding startPosition. A partially written event at the end of the last log
+// ends reading.
+// All logs are opened, and startPosition validated, before any event is handed over, such that a streaming caller
+// fails before it has written anything.
+func readBinlogEvents(binlogFiles []string, startPosition int64, stopPosition int64, onEvent func(binlogIndex int, event *inst.BinlogEvent) error) error {
+	readers := []*inst.BinlogReader{}
+	for _, binlogFile := range binlogFiles {
+		file, reader, err := openBinlog(binlogFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		readers = append(readers, reader)
+	}
+
+	// Events of the first log preceding startPosition are read through (rather than skipped) so as to track format
+	// descriptions along the way; those found are handed over, along with the event at startPosition, once
+	// startPosition is known to be an event boundary.
+	pending := []*inst.BinlogEvent{}
+	if len(readers) > 0 && startPosition > 0 {
+		for {
+			event, err := readers[0].ReadEvent()
+			if err == io.EOF || (err == io.ErrUnexpectedEOF && len(readers) == 1) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %+v", binlogFiles[0], err)
+			}
+			isHeader := (event.Position == inst.BinlogMagicSize && event.EventType == inst.FormatDescriptionEventType)
+			if event.Position < startPosition {
+				if event.EndPosition > startPosition {
+					return fmt.Errorf("%s: start position %d is not at an event boundary", binlogFiles[0], startPosition)
+				}
+				if isHeader {
+					pending = append(pending, event)
+				}
+				continue
+			}
+			pending = append(pending, event)
+			break
+		}
+	}
+
+	for i, reader := range readers {
+		isLast := (i == len(readers)-1)
+		for {
+			var event *inst.BinlogEvent
+			var err error
+			if i == 0 && len(pending) > 0 {
+				event, pending = pending[0], pending[1:]
+			} else if event, err = reader.ReadEvent(); err == io.EOF {
+				break
+			} else if err == io.ErrUnexpectedEOF && isLast {
+				break
+			} else if err != nil {
+				return fmt.Errorf("%s: %+v", binlogFiles[i], err)
+			}
+			if isLast && stopPosition != 0 && event.Position >= stopPosition {
+				break
+			}
+			if err := onEvent(i, event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListBinlogEvents lists up to limit events of a relay or binary log, starting at startPosition (which must be that
+// of an event, or zero for the log's beginning) and ending before stopPosition (or at the end of the log, if zero).
+// The returned page tells where the next page starts.
+func ListBinlogEvents(logFile string, startPosition int64, stopPosition int64, limit int) (*BinlogEventsPage, error) {
+	if limit <= 0 {
+		limit = defaultBinlogEventsLimit
+	}
+	if limit > maxBinlogEventsLimit {
+		limit = maxBinlogEventsLimit
+	}
+	fileName, err := ResolveLogFile(logFile)
+	if err != nil {
+		return nil, err
+	}
+	file, reader, err := openBinlog(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	page := &BinlogEventsPage{LogFile: fileName, Events: []BinlogEventEntry{}}
+	tracker := &inst.BinlogTransactionTracker{}
+	for {
+		event, err := reader.ReadEvent()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return page, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %+v", fileName, err)
+		}
+		if event.EventType == inst.FormatDescriptionEventType && reader.Position() < startPosition {
+			// Format description read; skip to the requested position
+			if err := reader.SkipTo(startPosition); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if stopPosition != 0 && event.Position >= stopPosition {
+			return page, nil
+		}
+		if len(page.Events) == limit {
+			page.NextPosition = event.Position
+			return page, nil
+		}
+
+		entry := BinlogEventEntry{
+			EventType:   event.EventType.String(),
+			Position:    event.Position,
+			EndPosition: event.EndPosition,
+			Timestamp:   event.Time(),
+			ServerId:    event.ServerId,
+			Info:        event.Info(),
+		}
+		switch payload := event.Payload.(type) {
+		case *inst.QueryEvent:
+			entry.Database = payload.Database
+		case *inst.TableMapEvent:
+			entry.Database, entry.Table = payload.Database, payload.Table
+		case *inst.RowsEvent:
+			entry.Database, entry.Table = payload.Database, payload.Table
+		}
+		tracker.Track(event)
+		if !event.EventType.IsGroupless() {
+			entry.Gtid = tracker.Gtid
+		}
+		page.Events = append(page.Events, entry)
+	}
+}
+
+// binlogHeaderSize returns the size of the magic header and format description event opening a log
+func binlogHeaderSize(binlogFile string) (int64, error) {
+	file, reader, err := openBinlog(binlogFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	event, err := reader.ReadEvent()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %+v", binlogFile, err)
+	}
+	if event.EventType != inst.FormatDescriptionEventType {
+		return 0, fmt.Errorf("%s: expected format description event, found %s", binlogFile, event.EventType)
+	}
+	return event.EndPosition, nil
+}
+
+// lineWrapWriter breaks written content into lines of given length
+type lineWrapWriter struct {
+	writer     io.Writer
+	lineLength int
+	column     int
+}
+
+func (this *lineWrapWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if remaining := this.lineLength - this.column; len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		written, err := this.writer.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+		this.column += len(chunk)
+		if this.column == this.lineLength {
+			if _, err := this.writer.Write([]byte("\n")); err != nil {
+				return n, err
+			}
+			this.column = 0
+		}
+	}
+	return n, nil
+}
+
+// Close terminates a partial last line
+func (this *lineWrapWriter) Close() error {
+	if this.column > 0 {
+		this.column = 0
+		_, err := this.writer.Write([]byte("\n"))
+		return err
+	}
+	return nil
+}
+
+// gzipBase64 compresses and encodes content as `gzip | base64` would
+func gzipBase64(writeContent func(writer io.Writer) error) (string, error) {
+	var output bytes.Buffer
+	wrapWriter := &lineWrapWriter{writer: &output, lineLength: base64LineLength}
+	encoder := base64.NewEncoder(base64.StdEncoding, wrapWriter)
+	gzipWriter := gzip.NewWriter(encoder)
+	if err := writeContent(gzipWriter); err != nil {
+		return "", err
+	}
+	for _, closer := range []io.Closer{gzipWriter, encoder, wrapWriter} {
+		if err := closer.Close(); err != nil {
+			return "", err
+		}
+	}
+	return output.String(), nil
+}
+
+// gunzipBase64 decodes and decompresses content as `base64 --decode | gunzip` would
+func gunzipBase64(content []byte) (io.Reader, error) {
+	return gzip.NewReader(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(content)))
+}
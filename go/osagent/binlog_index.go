@@ -0,0 +1,326 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+)
+
+// BinlogFile describes a binary or relay log file
+type BinlogFile struct {
+	LogFile        string
+	Size           int64
+	FirstEventTime time.Time
+	LastEventTime  time.Time
+	PreviousGtids  string // GTIDs executed before the log, where GTIDs are in use
+	LastGtid       string // GTID of the last transaction begun in the log, where GTIDs are in use
+	modTime        time.Time
+	inode          uint64
+	headerTime     uint32 // timestamp of the format description event opening the log
+	scannedTo      int64  // end of the last complete event scanned
+}
+
+// binlogFileScans caches scanned files by name. Logs only ever grow, hence a cached scan is resumed where it ended.
+// A log is told apart from another by the same name, e.g. following RESET MASTER, by its inode and the timestamp
+// of its format description event.
+var binlogFileScans = make(map[string]BinlogFile)
+var binlogFileScansMutex = &sync.Mutex{}
+
+// listedLogFiles are the logs last listed by each of the binary and relay log indexes
+var listedLogFiles = make(map[inst.BinlogType]map[string]bool)
+
+// pruneBinlogFileScans records the logs listed by an index, and drops cached scans of logs listed by neither
+// index, such as purged logs
+func pruneBinlogFileScans(logType inst.BinlogType, fileNames []string) {
+	binlogFileScansMutex.Lock()
+	defer binlogFileScansMutex.Unlock()
+	listedLogFiles[logType] = make(map[string]bool)
+	for _, fileName := range fileNames {
+		listedLogFiles[logType][fileName] = true
+	}
+	for fileName := range binlogFileScans {
+		if !listedLogFiles[inst.BinaryLog][fileName] && !listedLogFiles[inst.RelayLog][fileName] {
+			delete(binlogFileScans, fileName)
+		}
+	}
+}
+
+// fileInode returns the inode of a file, or zero where unknown
+func fileInode(fileInfo os.FileInfo) uint64 {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
+
+// scanBinlogFile reads the time span of a binary or relay log, by event headers. A partially written event at the
+// end of the log is not scanned.
+func scanBinlogFile(fileName string) (*BinlogFile, error) {
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	inode := fileInode(fileInfo)
+	binlogFileScansMutex.Lock()
+	cached, isCached := binlogFileScans[fileName]
+	binlogFileScansMutex.Unlock()
+	if isCached && cached.inode == inode && cached.Size == fileInfo.Size() && cached.modTime.Equal(fileInfo.ModTime()) {
+		return &cached, nil
+	}
+	binlogFile := BinlogFile{LogFile: fileName}
+	if isCached && cached.inode == inode && cached.Size <= fileInfo.Size() {
+		// Presumably the log scanned before, having grown since; told for sure by its format description
+		binlogFile = cached
+	}
+
+	file, reader, err := openBinlog(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	for {
+		event, err := reader.ReadEventHeader()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %+v", fileName, err)
+		}
+		if event.Position == inst.BinlogMagicSize && event.EventType == inst.FormatDescriptionEventType {
+			if event.Timestamp != binlogFile.headerTime {
+				// Not the log scanned before
+				binlogFile = BinlogFile{LogFile: fileName, headerTime: event.Timestamp}
+			} else if binlogFile.scannedTo > reader.Position() {
+				if err := reader.SkipTo(binlogFile.scannedTo); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		switch payload := event.Payload.(type) {
+		case *inst.PreviousGtidsEvent:
+			if binlogFile.PreviousGtids == "" {
+				binlogFile.PreviousGtids = payload.GtidSet.String()
+			}
+		case *inst.GtidEvent:
+			binlogFile.LastGtid = payload.Gtid()
+		case *inst.MariaDBGtidEvent:
+			binlogFile.LastGtid = payload.MariaDBGtid.String()
+		}
+		if event.Timestamp != 0 {
+			if binlogFile.FirstEventTime.IsZero() {
+				binlogFile.FirstEventTime = event.Time()
+			}
+			binlogFile.LastEventTime = event.Time()
+		}
+		binlogFile.scannedTo = event.EndPosition
+	}
+	if binlogFile.scannedTo < reader.Position() {
+		binlogFile.scannedTo = reader.Position()
+	}
+	binlogFile.Size = fileInfo.Size()
+	binlogFile.modTime = fileInfo.ModTime()
+	binlogFile.inode = inode
+
+	binlogFileScansMutex.Lock()
+	defer binlogFileScansMutex.Unlock()
+	binlogFileScans[fileName] = binlogFile
+	return &binlogFile, nil
+}
+
+// GetBinaryLogFiles lists the server's binary logs, with sizes and time spans
+func GetBinaryLogFiles() (binlogFiles []BinlogFile, err error) {
+	fileNames, err := getLogFileNames(inst.BinaryLog)
+	if err != nil {
+		return binlogFiles, err
+	}
+	for _, fileName := range fileNames {
+		binlogFile, err := scanBinlogFile(fileName)
+		if err != nil {
+			return binlogFiles, log.Errore(err)
+		}
+		binlogFiles = append(binlogFiles, *binlogFile)
+	}
+	return binlogFiles, nil
+}
+
+// GetBinaryLogEndCoordinates returns the coordinates at the end of the binary logs, as the server reports them
+func GetBinaryLogEndCoordinates() (coordinates *inst.BinlogCoordinates, err error) {
+	binlogIndexFile, err := GetBinaryLogIndexFileName()
+	if err != nil {
+		return coordinates, err
+	}
+	db, err := openMySQL()
+	if err != nil {
+		return coordinates, log.Errore(err)
+	}
+	instance, err := GetMySQLInstance()
+	if err != nil {
+		return coordinates, log.Errore(err)
+	}
+	query := "show master status"
+	if isVersionAtLeast(instance.Version, 8, 2, 0) && !instance.IsMariaDB() {
+		query = "show binary log status"
+	}
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		coordinates = &inst.BinlogCoordinates{
+			LogFile: path.Join(path.Dir(binlogIndexFile), m.GetString("File")),
+			LogPos:  m.GetInt64("Position"),
+			Type:    inst.BinaryLog,
+		}
+		return nil
+	})
+	if err != nil {
+		return coordinates, log.Errore(err)
+	}
+	if coordinates == nil {
+		return coordinates, log.Errorf("Binary logging is disabled")
+	}
+	return coordinates, nil
+}
+
+// errBinlogSearchComplete stops reading logs once a search is done
+var errBinlogSearchComplete = errors.New("Binlog search complete")
+
+// isSingleGtid tells whether a GTID set holds exactly one transaction (or, for MariaDB, one position)
+func isSingleGtid(gtidSet *inst.GtidSet) bool {
+	canonical := gtidSet.String()
+	if canonical == "" || strings.Contains(canonical, ",") {
+		return false
+	}
+	if gtidSet.Flavor == inst.MySQLGtidFlavor {
+		tokens := strings.Split(canonical, ":")
+		return len(tokens) == 2 && !strings.Contains(tokens[1], "-")
+	}
+	return true
+}
+
+// getLogFileNames returns the server's binary or relay logs, forgetting scans of logs no longer listed
+func getLogFileNames(logType inst.BinlogType) (fileNames []string, err error) {
+	if logType == inst.RelayLog {
+		fileNames, err = GetRelayLogFileNames()
+	} else {
+		fileNames, err = GetBinaryLogFileNames()
+	}
+	if err == nil {
+		pruneBinlogFileScans(logType, fileNames)
+	}
+	return fileNames, err
+}
+
+// FindBinlogCoordinatesByTime returns the coordinates of the transaction holding the first event at or after
+// given time, in binary or relay logs. Logs ending before that time are not read.
+func FindBinlogCoordinatesByTime(logType inst.BinlogType, atOrAfter time.Time) (*inst.BinlogCoordinates, error) {
+	fileNames, err := getLogFileNames(logType)
+	if err != nil {
+		return nil, err
+	}
+	for _, fileName := range fileNames {
+		binlogFile, err := scanBinlogFile(fileName)
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+		if binlogFile.LastEventTime.Before(atOrAfter) {
+			continue
+		}
+		var coordinates *inst.BinlogCoordinates
+		tracker := &inst.BinlogTransactionTracker{}
+		err = readBinlogEvents([]string{fileName}, 0, 0, func(binlogIndex int, event *inst.BinlogEvent) error {
+			tracker.Track(event)
+			if coordinates == nil && !event.EventType.IsGroupless() && !event.Time().Before(atOrAfter) {
+				coordinates = &inst.BinlogCoordinates{LogFile: fileName, LogPos: tracker.GroupStart, Type: logType}
+				return errBinlogSearchComplete
+			}
+			return nil
+		})
+		if coordinates != nil {
+			return coordinates, nil
+		}
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+	}
+	return nil, fmt.Errorf("No event found at or after %s", atOrAfter.Format(time.RFC3339))
+}
+
+// FindBinlogCoordinatesByGtid returns the coordinates where the transaction of given GTID begins, in binary
+// or relay logs. Logs' previous GTIDs tell which log holds the transaction.
+func FindBinlogCoordinatesByGtid(logType inst.BinlogType, gtid string) (*inst.BinlogCoordinates, error) {
+	gtidSet, err := inst.ParseGtidSet(gtid)
+	if err != nil {
+		return nil, err
+	}
+	if !isSingleGtid(gtidSet) {
+		return nil, fmt.Errorf("Expected a single GTID, got %s", gtid)
+	}
+	fileNames, err := getLogFileNames(logType)
+	if err != nil {
+		return nil, err
+	}
+	// Scan logs from the last one backwards, up to the first log not preceded by the GTID
+	for i := len(fileNames) - 1; i >= 0; i-- {
+		binlogFile, err := scanBinlogFile(fileNames[i])
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+		if binlogFile.PreviousGtids != "" {
+			if previousGtids, err := inst.ParseGtidSet(binlogFile.PreviousGtids); err == nil && previousGtids.Contains(gtidSet) {
+				continue
+			}
+		}
+		var coordinates *inst.BinlogCoordinates
+		err = readBinlogEvents([]string{fileNames[i]}, 0, 0, func(binlogIndex int, event *inst.BinlogEvent) error {
+			var eventGtid string
+			switch payload := event.Payload.(type) {
+			case *inst.GtidEvent:
+				eventGtid = payload.Gtid()
+			case *inst.MariaDBGtidEvent:
+				eventGtid = payload.MariaDBGtid.String()
+			default:
+				return nil
+			}
+			if eventGtidSet, err := inst.ParseGtidSet(eventGtid); err == nil && eventGtidSet.Equals(gtidSet) {
+				coordinates = &inst.BinlogCoordinates{LogFile: fileNames[i], LogPos: event.Position, Type: logType}
+				return errBinlogSearchComplete
+			}
+			return nil
+		})
+		if coordinates != nil {
+			return coordinates, nil
+		}
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+		if binlogFile.PreviousGtids != "" {
+			// Preceding logs are not expected to hold the GTID either
+			break
+		}
+	}
+	return nil, fmt.Errorf("GTID %s not found", gtid)
+}
@@ -0,0 +1,273 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+// errBinlogReplayStopped stops reading logs once a replay reaches its stop point
+var errBinlogReplayStopped = errors.New("Binlog replay stopped")
+
+// BinlogStopPoint tells where a replay ends. Transactions are never split: replay stops before the first
+// transaction at or after Time, before the transaction of Gtid, or before the first transaction starting at or
+// after Coordinates. Unset fields do not apply.
+type BinlogStopPoint struct {
+	Time        time.Time
+	Gtid        string
+	Coordinates *inst.BinlogCoordinates
+	gtidSet     *inst.GtidSet
+}
+
+// IsSet tells whether any stop condition is given
+func (this *BinlogStopPoint) IsSet() bool {
+	return !this.Time.IsZero() || this.Gtid != "" || this.Coordinates != nil
+}
+
+// validate parses the stop GTID
+func (this *BinlogStopPoint) validate() (err error) {
+	if this.Gtid == "" {
+		return nil
+	}
+	if this.gtidSet, err = inst.ParseGtidSet(this.Gtid); err != nil {
+		return err
+	}
+	if !isSingleGtid(this.gtidSet) {
+		return fmt.Errorf("Expected a single stop GTID, got %s", this.Gtid)
+	}
+	return nil
+}
+
+// reachedBy returns the reason for stopping before a transaction beginning with given event, or an empty string
+// where the transaction is to be replayed
+func (this *BinlogStopPoint) reachedBy(logFile string, event *inst.BinlogEvent, gtid string) string {
+	if !this.Time.IsZero() && !event.Time().Before(this.Time) {
+		return fmt.Sprintf("Reached stop time %s", this.Time.Format(time.RFC3339))
+	}
+	if this.gtidSet != nil && gtid != "" {
+		if gtidSet, err := inst.ParseGtidSet(gtid); err == nil && gtidSet.Equals(this.gtidSet) {
+			return fmt.Sprintf("Reached stop GTID %s", this.Gtid)
+		}
+	}
+	if this.Coordinates != nil && path.Base(logFile) == path.Base(this.Coordinates.LogFile) && event.Position >= this.Coordinates.LogPos {
+		return fmt.Sprintf("Reached stop position %s:%d", path.Base(this.Coordinates.LogFile), this.Coordinates.LogPos)
+	}
+	return ""
+}
+
+// replayDestination is where binary logs are replayed: a sandbox or the live MySQL server
+type replayDestination struct {
+	clientCommand string
+	queryValue    func(query string) (string, error)
+	done          func() error // where set, called once replaying is over, whether or not it succeeded
+}
+
+// liveReplayDestination replays onto the live MySQL server, by MySQLClientCommand
+func liveReplayDestination() *replayDestination {
+	return &replayDestination{
+		clientCommand: sudoCmd(config.Config.MySQLClientCommand),
+		queryValue: func(query string) (value string, err error) {
+			db, err := openMySQL()
+			if err != nil {
+				return value, err
+			}
+			err = db.QueryRow(query).Scan(&value)
+			return value, err
+		},
+	}
+}
+
+// executedGtids reads the GTIDs executed on the destination, MySQL's or MariaDB's
+func (this *replayDestination) executedGtids() (*inst.GtidSet, error) {
+	value, err := this.queryValue("select @@global.gtid_executed")
+	if err != nil {
+		if value, err = this.queryValue("select @@global.gtid_current_pos"); err != nil {
+			return nil, err
+		}
+	}
+	return inst.ParseGtidSet(value)
+}
+
+// BinlogFilter tells which events a replay leaves out
+type BinlogFilter struct {
+	Tables     []string // schema.table patterns, with shell wildcards, e.g. "test.*"; where given, other tables are left out
+	SkipTables []string // schema.table patterns, with shell wildcards, e.g. "test.*" or "*.audit_log"
+}
+
+// validate checks the filter's patterns
+func (this *BinlogFilter) validate() error {
+	for _, pattern := range append(append([]string{}, this.Tables...), this.SkipTables...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Bad table pattern %s: %+v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchesTable tells whether any of given patterns matches a table
+func matchesTable(patterns []string, database string, table string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, fmt.Sprintf("%s.%s", database, table)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *BinlogFilter) skipsTable(database string, table string) bool {
+	if len(this.Tables) > 0 && !matchesTable(this.Tables, database, table) {
+		return true
+	}
+	return matchesTable(this.SkipTables, database, table)
+}
+
+// skips tells whether an event is to be left out. Row events are filtered by their table; statements by
+// their default schema alone (as with replicate-ignore-db), hence only match "schema.*" patterns. Transaction
+// control statements are never filtered.
+func (this *BinlogFilter) skips(event *inst.BinlogEvent) bool {
+	switch payload := event.Payload.(type) {
+	case *inst.TableMapEvent:
+		return this.skipsTable(payload.Database, payload.Table)
+	case *inst.RowsEvent:
+		return this.skipsTable(payload.Database, payload.Table)
+	case *inst.QueryEvent:
+		switch strings.ToUpper(strings.TrimSpace(payload.Query)) {
+		case "BEGIN", "COMMIT", "ROLLBACK":
+			return false
+		}
+		return payload.Database != "" && this.skipsTable(payload.Database, "")
+	}
+	return false
+}
+
+// BinlogReplayReport tells how a replay went
+type BinlogReplayReport struct {
+	EventsApplied          int64
+	EventsSkipped          int64 // filtered out, or of skipped transactions
+	TransactionsApplied    int64
+	TransactionsSkipped    int64
+	LastAppliedGtid        string
+	LastAppliedTime        time.Time
+	LastAppliedCoordinates *inst.BinlogCoordinates // end of the last applied transaction
+	StopCoordinates        *inst.BinlogCoordinates // start of the transaction replay stopped before, if any
+	StopReason             string
+}
+
+// BinlogReplayTransaction describes a replayed transaction
+type BinlogReplayTransaction struct {
+	Gtid        string
+	Position    int64
+	EndPosition int64
+	Time        time.Time
+}
+
+// binlogReplay renders logs as SQL a transaction at a time, up to a stop point, leaving out filtered events.
+// Transactions whose GTIDs are already executed are skipped; MySQL would skip these as well, whereas MariaDB
+// would apply them again.
+type binlogReplay struct {
+	stop          BinlogStopPoint
+	filter        BinlogFilter
+	executedGtids *inst.GtidSet
+	skipGroups    map[int64]bool                                  // positions of transactions to skip, e.g. as applied by a previous attempt
+	onTransaction func(transaction BinlogReplayTransaction) error // called once a transaction is rendered
+	tracker       inst.BinlogTransactionTracker
+	skipping      bool
+	groupTime     time.Time
+	report        BinlogReplayReport
+}
+
+func newBinlogReplay(stop BinlogStopPoint, filter BinlogFilter, executedGtids *inst.GtidSet) (*binlogReplay, error) {
+	if err := stop.validate(); err != nil {
+		return nil, err
+	}
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+	return &binlogReplay{stop: stop, filter: filter, executedGtids: executedGtids}, nil
+}
+
+// isExecuted tells whether the transaction of given GTID is already executed
+func (this *binlogReplay) isExecuted(gtid string) bool {
+	if this.executedGtids == nil || gtid == "" {
+		return false
+	}
+	gtidSet, err := inst.ParseGtidSet(gtid)
+	if err != nil {
+		return false
+	}
+	return this.executedGtids.Contains(gtidSet)
+}
+
+// replayFile renders the events of a log, from startPosition, onto sqlWriter. logFile names the log in the
+// report, and may differ from the file actually read (e.g. a copy fetched from another host). Returns
+// errBinlogReplayStopped once the stop point is reached.
+func (this *binlogReplay) replayFile(logFile string, fileName string, startPosition int64, sqlWriter *inst.BinlogSQLWriter) error {
+	return readBinlogEvents([]string{fileName}, startPosition, 0, func(binlogIndex int, event *inst.BinlogEvent) error {
+		groupStart := !this.tracker.InGroup() && !event.EventType.IsGroupless()
+		groupEnd := this.tracker.Track(event)
+		if groupStart {
+			if reason := this.stop.reachedBy(logFile, event, this.tracker.Gtid); reason != "" {
+				this.report.StopCoordinates = &inst.BinlogCoordinates{LogFile: logFile, LogPos: this.tracker.GroupStart, Type: inst.BinaryLog}
+				this.report.StopReason = reason
+				return errBinlogReplayStopped
+			}
+			this.skipping = this.isExecuted(this.tracker.Gtid) || this.skipGroups[this.tracker.GroupStart]
+			this.groupTime = event.Time()
+		}
+		if this.skipping {
+			this.report.EventsSkipped++
+		} else if this.filter.skips(event) {
+			this.report.EventsSkipped++
+			if _, ok := event.Payload.(*inst.QueryEvent); ok && groupEnd && this.tracker.Gtid != "" {
+				// A filtered statement of its own; its GTID is nonetheless consumed
+				if err := sqlWriter.WriteEmptyTransaction(); err != nil {
+					return err
+				}
+			}
+		} else {
+			if err := sqlWriter.WriteEvent(event); err != nil {
+				return err
+			}
+			this.report.EventsApplied++
+		}
+		if groupEnd {
+			if this.skipping {
+				this.report.TransactionsSkipped++
+			} else {
+				this.report.TransactionsApplied++
+				this.report.LastAppliedGtid = this.tracker.Gtid
+				this.report.LastAppliedTime = this.groupTime
+				this.report.LastAppliedCoordinates = &inst.BinlogCoordinates{LogFile: logFile, LogPos: event.EndPosition, Type: inst.BinaryLog}
+				if this.onTransaction != nil {
+					transaction := BinlogReplayTransaction{Gtid: this.tracker.Gtid, Position: this.tracker.GroupStart, EndPosition: event.EndPosition, Time: this.groupTime}
+					if err := this.onTransaction(transaction); err != nil {
+						return err
+					}
+				}
+			}
+			this.skipping = false
+		}
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+
+	"github.com/outbrain/golib/log"
+)
+
+// Streamed binlog contents are followed by their digest, in these headers (HTTP trailers, as the digest is only
+// known once the content is sent)
+const (
+	BinlogContentLengthHeader   = "X-Binlog-Content-Length"
+	BinlogContentChecksumHeader = "X-Binlog-Content-Sha256"
+	BinlogContentErrorHeader    = "X-Binlog-Content-Error"
+)
+
+// ContentDigest is the length and SHA256 checksum of streamed content, as it is before compression
+type ContentDigest struct {
+	Length   int64
+	Checksum string
+}
+
+// ParseContentDigest reads a digest off header values, returning nil where neither is given
+func ParseContentDigest(length string, checksum string) (*ContentDigest, error) {
+	if length == "" && checksum == "" {
+		return nil, nil
+	}
+	digest := &ContentDigest{Length: -1, Checksum: checksum}
+	if length != "" {
+		var err error
+		if digest.Length, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return nil, fmt.Errorf("Cannot parse content length: %s", length)
+		}
+	}
+	return digest, nil
+}
+
+// Verify compares actual content against this, the expected digest. A negative length or empty checksum
+// is not verified.
+func (this *ContentDigest) Verify(actual ContentDigest) error {
+	if this.Length >= 0 && this.Length != actual.Length {
+		return fmt.Errorf("Content length mismatch: expected %d bytes, got %d", this.Length, actual.Length)
+	}
+	if this.Checksum != "" && this.Checksum != actual.Checksum {
+		return fmt.Errorf("Content checksum mismatch: expected %s, got %s", this.Checksum, actual.Checksum)
+	}
+	return nil
+}
+
+// digestWriter accumulates the digest of content written through it
+type digestWriter struct {
+	hash   hash.Hash
+	length int64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{hash: sha256.New()}
+}
+
+func (this *digestWriter) Write(p []byte) (n int, err error) {
+	this.hash.Write(p)
+	this.length += int64(len(p))
+	return len(p), nil
+}
+
+func (this *digestWriter) digest() ContentDigest {
+	return ContentDigest{Length: this.length, Checksum: hex.EncodeToString(this.hash.Sum(nil))}
+}
+
+// streamContents writes content, gzipped if so requested, returning the digest of the content
+func streamContents(writer io.Writer, compress bool, writeContent func(writer io.Writer) error) (ContentDigest, error) {
+	digest := newDigestWriter()
+	var gzipWriter *gzip.Writer
+	if compress {
+		gzipWriter = gzip.NewWriter(writer)
+		writer = gzipWriter
+	}
+	if err := writeContent(io.MultiWriter(writer, digest)); err != nil {
+		return ContentDigest{}, err
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return ContentDigest{}, err
+		}
+	}
+	return digest.digest(), nil
+}
+
+// StreamMySQLBinlogContents writes the events of given binary logs as SQL, optionally gzipped, rather than
+// holding the contents in memory as MySQLBinlogContents does
+func StreamMySQLBinlogContents(writer io.Writer, compress bool, binlogFiles []string, startPosition int64, stopPosition int64) (ContentDigest, error) {
+	if len(binlogFiles) == 0 {
+		return ContentDigest{}, log.Errorf("No binlog files provided in StreamMySQLBinlogContents")
+	}
+	return streamContents(writer, compress, func(writer io.Writer) error {
+		return writeBinlogSQL(writer, binlogFiles, startPosition, stopPosition)
+	})
+}
+
+// StreamMySQLBinlogBinaryContents writes the binary contents of given binary (or relay) logs, optionally gzipped,
+// rather than holding the contents in memory as MySQLBinlogBinaryContents does
+func StreamMySQLBinlogBinaryContents(writer io.Writer, compress bool, binlogFiles []string, startPosition int64, stopPosition int64) (ContentDigest, error) {
+	if len(binlogFiles) == 0 {
+		return ContentDigest{}, log.Errorf("No binlog files provided in StreamMySQLBinlogBinaryContents")
+	}
+	return streamContents(writer, compress, func(writer io.Writer) error {
+		return writeBinlogBinary(writer, binlogFiles, startPosition, stopPosition)
+	})
+}
+
+// ApplyRelaylogContentsStream applies relay log contents streamed in binary, optionally gzipped, as written by
+// StreamMySQLBinlogBinaryContents. expectedDigest is consulted once the content is read, such that the digest
+// may follow the content; it may return nil, in which case the content is not verified.
+func ApplyRelaylogContentsStream(reader io.Reader, compressed bool, expectedDigest func() (*ContentDigest, error), options RelaylogApplyOptions) (*RelaylogApplyReport, error) {
+	if compressed {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	return applyRelaylogContents(reader, expectedDigest, options)
+}
@@ -0,0 +1,522 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+// writeTestBinlog writes a binary log of given queries, returning the position of each
+func writeTestBinlog(t *testing.T, fileName string, queries []string, trailing []byte) []int64 {
+	binlog, positions := inst.EncodeQueryBinlog("8.0.20", 1600000000, 1, queries)
+	if err := ioutil.WriteFile(fileName, append(binlog, trailing...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return positions
+}
+
+func decodeBinlogContents(t *testing.T, contents string) []*inst.BinlogEvent {
+	for _, line := range strings.Split(strings.TrimSpace(contents), "\n") {
+		if len(line) > 76 {
+			t.Errorf("Expected base64 lines wrapped at 76 characters, got %d", len(line))
+		}
+	}
+	gzipReader, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binlog, _ := ioutil.ReadAll(gzipReader)
+	reader, err := inst.NewBinlogReader(bytes.NewReader(binlog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []*inst.BinlogEvent{}
+	for {
+		event, err := reader.ReadEvent()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestMySQLBinlogBinaryContents(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+
+	binlog1, binlog2 := path.Join(directory, "relay-bin.000001"), path.Join(directory, "relay-bin.000002")
+	positions1 := writeTestBinlog(t, binlog1, []string{"create table a (id int)", "create table b (id int)"}, nil)
+	positions2 := writeTestBinlog(t, binlog2, []string{"create table c (id int)", "create table d (id int)", "create table e (id int)"}, []byte{1, 2, 3})
+
+	headerSize, err := osagent.MySQLBinlogContentHeaderSize(binlog1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headerSize != positions1[0] {
+		t.Errorf("Expected header size %d, got %d", positions1[0], headerSize)
+	}
+
+	contents, err := osagent.MySQLBinlogBinaryContents([]string{binlog1, binlog2}, positions1[1], positions2[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []string{}
+	for _, event := range decodeBinlogContents(t, contents)[1:] {
+		queries = append(queries, event.Payload.(*inst.QueryEvent).Query)
+	}
+	if strings.Join(queries, ";") != "create table b (id int);create table c (id int);create table d (id int)" {
+		t.Errorf("Unexpected queries: %+v", queries)
+	}
+
+	// A partially written last event is left out
+	contents, err = osagent.MySQLBinlogBinaryContents([]string{binlog2}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := decodeBinlogContents(t, contents); len(events) != 4 {
+		t.Errorf("Expected 4 events, got %d", len(events))
+	}
+
+	if _, err := osagent.MySQLBinlogBinaryContents([]string{binlog1}, positions1[1]+1, 0); err == nil {
+		t.Errorf("Expected error on start position not at event boundary")
+	}
+}
+
+func TestMySQLBinlogContentsWithSudo(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("Files are readable by root")
+	}
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	// The stand-in sudo has no privileges, and makes the log readable to read it
+	binlog := path.Join(directory, "mysql-bin.000001")
+	writeTestBinlog(t, binlog, []string{"create table a (id int)"}, nil)
+	os.Chmod(binlog, 0)
+	ioutil.WriteFile(path.Join(directory, "sudo"), []byte("#!/bin/bash\nchmod 0644 \"${@: -1}\" && exec \"$@\"\n"), 0755)
+	originalPath := os.Getenv("PATH")
+	os.Setenv("PATH", directory+":"+originalPath)
+	defer os.Setenv("PATH", originalPath)
+
+	if _, err := osagent.MySQLBinlogBinaryContents([]string{binlog}, 0, 0); err == nil {
+		t.Errorf("Expected error reading log without sudo")
+	}
+	os.Chmod(binlog, 0)
+	config.Config.ExecWithSudo = true
+	defer func() { config.Config.ExecWithSudo = false }()
+	contents, err := osagent.MySQLBinlogBinaryContents([]string{binlog}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := decodeBinlogContents(t, contents); len(events) != 2 {
+		t.Errorf("Expected 2 events, got %d", len(events))
+	}
+}
+
+func TestListBinlogEvents(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	config.Config.MySQLDatadirCommand = "echo " + directory
+
+	positions := writeTestBinlog(t, path.Join(directory, "relay-bin.000001"), []string{"create table a (id int)", "create table b (id int)", "create table c (id int)"}, nil)
+	if err := ioutil.WriteFile(path.Join(directory, "relay-bin.index"), []byte("./relay-bin.000001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := osagent.ListBinlogEvents("relay-bin.000001", 0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 2 || page.Events[0].EventType != "Format_desc" || page.Events[1].Position != positions[0] || page.NextPosition != positions[1] {
+		t.Errorf("Unexpected first page: %+v", page)
+	}
+	page, err = osagent.ListBinlogEvents("relay-bin.000001", page.NextPosition, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 2 || page.Events[1].Info != "create table c (id int)" || page.NextPosition != 0 {
+		t.Errorf("Unexpected second page: %+v", page)
+	}
+	page, err = osagent.ListBinlogEvents(path.Join(directory, "relay-bin.000001"), positions[1], positions[2], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 1 || page.Events[0].EndPosition != positions[2] {
+		t.Errorf("Unexpected bounded page: %+v", page)
+	}
+
+	if _, err := osagent.ListBinlogEvents("/etc/passwd", 0, 0, 0); err == nil {
+		t.Errorf("Expected error listing a file which is not a relay or binary log")
+	}
+}
+
+// writeTestGtidBinlog writes a binary log of transactions of given GTID numbers and timestamps, returning the
+// position of each
+func writeTestGtidBinlog(t *testing.T, fileName string, previousGno int64, gnos []int64, timestamps []uint32) []int64 {
+	sid, _ := hex.DecodeString(strings.Replace(testUUID, "-", "", -1))
+	le := func(value uint64) []byte {
+		result := make([]byte, 8)
+		binary.LittleEndian.PutUint64(result, value)
+		return result
+	}
+	binlog := append(append([]byte{}, inst.BinlogMagic...), inst.EncodeFormatDescriptionEvent("8.0.20", timestamps[0], 1, inst.BinlogChecksumAlgCRC32)...)
+	addEvent := func(timestamp uint32, eventType inst.BinlogEventType, body []byte) {
+		header := inst.BinlogEventHeader{Timestamp: timestamp, EventType: eventType, ServerId: 1}
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), body, true)...)
+	}
+	previousGtids := le(0)
+	if previousGno > 0 {
+		previousGtids = bytes.Join([][]byte{le(1), sid, le(1), le(1), le(uint64(previousGno + 1))}, nil)
+	}
+	addEvent(timestamps[0], inst.PreviousGtidsEventType, previousGtids)
+	positions := []int64{}
+	for i, gno := range gnos {
+		positions = append(positions, int64(len(binlog)))
+		addEvent(timestamps[i], inst.GtidEventType, bytes.Join([][]byte{{1}, sid, le(uint64(gno))}, nil))
+		addEvent(timestamps[i], inst.QueryEventType, append(make([]byte, 14), []byte("BEGIN")...))
+		addEvent(timestamps[i], inst.XidEventType, le(uint64(gno)))
+	}
+	if err := ioutil.WriteFile(fileName, binlog, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return positions
+}
+
+const testUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+func TestFindBinlogCoordinates(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	config.Config.MySQLDatadirCommand = "echo " + directory
+
+	relaylog1, relaylog2 := path.Join(directory, "relay-bin.000001"), path.Join(directory, "relay-bin.000002")
+	positions1 := writeTestGtidBinlog(t, relaylog1, 0, []int64{1, 2, 3}, []uint32{1600000000, 1600000010, 1600000020})
+	positions2 := writeTestGtidBinlog(t, relaylog2, 3, []int64{4, 5}, []uint32{1600000030, 1600000040})
+	if err := ioutil.WriteFile(path.Join(directory, "relay-bin.index"), []byte("./relay-bin.000001\n./relay-bin.000002\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		timestamp int64
+		expected  inst.BinlogCoordinates
+	}{
+		{1500000000, inst.BinlogCoordinates{LogFile: relaylog1, LogPos: positions1[0], Type: inst.RelayLog}},
+		{1600000010, inst.BinlogCoordinates{LogFile: relaylog1, LogPos: positions1[1], Type: inst.RelayLog}},
+		{1600000011, inst.BinlogCoordinates{LogFile: relaylog1, LogPos: positions1[2], Type: inst.RelayLog}},
+		{1600000025, inst.BinlogCoordinates{LogFile: relaylog2, LogPos: positions2[0], Type: inst.RelayLog}},
+	}
+	for _, test := range tests {
+		coordinates, err := osagent.FindBinlogCoordinatesByTime(inst.RelayLog, time.Unix(test.timestamp, 0))
+		if err != nil {
+			t.Errorf("Unexpected error: %+v", err)
+			continue
+		}
+		if !coordinates.Equals(&test.expected) {
+			t.Errorf("At %d: expected %+v, got %+v", test.timestamp, test.expected, coordinates)
+		}
+	}
+	if _, err := osagent.FindBinlogCoordinatesByTime(inst.RelayLog, time.Unix(1600000041, 0)); err == nil {
+		t.Errorf("Expected error looking past the last event")
+	}
+
+	coordinates, err := osagent.FindBinlogCoordinatesByGtid(inst.RelayLog, testUUID+":2")
+	if err != nil || coordinates.LogFile != relaylog1 || coordinates.LogPos != positions1[1] {
+		t.Errorf("Unexpected coordinates of GTID 2: %+v, %+v", coordinates, err)
+	}
+	coordinates, err = osagent.FindBinlogCoordinatesByGtid(inst.RelayLog, strings.ToUpper(testUUID)+":5")
+	if err != nil || coordinates.LogFile != relaylog2 || coordinates.LogPos != positions2[1] {
+		t.Errorf("Unexpected coordinates of GTID 5: %+v, %+v", coordinates, err)
+	}
+	if _, err := osagent.FindBinlogCoordinatesByGtid(inst.RelayLog, testUUID+":6"); err == nil {
+		t.Errorf("Expected error looking for a missing GTID")
+	}
+	if _, err := osagent.FindBinlogCoordinatesByGtid(inst.RelayLog, testUUID+":1-2"); err == nil {
+		t.Errorf("Expected error looking for a GTID range")
+	}
+}
+
+func TestStreamMySQLBinlogBinaryContents(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	defer func(mySQLClientCommand string) { config.Config.MySQLClientCommand = mySQLClientCommand }(config.Config.MySQLClientCommand)
+	config.Config.MySQLClientCommand = ""
+
+	binlog := path.Join(directory, "relay-bin.000001")
+	writeTestBinlog(t, binlog, []string{"create table a (id int)", "create table b (id int)"}, nil)
+	expected, _ := ioutil.ReadFile(binlog)
+
+	for _, compress := range []bool{false, true} {
+		var output bytes.Buffer
+		digest, err := osagent.StreamMySQLBinlogBinaryContents(&output, compress, []string{binlog}, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := output.Bytes()
+		if compress {
+			gzipReader, err := gzip.NewReader(&output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, _ = ioutil.ReadAll(gzipReader)
+		}
+		if !bytes.Equal(contents, expected) || digest.Length != int64(len(expected)) {
+			t.Errorf("Unexpected streamed contents (compress: %t): %d bytes, digest %+v", compress, len(contents), digest)
+		}
+	}
+
+	var output bytes.Buffer
+	digest, _ := osagent.StreamMySQLBinlogBinaryContents(&output, true, []string{binlog}, 0, 0)
+	streamed := output.Bytes()
+	if _, err := osagent.ApplyRelaylogContentsStream(bytes.NewReader(streamed), true, func() (*osagent.ContentDigest, error) { return &digest, nil }, osagent.RelaylogApplyOptions{DryRun: true}); err != nil {
+		t.Errorf("Unexpected error applying streamed contents: %+v", err)
+	}
+	corrupt := osagent.ContentDigest{Length: digest.Length, Checksum: strings.Repeat("0", 64)}
+	if _, err := osagent.ApplyRelaylogContentsStream(bytes.NewReader(streamed), true, func() (*osagent.ContentDigest, error) { return &corrupt, nil }, osagent.RelaylogApplyOptions{DryRun: true}); err == nil {
+		t.Errorf("Expected error applying contents on checksum mismatch")
+	}
+	// Contents are not reported as applied where there is no client to apply them with
+	if _, err := osagent.ApplyRelaylogContentsStream(bytes.NewReader(streamed), true, func() (*osagent.ContentDigest, error) { return &digest, nil }, osagent.RelaylogApplyOptions{}); err == nil {
+		t.Errorf("Expected error applying contents with MySQLClientCommand unconfigured")
+	}
+}
+
+// writeTestRowsBinlog writes a binary log of three GTID transactions: a DDL statement on schema test, a row
+// change on test.t1 and a row change on other.t2, returning the position of each
+func writeTestRowsBinlog(t *testing.T, fileName string) []int64 {
+	sid, _ := hex.DecodeString(strings.Replace(testUUID, "-", "", -1))
+	le := func(size int, value uint64) []byte {
+		result := make([]byte, 8)
+		binary.LittleEndian.PutUint64(result, value)
+		return result[:size]
+	}
+	binlog := append(append([]byte{}, inst.BinlogMagic...), inst.EncodeFormatDescriptionEvent("8.0.20", 1600000000, 1, inst.BinlogChecksumAlgCRC32)...)
+	addEvent := func(eventType inst.BinlogEventType, body []byte) {
+		header := inst.BinlogEventHeader{Timestamp: 1600000000, EventType: eventType, ServerId: 1}
+		binlog = append(binlog, inst.EncodeBinlogEvent(header, int64(len(binlog)), body, true)...)
+	}
+	query := func(database string, query string) []byte {
+		return bytes.Join([][]byte{le(4, 7), le(4, 0), {byte(len(database))}, le(2, 0), le(2, 0), []byte(database), {0}, []byte(query)}, nil)
+	}
+	positions := []int64{}
+	addGtid := func(gno uint64) {
+		positions = append(positions, int64(len(binlog)))
+		addEvent(inst.GtidEventType, bytes.Join([][]byte{{1}, sid, le(8, gno)}, nil))
+	}
+	addGtid(1)
+	addEvent(inst.QueryEventType, query("test", "create table t1 (id int)"))
+	for i, table := range [][]byte{[]byte("\x04test\x00\x02t1\x00"), []byte("\x05other\x00\x02t2\x00")} {
+		addGtid(uint64(i + 2))
+		addEvent(inst.QueryEventType, query("", "BEGIN"))
+		addEvent(inst.TableMapEventType, bytes.Join([][]byte{le(6, 70), le(2, 1), table, {1, 3, 0, 0}}, nil))
+		addEvent(inst.WriteRowsEventV2, bytes.Join([][]byte{le(6, 70), le(2, 1), le(2, 2), {1, 0xff, 0}, le(4, 42)}, nil))
+		addEvent(inst.XidEventType, le(8, uint64(i)))
+	}
+	if err := ioutil.WriteFile(fileName, binlog, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return positions
+}
+
+func TestApplyRelaylogContentsDryRun(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	binlog := path.Join(directory, "relay-bin.000001")
+	positions := writeTestRowsBinlog(t, binlog)
+	contents, _ := ioutil.ReadFile(binlog)
+
+	apply := func(options osagent.RelaylogApplyOptions) *osagent.RelaylogApplyReport {
+		options.DryRun = true
+		report, err := osagent.ApplyRelaylogContentsStream(bytes.NewReader(contents), false, func() (*osagent.ContentDigest, error) { return nil, nil }, options)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return report
+	}
+
+	report := apply(osagent.RelaylogApplyOptions{})
+	if report.TransactionsApplied != 3 || report.EventsSkipped != 0 || report.LastAppliedGtid != testUUID+":3" || !strings.Contains(report.SQL, "create table t1") {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	report = apply(osagent.RelaylogApplyOptions{Filter: osagent.BinlogFilter{SkipTables: []string{"test.*"}}, StopPosition: positions[2]})
+	if report.TransactionsApplied != 2 || report.EventsSkipped != 3 || report.StopCoordinates == nil || report.StopCoordinates.LogPos != positions[2] {
+		t.Errorf("Unexpected filtered report: %+v", report)
+	}
+	// Rows of test.t1 filtered out, leaving the format description the only BINLOG statement
+	if strings.Contains(report.SQL, "create table t1") || strings.Count(report.SQL, "BINLOG '") != 1 || strings.Contains(report.SQL, testUUID+":3") {
+		t.Errorf("Unexpected filtered SQL:\n%s", report.SQL)
+	}
+	// The filtered statement's GTID is consumed by an empty transaction
+	if !strings.Contains(report.SQL, "BEGIN/*!*/;\nCOMMIT/*!*/;") {
+		t.Errorf("Expected empty transaction in:\n%s", report.SQL)
+	}
+
+	if _, err := osagent.ApplyRelaylogContents([]byte("not base64"), osagent.RelaylogApplyOptions{DryRun: true}); err == nil {
+		t.Errorf("Expected error applying malformed contents")
+	}
+}
+
+func TestApplyRelaylogContentsRequestId(t *testing.T) {
+	defer func(mySQLClientCommand string) { config.Config.MySQLClientCommand = mySQLClientCommand }(config.Config.MySQLClientCommand)
+	defer func(stateDirectory string) { config.Config.StateDirectory = stateDirectory }(config.Config.StateDirectory)
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	config.Config.StateDirectory = directory
+	osagent.ForgetRelaylogApplyRequests()
+	binlog := path.Join(directory, "relay-bin.000001")
+	positions := writeTestRowsBinlog(t, binlog)
+	contents, _ := ioutil.ReadFile(binlog)
+
+	apply := func(contents []byte) (*osagent.RelaylogApplyReport, error) {
+		return osagent.ApplyRelaylogContentsStream(bytes.NewReader(contents), false, nil, osagent.RelaylogApplyOptions{RequestId: "test-request-id"})
+	}
+	appliedPositions := func(report *osagent.RelaylogApplyReport) (result []int64) {
+		for _, transaction := range report.Transactions {
+			result = append(result, transaction.Position)
+		}
+		return result
+	}
+
+	// The client fails past the first transaction
+	config.Config.MySQLClientCommand = `awk '/AS progress_marker/ { print $2; if ($2 == 0) exit 1 }'`
+	report, err := apply(contents)
+	if err == nil || report == nil || !reflect.DeepEqual(appliedPositions(report), positions[:1]) || report.LastAppliedGtid != testUUID+":1" {
+		t.Fatalf("Expected failure after first transaction, got %+v, %+v", report, err)
+	}
+	// A retry, following a restart, resumes past the applied transaction
+	osagent.ForgetRelaylogApplyRequests()
+	config.Config.MySQLClientCommand = `awk '/AS progress_marker/ { print $2 }'`
+	report, err = apply(contents)
+	if err != nil || !reflect.DeepEqual(appliedPositions(report), positions[1:]) || report.TransactionsSkipped != 1 || report.Deduplicated {
+		t.Fatalf("Unexpected retry report: %+v, %+v", report, err)
+	}
+	// Once applied, the request is not applied again, restart or not
+	config.Config.MySQLClientCommand = "false"
+	osagent.ForgetRelaylogApplyRequests()
+	report, err = apply(contents)
+	if err != nil || !report.Deduplicated || !reflect.DeepEqual(appliedPositions(report), positions[1:]) {
+		t.Errorf("Expected deduplicated report, got %+v, %+v", report, err)
+	}
+	if _, err := apply(contents[:positions[2]]); err == nil {
+		t.Errorf("Expected error reusing request id for different contents")
+	}
+}
+
+func TestGetRelayLogEndCoordinates(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	config.Config.MySQLDatadirCommand = "echo " + directory
+
+	relaylog := path.Join(directory, "relay-bin.000001")
+	writeTestGtidBinlog(t, relaylog, 0, []int64{1, 2, 3}, []uint32{1600000000, 1600000010, 1600000020})
+	if err := ioutil.WriteFile(path.Join(directory, "relay-bin.index"), []byte("./relay-bin.000001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(relaylog)
+	size := int64(len(contents))
+
+	coordinates, err := osagent.GetRelayLogEndCoordinates()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if coordinates.LogFile != relaylog || coordinates.LogPos != size || coordinates.Gtid != testUUID+":3" || coordinates.Truncated {
+		t.Errorf("Unexpected end coordinates: %+v", coordinates)
+	}
+
+	// The IO thread has written part of the next transaction's GTID event
+	partial := inst.EncodeBinlogEvent(inst.BinlogEventHeader{Timestamp: 1600000030, EventType: inst.GtidEventType, ServerId: 1}, size, make([]byte, 25), true)
+	if err := ioutil.WriteFile(relaylog, append(contents, partial[:30]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	coordinates, err = osagent.GetRelayLogEndCoordinates()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if coordinates.LogPos != size || coordinates.Gtid != testUUID+":3" || !coordinates.Truncated {
+		t.Errorf("Unexpected end coordinates of truncated log: %+v", coordinates)
+	}
+}
+
+func TestBinlogFileScanCache(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	config.Config.MySQLDatadirCommand = "echo " + directory
+	relaylog1, relaylog2 := path.Join(directory, "relay-bin.000001"), path.Join(directory, "relay-bin.000002")
+	writeIndex := func(fileNames ...string) {
+		if err := ioutil.WriteFile(path.Join(directory, "relay-bin.index"), []byte(strings.Join(fileNames, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectEnd := func(fileName string, gtid string) {
+		coordinates, err := osagent.GetRelayLogEndCoordinates()
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		fileInfo, _ := os.Stat(fileName)
+		if coordinates.LogFile != fileName || coordinates.LogPos != fileInfo.Size() || coordinates.Gtid != gtid {
+			t.Errorf("Expected end of %s at %d, %s; got %+v", fileName, fileInfo.Size(), gtid, coordinates)
+		}
+	}
+	writeIndex(relaylog1)
+	writeTestGtidBinlog(t, relaylog1, 0, []int64{1, 2, 3}, []uint32{1600000000, 1600000010, 1600000020})
+	expectEnd(relaylog1, testUUID+":3")
+
+	// A different, larger log of the same name and file: not to be resumed where the scan of the former ended
+	writeTestGtidBinlog(t, relaylog1, 0, []int64{7, 8, 9, 10}, []uint32{1700000000, 1700000010, 1700000020, 1700000030})
+	expectEnd(relaylog1, testUUID+":10")
+
+	// Another log of the same name, size, modification time and format description, in a new file
+	fileInfo, _ := os.Stat(relaylog1)
+	replacement := path.Join(directory, "replacement")
+	writeTestGtidBinlog(t, replacement, 0, []int64{11, 12, 13, 14}, []uint32{1700000000, 1700000010, 1700000020, 1700000030})
+	os.Chtimes(replacement, fileInfo.ModTime(), fileInfo.ModTime())
+	if err := os.Rename(replacement, relaylog1); err != nil {
+		t.Fatal(err)
+	}
+	expectEnd(relaylog1, testUUID+":14")
+
+	// Scans of logs purged off the index are dropped
+	writeTestGtidBinlog(t, relaylog2, 14, []int64{15}, []uint32{1700000040})
+	writeIndex(relaylog1, relaylog2)
+	expectEnd(relaylog2, testUUID+":15")
+	if !osagent.CachedBinlogFileScans()[relaylog1] {
+		t.Errorf("Expected scan of %s to be cached", relaylog1)
+	}
+	writeIndex(relaylog2)
+	expectEnd(relaylog2, testUUID+":15")
+	if osagent.CachedBinlogFileScans()[relaylog1] {
+		t.Errorf("Expected scan of purged %s to be dropped", relaylog1)
+	}
+}
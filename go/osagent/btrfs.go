@@ -0,0 +1,181 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+)
+
+// BtrfsBackend is a StorageBackend on top of btrfs subvolume snapshots.
+// Snapshots are plain directories within SnapshotsDirectory; mounting them is a bind mount.
+type BtrfsBackend struct {
+	Subvolume          string
+	SnapshotsDirectory string
+	runCommand         CommandRunner
+}
+
+// NewBtrfsBackend creates a btrfs backend snapshotting given subvolume into given directory, executing commands via given runner
+func NewBtrfsBackend(subvolume string, snapshotsDirectory string, runCommand CommandRunner) *BtrfsBackend {
+	return &BtrfsBackend{
+		Subvolume:          subvolume,
+		SnapshotsDirectory: snapshotsDirectory,
+		runCommand:         runCommand,
+	}
+}
+
+func (this *BtrfsBackend) Name() string {
+	return BtrfsStorageBackend
+}
+
+// snapshotPath resolves a snapshot name into its path, refusing anything outside SnapshotsDirectory
+func (this *BtrfsBackend) snapshotPath(snapshotName string) (string, error) {
+	if this.SnapshotsDirectory == "" {
+		return "", errors.New("BtrfsSnapshotsDirectory is unconfigured")
+	}
+	if snapshotName == "" {
+		return "", errors.New("Empty snapshot name")
+	}
+	snapshotPath := path.Clean(snapshotName)
+	if !path.IsAbs(snapshotPath) {
+		snapshotPath = path.Join(this.SnapshotsDirectory, snapshotPath)
+	}
+	if path.Dir(snapshotPath) != path.Clean(this.SnapshotsDirectory) {
+		return "", fmt.Errorf("%s is not a snapshot within %s", snapshotName, this.SnapshotsDirectory)
+	}
+	return snapshotPath, nil
+}
+
+// snapshotsDirectoryFromRoot resolves SnapshotsDirectory relative to the root of its filesystem, which is how
+// btrfs lists subvolume paths. The filesystem may be mounted anywhere, and may be mounted by subvolume.
+func (this *BtrfsBackend) snapshotsDirectoryFromRoot() (string, error) {
+	snapshotsDirectory := path.Clean(this.SnapshotsDirectory)
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return "", err
+	}
+	mountInfo := FindContainingMountInfo(mounts, snapshotsDirectory)
+	if mountInfo == nil {
+		return "", fmt.Errorf("Cannot find mount containing %s", snapshotsDirectory)
+	}
+	relativePath := strings.TrimPrefix(snapshotsDirectory, mountInfo.MountPoint)
+	// Listed paths directly under the filesystem root have "." as their directory
+	return path.Join(".", path.Join(mountInfo.Root, relativePath)[1:]), nil
+}
+
+func (this *BtrfsBackend) Volumes(volumeName string, filterPattern string) ([]LogicalVolume, error) {
+	if this.SnapshotsDirectory == "" {
+		return nil, errors.New("BtrfsSnapshotsDirectory is unconfigured")
+	}
+	snapshotsDirectory, err := this.snapshotsDirectoryFromRoot()
+	if err != nil {
+		return nil, err
+	}
+	// -o lists only subvolumes below the subvolume containing given path, -s lists only snapshots. Each line ends
+	// with "path <path>", relative to the filesystem root
+	output, err := this.runCommand(sudoCmd(fmt.Sprintf("btrfs subvolume list -s -o %s", this.SnapshotsDirectory)))
+	lines, err := outputLines(output, err)
+	if err != nil {
+		return nil, err
+	}
+
+	logicalVolumes := []LogicalVolume{}
+	for _, line := range lines {
+		tokens := strings.SplitN(line, " path ", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		listedPath := path.Clean(strings.TrimSpace(tokens[1]))
+		if path.Dir(listedPath) != snapshotsDirectory {
+			// Snapshots elsewhere within the subvolume, or nested within other snapshots
+			continue
+		}
+		name := path.Base(listedPath)
+		logicalVolume := LogicalVolume{
+			Name:       name,
+			GroupName:  this.Subvolume,
+			Path:       path.Join(this.SnapshotsDirectory, name),
+			IsSnapshot: true,
+			Backend:    BtrfsStorageBackend,
+		}
+		if volumeName != "" && volumeName != logicalVolume.Name && volumeName != logicalVolume.Path {
+			continue
+		}
+		if strings.Contains(logicalVolume.Name, filterPattern) {
+			logicalVolumes = append(logicalVolumes, logicalVolume)
+		}
+	}
+	return logicalVolumes, nil
+}
+
+// CreateSnapshot runs CreateSnapshotCommand if configured, or otherwise takes a read-only snapshot of the subvolume
+func (this *BtrfsBackend) CreateSnapshot() error {
+	if config.Config.CreateSnapshotCommand != "" {
+		_, err := this.runCommand(config.Config.CreateSnapshotCommand)
+		return err
+	}
+	if this.Subvolume == "" {
+		return errors.New("BtrfsSubvolume is unconfigured")
+	}
+	snapshotPath, err := this.snapshotPath(fmt.Sprintf("orchestrator-agent-%s", time.Now().Format("20060102150405")))
+	if err != nil {
+		return err
+	}
+	_, err = this.runCommand(sudoCmd(fmt.Sprintf("btrfs subvolume snapshot -r %s %s", this.Subvolume, snapshotPath)))
+	return err
+}
+
+// Mount bind-mounts the snapshot directory onto mountPoint
+func (this *BtrfsBackend) Mount(mountPoint string, volumeName string) (Mount, error) {
+	mount := Mount{
+		Path:      mountPoint,
+		IsMounted: false,
+	}
+	snapshotPath, err := this.snapshotPath(volumeName)
+	if err != nil {
+		return mount, err
+	}
+	if _, err := this.runCommand(sudoCmd(fmt.Sprintf("mount --bind %s %s", snapshotPath, mountPoint))); err != nil {
+		return mount, err
+	}
+	return GetMount(mountPoint)
+}
+
+func (this *BtrfsBackend) Unmount(mountPoint string) (Mount, error) {
+	mount := Mount{
+		Path:      mountPoint,
+		IsMounted: false,
+	}
+	if _, err := this.runCommand(sudoCmd(fmt.Sprintf("umount %s", mountPoint))); err != nil {
+		return mount, err
+	}
+	return GetMount(mountPoint)
+}
+
+func (this *BtrfsBackend) Remove(volumeName string) error {
+	snapshotPath, err := this.snapshotPath(volumeName)
+	if err != nil {
+		return err
+	}
+	_, err = this.runCommand(sudoCmd(fmt.Sprintf("btrfs subvolume delete %s", snapshotPath)))
+	return err
+}
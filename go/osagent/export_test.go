@@ -0,0 +1,59 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"io/ioutil"
+
+	"github.com/github/orchestrator-agent/go/inst"
+)
+
+var ScanBinlogFile = scanBinlogFile
+var SelectPITRStart = selectPITRStart
+var PITRBinlogFilesUpTo = pitrBinlogFilesUpTo
+
+// ReplayBinlogFile renders a log as SQL, from given position up to a stop point, and returns the replay's report
+func ReplayBinlogFile(fileName string, startPosition int64, stop BinlogStopPoint, executedGtids *inst.GtidSet) (BinlogReplayReport, error) {
+	replay, err := newBinlogReplay(stop, BinlogFilter{}, executedGtids)
+	if err != nil {
+		return BinlogReplayReport{}, err
+	}
+	err = replay.replayFile(fileName, fileName, startPosition, inst.NewBinlogSQLWriter(ioutil.Discard))
+	if err == errBinlogReplayStopped {
+		err = nil
+	}
+	return replay.report, err
+}
+
+// CachedBinlogFileScans returns the names of logs whose scans are cached
+func CachedBinlogFileScans() map[string]bool {
+	binlogFileScansMutex.Lock()
+	defer binlogFileScansMutex.Unlock()
+	fileNames := map[string]bool{}
+	for fileName := range binlogFileScans {
+		fileNames[fileName] = true
+	}
+	return fileNames
+}
+
+// ForgetRelaylogApplyRequests drops apply requests held in memory, as does a restart of the agent
+func ForgetRelaylogApplyRequests() {
+	relaylogApplyRequestsMutex.Lock()
+	defer relaylogApplyRequestsMutex.Unlock()
+
+	relaylogApplyRequests = nil
+}
@@ -0,0 +1,252 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+)
+
+// BinlogFlashbackRequest tells which row changes to undo: those logged from (inclusive) one set of coordinates
+// to (exclusive) another, possibly across logs, of tables passing the filter
+type BinlogFlashbackRequest struct {
+	From   inst.BinlogCoordinates
+	To     inst.BinlogCoordinates
+	Filter BinlogFilter
+	Apply  bool
+}
+
+// BinlogFlashbackTransaction holds the statements undoing a transaction
+type BinlogFlashbackTransaction struct {
+	Gtid        string
+	Coordinates inst.BinlogCoordinates // of the transaction undone
+	Statements  []string
+	Undone      bool // the statements are applied
+}
+
+// BinlogFlashback holds the statements undoing row changes, by transaction, in the order they are to be applied:
+// latest transaction first
+type BinlogFlashback struct {
+	Transactions []BinlogFlashbackTransaction
+	RowsReversed int64
+	Warnings     []string // changes which are not undone, e.g. statements logged as such
+	Applied      bool
+	// On apply, the number of transactions undone; where applying fails, these are the first ones, as flagged
+	TransactionsUndone int64
+}
+
+// SQL renders the flashback as a script for the mysql command line client, a transaction at a time
+func (this *BinlogFlashback) SQL() string {
+	return this.sql(false)
+}
+
+// sql renders the flashback as SQL, optionally followed by a progress marker per transaction, as with relay logs
+// applied, telling which transactions are undone should the client fail
+func (this *BinlogFlashback) sql(withProgressMarkers bool) string {
+	var output bytes.Buffer
+	for i, transaction := range this.Transactions {
+		fmt.Fprintf(&output, "# Undo transaction at %s", transaction.Coordinates.DisplayString())
+		if transaction.Gtid != "" {
+			fmt.Fprintf(&output, ", GTID %s", transaction.Gtid)
+		}
+		fmt.Fprintf(&output, "\n")
+		fmt.Fprintf(&output, "BEGIN;\n")
+		for _, statement := range transaction.Statements {
+			fmt.Fprintf(&output, "%s;\n", statement)
+		}
+		fmt.Fprintf(&output, "COMMIT;\n")
+		if withProgressMarkers {
+			fmt.Fprintf(&output, "SELECT %d AS progress_marker;\n", i)
+		}
+	}
+	return output.String()
+}
+
+// tableColumns reads the columns of a table off the live server, in order
+func tableColumns(database string, table string) ([]inst.TableColumn, error) {
+	db, err := openMySQL()
+	if err != nil {
+		return nil, err
+	}
+	columns := []inst.TableColumn{}
+	query := `
+		select column_name, data_type, column_type, extra
+			from information_schema.columns
+			where table_schema = ? and table_name = ?
+			order by ordinal_position
+		`
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		columns = append(columns, inst.TableColumn{
+			Name:      m.GetString("column_name"),
+			DataType:  strings.ToLower(m.GetString("data_type")),
+			Unsigned:  strings.Contains(strings.ToLower(m.GetString("column_type")), "unsigned"),
+			Generated: strings.Contains(strings.ToUpper(m.GetString("extra")), "GENERATED"),
+		})
+		return nil
+	}, database, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("Table %s.%s not found", database, table)
+	}
+	return columns, nil
+}
+
+// resolveCoordinatesRange maps a range's logs onto the server's, listing the logs it spans
+func resolveCoordinatesRange(from inst.BinlogCoordinates, to inst.BinlogCoordinates) (*inst.BinlogCoordinatesRange, []string, error) {
+	var err error
+	if from.LogFile, err = ResolveLogFile(from.LogFile); err != nil {
+		return nil, nil, err
+	}
+	if to.LogFile, err = ResolveLogFile(to.LogFile); err != nil {
+		return nil, nil, err
+	}
+	coordinatesRange, err := inst.NewBinlogCoordinatesRange(from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	logFiles, err := coordinatesRange.LogFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, logFile := range logFiles {
+		if _, err := ResolveLogFile(logFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return coordinatesRange, logFiles, nil
+}
+
+// FlashbackBinlogs computes the statements undoing the row changes of a range of binary or relay logs, and given
+// Apply, applies them by MySQLClientCommand. Each transaction is undone by a transaction of its own, and
+// transactions are undone latest first; should applying fail, those undone are flagged as such. Table columns are
+// read off the live server, and are to match the tables' schema as logged.
+func FlashbackBinlogs(request BinlogFlashbackRequest) (*BinlogFlashback, error) {
+	if err := request.Filter.validate(); err != nil {
+		return nil, log.Errore(err)
+	}
+	coordinatesRange, logFiles, err := resolveCoordinatesRange(request.From, request.To)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	if request.Apply && config.Config.MySQLClientCommand == "" {
+		return nil, log.Errorf("MySQLClientCommand is not configured; cannot apply flashback")
+	}
+
+	flashback := &BinlogFlashback{Transactions: []BinlogFlashbackTransaction{}, Warnings: []string{}}
+	columnsByTable := make(map[string][]inst.TableColumn)
+	tracker := &inst.BinlogTransactionTracker{}
+	var transaction *BinlogFlashbackTransaction
+	endTransaction := func() {
+		if transaction != nil && len(transaction.Statements) > 0 {
+			flashback.Transactions = append([]BinlogFlashbackTransaction{*transaction}, flashback.Transactions...)
+		}
+		transaction = nil
+	}
+	err = readBinlogEvents(logFiles, coordinatesRange.From.LogPos, coordinatesRange.To.LogPos, func(binlogIndex int, event *inst.BinlogEvent) error {
+		groupStart := !tracker.InGroup() && !event.EventType.IsGroupless()
+		groupEnd := tracker.Track(event)
+		if groupStart {
+			transaction = &BinlogFlashbackTransaction{
+				Gtid:        tracker.Gtid,
+				Coordinates: inst.BinlogCoordinates{LogFile: logFiles[binlogIndex], LogPos: tracker.GroupStart, Type: request.From.Type},
+			}
+		}
+		switch payload := event.Payload.(type) {
+		case *inst.RowsEvent:
+			if request.Filter.skips(event) {
+				break
+			}
+			table := fmt.Sprintf("%s.%s", payload.Database, payload.Table)
+			columns, ok := columnsByTable[table]
+			if !ok {
+				var err error
+				if columns, err = tableColumns(payload.Database, payload.Table); err != nil {
+					return err
+				}
+				columnsByTable[table] = columns
+			}
+			statements, err := event.FlashbackStatements(columns)
+			if err != nil {
+				return fmt.Errorf("%s: %+v", logFiles[binlogIndex], err)
+			}
+			// Later events of a transaction are undone first
+			transaction.Statements = append(statements, transaction.Statements...)
+			flashback.RowsReversed += int64(len(statements))
+		case *inst.QueryEvent:
+			switch strings.ToUpper(strings.TrimSpace(payload.Query)) {
+			case "BEGIN", "COMMIT", "ROLLBACK":
+			default:
+				if !request.Filter.skips(event) {
+					flashback.Warnings = append(flashback.Warnings, fmt.Sprintf("Statement at %s:%d not undone: %s", path.Base(logFiles[binlogIndex]), event.Position, payload.Query))
+				}
+			}
+		default:
+			switch event.EventType {
+			case inst.PartialUpdateRowsEvent, inst.TransactionPayloadEvent:
+				return fmt.Errorf("%s: %s event at position %d not supported by flashback", logFiles[binlogIndex], event.EventType, event.Position)
+			}
+		}
+		if groupEnd {
+			endTransaction()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	if transaction != nil && len(transaction.Statements) > 0 {
+		flashback.Warnings = append(flashback.Warnings, fmt.Sprintf("Transaction at %s is cut short by the end of the range", transaction.Coordinates.DisplayString()))
+	}
+	endTransaction()
+
+	if request.Apply && len(flashback.Transactions) > 0 {
+		sqlFile, err := ioutil.TempFile("", "orchestrator-agent-flashback-sql-")
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+		defer os.Remove(sqlFile.Name())
+		_, err = sqlFile.WriteString(flashback.sql(true))
+		sqlFile.Close()
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+		markers, err := applyMarkedSQLFile(sqlFile.Name())
+		for _, index := range markers {
+			if index < len(flashback.Transactions) && !flashback.Transactions[index].Undone {
+				flashback.Transactions[index].Undone = true
+				flashback.TransactionsUndone++
+			}
+		}
+		if err != nil {
+			return flashback, log.Errorf("Undid %d of %d transactions from %s: %+v", flashback.TransactionsUndone, len(flashback.Transactions), coordinatesRange.From.DisplayString(), err)
+		}
+		flashback.Applied = true
+		log.Infof("Applied flashback of %s: %d transactions, %d rows", coordinatesRange.From.DisplayString(), len(flashback.Transactions), flashback.RowsReversed)
+	}
+	return flashback, nil
+}
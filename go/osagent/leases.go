@@ -0,0 +1,187 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/outbrain/golib/log"
+)
+
+// Lease is a claim on a resource (a mount point or a volume) by a holder (e.g. a running seed).
+// A leased resource may not be unmounted or removed unless forced. Leases expire unless renewed,
+// such that a resource is not held forever by a holder which has gone away.
+type Lease struct {
+	Id        string
+	Resource  string
+	Holder    string
+	Acquired  time.Time
+	ExpiresAt time.Time
+}
+
+// IsExpired returns true when the lease was not renewed in time
+func (this *Lease) IsExpired() bool {
+	return time.Now().After(this.ExpiresAt)
+}
+
+var leases = make(map[string]*Lease)
+var leasesMutex = &sync.Mutex{}
+
+func leaseTTL() time.Duration {
+	if config.Config.LeaseTTLSeconds == 0 {
+		return time.Minute
+	}
+	return time.Duration(config.Config.LeaseTTLSeconds) * time.Second
+}
+
+func newLeaseId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// purgeExpiredLeases removes leases which were not renewed in time. Expects leasesMutex to be held.
+func purgeExpiredLeases() {
+	for id, lease := range leases {
+		if lease.IsExpired() {
+			log.Infof("Lease %s on %s by %s expired", lease.Id, lease.Resource, lease.Holder)
+			delete(leases, id)
+		}
+	}
+}
+
+// AcquireLease places a lease on given resource. Any number of leases may be held on a resource.
+// A zero ttl stands for the configured LeaseTTLSeconds.
+func AcquireLease(resource string, holder string, ttl time.Duration) (*Lease, error) {
+	if resource == "" {
+		return nil, errors.New("Empty resource in AcquireLease")
+	}
+	if ttl <= 0 {
+		ttl = leaseTTL()
+	}
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+
+	now := time.Now()
+	lease := &Lease{
+		Id:        newLeaseId(),
+		Resource:  resource,
+		Holder:    holder,
+		Acquired:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+	leases[lease.Id] = lease
+	log.Debugf("Acquired lease %s on %s by %s", lease.Id, lease.Resource, lease.Holder)
+	result := *lease
+	return &result, nil
+}
+
+// RenewLease extends a lease by given ttl (or LeaseTTLSeconds when zero)
+func RenewLease(leaseId string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		ttl = leaseTTL()
+	}
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+
+	purgeExpiredLeases()
+	lease, ok := leases[leaseId]
+	if !ok {
+		return nil, fmt.Errorf("Lease not found: %s", leaseId)
+	}
+	lease.ExpiresAt = time.Now().Add(ttl)
+	result := *lease
+	return &result, nil
+}
+
+// ReleaseLease removes a lease. Releasing an unknown or expired lease is not an error.
+func ReleaseLease(leaseId string) {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+
+	delete(leases, leaseId)
+}
+
+// ActiveLeases returns unexpired leases on given resource, or on all resources when resource is empty
+func ActiveLeases(resource string) []Lease {
+	leasesMutex.Lock()
+	defer leasesMutex.Unlock()
+
+	purgeExpiredLeases()
+	result := []Lease{}
+	for _, lease := range leases {
+		if resource == "" || lease.Resource == resource {
+			result = append(result, *lease)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Acquired.Before(result[j].Acquired) })
+	return result
+}
+
+// checkNotLeased returns an error when any of given resources is leased
+func checkNotLeased(resources ...string) error {
+	for _, resource := range resources {
+		if activeLeases := ActiveLeases(resource); len(activeLeases) > 0 {
+			return fmt.Errorf("%s is in use: %d active lease(s), first held by %s. Use force to override", resource, len(activeLeases), activeLeases[0].Holder)
+		}
+	}
+	return nil
+}
+
+// WithLease runs given function while holding a lease on given resource. The lease is
+// kept alive for as long as the function runs, and released when it completes.
+func WithLease(resource string, holder string, f func() error) error {
+	lease, err := AcquireLease(resource, holder, 0)
+	if err != nil {
+		return err
+	}
+	return HoldLease(lease, f)
+}
+
+// HoldLease runs given function while holding an acquired lease, keeping it alive for as long as the function
+// runs, and releasing it when it completes. It allows acquiring a lease up front, then running in the background.
+func HoldLease(lease *Lease, f func() error) error {
+	defer ReleaseLease(lease.Id)
+
+	done := make(chan bool)
+	defer close(done)
+	go keepLeaseAlive(lease.Id, done)
+	return f()
+}
+
+// keepLeaseAlive renews a lease periodically, until done is closed
+func keepLeaseAlive(leaseId string, done chan bool) {
+	ticker := time.NewTicker(leaseTTL() / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			RenewLease(leaseId, 0)
+		case <-done:
+			return
+		}
+	}
+}
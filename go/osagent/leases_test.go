@@ -0,0 +1,54 @@
+package osagent_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+func TestLeases(t *testing.T) {
+	first, err := osagent.AcquireLease("/mnt/snapshots/a", "seed:1", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	second, err := osagent.AcquireLease("/mnt/snapshots/a", "sandbox:1", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if leases := osagent.ActiveLeases("/mnt/snapshots/a"); len(leases) != 2 {
+		t.Errorf("Expected 2 leases, got %+v", leases)
+	}
+	if leases := osagent.ActiveLeases("/mnt/snapshots/b"); len(leases) != 0 {
+		t.Errorf("Expected no leases, got %+v", leases)
+	}
+
+	osagent.ReleaseLease(first.Id)
+	if leases := osagent.ActiveLeases("/mnt/snapshots/a"); len(leases) != 1 || leases[0].Holder != "sandbox:1" {
+		t.Errorf("Expected single remaining lease, got %+v", leases)
+	}
+	osagent.ReleaseLease(second.Id)
+	if leases := osagent.ActiveLeases("/mnt/snapshots/a"); len(leases) != 0 {
+		t.Errorf("Expected no leases, got %+v", leases)
+	}
+	if _, err := osagent.AcquireLease("", "seed:1", time.Minute); err == nil {
+		t.Errorf("Expected error leasing empty resource")
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	lease, err := osagent.AcquireLease("lv-expiry", "seed:2", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := osagent.RenewLease(lease.Id, 20*time.Millisecond); err != nil {
+		t.Errorf("Unexpected error renewing lease: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if leases := osagent.ActiveLeases("lv-expiry"); len(leases) != 0 {
+		t.Errorf("Expected lease to expire, got %+v", leases)
+	}
+	if _, err := osagent.RenewLease(lease.Id, time.Minute); err == nil {
+		t.Errorf("Expected error renewing expired lease")
+	}
+}
@@ -0,0 +1,275 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+)
+
+// LogicalVolume describes an LVM volume, or a snapshot on any other storage backend
+type LogicalVolume struct {
+	Name            string
+	GroupName       string
+	Path            string
+	IsSnapshot      bool
+	SnapshotPercent float64
+	Backend         string
+	Size            int64     // bytes
+	Origin          string    // for snapshots, the origin volume
+	CreationTime    time.Time // zero when unknown
+	Attributes      string    // raw lv_attr, e.g. swi-aos---
+	IsActive        bool
+	IsOpen          bool
+	DataPercent     float64 // for thin volumes
+	GroupFree       int64   // free bytes in the volume group
+}
+
+// VolumeGroup describes an LVM volume group
+type VolumeGroup struct {
+	Name          string
+	Size          int64
+	Free          int64
+	LVCount       int
+	SnapshotCount int
+}
+
+// IsSnapshotValid returns true when this volume is a snapshot which has not overflowed
+func (this *LogicalVolume) IsSnapshotValid() bool {
+	if !this.IsSnapshot {
+		return false
+	}
+	if this.SnapshotPercent >= 100.0 {
+		return false
+	}
+	return true
+}
+
+// LVMBackend is a StorageBackend on top of LVM logical volumes and snapshots
+type LVMBackend struct {
+	runCommand CommandRunner
+}
+
+var lvmBackend = NewLVMBackend(commandOutput)
+
+// NewLVMBackend creates an LVM backend which executes commands via given runner
+func NewLVMBackend(runCommand CommandRunner) *LVMBackend {
+	return &LVMBackend{runCommand: runCommand}
+}
+
+func (this *LVMBackend) Name() string {
+	return LVMStorageBackend
+}
+
+// lvmReport is the structure of `lvs`/`vgs` output in --reportformat json. All values are reported as strings.
+type lvmReport struct {
+	Report []struct {
+		LV []map[string]string `json:"lv"`
+		VG []map[string]string `json:"vg"`
+	} `json:"report"`
+}
+
+// lvmReportRows runs given lvs/vgs command in json report format and returns its rows
+func (this *LVMBackend) lvmReportRows(command string) (rows []map[string]string, err error) {
+	output, err := this.runCommand(sudoCmd(fmt.Sprintf("%s --reportformat json --units b --nosuffix", command)))
+	if err != nil {
+		return rows, err
+	}
+	report := lvmReport{}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return rows, fmt.Errorf("Cannot parse LVM report: %s", err.Error())
+	}
+	for _, reportEntry := range report.Report {
+		rows = append(rows, reportEntry.LV...)
+		rows = append(rows, reportEntry.VG...)
+	}
+	return rows, nil
+}
+
+func (this *LVMBackend) Volumes(volumeName string, filterPattern string) ([]LogicalVolume, error) {
+	rows, err := this.lvmReportRows(fmt.Sprintf("lvs -o lv_name,vg_name,lv_path,lv_size,origin,lv_time,lv_attr,snap_percent,data_percent,vg_free %s", volumeName))
+	if err != nil {
+		return nil, err
+	}
+
+	logicalVolumes := []LogicalVolume{}
+	for _, row := range rows {
+		logicalVolume := LogicalVolume{
+			Name:       row["lv_name"],
+			GroupName:  row["vg_name"],
+			Path:       row["lv_path"],
+			Origin:     row["origin"],
+			Attributes: row["lv_attr"],
+			Backend:    LVMStorageBackend,
+		}
+		logicalVolume.Size, _ = strconv.ParseInt(row["lv_size"], 10, 64)
+		logicalVolume.GroupFree, _ = strconv.ParseInt(row["vg_free"], 10, 64)
+		logicalVolume.DataPercent, _ = strconv.ParseFloat(row["data_percent"], 64)
+		logicalVolume.CreationTime, _ = time.Parse("2006-01-02 15:04:05 -0700", row["lv_time"])
+		// lv_attr is e.g. "swi-aos---": 5th character is state, 6th is device open
+		if len(logicalVolume.Attributes) >= 6 {
+			logicalVolume.IsActive = (logicalVolume.Attributes[4] == 'a')
+			logicalVolume.IsOpen = (logicalVolume.Attributes[5] == 'o')
+		}
+		// Thin snapshots report no snap_percent: snapshots are told by their origin, or by an "s"/"S" volume type
+		logicalVolume.SnapshotPercent, _ = strconv.ParseFloat(row["snap_percent"], 64)
+		logicalVolume.IsSnapshot = (logicalVolume.Origin != "")
+		if len(logicalVolume.Attributes) > 0 && strings.ContainsRune("sS", rune(logicalVolume.Attributes[0])) {
+			logicalVolume.IsSnapshot = true
+		}
+		if strings.Contains(logicalVolume.Name, filterPattern) {
+			logicalVolumes = append(logicalVolumes, logicalVolume)
+		}
+	}
+	return logicalVolumes, nil
+}
+
+// VolumeGroups lists LVM volume groups
+func (this *LVMBackend) VolumeGroups() ([]VolumeGroup, error) {
+	rows, err := this.lvmReportRows("vgs -o vg_name,vg_size,vg_free,lv_count,snap_count")
+	if err != nil {
+		return nil, err
+	}
+
+	volumeGroups := []VolumeGroup{}
+	for _, row := range rows {
+		volumeGroup := VolumeGroup{Name: row["vg_name"]}
+		volumeGroup.Size, _ = strconv.ParseInt(row["vg_size"], 10, 64)
+		volumeGroup.Free, _ = strconv.ParseInt(row["vg_free"], 10, 64)
+		volumeGroup.LVCount, _ = strconv.Atoi(row["lv_count"])
+		volumeGroup.SnapshotCount, _ = strconv.Atoi(row["snap_count"])
+		volumeGroups = append(volumeGroups, volumeGroup)
+	}
+	return volumeGroups, nil
+}
+
+// VolumePath returns the device path of given logical volume
+func (this *LVMBackend) VolumePath(volumeName string) (string, error) {
+	if logicalVolumes, err := this.Volumes(volumeName, ""); err == nil && len(logicalVolumes) > 0 {
+		return logicalVolumes[0].Path, err
+	}
+	return "", errors.New(fmt.Sprintf("logical volume not found: %+v", volumeName))
+}
+
+// FSType returns the file system type (e.g. xfs, ext4) of given logical volume
+func (this *LVMBackend) FSType(volumeName string) (string, error) {
+	command := fmt.Sprintf("blkid %s", volumeName)
+	output, err := this.runCommand(sudoCmd(command))
+	lines, err := outputLines(output, err)
+	if err != nil {
+		return "", err
+	}
+	re := regexp.MustCompile(`TYPE="(.*?)"`)
+	for _, line := range lines {
+		if submatch := re.FindStringSubmatch(line); len(submatch) > 1 {
+			return submatch[1], nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("Cannot find FS type for logical volume %s", volumeName))
+}
+
+func (this *LVMBackend) CreateSnapshot() error {
+	_, err := this.runCommand(config.Config.CreateSnapshotCommand)
+	return err
+}
+
+func (this *LVMBackend) Mount(mountPoint string, volumeName string) (Mount, error) {
+	mount := Mount{
+		Path:      mountPoint,
+		IsMounted: false,
+	}
+	if volumeName == "" {
+		return mount, errors.New("Empty volumeName in MountLV")
+	}
+	fsType, err := this.FSType(volumeName)
+	if err != nil {
+		return mount, err
+	}
+
+	mountOptions := ""
+	if fsType == "xfs" {
+		mountOptions = "-o nouuid"
+	}
+	_, err = this.runCommand(sudoCmd(fmt.Sprintf("mount %s %s %s", mountOptions, volumeName, mountPoint)))
+	if err != nil {
+		return mount, err
+	}
+
+	return GetMount(mountPoint)
+}
+
+func (this *LVMBackend) Unmount(mountPoint string) (Mount, error) {
+	mount := Mount{
+		Path:      mountPoint,
+		IsMounted: false,
+	}
+	_, err := this.runCommand(sudoCmd(fmt.Sprintf("umount %s", mountPoint)))
+	if err != nil {
+		return mount, err
+	}
+	return GetMount(mountPoint)
+}
+
+// Merge merges a snapshot back into its origin volume, rolling the origin back to the snapshot's state
+func (this *LVMBackend) Merge(volumeName string) error {
+	_, err := this.runCommand(sudoCmd(fmt.Sprintf("lvconvert --merge %s", volumeName)))
+	return err
+}
+
+func (this *LVMBackend) Remove(volumeName string) error {
+	_, err := this.runCommand(sudoCmd(fmt.Sprintf("lvremove --force %s", volumeName)))
+	return err
+}
+
+func LogicalVolumes(volumeName string, filterPattern string) ([]LogicalVolume, error) {
+	return lvmBackend.Volumes(volumeName, filterPattern)
+}
+
+func VolumeGroups() ([]VolumeGroup, error) {
+	return lvmBackend.VolumeGroups()
+}
+
+func GetLogicalVolumePath(volumeName string) (string, error) {
+	return lvmBackend.VolumePath(volumeName)
+}
+
+func GetLogicalVolumeFSType(volumeName string) (string, error) {
+	return lvmBackend.FSType(volumeName)
+}
+
+func MountLV(mountPoint string, volumeName string) (Mount, error) {
+	return lvmBackend.Mount(mountPoint, volumeName)
+}
+
+func RemoveLV(volumeName string) error {
+	return lvmBackend.Remove(volumeName)
+}
+
+func CreateSnapshot() error {
+	return lvmBackend.CreateSnapshot()
+}
+
+func Unmount(mountPoint string) (Mount, error) {
+	return lvmBackend.Unmount(mountPoint)
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// MountInfoFile is the kernel's per-process mount table
+var MountInfoFile = "/proc/self/mountinfo"
+
+// MountInfo is a single entry of /proc/self/mountinfo, as described in proc(5)
+type MountInfo struct {
+	MountId      int
+	ParentId     int
+	MajorMinor   string
+	Root         string // root of the mount within the source file system; other than "/" for bind mounts
+	MountPoint   string
+	Options      []string
+	FileSystem   string
+	Source       string
+	SuperOptions []string
+}
+
+// IsReadOnly returns true when the mount is read only, either per mount or per super block
+func (this *MountInfo) IsReadOnly() bool {
+	for _, options := range [][]string{this.Options, this.SuperOptions} {
+		for _, option := range options {
+			if option == "ro" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsBindMount returns true when only a sub-tree of the source file system is mounted
+func (this *MountInfo) IsBindMount() bool {
+	return this.Root != "/"
+}
+
+// unescapeMountInfoField decodes octal escapes (e.g. \040 for space) used in mountinfo fields
+func unescapeMountInfoField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var result strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(field[i])
+	}
+	return result.String()
+}
+
+// ParseMountInfo parses mountinfo formatted content
+func ParseMountInfo(reader io.Reader) ([]MountInfo, error) {
+	mounts := []MountInfo{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// Optional fields are terminated by a single "-" field
+		tokens := strings.SplitN(line, " - ", 2)
+		if len(tokens) != 2 {
+			return mounts, fmt.Errorf("Cannot parse mountinfo line: %s", line)
+		}
+		mountFields := strings.Fields(tokens[0])
+		fileSystemFields := strings.Fields(tokens[1])
+		if len(mountFields) < 6 || len(fileSystemFields) < 2 {
+			return mounts, fmt.Errorf("Cannot parse mountinfo line: %s", line)
+		}
+		mount := MountInfo{
+			MajorMinor: mountFields[2],
+			Root:       unescapeMountInfoField(mountFields[3]),
+			MountPoint: unescapeMountInfoField(mountFields[4]),
+			Options:    strings.Split(mountFields[5], ","),
+			FileSystem: fileSystemFields[0],
+			Source:     unescapeMountInfoField(fileSystemFields[1]),
+		}
+		if len(fileSystemFields) > 2 {
+			mount.SuperOptions = strings.Split(fileSystemFields[2], ",")
+		}
+		var err error
+		if mount.MountId, err = strconv.Atoi(mountFields[0]); err != nil {
+			return mounts, fmt.Errorf("Cannot parse mount id in mountinfo line: %s", line)
+		}
+		if mount.ParentId, err = strconv.Atoi(mountFields[1]); err != nil {
+			return mounts, fmt.Errorf("Cannot parse parent id in mountinfo line: %s", line)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// ReadMountInfo reads and parses the mount table of this process
+func ReadMountInfo() ([]MountInfo, error) {
+	file, err := os.Open(MountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMountInfo(file)
+}
+
+// FindMountInfo returns the mount whose mount point is exactly the given path. When multiple
+// mounts are stacked on the same path, the topmost (last) one is returned.
+func FindMountInfo(mounts []MountInfo, mountPoint string) (result *MountInfo) {
+	mountPoint = path.Clean(mountPoint)
+	for i := range mounts {
+		if mounts[i].MountPoint == mountPoint {
+			result = &mounts[i]
+		}
+	}
+	return result
+}
+
+// FindContainingMountInfo returns the mount under which the given path resides, i.e. the mount
+// with the longest mount point which is a prefix of the path.
+func FindContainingMountInfo(mounts []MountInfo, filePath string) (result *MountInfo) {
+	filePath = path.Clean(filePath)
+	for i := range mounts {
+		mountPoint := mounts[i].MountPoint
+		if mountPoint == filePath || mountPoint == "/" || strings.HasPrefix(filePath, mountPoint+"/") {
+			if result == nil || len(mountPoint) >= len(result.MountPoint) {
+				result = &mounts[i]
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package osagent_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+const sampleMountInfo = `22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/vg0-root rw,attr2,inode64,noquota
+40 22 253:2 / /data rw,noatime shared:20 - xfs /dev/mapper/vg0-mysql_data rw,attr2,inode64,noquota
+41 22 253:3 / /tmp rw,relatime shared:21 - ext4 /dev/mapper/vg0-tmp rw
+57 41 253:4 / /tmp/foo ro,relatime shared:30 - xfs /dev/mapper/vg0-mysql--snap ro,nouuid
+58 22 253:2 /mysql/backups /mnt/my\040backups rw,noatime shared:20 - xfs /dev/mapper/vg0-mysql_data rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := osagent.ParseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(mounts) != 5 {
+		t.Fatalf("Expected 5 mounts, got %d", len(mounts))
+	}
+	if mounts[1].MountId != 40 || mounts[1].ParentId != 22 || mounts[1].Source != "/dev/mapper/vg0-mysql_data" || mounts[1].FileSystem != "xfs" {
+		t.Errorf("Unexpected mount: %+v", mounts[1])
+	}
+	if mounts[1].IsReadOnly() || !mounts[3].IsReadOnly() {
+		t.Errorf("Unexpected read only detection")
+	}
+	if mounts[4].MountPoint != "/mnt/my backups" || !mounts[4].IsBindMount() || mounts[1].IsBindMount() {
+		t.Errorf("Unexpected bind mount: %+v", mounts[4])
+	}
+
+	if _, err := osagent.ParseMountInfo(strings.NewReader("garbage\n")); err == nil {
+		t.Errorf("Expected error on malformed mountinfo")
+	}
+}
+
+func TestFindMountInfo(t *testing.T) {
+	mounts, _ := osagent.ParseMountInfo(strings.NewReader(sampleMountInfo))
+
+	if mount := osagent.FindMountInfo(mounts, "/tmp"); mount == nil || mount.Source != "/dev/mapper/vg0-tmp" {
+		t.Errorf("Expected exact match on /tmp, got %+v", mount)
+	}
+	if mount := osagent.FindMountInfo(mounts, "/tmp/foo/"); mount == nil || mount.MountId != 57 {
+		t.Errorf("Expected exact match on /tmp/foo, got %+v", mount)
+	}
+	if mount := osagent.FindMountInfo(mounts, "/tm"); mount != nil {
+		t.Errorf("Expected no match, got %+v", mount)
+	}
+	if mount := osagent.FindContainingMountInfo(mounts, "/data/mysql"); mount == nil || mount.MountPoint != "/data" {
+		t.Errorf("Expected /data to contain /data/mysql, got %+v", mount)
+	}
+	if mount := osagent.FindContainingMountInfo(mounts, "/database"); mount == nil || mount.MountPoint != "/" {
+		t.Errorf("Expected / to contain /database, got %+v", mount)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/outbrain/golib/log"
+)
+
+// SnapshotMountPointFor resolves a mount target name into a mount point under SnapshotMountRoot.
+// An empty target resolves to the legacy, single SnapshotMountPoint.
+func SnapshotMountPointFor(target string) (string, error) {
+	if target == "" {
+		if config.Config.SnapshotMountPoint == "" {
+			return "", errors.New("SnapshotMountPoint is unconfigured")
+		}
+		return config.Config.SnapshotMountPoint, nil
+	}
+	if config.Config.SnapshotMountRoot == "" {
+		return "", errors.New("SnapshotMountRoot is unconfigured; cannot mount on named targets")
+	}
+	if strings.Contains(target, "/") || target == "." || target == ".." {
+		return "", fmt.Errorf("Invalid mount target: %s", target)
+	}
+	return path.Join(config.Config.SnapshotMountRoot, target), nil
+}
+
+// MountSnapshot mounts given volume on the mount point resolved by given target
+func MountSnapshot(target string, volumeName string) (Mount, error) {
+	mountPoint, err := SnapshotMountPointFor(target)
+	if err != nil {
+		return Mount{Path: mountPoint}, err
+	}
+	backend, err := GetStorageBackend()
+	if err != nil {
+		return Mount{Path: mountPoint}, err
+	}
+	if current, err := GetMount(mountPoint); err == nil && current.IsMounted {
+		return current, fmt.Errorf("%s is already mounted", mountPoint)
+	}
+	if target != "" {
+		if _, err := commandOutput(sudoCmd(fmt.Sprintf("mkdir -p %s", mountPoint))); err != nil {
+			return Mount{Path: mountPoint}, err
+		}
+	}
+	mount, err := backend.Mount(mountPoint, volumeName)
+	if err != nil {
+		return mount, err
+	}
+	log.Infof("Mounted %s on %s", volumeName, mountPoint)
+
+	return mount, nil
+}
+
+// UnmountSnapshot unmounts the mount point resolved by given target. Unless forced, it refuses
+// to do so while the mount point is leased.
+func UnmountSnapshot(target string, force bool) (Mount, error) {
+	mountPoint, err := SnapshotMountPointFor(target)
+	if err != nil {
+		return Mount{Path: mountPoint}, err
+	}
+	if !force {
+		if err := checkNotLeased(mountPoint); err != nil {
+			return Mount{Path: mountPoint, IsMounted: true}, err
+		}
+	}
+	backend, err := GetStorageBackend()
+	if err != nil {
+		return Mount{Path: mountPoint}, err
+	}
+	return backend.Unmount(mountPoint)
+}
+
+// RemoveSnapshot removes given volume. Unless forced, it refuses to do so while the volume, by any of its names,
+// or a mount point onto which it is mounted, is leased.
+func RemoveSnapshot(volumeName string, force bool) error {
+	backend, err := GetStorageBackend()
+	if err != nil {
+		return err
+	}
+	if !force {
+		if err := checkNotLeased(volumeName); err != nil {
+			return err
+		}
+		if volumes, err := backend.Volumes(volumeName, ""); err == nil && len(volumes) > 0 {
+			if err := checkNotLeased(volumeNames(volumes[0])...); err != nil {
+				return err
+			}
+			for _, mountPoint := range mountPointsOfVolume(volumes[0]) {
+				if err := checkNotLeased(mountPoint); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return backend.Remove(volumeName)
+}
+
+// volumeNames lists the names by which a volume may be referred to, hence leased: e.g. "snap", "vg0/snap" and
+// "/dev/vg0/snap"
+func volumeNames(volume LogicalVolume) []string {
+	names := []string{volume.Name, volume.Path}
+	if volume.Backend == LVMStorageBackend && volume.GroupName != "" {
+		names = append(names, path.Join(volume.GroupName, volume.Name))
+	}
+	return names
+}
+
+// mountPointsOfVolume returns the managed mount points onto which given volume is mounted, as found in the
+// mount table
+func mountPointsOfVolume(volume LogicalVolume) (mountPoints []string) {
+	mounts, err := ReadMountInfo()
+	if err != nil {
+		return mountPoints
+	}
+	for _, mountPoint := range ManagedMountPoints() {
+		if mountInfo := FindMountInfo(mounts, mountPoint); mountInfo != nil && isVolumeMount(mountInfo, volume) {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+	return mountPoints
+}
+
+// isVolumeMount tells whether a mount is of given volume: by device, be it by a symlink such as /dev/mapper/*, by
+// the clone of a ZFS snapshot, or by the directory of a bind mounted snapshot
+func isVolumeMount(mountInfo *MountInfo, volume LogicalVolume) bool {
+	if mountInfo.Source == volume.Path || mountInfo.Source == volume.Name {
+		return true
+	}
+	if volume.Backend == ZFSStorageBackend && strings.Contains(volume.Path, "@") {
+		return mountInfo.Source == (&ZFSBackend{}).cloneName(volume.Path)
+	}
+	if mountInfo.IsBindMount() {
+		return path.IsAbs(volume.Path) && strings.HasSuffix(volume.Path, mountInfo.Root)
+	}
+	sourceDevice, err := filepath.EvalSymlinks(mountInfo.Source)
+	if err != nil {
+		return false
+	}
+	volumeDevice, err := filepath.EvalSymlinks(volume.Path)
+	return err == nil && sourceDevice == volumeDevice
+}
+
+// GetSnapshotMount returns the mount resolved by given target
+func GetSnapshotMount(target string) (Mount, error) {
+	mountPoint, err := SnapshotMountPointFor(target)
+	if err != nil {
+		return Mount{Path: mountPoint}, err
+	}
+	return GetMount(mountPoint)
+}
+
+// ManagedMountPoints lists the mount points this agent manages: the configured SnapshotMountPoint as well as
+// the named targets under SnapshotMountRoot onto which anything is mounted. These are read off the mount table,
+// such that mounts made before an agent restart are listed.
+func ManagedMountPoints() []string {
+	mountPoints := []string{}
+	if config.Config.SnapshotMountRoot != "" {
+		mounts, err := ReadMountInfo()
+		if err != nil {
+			log.Errore(err)
+		}
+		mountRoot := path.Clean(config.Config.SnapshotMountRoot)
+		seen := map[string]bool{path.Clean(config.Config.SnapshotMountPoint): true}
+		for _, mountInfo := range mounts {
+			// Mounts may be stacked on a mount point
+			if path.Dir(mountInfo.MountPoint) == mountRoot && !seen[mountInfo.MountPoint] {
+				seen[mountInfo.MountPoint] = true
+				mountPoints = append(mountPoints, mountInfo.MountPoint)
+			}
+		}
+	}
+	sort.Strings(mountPoints)
+	if config.Config.SnapshotMountPoint != "" {
+		mountPoints = append([]string{config.Config.SnapshotMountPoint}, mountPoints...)
+	}
+	return mountPoints
+}
+
+// ManagedMounts returns the details of all agent managed mounts
+func ManagedMounts() ([]Mount, error) {
+	mounts := []Mount{}
+	for _, mountPoint := range ManagedMountPoints() {
+		mount, err := GetMount(mountPoint)
+		if err != nil {
+			return mounts, err
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
@@ -0,0 +1,82 @@
+package osagent_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+const managedMountInfo = `22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/vg0-root rw
+40 22 253:2 / /data rw,noatime shared:20 - xfs /dev/mapper/vg0-mysql_data rw
+61 22 253:5 / /mnt/snapshots/b rw,relatime shared:31 - xfs /dev/vg0/snap_b rw,nouuid
+62 22 253:6 / /mnt/snapshots/a rw,relatime shared:32 - xfs /dev/vg0/snap_a rw,nouuid
+63 62 253:6 / /mnt/snapshots/a rw,relatime shared:32 - xfs /dev/vg0/snap_a rw,nouuid
+64 22 253:7 / /mnt/snapshots/a/nested rw,relatime shared:33 - xfs /dev/vg0/snap_c rw,nouuid
+65 22 253:8 / /mnt/snapshot rw,relatime shared:34 - xfs /dev/vg0/snap_d rw,nouuid
+`
+
+// useMountInfo points the agent at given mount table, and at a mount root of /mnt/snapshots
+func useMountInfo(t *testing.T, mountInfo string) func() {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	mountInfoFile := path.Join(directory, "mountinfo")
+	if err := ioutil.WriteFile(mountInfoFile, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	originalMountInfoFile := osagent.MountInfoFile
+	osagent.MountInfoFile = mountInfoFile
+	config.Config.SnapshotMountPoint = "/mnt/snapshot"
+	config.Config.SnapshotMountRoot = "/mnt/snapshots"
+	return func() {
+		osagent.MountInfoFile = originalMountInfoFile
+		config.Config.SnapshotMountPoint = ""
+		config.Config.SnapshotMountRoot = ""
+		os.RemoveAll(directory)
+	}
+}
+
+func TestManagedMountPoints(t *testing.T) {
+	defer useMountInfo(t, managedMountInfo)()
+
+	expected := []string{"/mnt/snapshot", "/mnt/snapshots/a", "/mnt/snapshots/b"}
+	if mountPoints := osagent.ManagedMountPoints(); !reflect.DeepEqual(mountPoints, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, mountPoints)
+	}
+}
+
+func TestRemoveSnapshotOfLeasedMount(t *testing.T) {
+	defer useMountInfo(t, managedMountInfo)()
+	runner := &fakeRunner{outputs: map[string]string{
+		"lvs":      `{"report": [{"lv": [{"lv_name":"snap_a", "vg_name":"vg0", "lv_path":"/dev/vg0/snap_a", "origin":"mysql_data", "lv_attr":"swi-aos---"}]}]}`,
+		"lvremove": "",
+	}}
+	osagent.SetStorageBackend(osagent.NewLVMBackend(runner.run))
+	defer osagent.SetStorageBackend(nil)
+
+	lease, err := osagent.AcquireLease("/mnt/snapshots/a", "seed:3", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := osagent.RemoveSnapshot("snap_a", false); err == nil {
+		t.Errorf("Expected error removing snapshot mounted on a leased mount point")
+	}
+	osagent.ReleaseLease(lease.Id)
+
+	// A volume leased by its path cannot be removed by its name
+	lease, err = osagent.AcquireLease("/dev/vg0/snap_a", "seed:3", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := osagent.RemoveSnapshot("snap_a", false); err == nil {
+		t.Errorf("Expected error removing snapshot leased by its path")
+	}
+	osagent.ReleaseLease(lease.Id)
+	if err := osagent.RemoveSnapshot("snap_a", false); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
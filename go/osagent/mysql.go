@@ -0,0 +1,191 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/go-sql-driver/mysql"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+)
+
+// MySQLInstance is the local MySQL server's self description, as read over a MySQL connection
+type MySQLInstance struct {
+	DataDir       string
+	Port          int64
+	Version       string
+	ServerId      uint
+	LogError      string
+	RelayLogIndex string
+	BinlogIndex   string
+	ReadOnly      bool
+}
+
+// IsMariaDB tells whether the server is MariaDB
+func (this *MySQLInstance) IsMariaDB() bool {
+	return strings.Contains(this.Version, "MariaDB")
+}
+
+// MySQLConnectionConfigured tells whether the agent is configured to connect to the local MySQL server.
+// When not, MySQL settings are read by the command based configuration.
+func MySQLConnectionConfigured() bool {
+	return config.Config.MySQLDSN != "" || config.Config.MySQLSocket != "" || config.Config.MySQLHost != ""
+}
+
+// ReadMySQLCredentialsConfigFile reads user & password from the [client] section of a my.cnf style file
+func ReadMySQLCredentialsConfigFile(fileName string) (user string, password string, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return user, password, err
+	}
+	defer file.Close()
+
+	inClientSection := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inClientSection = (line == "[client]")
+			continue
+		}
+		if !inClientSection {
+			continue
+		}
+		tokens := strings.SplitN(line, "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(tokens[1]), `"'`)
+		switch strings.TrimSpace(tokens[0]) {
+		case "user":
+			user = value
+		case "password":
+			password = value
+		}
+	}
+	return user, password, scanner.Err()
+}
+
+// mysqlDSN returns the configured DSN, or composes one from the connection settings
+func mysqlDSN() (string, error) {
+	if config.Config.MySQLDSN != "" {
+		return config.Config.MySQLDSN, nil
+	}
+	if !MySQLConnectionConfigured() {
+		return "", errors.New("MySQL connection is unconfigured")
+	}
+	mysqlConfig := mysql.NewConfig()
+	mysqlConfig.User = config.Config.MySQLUser
+	mysqlConfig.Passwd = config.Config.MySQLPassword
+	if config.Config.MySQLCredentialsConfigFile != "" {
+		user, password, err := ReadMySQLCredentialsConfigFile(config.Config.MySQLCredentialsConfigFile)
+		if err != nil {
+			return "", err
+		}
+		mysqlConfig.User = user
+		mysqlConfig.Passwd = password
+	}
+	if config.Config.MySQLSocket != "" {
+		mysqlConfig.Net = "unix"
+		mysqlConfig.Addr = config.Config.MySQLSocket
+	} else {
+		mysqlConfig.Net = "tcp"
+		mysqlConfig.Addr = fmt.Sprintf("%s:%d", config.Config.MySQLHost, config.Config.MySQLConnectPort)
+	}
+	mysqlConfig.Timeout = time.Duration(config.Config.MySQLConnectTimeoutSeconds) * time.Second
+	return mysqlConfig.FormatDSN(), nil
+}
+
+// openMySQL returns a (pooled) connection to the local MySQL server
+func openMySQL() (*sql.DB, error) {
+	dsn, err := mysqlDSN()
+	if err != nil {
+		return nil, err
+	}
+	db, cached, err := sqlutils.GetDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if !cached {
+		db.SetMaxOpenConns(3)
+		db.SetMaxIdleConns(1)
+	}
+	return db, nil
+}
+
+// GetMySQLInstance reads the local MySQL server's settings
+func GetMySQLInstance() (*MySQLInstance, error) {
+	db, err := openMySQL()
+	if err != nil {
+		return nil, err
+	}
+	instance := &MySQLInstance{}
+	err = sqlutils.QueryRowsMap(db, `select @@datadir as datadir, @@port as port, @@version as version, @@server_id as server_id,
+		@@log_error as log_error, ifnull(@@relay_log_index, '') as relay_log_index, ifnull(@@log_bin_index, '') as log_bin_index, @@read_only as read_only`,
+		func(m sqlutils.RowMap) error {
+			instance.DataDir = m.GetString("datadir")
+			instance.Port = m.GetInt64("port")
+			instance.Version = m.GetString("version")
+			instance.ServerId = m.GetUint("server_id")
+			instance.LogError = m.GetString("log_error")
+			instance.RelayLogIndex = m.GetString("relay_log_index")
+			instance.BinlogIndex = m.GetString("log_bin_index")
+			instance.ReadOnly = m.GetBool("read_only")
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if instance.DataDir == "" {
+		return nil, errors.New("Unable to read MySQL instance settings")
+	}
+	return instance, nil
+}
+
+// readMySQLInstance reads the local MySQL server's settings if a connection is configured, and otherwise
+// (or on failure) returns nil, such that callers fall back to command based settings
+func readMySQLInstance() *MySQLInstance {
+	if !MySQLConnectionConfigured() {
+		return nil
+	}
+	instance, err := GetMySQLInstance()
+	if err != nil {
+		log.Errorf("Cannot read MySQL instance settings; falling back to commands: %+v", err)
+		return nil
+	}
+	return instance
+}
+
+// resolveDataDirPath resolves a file name which MySQL interprets relative to its data directory
+func resolveDataDirPath(instance *MySQLInstance, fileName string) string {
+	if fileName == "" || path.IsAbs(fileName) {
+		return fileName
+	}
+	return path.Join(instance.DataDir, fileName)
+}
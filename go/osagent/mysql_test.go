@@ -0,0 +1,81 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+func TestReadMySQLCredentialsConfigFile(t *testing.T) {
+	file, _ := ioutil.TempFile("", "my.cnf")
+	defer os.Remove(file.Name())
+	file.WriteString(`[mysqld]
+user = mysql
+
+[client]
+# agent credentials
+user = agent
+password = "s3cr=t"
+
+[mysqldump]
+user = dumper
+`)
+	file.Close()
+
+	user, password, err := osagent.ReadMySQLCredentialsConfigFile(file.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if user != "agent" || password != "s3cr=t" {
+		t.Errorf("Unexpected credentials: %s, %s", user, password)
+	}
+	if _, _, err := osagent.ReadMySQLCredentialsConfigFile("/nonexistent/my.cnf"); err == nil {
+		t.Errorf("Expected error on missing file")
+	}
+}
+
+func TestMySQLSettingsFallback(t *testing.T) {
+	defer func() {
+		config.Config.MySQLHost = ""
+		config.Config.MySQLConnectPort = 3306
+	}()
+	config.Config.MySQLDatadirCommand = "echo /var/lib/mysql"
+	config.Config.MySQLPortCommand = "echo 3306"
+
+	config.Config.MySQLHost = ""
+	if osagent.MySQLConnectionConfigured() {
+		t.Errorf("Expected no MySQL connection to be configured")
+	}
+	if _, err := osagent.GetMySQLInstance(); err == nil {
+		t.Errorf("Expected error reading instance with no connection configured")
+	}
+
+	// Nothing listens on port 1: the connection fails and commands take over
+	config.Config.MySQLHost = "127.0.0.1"
+	config.Config.MySQLConnectPort = 1
+	if dataDir, err := osagent.GetMySQLDataDir(); err != nil || dataDir != "/var/lib/mysql" {
+		t.Errorf("Expected command fallback datadir, got %s, %+v", dataDir, err)
+	}
+	if port, err := osagent.GetMySQLPort(); err != nil || port != 3306 {
+		t.Errorf("Expected command fallback port, got %d, %+v", port, err)
+	}
+}
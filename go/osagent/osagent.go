@@ -19,6 +19,7 @@ package osagent
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -26,6 +27,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/github/orchestrator-agent/go/config"
 	"github.com/github/orchestrator-agent/go/inst"
@@ -37,23 +40,68 @@ const (
 )
 
 var activeCommands = make(map[string]*exec.Cmd)
+var activeCommandsMutex = &sync.Mutex{}
 
-// LogicalVolume describes an LVM volume
-type LogicalVolume struct {
-	Name            string
-	GroupName       string
-	Path            string
-	IsSnapshot      bool
-	SnapshotPercent float64
+// setActiveCommand tracks the command of a seed or job, by id. Jobs set their commands from background goroutines.
+func setActiveCommand(jobId string, cmd *exec.Cmd) {
+	activeCommandsMutex.Lock()
+	defer activeCommandsMutex.Unlock()
+	activeCommands[jobId] = cmd
 }
 
+func getActiveCommand(jobId string) (cmd *exec.Cmd, found bool) {
+	activeCommandsMutex.Lock()
+	defer activeCommandsMutex.Unlock()
+	cmd, found = activeCommands[jobId]
+	return cmd, found
+}
+
+// jobPhase is the in-agent part of a job (e.g. a transfer to or from the backup store), which may outlive
+// the job's command, or make for the entire job
+type jobPhase struct {
+	done bool
+	err  error
+}
+
+var jobPhases = make(map[string]*jobPhase)
+var jobPhasesMutex = &sync.Mutex{}
+
+func beginJobPhase(jobId string) {
+	jobPhasesMutex.Lock()
+	defer jobPhasesMutex.Unlock()
+	jobPhases[jobId] = &jobPhase{}
+}
+
+func endJobPhase(jobId string, err error) {
+	jobPhasesMutex.Lock()
+	defer jobPhasesMutex.Unlock()
+	jobPhases[jobId] = &jobPhase{done: true, err: err}
+}
+
+func getJobPhase(jobId string) (phase jobPhase, found bool) {
+	jobPhasesMutex.Lock()
+	defer jobPhasesMutex.Unlock()
+	if p, ok := jobPhases[jobId]; ok {
+		return *p, true
+	}
+	return phase, false
+}
+
+// GetMySQLDataDir reads @@datadir over the MySQL connection, falling back to MySQLDatadirCommand
 func GetMySQLDataDir() (string, error) {
+	if instance := readMySQLInstance(); instance != nil {
+		return instance.DataDir, nil
+	}
 	command := config.Config.MySQLDatadirCommand
 	output, err := commandOutput(command)
 	return strings.TrimSpace(fmt.Sprintf("%s", output)), err
 }
 
+// GetMySQLPort reads @@port over the MySQL connection, falling back to MySQLPortCommand
 func GetMySQLPort() (int64, error) {
+	if instance := readMySQLInstance(); instance != nil {
+		return instance.Port, nil
+	}
 	command := config.Config.MySQLPortCommand
 	output, err := commandOutput(command)
 	if err != nil {
@@ -62,8 +110,12 @@ func GetMySQLPort() (int64, error) {
 	return strconv.ParseInt(strings.TrimSpace(fmt.Sprintf("%s", output)), 10, 0)
 }
 
-// GetRelayLogIndexFileName attempts to find the relay log index file under the mysql datadir
+// GetRelayLogIndexFileName reads @@relay_log_index over the MySQL connection, or otherwise attempts
+// to find the relay log index file under the mysql datadir
 func GetRelayLogIndexFileName() (string, error) {
+	if instance := readMySQLInstance(); instance != nil && instance.RelayLogIndex != "" {
+		return resolveDataDirPath(instance, instance.RelayLogIndex), nil
+	}
 	directory, err := GetMySQLDataDir()
 	if err != nil {
 		return "", log.Errore(err)
@@ -77,169 +129,159 @@ func GetRelayLogIndexFileName() (string, error) {
 	return strings.TrimSpace(fmt.Sprintf("%s", output)), err
 }
 
-// GetRelayLogFileNames attempts to find the active relay logs
-func GetRelayLogFileNames() (fileNames []string, err error) {
-	relayLogIndexFile, err := GetRelayLogIndexFileName()
-	if err != nil {
-		return fileNames, log.Errore(err)
-	}
-
-	contents, err := ioutil.ReadFile(relayLogIndexFile)
+// readLogIndexFile returns the log files listed in a binary or relay log index file
+func readLogIndexFile(indexFile string) (fileNames []string, err error) {
+	contents, err := ioutil.ReadFile(indexFile)
 	if err != nil {
 		return fileNames, log.Errore(err)
 	}
 
 	for _, fileName := range strings.Split(string(contents), "\n") {
 		if fileName != "" {
-			fileName = path.Join(path.Dir(relayLogIndexFile), fileName)
+			if !path.IsAbs(fileName) {
+				fileName = path.Join(path.Dir(indexFile), fileName)
+			}
 			fileNames = append(fileNames, fileName)
 		}
 	}
 	return fileNames, nil
 }
 
-// GetRelayLogEndCoordinates returns the coordinates at the end of relay logs
-func GetRelayLogEndCoordinates() (coordinates *inst.BinlogCoordinates, err error) {
-	relaylogFileNames, err := GetRelayLogFileNames()
+// GetRelayLogFileNames attempts to find the active relay logs
+func GetRelayLogFileNames() (fileNames []string, err error) {
+	relayLogIndexFile, err := GetRelayLogIndexFileName()
 	if err != nil {
-		return coordinates, log.Errore(err)
+		return fileNames, log.Errore(err)
 	}
+	return readLogIndexFile(relayLogIndexFile)
+}
 
-	lastRelayLogFile := relaylogFileNames[len(relaylogFileNames)-1]
-	output, err := commandOutput(sudoCmd(fmt.Sprintf("du -b %s", lastRelayLogFile)))
-	tokens, err := outputTokens(`[ \t]+`, output, err)
+// GetBinaryLogIndexFileName reads @@log_bin_index over the MySQL connection
+func GetBinaryLogIndexFileName() (string, error) {
+	if !MySQLConnectionConfigured() {
+		return "", log.Errorf("Binary logs are located via the MySQL connection, which is unconfigured")
+	}
+	instance, err := GetMySQLInstance()
 	if err != nil {
-		return coordinates, err
+		return "", log.Errore(err)
 	}
+	if instance.BinlogIndex == "" {
+		return "", log.Errorf("Binary logging is disabled")
+	}
+	return resolveDataDirPath(instance, instance.BinlogIndex), nil
+}
 
-	var fileSize int64
-	for _, lineTokens := range tokens {
-		fileSize, err = strconv.ParseInt(lineTokens[0], 10, 0)
+// GetBinaryLogFileNames returns the server's binary logs, as listed in the binary log index
+func GetBinaryLogFileNames() (fileNames []string, err error) {
+	binlogIndexFile, err := GetBinaryLogIndexFileName()
+	if err != nil {
+		return fileNames, err
 	}
+	return readLogIndexFile(binlogIndexFile)
+}
+
+// LogEndCoordinates are the coordinates at the end of the last complete event of a log
+type LogEndCoordinates struct {
+	inst.BinlogCoordinates
+	Gtid      string // of the last transaction begun, where GTIDs are in use
+	Truncated bool   // the log ends with a partially written event, following the coordinates
+}
+
+// GetRelayLogEndCoordinates returns the coordinates at the end of relay logs. As relay logs are written by the
+// replication IO thread, the last log may end with a partially written event, which is not accounted for.
+func GetRelayLogEndCoordinates() (coordinates *LogEndCoordinates, err error) {
+	relaylogFileNames, err := getLogFileNames(inst.RelayLog)
+	if err != nil {
+		return coordinates, log.Errore(err)
+	}
+	if len(relaylogFileNames) == 0 {
+		return coordinates, log.Errorf("No relay logs found")
+	}
+
+	lastRelayLogFile := relaylogFileNames[len(relaylogFileNames)-1]
+	relaylogFile, err := scanBinlogFile(lastRelayLogFile)
 	if err != nil {
-		return coordinates, err
+		return coordinates, log.Errore(err)
+	}
+	coordinates = &LogEndCoordinates{
+		BinlogCoordinates: inst.BinlogCoordinates{LogFile: lastRelayLogFile, LogPos: relaylogFile.scannedTo, Type: inst.RelayLog},
+		Gtid:              relaylogFile.LastGtid,
+		Truncated:         relaylogFile.Size > relaylogFile.scannedTo,
 	}
-	return &inst.BinlogCoordinates{LogFile: lastRelayLogFile, LogPos: fileSize, Type: inst.RelayLog}, nil
+	return coordinates, nil
 }
 
+// MySQLBinlogContents returns the events of given binary logs, as SQL, gzipped and base64 encoded
 func MySQLBinlogContents(binlogFiles []string, startPosition int64, stopPosition int64) (string, error) {
 	if len(binlogFiles) == 0 {
 		return "", log.Errorf("No binlog files provided in MySQLBinlogContents")
 	}
-	cmd := `mysqlbinlog`
-	for _, binlogFile := range binlogFiles {
-		cmd = fmt.Sprintf("%s %s", cmd, binlogFile)
-	}
-	if startPosition != 0 {
-		cmd = fmt.Sprintf("%s --start-position=%d", cmd, startPosition)
+	return gzipBase64(func(writer io.Writer) error {
+		return writeBinlogSQL(writer, binlogFiles, startPosition, stopPosition)
+	})
+}
+
+// writeBinlogSQL writes the events of given binary logs as SQL. As with writeBinlogBinary, nothing is written
+// before logs are opened and validated.
+func writeBinlogSQL(writer io.Writer, binlogFiles []string, startPosition int64, stopPosition int64) error {
+	var sqlWriter *inst.BinlogSQLWriter
+	if err := readBinlogEvents(binlogFiles, startPosition, stopPosition, func(binlogIndex int, event *inst.BinlogEvent) error {
+		if sqlWriter == nil {
+			sqlWriter = inst.NewBinlogSQLWriter(writer)
+		}
+		return sqlWriter.WriteEvent(event)
+	}); err != nil {
+		return log.Errore(err)
 	}
-	if stopPosition != 0 {
-		cmd = fmt.Sprintf("%s --stop-position=%d", cmd, stopPosition)
+	if sqlWriter == nil {
+		sqlWriter = inst.NewBinlogSQLWriter(writer)
 	}
-	cmd = fmt.Sprintf("%s | gzip | base64", cmd)
-
-	output, err := commandOutput(cmd)
-	return string(output), err
+	return sqlWriter.Close()
 }
 
+// MySQLBinlogContentHeaderSize returns the size of the magic header and the format description event,
+// which typically ends at pos 120
 func MySQLBinlogContentHeaderSize(binlogFile string) (int64, error) {
-	// magic header
-	// There are the first 4 bytes, and then there's also the first entry (the format-description).
-	// We need both from the first log file.
-	// Typically, the format description ends at pos 120, but let's verify...
-
-	cmd := fmt.Sprintf("mysqlbinlog %s --start-position=4 | head | egrep -o 'end_log_pos [^ ]+' | head -1 | awk '{print $2}'", binlogFile)
-	if content, err := commandOutput(sudoCmd(cmd)); err != nil {
-		return 0, err
-	} else {
-		return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 0)
-	}
+	return binlogHeaderSize(binlogFile)
 }
 
+// MySQLBinlogBinaryContents returns the binary contents of given binary (or relay) logs, gzipped and base64 encoded.
+// The contents make for a single log: the header of the first log, followed by events of all logs.
 func MySQLBinlogBinaryContents(binlogFiles []string, startPosition int64, stopPosition int64) (result string, err error) {
 	if len(binlogFiles) == 0 {
 		return "", log.Errorf("No binlog files provided in MySQLBinlogContents")
 	}
-	tmpFile, err := ioutil.TempFile("", "orchestrator-agent-binlog-contents-")
-	if err != nil {
-		return "", log.Errore(err)
-	}
-	var headerSize int64
-	if startPosition != 0 {
-		if headerSize, err = MySQLBinlogContentHeaderSize(binlogFiles[0]); err != nil {
-			return "", log.Errore(err)
-		}
-		cmd := fmt.Sprintf("cat %s | head -c%d >> %s", binlogFiles[0], headerSize, tmpFile.Name())
-		if _, err := commandOutput(sudoCmd(cmd)); err != nil {
-			return "", err
-		}
-	}
-	for i, binlogFile := range binlogFiles {
-		cmd := fmt.Sprintf("cat %s", binlogFile)
+	return gzipBase64(func(writer io.Writer) error {
+		return writeBinlogBinary(writer, binlogFiles, startPosition, stopPosition)
+	})
+}
 
-		if i == len(binlogFiles)-1 && stopPosition != 0 {
-			cmd = fmt.Sprintf("%s | head -c %d", cmd, stopPosition)
+// writeBinlogBinary writes the binary contents of given binary (or relay) logs, as a single log. The magic header
+// is only written once logs are opened and validated, such that a streamed response may yet report an error.
+func writeBinlogBinary(writer io.Writer, binlogFiles []string, startPosition int64, stopPosition int64) error {
+	started := false
+	start := func() error {
+		if started {
+			return nil
 		}
-		if i == 0 && startPosition != 0 {
-			cmd = fmt.Sprintf("%s | tail -c+%d", cmd, startPosition+1)
+		started = true
+		_, err := writer.Write(inst.BinlogMagic)
+		return err
+	}
+	if err := readBinlogEvents(binlogFiles, startPosition, stopPosition, func(binlogIndex int, event *inst.BinlogEvent) error {
+		if err := start(); err != nil {
+			return err
 		}
-		if i > 0 {
+		if binlogIndex > 0 && event.Position == inst.BinlogMagicSize {
 			// At any case, we drop out binlog header (magic + format_description) for next relay logs
-			if headerSize, err = MySQLBinlogContentHeaderSize(binlogFile); err != nil {
-				return "", log.Errore(err)
-			}
-			cmd = fmt.Sprintf("%s | tail -c+%d", cmd, headerSize+1)
-		}
-		cmd = fmt.Sprintf("%s >> %s", cmd, tmpFile.Name())
-		if _, err := commandOutput(sudoCmd(cmd)); err != nil {
-			return "", err
+			return nil
 		}
-	}
-
-	cmd := fmt.Sprintf("cat %s | gzip | base64", tmpFile.Name())
-	output, err := commandOutput(cmd)
-	return string(output), err
-}
-
-func ApplyRelaylogContents(content []byte) error {
-	encodedContentsFile, err := ioutil.TempFile("", "orchestrator-agent-apply-relaylog-encoded-")
-	if err != nil {
-		return log.Errore(err)
-	}
-	if err := ioutil.WriteFile(encodedContentsFile.Name(), content, 0644); err != nil {
-		return log.Errore(err)
-	}
-
-	relaylogContentsFile, err := ioutil.TempFile("", "orchestrator-agent-apply-relaylog-bin-")
-	if err != nil {
-		return log.Errore(err)
-	}
-
-	cmd := fmt.Sprintf("cat %s | base64 --decode | gunzip > %s", encodedContentsFile.Name(), relaylogContentsFile.Name())
-	if _, err := commandOutput(sudoCmd(cmd)); err != nil {
+		_, err := writer.Write(event.Raw)
+		return err
+	}); err != nil {
 		return log.Errore(err)
 	}
-
-	if config.Config.MySQLClientCommand != "" {
-		cmd := fmt.Sprintf("mysqlbinlog %s | %s", relaylogContentsFile.Name(), config.Config.MySQLClientCommand)
-		if _, err := commandOutput(sudoCmd(cmd)); err != nil {
-			return log.Errore(err)
-		}
-	}
-	log.Infof("Applied relay log contents from %s", relaylogContentsFile.Name())
-
-	return nil
-}
-
-// Equals tests equality of this corrdinate and another one.
-func (this *LogicalVolume) IsSnapshotValid() bool {
-	if !this.IsSnapshot {
-		return false
-	}
-	if this.SnapshotPercent >= 100.0 {
-		return false
-	}
-	return true
+	return start()
 }
 
 // Mount describes a file system mount point
@@ -248,6 +290,9 @@ type Mount struct {
 	Device         string
 	LVPath         string
 	FileSystem     string
+	Options        []string
+	IsReadOnly     bool
+	IsBindMount    bool
 	IsMounted      bool
 	DiskUsage      int64
 	MySQLDataPath  string
@@ -342,119 +387,80 @@ func Hostname() (string, error) {
 	return os.Hostname()
 }
 
-func LogicalVolumes(volumeName string, filterPattern string) ([]LogicalVolume, error) {
-	output, err := commandOutput(sudoCmd(fmt.Sprintf("lvs --noheading -o lv_name,vg_name,lv_path,snap_percent %s", volumeName)))
-	tokens, err := outputTokens(`[ \t]+`, output, err)
-	if err != nil {
-		return nil, err
-	}
-
-	logicalVolumes := []LogicalVolume{}
-	for _, lineTokens := range tokens {
-		logicalVolume := LogicalVolume{
-			Name:      lineTokens[1],
-			GroupName: lineTokens[2],
-			Path:      lineTokens[3],
-		}
-		logicalVolume.SnapshotPercent, err = strconv.ParseFloat(lineTokens[4], 32)
-		logicalVolume.IsSnapshot = (err == nil)
-		if strings.Contains(logicalVolume.Name, filterPattern) {
-			logicalVolumes = append(logicalVolumes, logicalVolume)
-		}
-	}
-	return logicalVolumes, nil
-}
-
-func GetLogicalVolumePath(volumeName string) (string, error) {
-	if logicalVolumes, err := LogicalVolumes(volumeName, ""); err == nil && len(logicalVolumes) > 0 {
-		return logicalVolumes[0].Path, err
-	}
-	return "", errors.New(fmt.Sprintf("logical volume not found: %+v", volumeName))
-}
-
-func GetLogicalVolumeFSType(volumeName string) (string, error) {
-	command := fmt.Sprintf("blkid %s", volumeName)
-	output, err := commandOutput(sudoCmd(command))
-	lines, err := outputLines(output, err)
-	re := regexp.MustCompile(`TYPE="(.*?)"`)
-	for _, line := range lines {
-		fsType := re.FindStringSubmatch(line)[1]
-		return fsType, nil
-	}
-	return "", errors.New(fmt.Sprintf("Cannot find FS type for logical volume %s", volumeName))
-}
-
 func GetMount(mountPoint string) (Mount, error) {
 	mount := Mount{
 		Path:      mountPoint,
 		IsMounted: false,
 	}
 
-	output, err := commandOutput(fmt.Sprintf("grep %s /etc/mtab", mountPoint))
-	tokens, err := outputTokens(`[ \t]+`, output, err)
+	mounts, err := ReadMountInfo()
 	if err != nil {
-		// when grep does not find rows, it returns an error. So this is actually OK
-		return mount, nil
+		return mount, log.Errore(err)
 	}
-
-	for _, lineTokens := range tokens {
-		mount.IsMounted = true
-		mount.Device = lineTokens[0]
-		mount.Path = lineTokens[1]
-		mount.FileSystem = lineTokens[2]
-		mount.LVPath, _ = GetLogicalVolumePath(mount.Device)
-		mount.DiskUsage, _ = DiskUsage(mountPoint)
-		mount.MySQLDataPath, _ = HeuristicMySQLDataPath(mountPoint)
-		mount.MySQLDiskUsage, _ = DiskUsage(mount.MySQLDataPath)
+	if mountInfo := FindMountInfo(mounts, mountPoint); mountInfo != nil {
+		populateMount(&mount, mountInfo)
 	}
 	return mount, nil
 }
 
-func MountLV(mountPoint string, volumeName string) (Mount, error) {
-	mount := Mount{
-		Path:      mountPoint,
-		IsMounted: false,
-	}
-	if volumeName == "" {
-		return mount, errors.New("Empty columeName in MountLV")
+// populateMount fills in mount details from its mountinfo entry
+func populateMount(mount *Mount, mountInfo *MountInfo) {
+	mount.IsMounted = true
+	mount.Device = mountInfo.Source
+	mount.Path = mountInfo.MountPoint
+	mount.FileSystem = mountInfo.FileSystem
+	mount.Options = mountInfo.Options
+	mount.IsReadOnly = mountInfo.IsReadOnly()
+	mount.IsBindMount = mountInfo.IsBindMount()
+	mount.LVPath, _ = GetLogicalVolumePath(mount.Device)
+	// The mount may well be "/": its usage is read off the file system rather than by walking it
+	mount.DiskUsage, _ = FileSystemUsage(mount.Path)
+	mount.MySQLDataPath, _ = HeuristicMySQLDataPath(mount.Path)
+	if mount.MySQLDataPath != "" {
+		mount.MySQLDiskUsage, _ = DiskUsage(mount.MySQLDataPath)
 	}
-	fsType, err := GetLogicalVolumeFSType(volumeName)
+}
+
+// MySQLMounts lists mounts relevant to MySQL: the mount holding the MySQL data directory,
+// and any mount at or below the snapshot mount point/root, including agent managed mounts.
+func MySQLMounts() ([]Mount, error) {
+	result := []Mount{}
+	mounts, err := ReadMountInfo()
 	if err != nil {
-		return mount, err
+		return result, log.Errore(err)
 	}
 
-	mountOptions := ""
-	if fsType == "xfs" {
-		mountOptions = "-o nouuid"
+	relevantMountInfos := []*MountInfo{}
+	if datadir, err := GetMySQLDataDir(); err == nil && datadir != "" {
+		if mountInfo := FindContainingMountInfo(mounts, datadir); mountInfo != nil {
+			relevantMountInfos = append(relevantMountInfos, mountInfo)
+		}
 	}
-	_, err = commandOutput(sudoCmd(fmt.Sprintf("mount %s %s %s", mountOptions, volumeName, mountPoint)))
-	if err != nil {
-		return mount, err
+	roots := ManagedMountPoints()
+	if config.Config.SnapshotMountRoot != "" {
+		roots = append(roots, config.Config.SnapshotMountRoot)
 	}
-
-	return GetMount(mountPoint)
-}
-
-func RemoveLV(volumeName string) error {
-	_, err := commandOutput(sudoCmd(fmt.Sprintf("lvremove --force %s", volumeName)))
-	return err
-}
-
-func CreateSnapshot() error {
-	_, err := commandOutput(config.Config.CreateSnapshotCommand)
-	return err
-}
-
-func Unmount(mountPoint string) (Mount, error) {
-	mount := Mount{
-		Path:      mountPoint,
-		IsMounted: false,
+	for i := range mounts {
+		for _, root := range roots {
+			root = path.Clean(root)
+			if mounts[i].MountPoint == root || strings.HasPrefix(mounts[i].MountPoint, root+"/") {
+				relevantMountInfos = append(relevantMountInfos, &mounts[i])
+				break
+			}
+		}
 	}
-	_, err := commandOutput(sudoCmd(fmt.Sprintf("umount %s", mountPoint)))
-	if err != nil {
-		return mount, err
+
+	seen := make(map[int]bool)
+	for _, mountInfo := range relevantMountInfos {
+		if seen[mountInfo.MountId] {
+			continue
+		}
+		seen[mountInfo.MountId] = true
+		mount := Mount{Path: mountInfo.MountPoint}
+		populateMount(&mount, mountInfo)
+		result = append(result, mount)
 	}
-	return GetMount(mountPoint)
+	return result, nil
 }
 
 func DiskUsage(path string) (int64, error) {
@@ -473,6 +479,15 @@ func DiskUsage(path string) (int64, error) {
 	return result, err
 }
 
+// FileSystemUsage returns the bytes used on the file system holding given path
+func FileSystemUsage(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize), nil
+}
+
 // DeleteMySQLDataDir self explanatory. Be responsible! This function does not verify the MySQL service is down
 func DeleteMySQLDataDir() error {
 
@@ -558,7 +573,12 @@ func AvailableSnapshots(requireLocal bool) ([]string, error) {
 	return hosts, err
 }
 
+// MySQLErrorLogTail returns the last lines of the error log, as found by @@log_error or otherwise in /etc/my.cnf
 func MySQLErrorLogTail() ([]string, error) {
+	if instance := readMySQLInstance(); instance != nil && instance.LogError != "" && instance.LogError != "stderr" {
+		output, err := commandOutput(sudoCmd(fmt.Sprintf("tail -n 20 %s", resolveDataDirPath(instance, instance.LogError))))
+		return outputLines(output, err)
+	}
 	output, err := commandOutput(sudoCmd(`tail -n 20 $(egrep "log[-_]error" /etc/my.cnf | cut -d "=" -f 2)`))
 	tail, err := outputLines(output, err)
 	return tail, err
@@ -589,7 +609,7 @@ func ReceiveMySQLSeedData(seedId string) error {
 	err = commandRun(
 		fmt.Sprintf("%s %s %d", config.Config.ReceiveSeedDataCommand, directory, SeedTransferPort),
 		func(cmd *exec.Cmd) {
-			activeCommands[seedId] = cmd
+			setActiveCommand(seedId, cmd)
 			log.Debug("ReceiveMySQLSeedData command completed")
 		})
 	if err != nil {
@@ -605,7 +625,7 @@ func SendMySQLSeedData(targetHostname string, directory string, seedId string) e
 	}
 	err := commandRun(fmt.Sprintf("%s %s %s %d", config.Config.SendSeedDataCommand, directory, targetHostname, SeedTransferPort),
 		func(cmd *exec.Cmd) {
-			activeCommands[seedId] = cmd
+			setActiveCommand(seedId, cmd)
 			log.Debug("SendMySQLSeedData command completed")
 		})
 	if err != nil {
@@ -615,25 +635,35 @@ func SendMySQLSeedData(targetHostname string, directory string, seedId string) e
 }
 
 func SeedCommandCompleted(seedId string) bool {
-	if cmd, ok := activeCommands[seedId]; ok {
+	phase, hasPhase := getJobPhase(seedId)
+	if hasPhase && !phase.done {
+		return false
+	}
+	if cmd, ok := getActiveCommand(seedId); ok {
 		if cmd.ProcessState != nil {
 			return cmd.ProcessState.Exited()
 		}
+		return false
 	}
-	return false
+	return hasPhase
 }
 
 func SeedCommandSucceeded(seedId string) bool {
-	if cmd, ok := activeCommands[seedId]; ok {
+	phase, hasPhase := getJobPhase(seedId)
+	if hasPhase && (!phase.done || phase.err != nil) {
+		return false
+	}
+	if cmd, ok := getActiveCommand(seedId); ok {
 		if cmd.ProcessState != nil {
 			return cmd.ProcessState.Success()
 		}
+		return false
 	}
-	return false
+	return hasPhase
 }
 
 func AbortSeed(seedId string) error {
-	if cmd, ok := activeCommands[seedId]; ok {
+	if cmd, ok := getActiveCommand(seedId); ok {
 		log.Debugf("Killing process %d", cmd.Process.Pid)
 		return cmd.Process.Kill()
 	} else {
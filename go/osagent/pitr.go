@@ -0,0 +1,659 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/github/orchestrator-agent/go/ssl"
+	"github.com/outbrain/golib/log"
+)
+
+type PITRStatus string
+
+const (
+	PITRRunning   PITRStatus = "running"
+	PITRCompleted PITRStatus = "completed"
+	PITRFailed    PITRStatus = "failed"
+	PITRAborted   PITRStatus = "aborted"
+)
+
+// PITRRequest describes a point-in-time recovery: where the base data comes from, where binary logs come from,
+// and where to stop replaying them
+type PITRRequest struct {
+	Snapshot         string                  // mount target of a snapshot, recovered in a sandbox
+	SandboxTTL       time.Duration           // how long the sandbox stays up for inspection, once recovered
+	Backup           string                  // backup restored onto the live data directory; MySQL must be stopped
+	SourceAgent      string                  // base URL of an agent serving binary logs; local binary logs if empty
+	SourceToken      string                  `json:"-"`
+	StartCoordinates *inst.BinlogCoordinates // where replay starts; by default, by the recovered data's executed GTIDs
+	Stop             BinlogStopPoint
+}
+
+// PITRJob is a point-in-time recovery in progress or done. Recovered data is either a sandbox running against
+// a snapshot, or the live MySQL server (optionally restored from a backup beforehand); binary logs are replayed
+// onto it up to the stop point.
+type PITRJob struct {
+	Id             string
+	Request        PITRRequest
+	SandboxId      string
+	Status         PITRStatus
+	Phase          string
+	Started        time.Time
+	Completed      time.Time
+	BinlogFiles    []string // logs to replay
+	FilesReplayed  int
+	Report         BinlogReplayReport
+	Error          string
+	workDir        string
+	abortRequested chan bool
+}
+
+var pitrJobs = make(map[string]*PITRJob)
+var pitrJobsMutex = &sync.Mutex{}
+
+// StartPITR validates a point-in-time recovery request and runs it in the background
+func StartPITR(request PITRRequest) (PITRJob, error) {
+	if request.Snapshot != "" && request.Backup != "" {
+		return PITRJob{}, fmt.Errorf("Expected either snapshot or backup, not both")
+	}
+	if request.Snapshot != "" && request.SandboxTTL <= 0 {
+		return PITRJob{}, fmt.Errorf("A ttl is required when recovering a snapshot, such that the sandbox stays up for inspection")
+	}
+	if request.Snapshot == "" && request.Backup == "" && request.SourceAgent == "" {
+		return PITRJob{}, fmt.Errorf("Expected a snapshot, backup or source agent; the live server's binary logs are not to be replayed onto itself")
+	}
+	if request.Snapshot == "" && config.Config.MySQLClientCommand == "" {
+		return PITRJob{}, fmt.Errorf("MySQLClientCommand is required to replay binary logs onto the live server")
+	}
+	if err := request.Stop.validate(); err != nil {
+		return PITRJob{}, err
+	}
+	if config.Config.PITRDirectory == "" {
+		return PITRJob{}, fmt.Errorf("PITRDirectory is unconfigured")
+	}
+	if err := os.MkdirAll(config.Config.PITRDirectory, 0700); err != nil {
+		return PITRJob{}, log.Errore(err)
+	}
+	workDir, err := ioutil.TempDir(config.Config.PITRDirectory, "pitr-")
+	if err != nil {
+		return PITRJob{}, log.Errore(err)
+	}
+
+	pitrJobsMutex.Lock()
+	defer pitrJobsMutex.Unlock()
+
+	job := &PITRJob{
+		Id:             newLeaseId(),
+		Request:        request,
+		Status:         PITRRunning,
+		Started:        time.Now(),
+		workDir:        workDir,
+		abortRequested: make(chan bool, 1),
+	}
+	pitrJobs[job.Id] = job
+	log.Infof("Started point-in-time recovery %s", job.Id)
+
+	go func() {
+		defer os.RemoveAll(workDir)
+		err := runPITR(job)
+		updatePITRJob(job, func(job *PITRJob) {
+			job.Completed = time.Now()
+			switch {
+			case err == nil:
+				job.Status = PITRCompleted
+			case job.aborted():
+				job.Status = PITRAborted
+				job.Error = err.Error()
+			default:
+				job.Status = PITRFailed
+				job.Error = err.Error()
+			}
+		})
+		log.Infof("Point-in-time recovery %s %s", job.Id, job.Status)
+	}()
+	return job.snapshot(), nil
+}
+
+// snapshot returns a copy of the job, safe for reading by the caller. Expects pitrJobsMutex to be held.
+func (this *PITRJob) snapshot() PITRJob {
+	result := *this
+	result.BinlogFiles = append([]string{}, this.BinlogFiles...)
+	return result
+}
+
+// aborted tells whether an abort was requested, without blocking
+func (this *PITRJob) aborted() bool {
+	select {
+	case <-this.abortRequested:
+		// Leave the request in place for subsequent checks
+		this.abortRequested <- true
+		return true
+	default:
+		return false
+	}
+}
+
+// checkAborted returns an error once an abort was requested
+func (this *PITRJob) checkAborted() error {
+	if this.aborted() {
+		return errors.New("Point-in-time recovery aborted")
+	}
+	return nil
+}
+
+// updatePITRJob applies given function on a job under lock
+func updatePITRJob(job *PITRJob, f func(job *PITRJob)) {
+	pitrJobsMutex.Lock()
+	defer pitrJobsMutex.Unlock()
+	f(job)
+}
+
+func (this *PITRJob) setPhase(phase string) {
+	updatePITRJob(this, func(job *PITRJob) { job.Phase = phase })
+	log.Infof("Point-in-time recovery %s: %s", this.Id, phase)
+}
+
+// runPITR drives the recovery: list binary logs, prepare the recovered data, then replay logs onto it
+func runPITR(job *PITRJob) error {
+	request := job.Request
+	job.setPhase("listing binary logs")
+	binlogFiles, err := job.listBinlogFiles()
+	if err != nil {
+		return log.Errore(err)
+	}
+	// Where each log is read from; logs of a source agent are fetched as replay proceeds
+	fileNames := make(map[string]string)
+	if request.SourceAgent == "" {
+		for _, binlogFile := range binlogFiles {
+			fileNames[binlogFile.LogFile] = binlogFile.LogFile
+		}
+	}
+	if request.SourceAgent == "" && request.Backup != "" {
+		if err := job.copyDataDirBinlogFiles(binlogFiles, fileNames); err != nil {
+			return log.Errore(err)
+		}
+	}
+	if err := job.checkAborted(); err != nil {
+		return err
+	}
+
+	var destination *replayDestination
+	if request.Snapshot != "" {
+		destination, err = job.startSandbox()
+	} else {
+		destination, err = job.prepareLiveServer()
+	}
+	if err != nil {
+		return log.Errore(err)
+	}
+	if destination.done != nil {
+		defer func() {
+			if err := destination.done(); err != nil {
+				log.Errore(err)
+			}
+		}()
+	}
+	if err := job.checkAborted(); err != nil {
+		return err
+	}
+
+	executedGtids, err := destination.executedGtids()
+	if err != nil {
+		return log.Errore(err)
+	}
+	startIndex, startPosition, err := selectPITRStart(binlogFiles, request.StartCoordinates, executedGtids)
+	if err != nil {
+		return log.Errore(err)
+	}
+	binlogFiles = binlogFiles[startIndex:]
+	updatePITRJob(job, func(job *PITRJob) {
+		job.BinlogFiles = []string{}
+		for _, binlogFile := range binlogFiles {
+			job.BinlogFiles = append(job.BinlogFiles, binlogFile.LogFile)
+		}
+	})
+
+	replay, err := newBinlogReplay(request.Stop, BinlogFilter{}, executedGtids)
+	if err != nil {
+		return log.Errore(err)
+	}
+	for i, binlogFile := range binlogFiles {
+		if err := job.checkAborted(); err != nil {
+			return err
+		}
+		job.setPhase(fmt.Sprintf("replaying %s", path.Base(binlogFile.LogFile)))
+		stopped, err := job.replayBinlogFile(replay, destination, binlogFile.LogFile, fileNames[binlogFile.LogFile], startPosition)
+		updatePITRJob(job, func(job *PITRJob) {
+			job.Report = replay.report
+			if err == nil {
+				job.FilesReplayed = i + 1
+			}
+		})
+		if err != nil {
+			return log.Errore(err)
+		}
+		if stopped {
+			break
+		}
+		startPosition = 0
+	}
+	if replay.report.StopReason == "" {
+		updatePITRJob(job, func(job *PITRJob) { job.Report.StopReason = "Reached end of binary logs" })
+	}
+	job.setPhase("done")
+	return nil
+}
+
+// listBinlogFiles lists the source's binary logs, leaving out those entirely beyond the stop point
+func (this *PITRJob) listBinlogFiles() (binlogFiles []BinlogFile, err error) {
+	if this.Request.SourceAgent != "" {
+		err = this.sourceAgentGet("/api/mysql-binlog-files", url.Values{}, &binlogFiles)
+	} else {
+		binlogFiles, err = GetBinaryLogFiles()
+	}
+	if err != nil {
+		return binlogFiles, err
+	}
+	if len(binlogFiles) == 0 {
+		return binlogFiles, fmt.Errorf("No binary logs found")
+	}
+	return pitrBinlogFilesUpTo(binlogFiles, this.Request.Stop)
+}
+
+// pitrBinlogFilesUpTo truncates a list of logs following the one where given stop point is met
+func pitrBinlogFilesUpTo(binlogFiles []BinlogFile, stop BinlogStopPoint) ([]BinlogFile, error) {
+	if err := stop.validate(); err != nil {
+		return binlogFiles, err
+	}
+	if stop.Coordinates != nil {
+		for i, binlogFile := range binlogFiles {
+			if path.Base(binlogFile.LogFile) == path.Base(stop.Coordinates.LogFile) {
+				return binlogFiles[:i+1], nil
+			}
+		}
+		return binlogFiles, fmt.Errorf("Stop coordinates %s not found in binary logs", stop.Coordinates.LogFile)
+	}
+	for i := 1; i < len(binlogFiles); i++ {
+		if !stop.Time.IsZero() && binlogFiles[i].FirstEventTime.After(stop.Time) {
+			return binlogFiles[:i], nil
+		}
+		if stop.gtidSet != nil && binlogFiles[i].PreviousGtids != "" {
+			if previousGtids, err := inst.ParseGtidSet(binlogFiles[i].PreviousGtids); err == nil && previousGtids.Contains(stop.gtidSet) {
+				return binlogFiles[:i], nil
+			}
+		}
+	}
+	return binlogFiles, nil
+}
+
+// selectPITRStart returns the log, and position within it, where replay starts: explicit start coordinates,
+// or else the last log whose previous GTIDs are all executed on the recovered data
+func selectPITRStart(binlogFiles []BinlogFile, startCoordinates *inst.BinlogCoordinates, executedGtids *inst.GtidSet) (int, int64, error) {
+	if startCoordinates != nil {
+		for i, binlogFile := range binlogFiles {
+			if path.Base(binlogFile.LogFile) == path.Base(startCoordinates.LogFile) {
+				return i, startCoordinates.LogPos, nil
+			}
+		}
+		return 0, 0, fmt.Errorf("Start coordinates %s not found in binary logs", startCoordinates.LogFile)
+	}
+	if executedGtids == nil || executedGtids.IsEmpty() {
+		return 0, 0, fmt.Errorf("Recovered data has no executed GTIDs; start coordinates are required")
+	}
+	startIndex := -1
+	for i, binlogFile := range binlogFiles {
+		if binlogFile.PreviousGtids == "" {
+			if i == 0 {
+				startIndex = 0
+			}
+			continue
+		}
+		if previousGtids, err := inst.ParseGtidSet(binlogFile.PreviousGtids); err == nil && executedGtids.Contains(previousGtids) {
+			startIndex = i
+		}
+	}
+	if startIndex < 0 {
+		return 0, 0, fmt.Errorf("Binary logs begin past the recovered data: %s precedes %s, whereas recovered data executed %s",
+			binlogFiles[0].PreviousGtids, path.Base(binlogFiles[0].LogFile), executedGtids.String())
+	}
+	return startIndex, 0, nil
+}
+
+// sourceAgentGet reads a JSON response off the source agent's API
+func (this *PITRJob) sourceAgentGet(apiPath string, query url.Values, result interface{}) error {
+	response, err := this.sourceAgentRequest(apiPath, query)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// sourceAgentRequest issues a request to the source agent's API, returning a successful response
+func (this *PITRJob) sourceAgentRequest(apiPath string, query url.Values) (*http.Response, error) {
+	tlsConfig, err := ssl.NewTLSConfig(config.Config.SSLCAFile, config.Config.UseMutualTLS)
+	if err != nil {
+		return nil, err
+	}
+	_ = ssl.AppendKeyPair(tlsConfig, config.Config.SSLCertFile, config.Config.SSLPrivateKeyFile)
+	tlsConfig.InsecureSkipVerify = config.Config.SSLSkipVerify
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, time.Duration(config.Config.HttpTimeoutSeconds)*time.Second)
+		},
+	}}
+
+	query.Set("token", this.Request.SourceToken)
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s?%s", strings.TrimRight(this.Request.SourceAgent, "/"), apiPath, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.Config.TokenHttpHeader != "" {
+		request.Header.Set(config.Config.TokenHttpHeader, this.Request.SourceToken)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		var apiResponse struct{ Message string }
+		json.NewDecoder(response.Body).Decode(&apiResponse)
+		return nil, fmt.Errorf("%s: %s %s", apiPath, response.Status, apiResponse.Message)
+	}
+	return response, nil
+}
+
+// fetchBinlogFile downloads a binary log off the source agent into the job's work directory, verifying it
+// against the digest trailing the streamed content
+func (this *PITRJob) fetchBinlogFile(logFile string) (string, error) {
+	response, err := this.sourceAgentRequest("/api/mysql-binlog-binary-contents-stream", url.Values{"binlog": {logFile}})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	digest := newDigestWriter()
+	fileName, err := this.writeBinlogFile(logFile, io.TeeReader(response.Body, digest))
+	if err != nil {
+		return "", err
+	}
+	if streamErr := response.Trailer.Get(BinlogContentErrorHeader); streamErr != "" {
+		return "", fmt.Errorf("%s: %s", logFile, streamErr)
+	}
+	expected, err := ParseContentDigest(response.Trailer.Get(BinlogContentLengthHeader), response.Trailer.Get(BinlogContentChecksumHeader))
+	if err != nil {
+		return "", err
+	}
+	if expected == nil {
+		return "", fmt.Errorf("%s: no content digest received", logFile)
+	}
+	if err := expected.Verify(digest.digest()); err != nil {
+		return "", fmt.Errorf("%s: %+v", logFile, err)
+	}
+	return fileName, nil
+}
+
+// copyDataDirBinlogFiles copies the local logs residing in the data directory, which the backup restore is about
+// to remove, into the job's work directory, and points fileNames at the copies. Copying begins with the log
+// of the start coordinates; without these, the logs needed are only told by the restored data, hence all are
+// copied.
+func (this *PITRJob) copyDataDirBinlogFiles(binlogFiles []BinlogFile, fileNames map[string]string) error {
+	dataDirectory, err := GetMySQLDataDir()
+	if err != nil {
+		return err
+	}
+	if dataDirectory == "" {
+		return errors.New("Empty MySQL data directory")
+	}
+	dataDirectory = path.Clean(dataDirectory) + "/"
+	if strings.HasPrefix(path.Clean(this.workDir)+"/", dataDirectory) {
+		return fmt.Errorf("PITRDirectory %s is within the data directory about to be restored", config.Config.PITRDirectory)
+	}
+	startIndex := 0
+	if this.Request.StartCoordinates != nil {
+		if startIndex, _, err = selectPITRStart(binlogFiles, this.Request.StartCoordinates, nil); err != nil {
+			return err
+		}
+	}
+	this.setPhase("copying binary logs")
+	for _, binlogFile := range binlogFiles[startIndex:] {
+		if !strings.HasPrefix(binlogFile.LogFile, dataDirectory) {
+			continue
+		}
+		if err := this.checkAborted(); err != nil {
+			return err
+		}
+		if fileNames[binlogFile.LogFile], err = this.copyBinlogFile(binlogFile.LogFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBinlogFile copies a local binary log into the job's work directory
+func (this *PITRJob) copyBinlogFile(logFile string) (string, error) {
+	file, err := openLogFile(logFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return this.writeBinlogFile(logFile, file)
+}
+
+func (this *PITRJob) writeBinlogFile(logFile string, reader io.Reader) (string, error) {
+	fileName := path.Join(this.workDir, path.Base(logFile))
+	file, err := os.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, reader); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// startSandbox starts a sandbox against the snapshot and waits for it to serve queries. The sandbox's mysqld
+// is read-only; logs are replayed as its replay user, which may write nonetheless. The replay user is dropped once
+// replaying is over, as the recovered snapshot is not to keep an account with all privileges.
+func (this *PITRJob) startSandbox() (*replayDestination, error) {
+	this.setPhase("starting sandbox")
+	sandbox, err := startSandbox(this.Request.Snapshot, this.Request.SandboxTTL, true)
+	if err != nil {
+		return nil, err
+	}
+	updatePITRJob(this, func(job *PITRJob) { job.SandboxId = sandbox.Id })
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for sandbox.Status == SandboxStarting {
+		select {
+		case <-ticker.C:
+		case <-this.abortRequested:
+			this.abortRequested <- true
+			StopSandbox(sandbox.Id)
+			return nil, errors.New("Point-in-time recovery aborted")
+		}
+		if sandbox, err = GetSandbox(sandbox.Id); err != nil {
+			return nil, err
+		}
+	}
+	if sandbox.Status != SandboxRunning {
+		return nil, fmt.Errorf("Sandbox %s %s: %s", sandbox.Id, sandbox.Status, sandbox.Error)
+	}
+	return &replayDestination{
+		clientCommand: sudoCmd(sandbox.replayClientCommand("mysql")),
+		queryValue: func(query string) (string, error) {
+			output, err := sandboxQuery(&sandbox, query)
+			if err != nil {
+				return "", err
+			}
+			// Batch output: column name, then value, with line breaks escaped
+			lines := strings.Split(strings.TrimSpace(output), "\n")
+			if len(lines) < 2 {
+				return "", nil
+			}
+			return strings.Replace(lines[1], `\n`, "", -1), nil
+		},
+		done: func() error {
+			return sandbox.dropUsers(sandboxReplayMySQLUser)
+		},
+	}, nil
+}
+
+// prepareLiveServer restores the backup, if any, onto the live data directory and starts MySQL, then waits
+// for MySQL to accept connections
+func (this *PITRJob) prepareLiveServer() (*replayDestination, error) {
+	if this.Request.Backup != "" {
+		this.setPhase(fmt.Sprintf("restoring backup %s", this.Request.Backup))
+		if err := RestoreBackup(this.Request.Backup, this.Id); err != nil {
+			return nil, err
+		}
+		for {
+			if phase, _ := getJobPhase(this.Id); phase.done {
+				if phase.err != nil {
+					return nil, phase.err
+				}
+				break
+			}
+			if this.aborted() {
+				AbortSeed(this.Id)
+			}
+			time.Sleep(time.Second)
+		}
+		if err := this.checkAborted(); err != nil {
+			return nil, err
+		}
+		this.setPhase("starting MySQL")
+		if err := MySQLStart(); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := time.After(time.Duration(config.Config.MySQLStartupTimeoutSeconds) * time.Second)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		db, err := openMySQL()
+		if err == nil {
+			if err = db.Ping(); err == nil {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-this.abortRequested:
+			this.abortRequested <- true
+			return nil, errors.New("Point-in-time recovery aborted")
+		case <-timeout:
+			return nil, fmt.Errorf("Timeout waiting for MySQL to accept connections: %+v", err)
+		}
+	}
+	return liveReplayDestination(), nil
+}
+
+// replayBinlogFile replays a single log, read off fileName, onto the destination, returning true once the stop
+// point is reached. With no fileName, the log is fetched from the source agent.
+func (this *PITRJob) replayBinlogFile(replay *binlogReplay, destination *replayDestination, logFile string, fileName string, startPosition int64) (stopped bool, err error) {
+	if fileName == "" {
+		if fileName, err = this.fetchBinlogFile(logFile); err != nil {
+			return false, err
+		}
+		defer os.Remove(fileName)
+	}
+	sqlFile, err := ioutil.TempFile(this.workDir, "replay-sql-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(sqlFile.Name())
+	defer sqlFile.Close()
+
+	sqlWriter := inst.NewBinlogSQLWriter(sqlFile)
+	err = replay.replayFile(logFile, fileName, startPosition, sqlWriter)
+	if err == errBinlogReplayStopped {
+		stopped, err = true, nil
+	}
+	if err != nil {
+		return stopped, err
+	}
+	if err := sqlWriter.Close(); err != nil {
+		return stopped, err
+	}
+	err = commandRun(fmt.Sprintf("%s < %s", destination.clientCommand, sqlFile.Name()), func(cmd *exec.Cmd) {
+		setActiveCommand(this.Id, cmd)
+	})
+	return stopped, err
+}
+
+// GetPITRJob returns a point-in-time recovery job
+func GetPITRJob(jobId string) (PITRJob, error) {
+	pitrJobsMutex.Lock()
+	defer pitrJobsMutex.Unlock()
+	job, ok := pitrJobs[jobId]
+	if !ok {
+		return PITRJob{}, fmt.Errorf("Unknown point-in-time recovery: %s", jobId)
+	}
+	return job.snapshot(), nil
+}
+
+// PITRJobs lists point-in-time recovery jobs
+func PITRJobs() []PITRJob {
+	pitrJobsMutex.Lock()
+	defer pitrJobsMutex.Unlock()
+	result := []PITRJob{}
+	for _, job := range pitrJobs {
+		result = append(result, job.snapshot())
+	}
+	return result
+}
+
+// AbortPITR requests a running point-in-time recovery to stop, killing its running command, if any. Data
+// recovered so far is left as is.
+func AbortPITR(jobId string) error {
+	pitrJobsMutex.Lock()
+	defer pitrJobsMutex.Unlock()
+	job, ok := pitrJobs[jobId]
+	if !ok {
+		return fmt.Errorf("Unknown point-in-time recovery: %s", jobId)
+	}
+	if job.Status != PITRRunning {
+		return fmt.Errorf("Point-in-time recovery %s is %s", jobId, job.Status)
+	}
+	select {
+	case job.abortRequested <- true:
+	default:
+	}
+	AbortSeed(jobId)
+	return nil
+}
@@ -0,0 +1,225 @@
+package osagent_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+func TestStartPITRValidation(t *testing.T) {
+	requests := []osagent.PITRRequest{
+		{Snapshot: "/mnt/snapshots/a", Backup: "nightly", SandboxTTL: time.Hour},
+		{Snapshot: "/mnt/snapshots/a"},
+		{Backup: "nightly", Stop: osagent.BinlogStopPoint{Gtid: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"}},
+		{Backup: "nightly", Stop: osagent.BinlogStopPoint{Gtid: "not a gtid"}},
+		// Neither snapshot, backup nor source agent: the live server's own logs
+		{Stop: osagent.BinlogStopPoint{Time: time.Now()}},
+	}
+	defer func(command string) { config.Config.MySQLClientCommand = command }(config.Config.MySQLClientCommand)
+	config.Config.MySQLClientCommand = "mysql"
+	for _, request := range requests {
+		if _, err := osagent.StartPITR(request); err == nil {
+			t.Errorf("Expected error on %+v", request)
+		}
+	}
+	if _, err := osagent.GetPITRJob("no-such-job"); err == nil {
+		t.Errorf("Expected error getting unknown job")
+	}
+}
+
+func waitForPITRJob(t *testing.T, jobId string) osagent.PITRJob {
+	for i := 0; i < 100; i++ {
+		job, err := osagent.GetPITRJob(jobId)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if job.Status != osagent.PITRRunning {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for job %s", jobId)
+	return osagent.PITRJob{}
+}
+
+func TestPITRSourceAgent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(500)
+			w.Write([]byte(`{"Code":"ERROR","Message":"Invalid token"}`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	defer func(directory string) { config.Config.PITRDirectory = directory }(config.Config.PITRDirectory)
+	config.Config.PITRDirectory = directory
+
+	tests := []struct {
+		token         string
+		expectedError string
+	}{
+		{"secret", "No binary logs found"},
+		{"wrong", "Invalid token"},
+	}
+	for _, test := range tests {
+		job, err := osagent.StartPITR(osagent.PITRRequest{SourceAgent: server.URL, SourceToken: test.token})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		job = waitForPITRJob(t, job.Id)
+		if job.Status != osagent.PITRFailed || !strings.Contains(job.Error, test.expectedError) {
+			t.Errorf("Expected failure with %q, got %+v", test.expectedError, job)
+		}
+	}
+	// Work directories are removed once jobs are done
+	if fileInfos, _ := ioutil.ReadDir(directory); len(fileInfos) != 0 {
+		t.Errorf("Expected no work directories left in %s, found %d", directory, len(fileInfos))
+	}
+}
+
+// writeTestPITRBinlogs writes three logs of three transactions each, GTIDs 1-3, 4-6 and 7-9, spaced 100 seconds
+// apart, and returns their scans along with the positions of transactions in the second log
+func writeTestPITRBinlogs(t *testing.T, directory string) ([]osagent.BinlogFile, []int64) {
+	binlogFiles := []osagent.BinlogFile{}
+	var positions []int64
+	for i := 0; i < 3; i++ {
+		fileName := path.Join(directory, "mysql-bin.00000"+string('1'+rune(i)))
+		gno := int64(3 * i)
+		timestamp := uint32(1600000000 + 100*i)
+		filePositions := writeTestGtidBinlog(t, fileName, gno, []int64{gno + 1, gno + 2, gno + 3}, []uint32{timestamp, timestamp + 10, timestamp + 20})
+		if i == 1 {
+			positions = filePositions
+		}
+		binlogFile, err := osagent.ScanBinlogFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binlogFiles = append(binlogFiles, *binlogFile)
+	}
+	return binlogFiles, positions
+}
+
+func TestSelectPITRStart(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	binlogFiles, _ := writeTestPITRBinlogs(t, directory)
+	gtidSet := func(gtid string) *inst.GtidSet {
+		gtidSet, err := inst.ParseGtidSet(gtid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gtidSet
+	}
+
+	tests := []struct {
+		executedGtids *inst.GtidSet
+		expectedIndex int
+	}{
+		{gtidSet(testUUID + ":1-2"), 0},
+		{gtidSet(testUUID + ":1-4"), 1},
+		{gtidSet(testUUID + ":1-6"), 2},
+		{gtidSet(testUUID + ":1-9"), 2},
+	}
+	for _, test := range tests {
+		index, position, err := osagent.SelectPITRStart(binlogFiles, nil, test.executedGtids)
+		if err != nil || index != test.expectedIndex || position != 0 {
+			t.Errorf("Expected start at log %d given %s, got %d:%d, %+v", test.expectedIndex, test.executedGtids, index, position, err)
+		}
+	}
+	index, position, err := osagent.SelectPITRStart(binlogFiles, &inst.BinlogCoordinates{LogFile: "mysql-bin.000002", LogPos: 123}, nil)
+	if err != nil || index != 1 || position != 123 {
+		t.Errorf("Expected start at given coordinates, got %d:%d, %+v", index, position, err)
+	}
+	if _, _, err := osagent.SelectPITRStart(binlogFiles, &inst.BinlogCoordinates{LogFile: "mysql-bin.000009"}, nil); err == nil {
+		t.Errorf("Expected error on unknown start coordinates")
+	}
+	if _, _, err := osagent.SelectPITRStart(binlogFiles, nil, gtidSet("")); err == nil {
+		t.Errorf("Expected error on recovered data with no executed GTIDs")
+	}
+	if _, _, err := osagent.SelectPITRStart(binlogFiles[1:], nil, gtidSet(testUUID+":1-2")); err == nil {
+		t.Errorf("Expected error on logs beginning past the recovered data")
+	}
+}
+
+func TestPITRBinlogFilesUpTo(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	binlogFiles, _ := writeTestPITRBinlogs(t, directory)
+
+	tests := []struct {
+		stop          osagent.BinlogStopPoint
+		expectedCount int
+	}{
+		{osagent.BinlogStopPoint{}, 3},
+		{osagent.BinlogStopPoint{Time: time.Unix(1600000150, 0)}, 2},
+		{osagent.BinlogStopPoint{Time: time.Unix(1600000200, 0)}, 3},
+		{osagent.BinlogStopPoint{Gtid: testUUID + ":2"}, 1},
+		{osagent.BinlogStopPoint{Gtid: testUUID + ":5"}, 2},
+		{osagent.BinlogStopPoint{Gtid: testUUID + ":8"}, 3},
+		{osagent.BinlogStopPoint{Coordinates: &inst.BinlogCoordinates{LogFile: path.Join("/elsewhere", "mysql-bin.000002"), LogPos: 4}}, 2},
+	}
+	for _, test := range tests {
+		upTo, err := osagent.PITRBinlogFilesUpTo(binlogFiles, test.stop)
+		if err != nil || len(upTo) != test.expectedCount {
+			t.Errorf("Expected %d logs up to %+v, got %d, %+v", test.expectedCount, test.stop, len(upTo), err)
+		}
+	}
+	if _, err := osagent.PITRBinlogFilesUpTo(binlogFiles, osagent.BinlogStopPoint{Coordinates: &inst.BinlogCoordinates{LogFile: "mysql-bin.000009"}}); err == nil {
+		t.Errorf("Expected error on unknown stop coordinates")
+	}
+}
+
+func TestBinlogReplayStop(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	binlogFiles, positions := writeTestPITRBinlogs(t, directory)
+	logFile := binlogFiles[1].LogFile
+	executedGtids, _ := inst.ParseGtidSet(testUUID + ":1-4")
+
+	tests := []struct {
+		startPosition   int64
+		stop            osagent.BinlogStopPoint
+		executedGtids   *inst.GtidSet
+		expectedApplied int64
+		expectedSkipped int64
+		expectedStop    int64 // position replay stops at, if any
+		expectedReason  string
+	}{
+		{0, osagent.BinlogStopPoint{}, nil, 3, 0, 0, ""},
+		{0, osagent.BinlogStopPoint{Time: time.Unix(1600000110, 0)}, nil, 1, 0, positions[1], "stop time"},
+		{0, osagent.BinlogStopPoint{Time: time.Unix(1600000105, 0)}, nil, 1, 0, positions[1], "stop time"},
+		{0, osagent.BinlogStopPoint{Gtid: testUUID + ":6"}, nil, 2, 0, positions[2], "stop GTID"},
+		{0, osagent.BinlogStopPoint{Coordinates: &inst.BinlogCoordinates{LogFile: logFile, LogPos: positions[1]}}, nil, 1, 0, positions[1], "stop position"},
+		{0, osagent.BinlogStopPoint{Coordinates: &inst.BinlogCoordinates{LogFile: logFile, LogPos: positions[1] + 1}}, nil, 2, 0, positions[2], "stop position"},
+		{0, osagent.BinlogStopPoint{Gtid: testUUID + ":6"}, executedGtids, 1, 1, positions[2], "stop GTID"},
+		{positions[1], osagent.BinlogStopPoint{}, nil, 2, 0, 0, ""},
+	}
+	for i, test := range tests {
+		report, err := osagent.ReplayBinlogFile(logFile, test.startPosition, test.stop, test.executedGtids)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if report.TransactionsApplied != test.expectedApplied || report.TransactionsSkipped != test.expectedSkipped {
+			t.Errorf("%d: expected %d transactions applied and %d skipped, got %+v", i, test.expectedApplied, test.expectedSkipped, report)
+		}
+		if test.expectedStop == 0 {
+			if report.StopCoordinates != nil || report.StopReason != "" {
+				t.Errorf("%d: expected no stop, got %+v", i, report)
+			}
+		} else if report.StopCoordinates == nil || report.StopCoordinates.LogPos != test.expectedStop || !strings.Contains(report.StopReason, test.expectedReason) {
+			t.Errorf("%d: expected stop at %d on %s, got %+v", i, test.expectedStop, test.expectedReason, report)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/outbrain/golib/log"
+)
+
+// relaylogApplyRequestRetention is how long applied requests are remembered, for retries to be recognized
+const relaylogApplyRequestRetention = 24 * time.Hour
+
+// RelaylogApplyOptions control how relay log contents are applied
+type RelaylogApplyOptions struct {
+	RequestId         string // identifies the request, such that retries of an applied request are not applied again
+	DryRun            bool   // render the contents as SQL without applying them
+	Filter            BinlogFilter
+	SkipExecutedGtids bool  // skip transactions the server has already executed
+	StopPosition      int64 // position within the contents; transactions starting at or after it are not applied
+}
+
+// RelaylogApplyReport tells what applying relay log contents did, or would do
+type RelaylogApplyReport struct {
+	BinlogReplayReport
+	RequestId    string
+	DryRun       bool
+	Deduplicated bool                      // a retry of an applied request, hence not applied again
+	Transactions []BinlogReplayTransaction // applied, or on dry run, to be applied
+	SQL          string                    `json:",omitempty"` // on dry run: the SQL which would be applied
+}
+
+// relaylogApplyRequest is an apply request, in progress or done. Requests are kept in StateDirectory, such that
+// retries are recognized across restarts of the agent.
+type relaylogApplyRequest struct {
+	Checksum            string
+	InProgress          bool `json:"-"`
+	Done                bool
+	Report              *RelaylogApplyReport
+	AppliedTransactions map[int64]bool // positions of transactions applied by failed attempts
+	Updated             time.Time
+}
+
+// relaylogApplyRequestsFile is the file, in StateDirectory, keeping apply requests
+const relaylogApplyRequestsFile = "relaylog-apply-requests.json"
+
+var relaylogApplyRequests map[string]*relaylogApplyRequest
+var relaylogApplyRequestsMutex = &sync.Mutex{}
+
+// loadRelaylogApplyRequests reads apply requests once, as kept by previous runs of the agent. A request in progress
+// as the agent stopped is known by the transactions its earlier attempts applied, if any: those applied by the
+// interrupted attempt itself are unknown. Expects relaylogApplyRequestsMutex to be held.
+func loadRelaylogApplyRequests() {
+	if relaylogApplyRequests != nil {
+		return
+	}
+	relaylogApplyRequests = make(map[string]*relaylogApplyRequest)
+	if err := readStateFile(relaylogApplyRequestsFile, &relaylogApplyRequests); err != nil {
+		log.Errore(err)
+	}
+}
+
+// storeRelaylogApplyRequests keeps apply requests in StateDirectory. Expects relaylogApplyRequestsMutex to be held.
+func storeRelaylogApplyRequests() {
+	if err := writeStateFile(relaylogApplyRequestsFile, relaylogApplyRequests); err != nil {
+		log.Errore(err)
+	}
+}
+
+// ApplyRelaylogContents applies relay log contents, gzipped and base64 encoded as by MySQLBinlogBinaryContents
+func ApplyRelaylogContents(content []byte, options RelaylogApplyOptions) (*RelaylogApplyReport, error) {
+	relaylogContents, err := gunzipBase64(content)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	return applyRelaylogContents(relaylogContents, nil, options)
+}
+
+// applyRelaylogContents stores relay log contents read off given reader, verifies them against the expected
+// digest, if any, then applies them. A request applied before, by id, is not applied again; one which failed
+// is resumed past the transactions its previous attempts applied.
+func applyRelaylogContents(relaylogContents io.Reader, expectedDigest func() (*ContentDigest, error), options RelaylogApplyOptions) (*RelaylogApplyReport, error) {
+	relaylogContentsFile, err := ioutil.TempFile("", "orchestrator-agent-apply-relaylog-bin-")
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	defer os.Remove(relaylogContentsFile.Name())
+	defer relaylogContentsFile.Close()
+	digest := newDigestWriter()
+	if _, err := io.Copy(io.MultiWriter(relaylogContentsFile, digest), relaylogContents); err != nil {
+		return nil, log.Errore(err)
+	}
+	if expectedDigest != nil {
+		expected, err := expectedDigest()
+		if err != nil {
+			return nil, log.Errore(err)
+		}
+		if expected != nil {
+			if err := expected.Verify(digest.digest()); err != nil {
+				return nil, log.Errore(err)
+			}
+		}
+	}
+
+	if options.DryRun || options.RequestId == "" {
+		return applyRelaylogFile(relaylogContentsFile.Name(), options, nil)
+	}
+	request, err := beginRelaylogApplyRequest(options.RequestId, digest.digest().Checksum)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	if request.Done {
+		log.Infof("Relay log contents of request %s already applied", options.RequestId)
+		report := *request.Report
+		report.Deduplicated = true
+		return &report, nil
+	}
+	report, err := applyRelaylogFile(relaylogContentsFile.Name(), options, request.AppliedTransactions)
+	endRelaylogApplyRequest(request, report, err)
+	return report, err
+}
+
+// beginRelaylogApplyRequest registers an apply request by id, or returns the one registered, if done. A request
+// is not to be applied concurrently with its retries, nor may its id be reused for different contents.
+func beginRelaylogApplyRequest(requestId string, checksum string) (*relaylogApplyRequest, error) {
+	relaylogApplyRequestsMutex.Lock()
+	defer relaylogApplyRequestsMutex.Unlock()
+
+	loadRelaylogApplyRequests()
+	for id, request := range relaylogApplyRequests {
+		if !request.InProgress && time.Since(request.Updated) > relaylogApplyRequestRetention {
+			delete(relaylogApplyRequests, id)
+		}
+	}
+	request, ok := relaylogApplyRequests[requestId]
+	if !ok {
+		request = &relaylogApplyRequest{Checksum: checksum, InProgress: true, AppliedTransactions: make(map[int64]bool), Updated: time.Now()}
+		relaylogApplyRequests[requestId] = request
+		return request, nil
+	}
+	if request.Checksum != checksum {
+		return nil, fmt.Errorf("Request %s was made with different contents", requestId)
+	}
+	if request.Done {
+		return request, nil
+	}
+	if request.InProgress {
+		return nil, fmt.Errorf("Request %s is being applied", requestId)
+	}
+	// A retry of a failed request
+	if request.AppliedTransactions == nil {
+		request.AppliedTransactions = make(map[int64]bool)
+	}
+	request.InProgress = true
+	request.Updated = time.Now()
+	return request, nil
+}
+
+// endRelaylogApplyRequest records the outcome of an apply request. A failed request may be retried.
+func endRelaylogApplyRequest(request *relaylogApplyRequest, report *RelaylogApplyReport, err error) {
+	relaylogApplyRequestsMutex.Lock()
+	defer relaylogApplyRequestsMutex.Unlock()
+
+	request.InProgress = false
+	request.Updated = time.Now()
+	if report != nil {
+		for _, transaction := range report.Transactions {
+			request.AppliedTransactions[transaction.Position] = true
+		}
+	}
+	if err == nil {
+		request.Done = true
+		request.Report = report
+	}
+	storeRelaylogApplyRequests()
+}
+
+// applyRelaylogFile renders a relay log as SQL and applies it, a transaction at a time: each commits on its own,
+// and is followed by a progress marker, such that the client's output tells exactly which were applied should
+// the client fail. A transaction cut short by a failure is rolled back as the client disconnects. Transactions
+// at given positions are skipped. On failure, the report of transactions applied so far is returned along with
+// the error.
+func applyRelaylogFile(fileName string, options RelaylogApplyOptions, skipTransactions map[int64]bool) (*RelaylogApplyReport, error) {
+	if !options.DryRun && config.Config.MySQLClientCommand == "" {
+		return nil, log.Errorf("MySQLClientCommand is unconfigured; cannot apply relay log contents")
+	}
+	var executedGtids *inst.GtidSet
+	var err error
+	if options.SkipExecutedGtids {
+		if executedGtids, err = liveReplayDestination().executedGtids(); err != nil {
+			return nil, log.Errore(err)
+		}
+	}
+	var stop BinlogStopPoint
+	if options.StopPosition > 0 {
+		stop.Coordinates = &inst.BinlogCoordinates{LogFile: fileName, LogPos: options.StopPosition, Type: inst.RelayLog}
+	}
+	replay, err := newBinlogReplay(stop, options.Filter, executedGtids)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	replay.skipGroups = skipTransactions
+
+	// SQL is rendered into a file to apply, or on dry run, into a buffer to return
+	var sqlOutput bytes.Buffer
+	var sqlFile *os.File
+	var sqlWriter *inst.BinlogSQLWriter
+	if options.DryRun {
+		sqlWriter = inst.NewBinlogSQLWriter(&sqlOutput)
+	} else {
+		if sqlFile, err = ioutil.TempFile("", "orchestrator-agent-apply-relaylog-sql-"); err != nil {
+			return nil, log.Errore(err)
+		}
+		defer os.Remove(sqlFile.Name())
+		defer sqlFile.Close()
+		sqlWriter = inst.NewBinlogSQLWriter(sqlFile)
+	}
+	transactions := []BinlogReplayTransaction{}
+	replay.onTransaction = func(transaction BinlogReplayTransaction) error {
+		transactions = append(transactions, transaction)
+		if options.DryRun {
+			return nil
+		}
+		return sqlWriter.WriteProgressMarker(len(transactions) - 1)
+	}
+	if err := replay.replayFile(fileName, fileName, 0, sqlWriter); err != nil && err != errBinlogReplayStopped {
+		return nil, log.Errore(err)
+	}
+	if err := sqlWriter.Close(); err != nil {
+		return nil, log.Errore(err)
+	}
+	report := &RelaylogApplyReport{BinlogReplayReport: replay.report, RequestId: options.RequestId, DryRun: options.DryRun, Transactions: transactions}
+	if options.DryRun {
+		report.SQL = sqlOutput.String()
+		return report, nil
+	}
+
+	report.Transactions = []BinlogReplayTransaction{}
+	markers, err := applyMarkedSQLFile(sqlFile.Name())
+	for _, index := range markers {
+		if index < len(transactions) {
+			report.Transactions = append(report.Transactions, transactions[index])
+		}
+	}
+	report.TransactionsApplied = int64(len(report.Transactions))
+	if err != nil {
+		report.LastAppliedGtid, report.LastAppliedTime, report.LastAppliedCoordinates = "", time.Time{}, nil
+		if len(report.Transactions) > 0 {
+			last := report.Transactions[len(report.Transactions)-1]
+			report.LastAppliedGtid, report.LastAppliedTime = last.Gtid, last.Time
+			report.LastAppliedCoordinates = &inst.BinlogCoordinates{LogFile: fileName, LogPos: last.EndPosition, Type: inst.BinaryLog}
+		}
+		return report, log.Errorf("Applied %d of %d transactions of %s: %+v", len(report.Transactions), len(transactions), fileName, err)
+	}
+	log.Infof("Applied relay log contents from %s: %d transactions applied, %d skipped", fileName, report.TransactionsApplied, report.TransactionsSkipped)
+
+	return report, nil
+}
+
+// applyMarkedSQLFile applies a file of SQL by MySQLClientCommand, returning the progress markers found in the
+// client's output, in order. Markers are the indexes of transactions, each selected once its transaction commits,
+// such that they tell which transactions were applied should the client fail.
+func applyMarkedSQLFile(fileName string) (markers []int, err error) {
+	cmd, tmpFileName, err := execCmd(sudoCmd(fmt.Sprintf("cat %s | %s", fileName, config.Config.MySQLClientCommand)))
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	defer os.Remove(tmpFileName)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	for _, line := range strings.Split(string(output), "\n") {
+		if index, parseErr := strconv.Atoi(strings.TrimSpace(line)); parseErr == nil && index >= 0 {
+			markers = append(markers, index)
+		}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("%s: %s", exitErr.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return markers, err
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/github/orchestrator-agent/go/inst"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+)
+
+// rowMapValues converts a RowMap into plain values, omitting NULLs
+func rowMapValues(m sqlutils.RowMap) map[string]string {
+	values := make(map[string]string)
+	for column, cell := range m {
+		if cell.Valid {
+			values[column] = cell.String
+		}
+	}
+	return values
+}
+
+// ReplicationStatus returns the status of each of the local MySQL server's replication channels;
+// none when the server is not a replica
+func ReplicationStatus() ([]inst.ReplicationStatus, error) {
+	statuses := []inst.ReplicationStatus{}
+	db, err := openMySQL()
+	if err != nil {
+		return statuses, err
+	}
+	instance, err := GetMySQLInstance()
+	if err != nil {
+		return statuses, err
+	}
+	onRow := func(m sqlutils.RowMap) error {
+		statuses = append(statuses, *inst.NewReplicationStatus(rowMapValues(m)))
+		return nil
+	}
+
+	if instance.IsMariaDB() {
+		if err := sqlutils.QueryRowsMap(db, "show all slaves status", onRow); err != nil {
+			return statuses, log.Errore(err)
+		}
+		// MariaDB does not list executed GTIDs per connection; its slave position is global
+		var gtidSlavePos string
+		if err := db.QueryRow("select @@gtid_slave_pos").Scan(&gtidSlavePos); err == nil {
+			for i := range statuses {
+				statuses[i].ExecutedGtidSet = gtidSlavePos
+			}
+		}
+		return statuses, nil
+	}
+	// Multi-source replicas list a row per channel
+	query := "show slave status"
+	if isVersionAtLeast(instance.Version, 8, 0, 22) {
+		query = "show replica status"
+	}
+	if err := sqlutils.QueryRowsMap(db, query, onRow); err != nil {
+		return statuses, log.Errore(err)
+	}
+	return statuses, nil
+}
+
+// isVersionAtLeast compares a server version such as 8.0.22-log with given major.minor.patch
+func isVersionAtLeast(version string, atLeast ...int) bool {
+	tokens := strings.Split(strings.SplitN(version, "-", 2)[0], ".")
+	for i, minimum := range atLeast {
+		if i >= len(tokens) {
+			return false
+		}
+		number, err := strconv.Atoi(tokens[i])
+		if err != nil {
+			return false
+		}
+		if number != minimum {
+			return number > minimum
+		}
+	}
+	return true
+}
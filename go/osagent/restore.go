@@ -0,0 +1,153 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/outbrain/golib/log"
+)
+
+// SnapshotRestore records a rollback of an origin volume onto one of its snapshots
+type SnapshotRestore struct {
+	Snapshot             string
+	Origin               string
+	GroupName            string
+	SnapshotCreationTime time.Time
+	Restored             time.Time
+	IsMergePending       bool // merge is deferred until the origin volume is next activated
+	IsMergeInProgress    bool // merge has started, and the snapshot is still being copied onto the origin
+}
+
+// snapshotRestoresFile is the file, in StateDirectory, keeping the history of snapshot restores
+const snapshotRestoresFile = "snapshot-restores.json"
+
+var snapshotRestores []SnapshotRestore
+var snapshotRestoresMutex = &sync.Mutex{}
+
+// loadSnapshotRestores reads the history of snapshot restores once, as kept by previous runs of the agent.
+// Expects snapshotRestoresMutex to be held.
+func loadSnapshotRestores() {
+	if snapshotRestores != nil {
+		return
+	}
+	snapshotRestores = []SnapshotRestore{}
+	if err := readStateFile(snapshotRestoresFile, &snapshotRestores); err != nil {
+		log.Errore(err)
+	}
+}
+
+// recordSnapshotRestore appends a restore to the history, and keeps the history in StateDirectory
+func recordSnapshotRestore(restore SnapshotRestore) {
+	snapshotRestoresMutex.Lock()
+	defer snapshotRestoresMutex.Unlock()
+
+	loadSnapshotRestores()
+	snapshotRestores = append(snapshotRestores, restore)
+	if err := writeStateFile(snapshotRestoresFile, snapshotRestores); err != nil {
+		log.Errore(err)
+	}
+}
+
+// RestoreSnapshot rolls the origin of given snapshot back to the snapshot's state, by merging the snapshot
+// into its origin. The snapshot is consumed by the merge. MySQL must be stopped; the snapshot must be valid,
+// not open (e.g. mounted) and, unless forced, not leased.
+func RestoreSnapshot(volumeName string, force bool) (SnapshotRestore, error) {
+	restore := SnapshotRestore{Snapshot: volumeName}
+	if volumeName == "" {
+		return restore, errors.New("Empty volumeName in RestoreSnapshot")
+	}
+	backend, err := GetStorageBackend()
+	if err != nil {
+		return restore, err
+	}
+	lvm, ok := backend.(*LVMBackend)
+	if !ok {
+		return restore, fmt.Errorf("Snapshot restore is not supported by %s storage backend", backend.Name())
+	}
+
+	if running, err := MySQLRunning(); err != nil {
+		return restore, err
+	} else if running {
+		return restore, errors.New("MySQL is running; refusing to restore snapshot")
+	}
+	logicalVolumes, err := lvm.Volumes(volumeName, "")
+	if err != nil {
+		return restore, err
+	}
+	if len(logicalVolumes) != 1 {
+		return restore, fmt.Errorf("Expected a single logical volume by %s, found %d", volumeName, len(logicalVolumes))
+	}
+	snapshot := logicalVolumes[0]
+	if !snapshot.IsSnapshotValid() {
+		return restore, fmt.Errorf("%s is not a valid snapshot", volumeName)
+	}
+	if snapshot.IsOpen {
+		return restore, fmt.Errorf("%s is open (mounted or otherwise in use); refusing to restore", volumeName)
+	}
+	if !force {
+		if err := checkNotLeased(volumeName); err != nil {
+			return restore, err
+		}
+		if err := checkNotLeased(volumeNames(snapshot)...); err != nil {
+			return restore, err
+		}
+		for _, mountPoint := range mountPointsOfVolume(snapshot) {
+			if err := checkNotLeased(mountPoint); err != nil {
+				return restore, err
+			}
+		}
+	}
+	// When the origin is open (e.g. the datadir is still mounted) the merge only takes place on its next activation.
+	// Otherwise it starts right away, and runs in the background.
+	originIsOpen := false
+	if origins, err := lvm.Volumes(path.Join(snapshot.GroupName, snapshot.Origin), ""); err == nil && len(origins) > 0 {
+		originIsOpen = origins[0].IsOpen
+	}
+
+	restore.Snapshot = snapshot.Name
+	restore.Origin = snapshot.Origin
+	restore.GroupName = snapshot.GroupName
+	restore.SnapshotCreationTime = snapshot.CreationTime
+	if err := lvm.Merge(snapshot.Path); err != nil {
+		return restore, err
+	}
+	restore.Restored = time.Now()
+	// The snapshot remains visible until the merge completes
+	if remaining, err := lvm.Volumes(snapshot.Path, ""); err == nil && len(remaining) > 0 {
+		restore.IsMergePending = originIsOpen
+		restore.IsMergeInProgress = !originIsOpen
+	}
+
+	recordSnapshotRestore(restore)
+	log.Infof("Restored %s/%s onto snapshot %s created at %+v; merge pending: %t, in progress: %t", restore.GroupName, restore.Origin, restore.Snapshot, restore.SnapshotCreationTime, restore.IsMergePending, restore.IsMergeInProgress)
+
+	return restore, nil
+}
+
+// SnapshotRestores returns the history of snapshot restores made by this agent, including by its previous runs
+func SnapshotRestores() []SnapshotRestore {
+	snapshotRestoresMutex.Lock()
+	defer snapshotRestoresMutex.Unlock()
+
+	loadSnapshotRestores()
+	return append([]SnapshotRestore{}, snapshotRestores...)
+}
@@ -0,0 +1,73 @@
+package osagent_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+const lvsCommand = "lvs -o lv_name,vg_name,lv_path,lv_size,origin,lv_time,lv_attr,snap_percent,data_percent,vg_free "
+
+func lvsReport(name string, origin string, attributes string) string {
+	return `{"report": [{"lv": [{"lv_name":"` + name + `", "vg_name":"vg0", "lv_path":"/dev/vg0/` + name + `", "origin":"` + origin + `", "lv_attr":"` + attributes + `", "snap_percent":"10.00"}]}]}`
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	defer useMountInfo(t, "22 1 253:0 / / rw - xfs /dev/mapper/vg0-root rw\n")()
+	config.Config.StateDirectory = directory
+	defer func() { config.Config.StateDirectory = "" }()
+	config.Config.MySQLServiceStatusCommand = "false"
+	defer func() { config.Config.MySQLServiceStatusCommand = "" }()
+
+	runner := &fakeRunner{outputs: map[string]string{
+		lvsCommand + "snap ":              lvsReport("snap", "mysql_data", "swi-a-s---"),
+		lvsCommand + "vg0/mysql_data ":    lvsReport("mysql_data", "", "owi-a-s---"),
+		lvsCommand + "/dev/vg0/snap ":     lvsReport("snap", "mysql_data", "Swi-a-s---"),
+		"lvconvert --merge /dev/vg0/snap": "",
+	}}
+	osagent.SetStorageBackend(osagent.NewLVMBackend(runner.run))
+	defer osagent.SetStorageBackend(nil)
+
+	lease, err := osagent.AcquireLease("vg0/snap", "seed:4", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := osagent.RestoreSnapshot("snap", false); err == nil {
+		t.Errorf("Expected error restoring snapshot leased by its group qualified name")
+	}
+	osagent.ReleaseLease(lease.Id)
+
+	restore, err := osagent.RestoreSnapshot("snap", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The origin is not open, hence the merge is under way rather than deferred
+	if restore.Origin != "mysql_data" || restore.IsMergePending || !restore.IsMergeInProgress {
+		t.Errorf("Unexpected restore: %+v", restore)
+	}
+	runner.outputs[lvsCommand+"vg0/mysql_data "] = lvsReport("mysql_data", "", "owi-aos---")
+	if restore, err = osagent.RestoreSnapshot("snap", false); err != nil || !restore.IsMergePending || restore.IsMergeInProgress {
+		t.Errorf("Expected pending merge on open origin: %+v, %+v", restore, err)
+	}
+
+	persisted := []osagent.SnapshotRestore{}
+	contents, err := ioutil.ReadFile(path.Join(directory, "snapshot-restores.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(contents, &persisted); err != nil {
+		t.Fatal(err)
+	}
+	restores := osagent.SnapshotRestores()
+	if len(persisted) < 2 || len(restores) != len(persisted) || persisted[len(persisted)-1].Snapshot != "snap" {
+		t.Errorf("Unexpected restore history: %+v, persisted: %+v", restores, persisted)
+	}
+}
@@ -0,0 +1,552 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/outbrain/golib/log"
+)
+
+type SandboxStatus string
+
+const (
+	SandboxStarting SandboxStatus = "starting"
+	SandboxRunning  SandboxStatus = "running"
+	SandboxVerified SandboxStatus = "verified"
+	SandboxFailed   SandboxStatus = "failed"
+	SandboxStopped  SandboxStatus = "stopped"
+)
+
+// SandboxCheck is the result of a sanity query executed on a sandbox
+type SandboxCheck struct {
+	Query  string
+	Output string
+	Error  string
+}
+
+// Sandbox is a temporary mysqld, started on an alternate port and socket against a mounted snapshot's
+// data directory. It proves the snapshot is recoverable, and can optionally serve read-only queries until it expires.
+type Sandbox struct {
+	Id               string
+	MountPoint       string
+	DataPath         string
+	Port             int
+	SocketFile       string
+	ErrorLogFile     string
+	Status           SandboxStatus
+	Started          time.Time
+	Ready            time.Time
+	ExpiresAt        time.Time
+	RecoverySeconds  float64
+	SanityChecks     []SandboxCheck
+	Error            string
+	workDir          string
+	pidFile          string
+	clientFile       string
+	adminClientFile  string
+	replayClientFile string // where binary logs may be replayed onto the sandbox
+	leaseId          string
+	cmd              *exec.Cmd
+	stopRequested    chan bool
+	processCompleted chan bool
+}
+
+var sandboxes = make(map[string]*Sandbox)
+var sandboxesMutex = &sync.Mutex{}
+
+var readOnlyQueryPattern = regexp.MustCompile(`(?i)^\s*(select|show|desc|describe|explain)\s`)
+
+// fileAccessQueryPattern matches queries reading or writing server side files
+var fileAccessQueryPattern = regexp.MustCompile(`(?i)\binto\s+(outfile|dumpfile)\b|\bload_file\s*\(`)
+
+// sandboxMySQLUser is the user queries are run as on sandboxes. It is created, with a random password, as the
+// sandbox starts, and is only granted reading: in particular, not FILE.
+const sandboxMySQLUser = "orchestrator_sandbox"
+
+// sandboxAdminMySQLUser is the user which drops the sandbox's users, itself included, as the sandbox is torn down:
+// users are created in the snapshot's own data, which is not to keep them once the sandbox is gone. It may manage
+// users despite read_only, and is never used for ad-hoc queries.
+const sandboxAdminMySQLUser = "orchestrator_sandbox_admin"
+
+// sandboxReplayMySQLUser is the user binary logs are replayed as, on sandboxes of point-in-time recoveries. It
+// has all privileges, hence writes despite read_only, and is never used for ad-hoc queries.
+const sandboxReplayMySQLUser = "orchestrator_replay"
+
+// snapshot returns a copy of the sandbox, safe for reading by the caller. Expects sandboxesMutex to be held.
+func (this *Sandbox) snapshot() Sandbox {
+	result := *this
+	result.SanityChecks = append([]SandboxCheck{}, this.SanityChecks...)
+	return result
+}
+
+// IsActive returns true while the sandbox's mysqld is expected to be up
+func (this *Sandbox) IsActive() bool {
+	return this.Status == SandboxStarting || this.Status == SandboxRunning
+}
+
+// clientCommand returns a mysql client command connecting to the sandbox via its socket, as sandboxMySQLUser
+func (this *Sandbox) clientCommand(client string) string {
+	return fmt.Sprintf("%s --defaults-file=%s", client, this.clientFile)
+}
+
+// adminClientCommand returns a mysql client command connecting to the sandbox as sandboxAdminMySQLUser
+func (this *Sandbox) adminClientCommand(client string) string {
+	return fmt.Sprintf("%s --defaults-file=%s", client, this.adminClientFile)
+}
+
+// replayClientCommand returns a mysql client command connecting to the sandbox as sandboxReplayMySQLUser
+func (this *Sandbox) replayClientCommand(client string) string {
+	return fmt.Sprintf("%s --defaults-file=%s", client, this.replayClientFile)
+}
+
+// writeClientOptionFile writes the option file of clients connecting to a sandbox via its socket
+func writeClientOptionFile(sandbox *Sandbox, fileName string, user string, password string) error {
+	clientOptions := []string{
+		"[client]",
+		fmt.Sprintf("user=%s", user),
+		fmt.Sprintf("password=%s", password),
+		fmt.Sprintf("socket=%s", sandbox.SocketFile),
+	}
+	return ioutil.WriteFile(fileName, []byte(strings.Join(clientOptions, "\n")+"\n"), 0600)
+}
+
+// writeSandboxOptionFiles writes the option files of a sandbox's mysqld and clients, and the init file creating the
+// sandbox's users. Users left over by a sandbox which was not torn down are replaced. mysqld reads no option file but its own: it is not to inherit the server's paths (logs, InnoDB
+// directories) or sizes (buffer pool), and only binds locally, on its own port. It cannot write outside its data
+// path and work directory, as secure_file_priv points at an empty directory.
+func writeSandboxOptionFiles(sandbox *Sandbox) (mysqldFile string, err error) {
+	password := newLeaseId() + newLeaseId()
+	filesDir := path.Join(sandbox.workDir, "files")
+	if err := os.Mkdir(filesDir, 0700); err != nil {
+		return "", err
+	}
+	initFile := path.Join(sandbox.workDir, "init.sql")
+	adminPassword := newLeaseId() + newLeaseId()
+	initStatements := []string{
+		fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost'", sandboxMySQLUser),
+		fmt.Sprintf("CREATE USER '%s'@'localhost' IDENTIFIED BY '%s'", sandboxMySQLUser, password),
+		fmt.Sprintf("GRANT SELECT, SHOW DATABASES, SHOW VIEW, PROCESS ON *.* TO '%s'@'localhost'", sandboxMySQLUser),
+		fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost'", sandboxAdminMySQLUser),
+		fmt.Sprintf("CREATE USER '%s'@'localhost' IDENTIFIED BY '%s'", sandboxAdminMySQLUser, adminPassword),
+		fmt.Sprintf("GRANT CREATE USER, SUPER ON *.* TO '%s'@'localhost'", sandboxAdminMySQLUser),
+	}
+	replayPassword := newLeaseId() + newLeaseId()
+	if sandbox.replayClientFile != "" {
+		initStatements = append(initStatements,
+			fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost'", sandboxReplayMySQLUser),
+			fmt.Sprintf("CREATE USER '%s'@'localhost' IDENTIFIED BY '%s'", sandboxReplayMySQLUser, replayPassword),
+			fmt.Sprintf("GRANT ALL PRIVILEGES ON *.* TO '%s'@'localhost'", sandboxReplayMySQLUser),
+		)
+	}
+	if err := ioutil.WriteFile(initFile, []byte(strings.Join(initStatements, ";\n")+";\n"), 0600); err != nil {
+		return "", err
+	}
+
+	mysqldOptions := []string{
+		"[mysqld]",
+		fmt.Sprintf("datadir=%s", sandbox.DataPath),
+		fmt.Sprintf("port=%d", sandbox.Port),
+		"bind-address=127.0.0.1",
+		fmt.Sprintf("socket=%s", sandbox.SocketFile),
+		fmt.Sprintf("pid-file=%s", sandbox.pidFile),
+		fmt.Sprintf("log-error=%s", sandbox.ErrorLogFile),
+		fmt.Sprintf("secure-file-priv=%s", filesDir),
+		fmt.Sprintf("init-file=%s", initFile),
+		"innodb_buffer_pool_size=128M",
+		"skip-slave-start",
+		"read-only",
+		"skip-name-resolve",
+		// Options unknown to some versions are prefixed "loose", hence ignored where unknown
+		"loose-disable-log-bin",
+		"loose-mysqlx=0",
+		"loose-performance_schema=0",
+	}
+	mysqldOptions = append(mysqldOptions, config.Config.SandboxMySQLDOptions...)
+	mysqldFile = path.Join(sandbox.workDir, "mysqld.cnf")
+	if err := ioutil.WriteFile(mysqldFile, []byte(strings.Join(mysqldOptions, "\n")+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	if err := writeClientOptionFile(sandbox, sandbox.clientFile, sandboxMySQLUser, password); err != nil {
+		return "", err
+	}
+	if err := writeClientOptionFile(sandbox, sandbox.adminClientFile, sandboxAdminMySQLUser, adminPassword); err != nil {
+		return "", err
+	}
+	if sandbox.replayClientFile != "" {
+		if err := writeClientOptionFile(sandbox, sandbox.replayClientFile, sandboxReplayMySQLUser, replayPassword); err != nil {
+			return "", err
+		}
+	}
+	// mysqld runs as a different user, which needs to read its files, and write its socket, pid and log here.
+	// Other users are kept out, as the work directory holds the sandbox user's password.
+	if _, err := commandOutput(sudoCmd(fmt.Sprintf("chown -R %s %s", config.Config.SandboxMySQLUser, sandbox.workDir))); err != nil {
+		return "", err
+	}
+	return mysqldFile, nil
+}
+
+// isReadOnlyFileSystem tells whether given path may not be written, whoever the writer, for being on a read only
+// file system or subvolume, which mount options do not always tell
+func isReadOnlyFileSystem(fileName string) bool {
+	const writeAccess = 0x2 // W_OK
+	return syscall.Access(fileName, writeAccess) == syscall.EROFS
+}
+
+// allocateSandboxPort returns the first port, starting SandboxPort, not used by an active sandbox. Expects sandboxesMutex to be held.
+func allocateSandboxPort() int {
+	usedPorts := make(map[int]bool)
+	for _, sandbox := range sandboxes {
+		if sandbox.IsActive() {
+			usedPorts[sandbox.Port] = true
+		}
+	}
+	port := int(config.Config.SandboxPort)
+	for usedPorts[port] {
+		port++
+	}
+	return port
+}
+
+// StartSandbox starts a temporary mysqld against the MySQL data path of the snapshot mounted on given target.
+// With zero ttl the sandbox is torn down as soon as it is verified; otherwise it stays up for ad-hoc
+// queries until ttl passes or it is explicitly stopped. Startup proceeds asynchronously.
+func StartSandbox(target string, ttl time.Duration) (Sandbox, error) {
+	return startSandbox(target, ttl, false)
+}
+
+// startSandbox starts a sandbox, optionally with a user binary logs may be replayed as
+func startSandbox(target string, ttl time.Duration, replayable bool) (Sandbox, error) {
+	mount, err := GetSnapshotMount(target)
+	if err != nil {
+		return Sandbox{}, err
+	}
+	if !mount.IsMounted {
+		return Sandbox{}, fmt.Errorf("%s is not mounted", mount.Path)
+	}
+	if mount.MySQLDataPath == "" {
+		return Sandbox{}, fmt.Errorf("Cannot find MySQL data path on %s", mount.Path)
+	}
+	// mysqld writes its data as it recovers: rather than have it fail on startup, read only snapshots (as with
+	// read only btrfs subvolumes, or ZFS snapshots mounted other than by clone) are rejected up front
+	if mount.IsReadOnly || isReadOnlyFileSystem(mount.MySQLDataPath) {
+		return Sandbox{}, fmt.Errorf("%s is read only; sandboxes need a writable snapshot (with ZFS, see ZFSMountByClone)", mount.MySQLDataPath)
+	}
+	workDir, err := ioutil.TempDir("", "orchestrator-agent-sandbox-")
+	if err != nil {
+		return Sandbox{}, log.Errore(err)
+	}
+
+	sandboxesMutex.Lock()
+	defer sandboxesMutex.Unlock()
+
+	sandbox := &Sandbox{
+		Id:               newLeaseId(),
+		MountPoint:       mount.Path,
+		DataPath:         mount.MySQLDataPath,
+		Port:             allocateSandboxPort(),
+		SocketFile:       path.Join(workDir, "mysql.sock"),
+		ErrorLogFile:     path.Join(workDir, "error.log"),
+		Status:           SandboxStarting,
+		Started:          time.Now(),
+		workDir:          workDir,
+		pidFile:          path.Join(workDir, "mysqld.pid"),
+		clientFile:       path.Join(workDir, "client.cnf"),
+		adminClientFile:  path.Join(workDir, "admin-client.cnf"),
+		stopRequested:    make(chan bool, 1),
+		processCompleted: make(chan bool),
+	}
+	if replayable {
+		sandbox.replayClientFile = path.Join(workDir, "replay-client.cnf")
+	}
+	mysqldFile, err := writeSandboxOptionFiles(sandbox)
+	if err != nil {
+		os.RemoveAll(workDir)
+		return Sandbox{}, log.Errore(err)
+	}
+	lease, err := AcquireLease(sandbox.MountPoint, fmt.Sprintf("sandbox:%s", sandbox.Id), 0)
+	if err != nil {
+		os.RemoveAll(workDir)
+		return Sandbox{}, err
+	}
+	sandbox.leaseId = lease.Id
+
+	// --defaults-file is to come first; it makes mysqld read no other option file
+	commandText := fmt.Sprintf("%s --defaults-file=%s --user=%s", config.Config.SandboxMySQLDCommand, mysqldFile, config.Config.SandboxMySQLUser)
+	// exec, such that the started process is mysqld (or sudo) itself rather than a wrapping shell
+	cmd, tmpFileName, err := execCmd("exec " + sudoCmd(commandText))
+	if err != nil {
+		ReleaseLease(sandbox.leaseId)
+		return Sandbox{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		os.Remove(tmpFileName)
+		ReleaseLease(sandbox.leaseId)
+		return Sandbox{}, log.Errore(err)
+	}
+	sandbox.cmd = cmd
+	sandboxes[sandbox.Id] = sandbox
+	log.Infof("Started sandbox %s on port %d against %s", sandbox.Id, sandbox.Port, sandbox.DataPath)
+
+	go func() {
+		cmd.Wait()
+		os.Remove(tmpFileName)
+		close(sandbox.processCompleted)
+	}()
+	go runSandbox(sandbox, ttl)
+
+	return sandbox.snapshot(), nil
+}
+
+// updateSandbox applies given function on a sandbox under lock
+func updateSandbox(sandbox *Sandbox, f func(sandbox *Sandbox)) {
+	sandboxesMutex.Lock()
+	defer sandboxesMutex.Unlock()
+	f(sandbox)
+}
+
+// runSandbox drives the sandbox lifecycle: wait for recovery, verify, serve until expiry, tear down
+func runSandbox(sandbox *Sandbox, ttl time.Duration) {
+	defer teardownSandbox(sandbox)
+	leaseDone := make(chan bool)
+	defer close(leaseDone)
+	go keepLeaseAlive(sandbox.leaseId, leaseDone)
+
+	if err := waitForSandbox(sandbox); err != nil {
+		updateSandbox(sandbox, func(sandbox *Sandbox) {
+			sandbox.Status = SandboxFailed
+			sandbox.Error = err.Error()
+		})
+		return
+	}
+	checks, err := sandboxSanityChecks(sandbox)
+	updateSandbox(sandbox, func(sandbox *Sandbox) {
+		sandbox.SanityChecks = checks
+		if err != nil {
+			sandbox.Status = SandboxFailed
+			sandbox.Error = err.Error()
+		} else if ttl > 0 {
+			sandbox.Status = SandboxRunning
+			sandbox.ExpiresAt = time.Now().Add(ttl)
+		} else {
+			sandbox.Status = SandboxVerified
+		}
+	})
+	if err != nil || ttl <= 0 {
+		return
+	}
+
+	expire := time.NewTimer(ttl)
+	defer expire.Stop()
+	select {
+	case <-expire.C:
+		log.Infof("Sandbox %s expired", sandbox.Id)
+	case <-sandbox.stopRequested:
+	case <-sandbox.processCompleted:
+		updateSandbox(sandbox, func(sandbox *Sandbox) {
+			sandbox.Status = SandboxFailed
+			sandbox.Error = "mysqld terminated unexpectedly"
+		})
+	}
+}
+
+// waitForSandbox waits for mysqld to complete crash recovery and accept connections
+func waitForSandbox(sandbox *Sandbox) error {
+	timeout := time.After(time.Duration(config.Config.SandboxStartupTimeoutSeconds) * time.Second)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := commandOutput(sudoCmd(fmt.Sprintf("%s ping", sandbox.clientCommand("mysqladmin")))); err == nil {
+				updateSandbox(sandbox, func(sandbox *Sandbox) {
+					sandbox.Ready = time.Now()
+					sandbox.RecoverySeconds = sandbox.Ready.Sub(sandbox.Started).Seconds()
+				})
+				return nil
+			}
+		case <-sandbox.processCompleted:
+			return fmt.Errorf("mysqld terminated during startup; see %s", sandbox.ErrorLogFile)
+		case <-sandbox.stopRequested:
+			return errors.New("Sandbox stopped during startup")
+		case <-timeout:
+			return fmt.Errorf("Timeout waiting for mysqld to start; see %s", sandbox.ErrorLogFile)
+		}
+	}
+}
+
+// runSandboxSQL runs SQL on a sandbox, by given client command, returning the client's batch output
+func runSandboxSQL(clientCommand string, sql string) (string, error) {
+	sqlFile, err := ioutil.TempFile("", "orchestrator-agent-sandbox-query-")
+	if err != nil {
+		return "", log.Errore(err)
+	}
+	defer os.Remove(sqlFile.Name())
+	_, err = sqlFile.WriteString(sql)
+	sqlFile.Close()
+	if err != nil {
+		return "", log.Errore(err)
+	}
+
+	output, err := commandOutput(sudoCmd(fmt.Sprintf("%s --batch < %s", clientCommand, sqlFile.Name())))
+	return string(output), err
+}
+
+// sandboxQuery runs a query on the sandbox, within a read only transaction
+func sandboxQuery(sandbox *Sandbox, query string) (string, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	return runSandboxSQL(sandbox.clientCommand("mysql"), fmt.Sprintf("START TRANSACTION READ ONLY;\n%s;\nROLLBACK;\n", query))
+}
+
+// dropUsers drops given users off the sandbox, as its admin user
+func (this *Sandbox) dropUsers(users ...string) error {
+	statements := []string{}
+	for _, user := range users {
+		statements = append(statements, fmt.Sprintf("DROP USER IF EXISTS '%s'@'localhost';\n", user))
+	}
+	_, err := runSandboxSQL(this.adminClientCommand("mysql"), strings.Join(statements, ""))
+	return err
+}
+
+// sandboxSanityChecks runs the configured sanity queries
+func sandboxSanityChecks(sandbox *Sandbox) (checks []SandboxCheck, err error) {
+	for _, query := range config.Config.SandboxSanityQueries {
+		check := SandboxCheck{Query: query}
+		output, queryErr := sandboxQuery(sandbox, query)
+		check.Output = output
+		if queryErr != nil {
+			check.Error = queryErr.Error()
+			err = fmt.Errorf("Sanity query failed: %s", query)
+		}
+		checks = append(checks, check)
+	}
+	return checks, err
+}
+
+// teardownSandbox drops the sandbox's users and shuts down its mysqld, killing it if it does not comply, and
+// releases its lease. As the admin user drops itself, mysqld is shut down by signal rather than by a client.
+func teardownSandbox(sandbox *Sandbox) {
+	select {
+	case <-sandbox.processCompleted:
+	default:
+		users := []string{sandboxMySQLUser}
+		if sandbox.replayClientFile != "" {
+			users = append(users, sandboxReplayMySQLUser)
+		}
+		users = append(users, sandboxAdminMySQLUser)
+		if err := sandbox.dropUsers(users...); err != nil {
+			log.Errorf("Cannot drop users of sandbox %s; the data on %s may keep %s: %+v", sandbox.Id, sandbox.MountPoint, strings.Join(users, ", "), err)
+		}
+		commandOutput(sudoCmd(fmt.Sprintf("kill $(cat %s)", sandbox.pidFile)))
+		select {
+		case <-sandbox.processCompleted:
+		case <-time.After(time.Duration(config.Config.SandboxStartupTimeoutSeconds) * time.Second):
+			log.Warningf("Sandbox %s did not shut down; killing", sandbox.Id)
+			commandOutput(sudoCmd(fmt.Sprintf("kill -9 $(cat %s)", sandbox.pidFile)))
+			if sandbox.cmd.Process != nil {
+				sandbox.cmd.Process.Kill()
+			}
+		}
+	}
+	ReleaseLease(sandbox.leaseId)
+	var status SandboxStatus
+	updateSandbox(sandbox, func(sandbox *Sandbox) {
+		if sandbox.IsActive() {
+			sandbox.Status = SandboxStopped
+		}
+		status = sandbox.Status
+	})
+	// The error log is kept for failed sandboxes, for investigation
+	if status != SandboxFailed {
+		commandOutput(sudoCmd(fmt.Sprintf("rm -rf %s", sandbox.workDir)))
+	}
+	log.Infof("Sandbox %s torn down: %s", sandbox.Id, status)
+}
+
+// GetSandbox returns a sandbox by id
+func GetSandbox(sandboxId string) (Sandbox, error) {
+	sandboxesMutex.Lock()
+	defer sandboxesMutex.Unlock()
+
+	sandbox, ok := sandboxes[sandboxId]
+	if !ok {
+		return Sandbox{}, fmt.Errorf("Sandbox not found: %s", sandboxId)
+	}
+	return sandbox.snapshot(), nil
+}
+
+// Sandboxes lists all known sandboxes, most recent first
+func Sandboxes() []Sandbox {
+	sandboxesMutex.Lock()
+	defer sandboxesMutex.Unlock()
+
+	result := []Sandbox{}
+	for _, sandbox := range sandboxes {
+		result = append(result, sandbox.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.After(result[j].Started) })
+	return result
+}
+
+// StopSandbox requests an active sandbox to tear down
+func StopSandbox(sandboxId string) error {
+	sandboxesMutex.Lock()
+	defer sandboxesMutex.Unlock()
+
+	sandbox, ok := sandboxes[sandboxId]
+	if !ok {
+		return fmt.Errorf("Sandbox not found: %s", sandboxId)
+	}
+	select {
+	case sandbox.stopRequested <- true:
+	default:
+	}
+	return nil
+}
+
+// SandboxQuery runs an ad-hoc read-only query on a running sandbox
+func SandboxQuery(sandboxId string, query string) (string, error) {
+	sandboxesMutex.Lock()
+	sandbox, ok := sandboxes[sandboxId]
+	if ok && sandbox.Status != SandboxRunning {
+		ok = false
+	}
+	sandboxesMutex.Unlock()
+	if !ok {
+		return "", fmt.Errorf("No running sandbox: %s", sandboxId)
+	}
+	if !readOnlyQueryPattern.MatchString(query+" ") || strings.Contains(strings.TrimRight(strings.TrimSpace(query), ";"), ";") {
+		return "", errors.New("Only single SELECT, SHOW, DESCRIBE and EXPLAIN queries are allowed on sandboxes")
+	}
+	if fileAccessQueryPattern.MatchString(query) {
+		return "", errors.New("Queries reading or writing files are not allowed on sandboxes")
+	}
+	return sandboxQuery(sandbox, query)
+}
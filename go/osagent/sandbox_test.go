@@ -0,0 +1,141 @@
+package osagent_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+// writeFakeMySQLBinaries writes mysqld, mysql and mysqladmin stand-ins into a directory added to PATH. The fake
+// mysqld keeps a copy of its option file in the directory, and the fake mysql appends the SQL it runs to mysql.log.
+func writeFakeMySQLBinaries(t *testing.T, directory string) {
+	binaries := map[string]string{
+		"mysqld": fmt.Sprintf(`options="${1#--defaults-file=}"
+cp "$options" %s/mysqld.cnf
+echo $$ > "$(grep ^pid-file= "$options" | cut -d= -f2)"
+exec sleep 60
+`, directory),
+		"mysqladmin": `exit 0
+`,
+		"mysql": fmt.Sprintf(`echo "$1"
+tee -a %s/mysql.log
+`, directory),
+	}
+	for name, script := range binaries {
+		if err := ioutil.WriteFile(path.Join(directory, name), []byte("#!/bin/bash\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func waitForSandboxStatus(t *testing.T, sandboxId string, status osagent.SandboxStatus) osagent.Sandbox {
+	for i := 0; i < 100; i++ {
+		sandbox, err := osagent.GetSandbox(sandboxId)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if sandbox.Status == status {
+			return sandbox
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for sandbox %s to be %s", sandboxId, status)
+	return osagent.Sandbox{}
+}
+
+func TestSandbox(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	mountPoint := path.Join(directory, "snapshot")
+	os.MkdirAll(path.Join(mountPoint, "data/mysql"), 0755)
+	ioutil.WriteFile(path.Join(mountPoint, "data/mysql/ibdata1"), []byte{}, 0644)
+	writeFakeMySQLBinaries(t, directory)
+
+	defer useMountInfo(t, fmt.Sprintf("22 1 253:0 / / rw - xfs /dev/mapper/vg0-root rw\n65 22 253:8 / %s rw - xfs /dev/vg0/snap rw\n", mountPoint))()
+	config.Config.SnapshotMountPoint = mountPoint
+	originalPath := os.Getenv("PATH")
+	os.Setenv("PATH", directory+":"+originalPath)
+	defer os.Setenv("PATH", originalPath)
+	currentUser, _ := user.Current()
+	config.Config.MySQLDatadirCommand = "echo /data/mysql"
+	config.Config.SandboxMySQLDCommand = path.Join(directory, "mysqld")
+	config.Config.SandboxMySQLUser = currentUser.Username
+	config.Config.SandboxMySQLDOptions = []string{"lower_case_table_names=1"}
+	config.Config.SandboxSanityQueries = []string{"SELECT 1"}
+	config.Config.SandboxStartupTimeoutSeconds = 10
+
+	sandbox, err := osagent.StartSandbox("", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sandbox = waitForSandboxStatus(t, sandbox.Id, osagent.SandboxRunning)
+	if len(sandbox.SanityChecks) != 1 || sandbox.SanityChecks[0].Error != "" {
+		t.Errorf("Unexpected sanity checks: %+v", sandbox.SanityChecks)
+	}
+
+	options, err := ioutil.ReadFile(path.Join(directory, "mysqld.cnf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []string{"datadir=" + path.Join(mountPoint, "data/mysql"), "bind-address=127.0.0.1", "secure-file-priv=", "init-file=", "read-only", "lower_case_table_names=1"} {
+		if !strings.Contains(string(options), option) {
+			t.Errorf("Expected %s in sandbox options: %s", option, options)
+		}
+	}
+	if strings.Contains(string(options), "skip-grant-tables") {
+		t.Errorf("Unexpected skip-grant-tables in sandbox options: %s", options)
+	}
+
+	output, err := osagent.SandboxQuery(sandbox.Id, "select * from t")
+	if err != nil || !strings.Contains(output, "--defaults-file=") || !strings.Contains(output, "START TRANSACTION READ ONLY;\nselect * from t;\n") {
+		t.Errorf("Unexpected query output: %s, %+v", output, err)
+	}
+	for _, query := range []string{
+		"select * from t into outfile '/etc/cron.d/x'",
+		"SELECT 1 INTO   DUMPFILE '/tmp/x'",
+		"select load_file('/etc/shadow')",
+		"delete from t",
+		"select 1; drop table t",
+	} {
+		if _, err := osagent.SandboxQuery(sandbox.Id, query); err == nil {
+			t.Errorf("Expected error on query: %s", query)
+		}
+	}
+
+	if err := osagent.StopSandbox(sandbox.Id); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitForSandboxStatus(t, sandbox.Id, osagent.SandboxStopped)
+
+	// Users created in the snapshot's data are dropped on teardown, the admin user last
+	sql, _ := ioutil.ReadFile(path.Join(directory, "mysql.log"))
+	if !strings.HasSuffix(string(sql), "DROP USER IF EXISTS 'orchestrator_sandbox'@'localhost';\nDROP USER IF EXISTS 'orchestrator_sandbox_admin'@'localhost';\n") {
+		t.Errorf("Expected sandbox users dropped on teardown, got:\n%s", sql)
+	}
+}
+
+func TestSandboxReadOnlyMount(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "orchestrator-agent-test-")
+	defer os.RemoveAll(directory)
+	mountPoint := path.Join(directory, "snapshot")
+	os.MkdirAll(path.Join(mountPoint, "data/mysql"), 0755)
+	ioutil.WriteFile(path.Join(mountPoint, "data/mysql/ibdata1"), []byte{}, 0644)
+	writeFakeMySQLBinaries(t, directory)
+
+	defer useMountInfo(t, fmt.Sprintf("22 1 253:0 / / rw - xfs /dev/mapper/vg0-root rw\n65 22 0:52 /snap %s ro,relatime - zfs tank/mysql@snap ro\n", mountPoint))()
+	config.Config.SnapshotMountPoint = mountPoint
+	config.Config.MySQLDatadirCommand = "echo /data/mysql"
+	config.Config.SandboxMySQLDCommand = path.Join(directory, "mysqld")
+
+	if _, err := osagent.StartSandbox("", time.Minute); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Errorf("Expected error starting sandbox on read only snapshot, got %+v", err)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/github/orchestrator-agent/go/config"
+)
+
+// readStateFile reads state kept as JSON in a file of StateDirectory into given value. A missing file, or an
+// unconfigured StateDirectory, leaves the value as is.
+func readStateFile(name string, value interface{}) error {
+	if config.Config.StateDirectory == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path.Join(config.Config.StateDirectory, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, value)
+}
+
+// writeStateFile writes state as JSON into a file of StateDirectory, replacing it as a whole such that it is
+// never partially written. With StateDirectory unconfigured, state is not kept.
+func writeStateFile(name string, value interface{}) error {
+	if config.Config.StateDirectory == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.Config.StateDirectory, 0700); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(config.Config.StateDirectory, name+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(contents)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path.Join(config.Config.StateDirectory, name))
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/github/orchestrator-agent/go/config"
+)
+
+// CommandRunner executes a command text and returns its output. Storage backends execute
+// all of their commands via a CommandRunner, such that tests can fake them.
+type CommandRunner func(commandText string) ([]byte, error)
+
+// StorageBackend abstracts the storage layer on which snapshots are listed, created, mounted and removed.
+type StorageBackend interface {
+	// Name is the backend's identifier, as used in the StorageBackend config
+	Name() string
+	// Volumes lists volumes (or a specific volume when volumeName is given) whose name contains filterPattern
+	Volumes(volumeName string, filterPattern string) ([]LogicalVolume, error)
+	// CreateSnapshot creates a new snapshot
+	CreateSnapshot() error
+	// Mount mounts given volume/snapshot onto mountPoint
+	Mount(mountPoint string, volumeName string) (Mount, error)
+	// Unmount releases whatever is mounted on mountPoint
+	Unmount(mountPoint string) (Mount, error)
+	// Remove destroys given volume/snapshot
+	Remove(volumeName string) error
+}
+
+const (
+	LVMStorageBackend   = "lvm"
+	ZFSStorageBackend   = "zfs"
+	BtrfsStorageBackend = "btrfs"
+)
+
+var storageBackendOverride StorageBackend
+
+// GetStorageBackend returns the storage backend as configured by StorageBackend
+func GetStorageBackend() (StorageBackend, error) {
+	if storageBackendOverride != nil {
+		return storageBackendOverride, nil
+	}
+	switch strings.ToLower(config.Config.StorageBackend) {
+	case "", LVMStorageBackend:
+		return lvmBackend, nil
+	case ZFSStorageBackend:
+		return NewZFSBackend(config.Config.ZFSDataset, config.Config.ZFSMountByClone, commandOutput), nil
+	case BtrfsStorageBackend:
+		return NewBtrfsBackend(config.Config.BtrfsSubvolume, config.Config.BtrfsSnapshotsDirectory, commandOutput), nil
+	}
+	return nil, fmt.Errorf("Unknown StorageBackend: %s", config.Config.StorageBackend)
+}
+
+// SetStorageBackend overrides the configured storage backend. Passing nil reverts to configuration.
+func SetStorageBackend(backend StorageBackend) {
+	storageBackendOverride = backend
+}
@@ -0,0 +1,174 @@
+package osagent_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+// fakeRunner records executed commands and answers with canned output, keyed by command prefix
+type fakeRunner struct {
+	commands []string
+	outputs  map[string]string
+}
+
+func (this *fakeRunner) run(commandText string) ([]byte, error) {
+	this.commands = append(this.commands, commandText)
+	for prefix, output := range this.outputs {
+		if strings.HasPrefix(commandText, prefix) {
+			return []byte(output), nil
+		}
+	}
+	return nil, errors.New("unexpected command: " + commandText)
+}
+
+func TestLVMVolumes(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string]string{
+		"lvs": `{
+      "report": [
+          {
+              "lv": [
+                  {"lv_name":"mysql_data", "vg_name":"vg0", "lv_path":"/dev/vg0/mysql_data", "lv_size":"107374182400", "origin":"", "lv_time":"2019-05-01 08:00:00 +0000", "lv_attr":"owi-aos---", "snap_percent":"", "data_percent":"", "vg_free":"53687091200"},
+                  {"lv_name":"mysql snap 1", "vg_name":"vg0", "lv_path":"/dev/vg0/mysql snap 1", "lv_size":"10737418240", "origin":"mysql_data", "lv_time":"2019-05-02 03:00:00 +0000", "lv_attr":"swi-a-s---", "snap_percent":"12.50", "data_percent":"12.50", "vg_free":"53687091200"},
+                  {"lv_name":"thin_snap_1", "vg_name":"vg0", "lv_path":"/dev/vg0/thin_snap_1", "lv_size":"10737418240", "origin":"thin_data", "lv_time":"2019-05-03 03:00:00 +0000", "lv_attr":"Vwi---tz-k", "snap_percent":"", "data_percent":"3.00", "vg_free":"53687091200"}
+              ]
+          }
+      ]
+  }`,
+	}}
+	backend := osagent.NewLVMBackend(runner.run)
+
+	volumes, err := backend.Volumes("", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(volumes) != 3 {
+		t.Fatalf("Expected 3 volumes, got %+v", volumes)
+	}
+	if volumes[0].IsSnapshot {
+		t.Errorf("Expected %s not to be a snapshot", volumes[0].Name)
+	}
+	if !volumes[0].IsActive || !volumes[0].IsOpen || volumes[0].Size != 107374182400 || volumes[0].GroupFree != 53687091200 {
+		t.Errorf("Unexpected volume: %+v", volumes[0])
+	}
+	if !volumes[1].IsSnapshot || volumes[1].SnapshotPercent != 12.5 || volumes[1].Path != "/dev/vg0/mysql snap 1" {
+		t.Errorf("Unexpected snapshot volume: %+v", volumes[1])
+	}
+	if volumes[1].Origin != "mysql_data" || volumes[1].IsOpen || volumes[1].CreationTime.Day() != 2 {
+		t.Errorf("Unexpected snapshot volume: %+v", volumes[1])
+	}
+
+	if !volumes[2].IsSnapshot || volumes[2].DataPercent != 3.0 {
+		t.Errorf("Expected thin snapshot volume: %+v", volumes[2])
+	}
+
+	volumes, err = backend.Volumes("", " snap ")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(volumes) != 1 || volumes[0].Name != "mysql snap 1" {
+		t.Errorf("Filter failed: %+v", volumes)
+	}
+}
+
+func TestLVMVolumeGroups(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string]string{
+		"vgs": `{"report": [{"vg": [{"vg_name":"vg0", "vg_size":"214748364800", "vg_free":"53687091200", "lv_count":"2", "snap_count":"1"}]}]}`,
+	}}
+	backend := osagent.NewLVMBackend(runner.run)
+
+	volumeGroups, err := backend.VolumeGroups()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(volumeGroups) != 1 {
+		t.Fatalf("Expected 1 volume group, got %+v", volumeGroups)
+	}
+	if volumeGroups[0].Name != "vg0" || volumeGroups[0].Free != 53687091200 || volumeGroups[0].LVCount != 2 || volumeGroups[0].SnapshotCount != 1 {
+		t.Errorf("Unexpected volume group: %+v", volumeGroups[0])
+	}
+}
+
+func TestZFSVolumes(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string]string{
+		"zfs list": "tank/mysql@daily-1\ntank/mysql@daily-2\ntank/mysql@manual\n",
+	}}
+	backend := osagent.NewZFSBackend("tank/mysql", false, runner.run)
+
+	volumes, err := backend.Volumes("", "daily")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(volumes) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %+v", volumes)
+	}
+	if volumes[1].Name != "daily-2" || volumes[1].GroupName != "tank/mysql" || volumes[1].Path != "tank/mysql@daily-2" || !volumes[1].IsSnapshot {
+		t.Errorf("Unexpected snapshot: %+v", volumes[1])
+	}
+	if runner.commands[0] != "zfs list -H -t snapshot -o name -d 1 tank/mysql" {
+		t.Errorf("Unexpected command: %s", runner.commands[0])
+	}
+}
+
+func TestZFSCreateAndRemove(t *testing.T) {
+	config.Config.CreateSnapshotCommand = ""
+	runner := &fakeRunner{outputs: map[string]string{
+		"zfs snapshot": "",
+		"zfs destroy":  "",
+	}}
+	backend := osagent.NewZFSBackend("tank/mysql", false, runner.run)
+
+	if err := backend.CreateSnapshot(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(runner.commands[0], "zfs snapshot tank/mysql@orchestrator-agent-") {
+		t.Errorf("Unexpected command: %s", runner.commands[0])
+	}
+
+	if err := backend.Remove("daily-1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if runner.commands[1] != "zfs destroy tank/mysql@daily-1" {
+		t.Errorf("Unexpected command: %s", runner.commands[1])
+	}
+	if err := backend.Remove(""); err == nil {
+		t.Errorf("Expected error removing empty snapshot name")
+	}
+}
+
+func TestBtrfsVolumes(t *testing.T) {
+	// The filesystem is mounted by its @data subvolume; listed paths are relative to the filesystem root
+	defer useMountInfo(t, "22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n40 22 0:45 /@data /data rw,relatime - btrfs /dev/sdb rw,subvol=/@data\n")()
+	runner := &fakeRunner{outputs: map[string]string{
+		"btrfs subvolume list": "ID 261 gen 40 cgen 38 top level 5 otime 2020-01-01 10:00:00 path @data/.snapshots/mysql-snap-1\n" +
+			"ID 262 gen 41 cgen 41 top level 5 otime 2020-01-02 10:00:00 path @data/.snapshots/other\n" +
+			"ID 263 gen 42 cgen 42 top level 5 otime 2020-01-03 10:00:00 path @data/mysql/.snapshots/mysql-snap-2\n" +
+			"ID 264 gen 43 cgen 43 top level 5 otime 2020-01-04 10:00:00 path @data/.snapshots/archive/mysql-snap-3\n",
+		"btrfs subvolume delete": "",
+	}}
+	backend := osagent.NewBtrfsBackend("/data/mysql", "/data/.snapshots", runner.run)
+
+	volumes, err := backend.Volumes("", "mysql-snap")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("Expected 1 snapshot, got %+v", volumes)
+	}
+	if volumes[0].Name != "mysql-snap-1" || volumes[0].Path != "/data/.snapshots/mysql-snap-1" || volumes[0].Backend != osagent.BtrfsStorageBackend {
+		t.Errorf("Unexpected snapshot: %+v", volumes[0])
+	}
+
+	if err := backend.Remove("mysql-snap-1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if runner.commands[1] != "btrfs subvolume delete /data/.snapshots/mysql-snap-1" {
+		t.Errorf("Unexpected command: %s", runner.commands[1])
+	}
+	if err := backend.Remove("../mysql"); err == nil {
+		t.Errorf("Expected error removing a path outside the snapshots directory")
+	}
+}
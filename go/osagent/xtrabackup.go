@@ -0,0 +1,457 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/outbrain/golib/log"
+)
+
+const (
+	FullPhysicalBackup        = "full"
+	IncrementalPhysicalBackup = "incremental"
+)
+
+const xtrabackupCheckpointsFile = "xtrabackup_checkpoints"
+const physicalBackupMetadataFile = "orchestrator-agent-backup.json"
+
+// backupNamePattern restricts chain names and seed ids, which make up paths and shell command arguments
+var backupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// XtrabackupCheckpoints is the content of xtrabackup_checkpoints, as written by xtrabackup into each backup
+type XtrabackupCheckpoints struct {
+	BackupType string
+	FromLSN    uint64
+	ToLSN      uint64
+	LastLSN    uint64
+}
+
+// ParseXtrabackupCheckpoints parses the "key = value" lines of an xtrabackup_checkpoints file
+func ParseXtrabackupCheckpoints(reader io.Reader) (checkpoints XtrabackupCheckpoints, err error) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		tokens := strings.SplitN(scanner.Text(), "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(tokens[0]), strings.TrimSpace(tokens[1])
+		switch key {
+		case "backup_type":
+			checkpoints.BackupType = value
+		case "from_lsn":
+			checkpoints.FromLSN, err = strconv.ParseUint(value, 10, 64)
+		case "to_lsn":
+			checkpoints.ToLSN, err = strconv.ParseUint(value, 10, 64)
+		case "last_lsn":
+			checkpoints.LastLSN, err = strconv.ParseUint(value, 10, 64)
+		}
+		if err != nil {
+			return checkpoints, fmt.Errorf("Invalid %s in %s: %s", key, xtrabackupCheckpointsFile, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return checkpoints, err
+	}
+	if checkpoints.BackupType == "" {
+		return checkpoints, fmt.Errorf("No backup_type found in %s", xtrabackupCheckpointsFile)
+	}
+	return checkpoints, nil
+}
+
+// PhysicalBackup is an xtrabackup backup, either the full base of a chain or an incremental on top of its predecessor
+type PhysicalBackup struct {
+	Name      string
+	Chain     string
+	Type      string
+	Parent    string
+	Directory string
+	Created   time.Time
+	FromLSN   uint64
+	ToLSN     uint64
+}
+
+// BackupChain is a full backup followed by the incrementals applied on it, in order
+type BackupChain struct {
+	Name    string
+	Backups []PhysicalBackup
+}
+
+// Last returns the most recent backup in the chain
+func (this *BackupChain) Last() *PhysicalBackup {
+	if len(this.Backups) == 0 {
+		return nil
+	}
+	return &this.Backups[len(this.Backups)-1]
+}
+
+// Validate verifies the chain is based on a full backup, and that each incremental picks up at the LSN its parent ends at
+func (this *BackupChain) Validate() error {
+	for i, backup := range this.Backups {
+		if i == 0 {
+			if backup.Type != FullPhysicalBackup {
+				return fmt.Errorf("Chain %s begins with %s backup %s", this.Name, backup.Type, backup.Name)
+			}
+			continue
+		}
+		parent := this.Backups[i-1]
+		if backup.Type != IncrementalPhysicalBackup || backup.Parent != parent.Name {
+			return fmt.Errorf("Chain %s: %s is not an incremental on top of %s", this.Name, backup.Name, parent.Name)
+		}
+		if backup.FromLSN != parent.ToLSN {
+			return fmt.Errorf("Chain %s: LSN gap between %s (to %d) and %s (from %d)", this.Name, parent.Name, parent.ToLSN, backup.Name, backup.FromLSN)
+		}
+	}
+	return nil
+}
+
+// UpTo returns the chain truncated after given backup
+func (this *BackupChain) UpTo(backupName string) (*BackupChain, error) {
+	for i, backup := range this.Backups {
+		if backup.Name == backupName {
+			return &BackupChain{Name: this.Name, Backups: this.Backups[:i+1]}, nil
+		}
+	}
+	return nil, fmt.Errorf("Backup %s not found in chain %s", backupName, this.Name)
+}
+
+var backupChainsInProgress = make(map[string]bool)
+var backupChainsInProgressMutex = &sync.Mutex{}
+
+// beginChainOperation makes sure a single backup or restore runs on a chain at any given time
+func beginChainOperation(chainName string) error {
+	backupChainsInProgressMutex.Lock()
+	defer backupChainsInProgressMutex.Unlock()
+	if backupChainsInProgress[chainName] {
+		return fmt.Errorf("An operation is already in progress on chain %s", chainName)
+	}
+	backupChainsInProgress[chainName] = true
+	return nil
+}
+
+func endChainOperation(chainName string) {
+	backupChainsInProgressMutex.Lock()
+	defer backupChainsInProgressMutex.Unlock()
+	delete(backupChainsInProgress, chainName)
+}
+
+// chainDirectory returns the directory of given chain, under which each of its backups has its own directory
+func chainDirectory(chainName string) (string, error) {
+	if config.Config.XtrabackupDirectory == "" {
+		return "", errors.New("XtrabackupDirectory is unconfigured")
+	}
+	if !backupNamePattern.MatchString(chainName) {
+		return "", fmt.Errorf("Invalid chain name: %s", chainName)
+	}
+	return path.Join(config.Config.XtrabackupDirectory, chainName), nil
+}
+
+// readPhysicalBackup reads a backup's metadata. Backups lacking metadata are incomplete, or not ours.
+func readPhysicalBackup(backupDirectory string) (backup PhysicalBackup, err error) {
+	content, err := ioutil.ReadFile(path.Join(backupDirectory, physicalBackupMetadataFile))
+	if err != nil {
+		return backup, err
+	}
+	err = json.Unmarshal(content, &backup)
+	return backup, err
+}
+
+// GetBackupChain reads a chain from the catalog, which is the backup directory structure itself
+func GetBackupChain(chainName string) (*BackupChain, error) {
+	directory, err := chainDirectory(chainName)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	chain := &BackupChain{Name: chainName, Backups: []PhysicalBackup{}}
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() {
+			continue
+		}
+		backup, err := readPhysicalBackup(path.Join(directory, fileInfo.Name()))
+		if err != nil {
+			continue
+		}
+		chain.Backups = append(chain.Backups, backup)
+	}
+	chain.Backups = orderBackupChain(chain.Backups)
+	return chain, nil
+}
+
+// orderBackupChain orders backups by following Parent links from the full backup. LSNs alone do not make for an
+// order: incrementals taken with no writes in between share their LSNs. Backups which the links do not reach
+// follow in order of LSN and creation, for Validate to report.
+func orderBackupChain(backups []PhysicalBackup) []PhysicalBackup {
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].ToLSN != backups[j].ToLSN {
+			return backups[i].ToLSN < backups[j].ToLSN
+		}
+		return backups[i].Created.Before(backups[j].Created)
+	})
+	ordered := []PhysicalBackup{}
+	reached := map[string]bool{}
+	for parent := ""; ; {
+		next := -1
+		for i, backup := range backups {
+			if reached[backup.Name] {
+				continue
+			}
+			if (parent == "" && backup.Type == FullPhysicalBackup) || (parent != "" && backup.Parent == parent) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		ordered = append(ordered, backups[next])
+		reached[backups[next].Name] = true
+		parent = backups[next].Name
+	}
+	for _, backup := range backups {
+		if !reached[backup.Name] {
+			ordered = append(ordered, backup)
+		}
+	}
+	return ordered
+}
+
+// BackupChains lists the catalog of backup chains
+func BackupChains() ([]BackupChain, error) {
+	chains := []BackupChain{}
+	if config.Config.XtrabackupDirectory == "" {
+		return chains, errors.New("XtrabackupDirectory is unconfigured")
+	}
+	fileInfos, err := ioutil.ReadDir(config.Config.XtrabackupDirectory)
+	if err != nil {
+		return chains, log.Errore(err)
+	}
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".") {
+			continue
+		}
+		chain, err := GetBackupChain(fileInfo.Name())
+		if err != nil {
+			log.Errore(err)
+			continue
+		}
+		chains = append(chains, *chain)
+	}
+	return chains, nil
+}
+
+// xtrabackupCmd returns an xtrabackup invocation with given arguments and the configured options
+func xtrabackupCmd(arguments string) string {
+	return sudoCmd(strings.TrimSpace(fmt.Sprintf("%s %s %s", config.Config.XtrabackupCommand, arguments, config.Config.XtrabackupOptions)))
+}
+
+// CreatePhysicalBackup takes an xtrabackup backup of the running MySQL into given chain. A full backup starts
+// a new chain; an incremental copies the pages changed since the LSN the chain's last backup ends at.
+// Having validated the request, it runs in the background as a job identified by jobId.
+func CreatePhysicalBackup(chainName string, backupType string, jobId string) (backup PhysicalBackup, err error) {
+	directory, err := chainDirectory(chainName)
+	if err != nil {
+		return backup, log.Errore(err)
+	}
+	backup = PhysicalBackup{
+		Chain:   chainName,
+		Type:    backupType,
+		Created: time.Now(),
+	}
+	backup.Name = fmt.Sprintf("%s-%s", backupType, backup.Created.Format("20060102150405"))
+	backup.Directory = path.Join(directory, backup.Name)
+
+	if err := beginChainOperation(chainName); err != nil {
+		return backup, log.Errore(err)
+	}
+	arguments := fmt.Sprintf("--backup --target-dir=%s", backup.Directory)
+	switch backupType {
+	case FullPhysicalBackup:
+		if _, err := os.Stat(directory); err == nil {
+			endChainOperation(chainName)
+			return backup, log.Errorf("Chain %s already exists", chainName)
+		}
+	case IncrementalPhysicalBackup:
+		chain, err := GetBackupChain(chainName)
+		if err == nil {
+			err = chain.Validate()
+		}
+		if err == nil && chain.Last() == nil {
+			err = fmt.Errorf("Chain %s has no base backup", chainName)
+		}
+		if err != nil {
+			endChainOperation(chainName)
+			return backup, log.Errore(err)
+		}
+		backup.Parent = chain.Last().Name
+		backup.FromLSN = chain.Last().ToLSN
+		arguments = fmt.Sprintf("%s --incremental-lsn=%d", arguments, backup.FromLSN)
+	default:
+		endChainOperation(chainName)
+		return backup, log.Errorf("Unknown backup type: %s", backupType)
+	}
+
+	beginJobPhase(jobId)
+	go func() {
+		defer endChainOperation(chainName)
+		err := commandRun(fmt.Sprintf("mkdir -p %s && %s", directory, xtrabackupCmd(arguments)), func(cmd *exec.Cmd) {
+			setActiveCommand(jobId, cmd)
+		})
+		if err == nil {
+			err = completePhysicalBackup(backup)
+		}
+		if err != nil {
+			// Leave no partial backup behind: a chain directory lacking its full backup would fail both
+			// further full backups, as existing, and incrementals, as having no base.
+			removeDirectory := backup.Directory
+			if backupType == FullPhysicalBackup {
+				removeDirectory = directory
+			}
+			if removeErr := os.RemoveAll(removeDirectory); removeErr != nil {
+				log.Errore(removeErr)
+			}
+		}
+		endJobPhase(jobId, log.Errore(err))
+	}()
+	return backup, nil
+}
+
+// completePhysicalBackup reads the LSNs of a backup taken by xtrabackup, and records the backup in the catalog
+func completePhysicalBackup(backup PhysicalBackup) error {
+	file, err := os.Open(path.Join(backup.Directory, xtrabackupCheckpointsFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	checkpoints, err := ParseXtrabackupCheckpoints(file)
+	if err != nil {
+		return err
+	}
+	if backup.Type == IncrementalPhysicalBackup && checkpoints.FromLSN != backup.FromLSN {
+		return fmt.Errorf("Incremental backup %s starts at LSN %d; expected %d", backup.Name, checkpoints.FromLSN, backup.FromLSN)
+	}
+	backup.FromLSN = checkpoints.FromLSN
+	backup.ToLSN = checkpoints.ToLSN
+
+	content, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(backup.Directory, physicalBackupMetadataFile), content, 0644); err != nil {
+		return err
+	}
+	log.Infof("Completed %s backup %s of chain %s, LSN %d-%d", backup.Type, backup.Name, backup.Chain, backup.FromLSN, backup.ToLSN)
+	return nil
+}
+
+// restoreChainCommand prepares a copy of the chain's base, applies the incrementals in order, and moves the
+// result into the data directory. All but the last step apply redo only, leaving rollback to the last.
+func restoreChainCommand(chain *BackupChain, stagingDirectory string, dataDirectory string) string {
+	commands := []string{
+		sudoCmd(fmt.Sprintf("cp -a %s %s", chain.Backups[0].Directory, stagingDirectory)),
+	}
+	for i, backup := range chain.Backups {
+		arguments := fmt.Sprintf("--prepare --target-dir=%s", stagingDirectory)
+		if i < len(chain.Backups)-1 {
+			arguments += " --apply-log-only"
+		}
+		if backup.Type == IncrementalPhysicalBackup {
+			arguments += fmt.Sprintf(" --incremental-dir=%s", backup.Directory)
+		}
+		commands = append(commands, xtrabackupCmd(arguments))
+	}
+	commands = append(commands, xtrabackupCmd(fmt.Sprintf("--move-back --target-dir=%s --datadir=%s", stagingDirectory, dataDirectory)))
+	if config.Config.XtrabackupRestoreOwner != "" {
+		commands = append(commands, sudoCmd(fmt.Sprintf("chown -R %s %s", config.Config.XtrabackupRestoreOwner, dataDirectory)))
+	}
+	return strings.Join(commands, " && ")
+}
+
+// RestoreBackupChain restores the MySQL data directory from a chain, up to and including given backup
+// (or the entire chain, if empty). The chain's backups are not modified: preparation takes place on a copy
+// of the base. MySQL must be stopped and the data directory empty. Having validated the request, it runs
+// in the background as a job identified by seedId.
+func RestoreBackupChain(chainName string, upToBackup string, seedId string) error {
+	if !backupNamePattern.MatchString(seedId) {
+		return log.Errorf("Invalid seed id: %s", seedId)
+	}
+	chain, err := GetBackupChain(chainName)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if upToBackup != "" {
+		if chain, err = chain.UpTo(upToBackup); err != nil {
+			return log.Errore(err)
+		}
+	}
+	if err := chain.Validate(); err != nil {
+		return log.Errore(err)
+	}
+	if chain.Last() == nil {
+		return log.Errorf("Chain %s is empty", chainName)
+	}
+	if running, err := MySQLRunning(); err != nil {
+		return log.Errore(err)
+	} else if running {
+		return log.Errorf("MySQL is running; refusing to restore chain %s", chainName)
+	}
+	dataDirectory, err := GetMySQLDataDir()
+	if err != nil {
+		return log.Errore(err)
+	}
+	if dataDirectory == "" {
+		return log.Errorf("Empty MySQL data directory")
+	}
+	if err := beginChainOperation(chainName); err != nil {
+		return log.Errore(err)
+	}
+
+	stagingDirectory := path.Join(config.Config.XtrabackupDirectory, fmt.Sprintf(".restore-%s-%s", chainName, seedId))
+	beginJobPhase(seedId)
+	go func() {
+		defer endChainOperation(chainName)
+		err := commandRun(restoreChainCommand(chain, stagingDirectory, dataDirectory), func(cmd *exec.Cmd) {
+			setActiveCommand(seedId, cmd)
+		})
+		if removeErr := os.RemoveAll(stagingDirectory); removeErr != nil {
+			log.Errore(removeErr)
+		}
+		if err == nil {
+			log.Infof("Restored chain %s up to %s into %s", chainName, chain.Last().Name, dataDirectory)
+		}
+		endJobPhase(seedId, log.Errore(err))
+	}()
+	return nil
+}
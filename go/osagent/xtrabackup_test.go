@@ -0,0 +1,211 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+	"github.com/github/orchestrator-agent/go/osagent"
+)
+
+func TestParseXtrabackupCheckpoints(t *testing.T) {
+	checkpoints, err := osagent.ParseXtrabackupCheckpoints(strings.NewReader(`backup_type = incremental
+from_lsn = 1626007
+to_lsn = 1640203
+last_lsn = 1640212
+compact = 0
+recover_binlog_info = 0
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if checkpoints.BackupType != "incremental" || checkpoints.FromLSN != 1626007 || checkpoints.ToLSN != 1640203 || checkpoints.LastLSN != 1640212 {
+		t.Errorf("Unexpected checkpoints: %+v", checkpoints)
+	}
+	if _, err := osagent.ParseXtrabackupCheckpoints(strings.NewReader("backup_type = full-backuped\nto_lsn = x\n")); err == nil {
+		t.Errorf("Expected error on invalid LSN")
+	}
+	if _, err := osagent.ParseXtrabackupCheckpoints(strings.NewReader("")); err == nil {
+		t.Errorf("Expected error on missing backup_type")
+	}
+}
+
+func TestBackupChains(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "xtrabackup")
+	defer os.RemoveAll(directory)
+	config.Config.XtrabackupDirectory = directory
+
+	backups := []osagent.PhysicalBackup{
+		{Name: "full-1", Chain: "c1", Type: osagent.FullPhysicalBackup, FromLSN: 0, ToLSN: 100},
+		{Name: "incremental-2", Chain: "c1", Type: osagent.IncrementalPhysicalBackup, Parent: "full-1", FromLSN: 100, ToLSN: 250},
+		{Name: "incremental-3", Chain: "c1", Type: osagent.IncrementalPhysicalBackup, Parent: "incremental-2", FromLSN: 250, ToLSN: 300},
+	}
+	for _, backup := range backups {
+		backupDirectory := path.Join(directory, backup.Chain, backup.Name)
+		os.MkdirAll(backupDirectory, 0755)
+		content, _ := json.Marshal(backup)
+		ioutil.WriteFile(path.Join(backupDirectory, "orchestrator-agent-backup.json"), content, 0644)
+	}
+	// Incomplete backup, lacking metadata
+	os.MkdirAll(path.Join(directory, "c1", "incremental-4"), 0755)
+
+	chains, err := osagent.BackupChains()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(chains) != 1 || len(chains[0].Backups) != 3 || chains[0].Last().Name != "incremental-3" {
+		t.Fatalf("Unexpected chains: %+v", chains)
+	}
+	chain := chains[0]
+	if err := chain.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %s", err)
+	}
+	upTo, err := chain.UpTo("incremental-2")
+	if err != nil || len(upTo.Backups) != 2 {
+		t.Errorf("Unexpected truncated chain: %+v, %+v", upTo, err)
+	}
+	if _, err := chain.UpTo("incremental-4"); err == nil {
+		t.Errorf("Expected error truncating on incomplete backup")
+	}
+
+	chain.Backups[2].FromLSN = 260
+	if err := chain.Validate(); err == nil || !strings.Contains(err.Error(), "LSN gap") {
+		t.Errorf("Expected LSN gap error, got %+v", err)
+	}
+	chain.Backups = chain.Backups[1:]
+	if err := chain.Validate(); err == nil {
+		t.Errorf("Expected error on chain lacking full backup")
+	}
+}
+
+func TestBackupChainOrder(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "xtrabackup")
+	defer os.RemoveAll(directory)
+	config.Config.XtrabackupDirectory = directory
+
+	// With no writes in between, incrementals share their LSNs; listed by name, incremental-3 comes first
+	created := time.Now()
+	backups := []osagent.PhysicalBackup{
+		{Name: "full-1", Chain: "c1", Type: osagent.FullPhysicalBackup, Created: created, FromLSN: 0, ToLSN: 100},
+		{Name: "incremental-4", Chain: "c1", Type: osagent.IncrementalPhysicalBackup, Parent: "full-1", Created: created.Add(time.Minute), FromLSN: 100, ToLSN: 100},
+		{Name: "incremental-3", Chain: "c1", Type: osagent.IncrementalPhysicalBackup, Parent: "incremental-4", Created: created.Add(time.Minute), FromLSN: 100, ToLSN: 100},
+		{Name: "incremental-2", Chain: "c1", Type: osagent.IncrementalPhysicalBackup, Parent: "incremental-3", Created: created.Add(2 * time.Minute), FromLSN: 100, ToLSN: 100},
+	}
+	for _, backup := range backups {
+		backupDirectory := path.Join(directory, backup.Chain, backup.Name)
+		os.MkdirAll(backupDirectory, 0755)
+		content, _ := json.Marshal(backup)
+		ioutil.WriteFile(path.Join(backupDirectory, "orchestrator-agent-backup.json"), content, 0644)
+	}
+
+	chain, err := osagent.GetBackupChain("c1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	names := []string{}
+	for _, backup := range chain.Backups {
+		names = append(names, backup.Name)
+	}
+	if strings.Join(names, ",") != "full-1,incremental-4,incremental-3,incremental-2" {
+		t.Errorf("Unexpected chain order: %+v", names)
+	}
+	if err := chain.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %s", err)
+	}
+}
+
+// writeFakeXtrabackup writes an xtrabackup stand-in, which takes backups ending at LSN 100, and fails while a
+// "fail" file exists in given directory
+func writeFakeXtrabackup(t *testing.T, directory string) string {
+	command := path.Join(directory, "xtrabackup")
+	script := `#!/bin/bash
+[ -f ` + path.Join(directory, "fail") + ` ] && exit 1
+for argument in "$@" ; do
+  case "$argument" in
+    --target-dir=*) target="${argument#--target-dir=}" ;;
+    --backup) backup=1 ;;
+  esac
+done
+if [ -n "$backup" ] ; then
+  mkdir -p "$target" && printf "backup_type = full-backuped\nfrom_lsn = 0\nto_lsn = 100\n" > "$target/xtrabackup_checkpoints"
+fi
+`
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return command
+}
+
+func TestPhysicalBackupAndRestore(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "xtrabackup")
+	defer os.RemoveAll(directory)
+	backupDirectory := path.Join(directory, "backups")
+	config.Config.XtrabackupDirectory = backupDirectory
+	config.Config.XtrabackupCommand = writeFakeXtrabackup(t, directory)
+	config.Config.XtrabackupRestoreOwner = ""
+	config.Config.MySQLDatadirCommand = "echo " + path.Join(directory, "datadir")
+	config.Config.MySQLServiceStatusCommand = "false"
+	defer func() {
+		config.Config.XtrabackupDirectory = ""
+		config.Config.XtrabackupCommand = "xtrabackup"
+		config.Config.XtrabackupRestoreOwner = "mysql:mysql"
+		config.Config.MySQLServiceStatusCommand = ""
+	}()
+
+	if _, err := osagent.CreatePhysicalBackup("../c1", osagent.FullPhysicalBackup, "backup-0"); err == nil {
+		t.Errorf("Expected error on invalid chain name")
+	}
+
+	// A failed full backup leaves no chain behind, such that it may be retried
+	ioutil.WriteFile(path.Join(directory, "fail"), []byte{}, 0644)
+	if _, err := osagent.CreatePhysicalBackup("c1", osagent.FullPhysicalBackup, "backup-1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if waitForJob(t, "backup-1") {
+		t.Errorf("Expected backup to fail")
+	}
+	if _, err := os.Stat(path.Join(backupDirectory, "c1")); !os.IsNotExist(err) {
+		t.Errorf("Expected chain directory to be removed, got %+v", err)
+	}
+	os.Remove(path.Join(directory, "fail"))
+	if _, err := osagent.CreatePhysicalBackup("c1", osagent.FullPhysicalBackup, "backup-2"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !waitForJob(t, "backup-2") {
+		t.Fatalf("Expected backup to succeed")
+	}
+
+	if err := osagent.RestoreBackupChain("c1", "", "1 ; touch /tmp/x"); err == nil {
+		t.Errorf("Expected error on invalid seed id")
+	}
+	if err := osagent.RestoreBackupChain("c1", "", "restore-1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !waitForJob(t, "restore-1") {
+		t.Errorf("Expected restore to succeed")
+	}
+	if _, err := os.Stat(path.Join(backupDirectory, ".restore-c1-restore-1")); !os.IsNotExist(err) {
+		t.Errorf("Expected staging directory to be removed, got %+v", err)
+	}
+}
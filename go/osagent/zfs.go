@@ -0,0 +1,175 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package osagent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/github/orchestrator-agent/go/config"
+)
+
+// zfsClonePrefix marks clones created by this agent, such that unmounting knows to destroy them
+const zfsClonePrefix = "orchestrator-agent-clone-"
+
+// ZFSBackend is a StorageBackend on top of ZFS dataset snapshots.
+// Snapshots are either mounted directly (read only) or cloned into a writable dataset.
+type ZFSBackend struct {
+	Dataset      string
+	MountByClone bool
+	runCommand   CommandRunner
+}
+
+// NewZFSBackend creates a ZFS backend managing snapshots of given dataset, executing commands via given runner
+func NewZFSBackend(dataset string, mountByClone bool, runCommand CommandRunner) *ZFSBackend {
+	return &ZFSBackend{
+		Dataset:      strings.Trim(dataset, "/"),
+		MountByClone: mountByClone,
+		runCommand:   runCommand,
+	}
+}
+
+func (this *ZFSBackend) Name() string {
+	return ZFSStorageBackend
+}
+
+// snapshotFullName normalizes a snapshot name into the dataset@snapshot form
+func (this *ZFSBackend) snapshotFullName(snapshotName string) (string, error) {
+	if snapshotName == "" {
+		return "", errors.New("Empty snapshot name")
+	}
+	if strings.Contains(snapshotName, "@") {
+		return snapshotName, nil
+	}
+	if this.Dataset == "" {
+		return "", fmt.Errorf("Cannot resolve snapshot %s: ZFSDataset is unconfigured", snapshotName)
+	}
+	return fmt.Sprintf("%s@%s", this.Dataset, snapshotName), nil
+}
+
+// cloneName returns the name of the dataset into which given snapshot is cloned
+func (this *ZFSBackend) cloneName(snapshotFullName string) string {
+	tokens := strings.SplitN(snapshotFullName, "@", 2)
+	pool := strings.SplitN(tokens[0], "/", 2)[0]
+	return path.Join(pool, zfsClonePrefix+tokens[1])
+}
+
+func (this *ZFSBackend) Volumes(volumeName string, filterPattern string) ([]LogicalVolume, error) {
+	target := this.Dataset
+	if volumeName != "" {
+		snapshotFullName, err := this.snapshotFullName(volumeName)
+		if err != nil {
+			return nil, err
+		}
+		target = snapshotFullName
+	}
+	if target == "" {
+		return nil, errors.New("ZFSDataset is unconfigured")
+	}
+	output, err := this.runCommand(sudoCmd(fmt.Sprintf("zfs list -H -t snapshot -o name -d 1 %s", target)))
+	lines, err := outputLines(output, err)
+	if err != nil {
+		return nil, err
+	}
+
+	logicalVolumes := []LogicalVolume{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		tokens := strings.SplitN(line, "@", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		logicalVolume := LogicalVolume{
+			Name:       tokens[1],
+			GroupName:  tokens[0],
+			Path:       line,
+			IsSnapshot: true,
+			Backend:    ZFSStorageBackend,
+		}
+		if strings.Contains(logicalVolume.Name, filterPattern) {
+			logicalVolumes = append(logicalVolumes, logicalVolume)
+		}
+	}
+	return logicalVolumes, nil
+}
+
+// CreateSnapshot runs CreateSnapshotCommand if configured, or otherwise takes a snapshot of the dataset
+func (this *ZFSBackend) CreateSnapshot() error {
+	if config.Config.CreateSnapshotCommand != "" {
+		_, err := this.runCommand(config.Config.CreateSnapshotCommand)
+		return err
+	}
+	if this.Dataset == "" {
+		return errors.New("ZFSDataset is unconfigured")
+	}
+	snapshotName := fmt.Sprintf("%s@orchestrator-agent-%s", this.Dataset, time.Now().Format("20060102150405"))
+	_, err := this.runCommand(sudoCmd(fmt.Sprintf("zfs snapshot %s", snapshotName)))
+	return err
+}
+
+func (this *ZFSBackend) Mount(mountPoint string, volumeName string) (Mount, error) {
+	mount := Mount{
+		Path:      mountPoint,
+		IsMounted: false,
+	}
+	snapshotFullName, err := this.snapshotFullName(volumeName)
+	if err != nil {
+		return mount, err
+	}
+	if this.MountByClone {
+		_, err = this.runCommand(sudoCmd(fmt.Sprintf("zfs clone -o mountpoint=%s %s %s", mountPoint, snapshotFullName, this.cloneName(snapshotFullName))))
+	} else {
+		_, err = this.runCommand(sudoCmd(fmt.Sprintf("mount -t zfs %s %s", snapshotFullName, mountPoint)))
+	}
+	if err != nil {
+		return mount, err
+	}
+	return GetMount(mountPoint)
+}
+
+// Unmount unmounts a snapshot; a clone made by this agent is destroyed altogether
+func (this *ZFSBackend) Unmount(mountPoint string) (Mount, error) {
+	mount := Mount{
+		Path:      mountPoint,
+		IsMounted: false,
+	}
+	current, err := GetMount(mountPoint)
+	if err != nil {
+		return mount, err
+	}
+	command := fmt.Sprintf("umount %s", mountPoint)
+	if current.IsMounted && strings.HasPrefix(path.Base(current.Device), zfsClonePrefix) {
+		command = fmt.Sprintf("zfs destroy %s", current.Device)
+	}
+	if _, err := this.runCommand(sudoCmd(command)); err != nil {
+		return mount, err
+	}
+	return GetMount(mountPoint)
+}
+
+// Remove destroys a snapshot. It refuses to destroy anything that is not a snapshot.
+func (this *ZFSBackend) Remove(volumeName string) error {
+	snapshotFullName, err := this.snapshotFullName(volumeName)
+	if err != nil {
+		return err
+	}
+	_, err = this.runCommand(sudoCmd(fmt.Sprintf("zfs destroy %s", snapshotFullName)))
+	return err
+}